@@ -324,6 +324,24 @@ type FuncCallNode struct {
 	Args   []IExpressionNode `json:"args"`
 }
 
+type SpawnNode struct {
+	Type string `json:"type"`
+	IElement
+	Filepos Position `json:"fp"`
+	IStatementNode
+	IExpressionNode
+	Call FuncCallNode `json:"call"`
+}
+
+type JoinNode struct {
+	Type string `json:"type"`
+	IElement
+	Filepos Position `json:"fp"`
+	IStatementNode
+	IExpressionNode
+	Target IExpressionNode `json:"target"`
+}
+
 type IntNode struct {
 	Type string `json:"type"`
 	IElement
@@ -375,6 +393,8 @@ func (e NonStdSyscallNode) GetType() string      { return e.Type }
 func (e NonStdAddrOfNode) GetType() string       { return e.Type }
 func (e NonStdDerefNode) GetType() string        { return e.Type }
 func (e FuncCallNode) GetType() string           { return e.Type }
+func (e SpawnNode) GetType() string              { return e.Type }
+func (e JoinNode) GetType() string               { return e.Type }
 func (e IntNode) GetType() string                { return e.Type }
 func (e VarNode) GetType() string                { return e.Type }
 
@@ -623,6 +643,18 @@ func ParseJsonElement(raw Object) IElement {
 			Target:  ParseJsonElement(raw["target"].(Object)).(IExpressionNode),
 			Args:    args,
 		}
+	case "SpawnNode":
+		return SpawnNode{
+			Type:    raw["type"].(string),
+			Filepos: ParseJsonElement(raw["fp"].(Object)).(Position),
+			Call:    ParseJsonElement(raw["call"].(Object)).(FuncCallNode),
+		}
+	case "JoinNode":
+		return JoinNode{
+			Type:    raw["type"].(string),
+			Filepos: ParseJsonElement(raw["fp"].(Object)).(Position),
+			Target:  ParseJsonElement(raw["target"].(Object)).(IExpressionNode),
+		}
 	case "VarNode":
 		return VarNode{
 			Type:    raw["type"].(string),
@@ -656,6 +688,7 @@ func ParseStatement(element IStatementNode) parser.BaseStatement {
 		params := ParseTypedDeclarations(n.Params)
 		body := ParseStatements(n.Body)
 		return parser.FuncDefStatement{
+			Pos:        n.Filepos.Convert(),
 			Identifier: n.Target.Convert(),
 			ReturnType: n.ValueType.Token.Convert(),
 			Parameters: params,
@@ -664,6 +697,7 @@ func ParseStatement(element IStatementNode) parser.BaseStatement {
 	case "ReturnNode":
 		n := element.(ReturnNode)
 		return parser.ReturnStatement{
+			Pos:   n.Filepos.Convert(),
 			Value: ParseBaseExpression(n.Value),
 		}
 	case "WhileNode":
@@ -671,6 +705,7 @@ func ParseStatement(element IStatementNode) parser.BaseStatement {
 		condition := ParseBaseExpression(n.Condition)
 		body := ParseStatements(n.Body)
 		return parser.WhileStatement{
+			Pos:       n.Filepos.Convert(),
 			Condition: condition,
 			Body:      body,
 		}
@@ -680,6 +715,7 @@ func ParseStatement(element IStatementNode) parser.BaseStatement {
 		body_truthy := ParseStatements(n.Truthy)
 		body_falsy := ParseStatements(n.Falsy)
 		return parser.IfElseStatement{
+			Pos:       n.Filepos.Convert(),
 			Condition: condition,
 			Truthy:    body_truthy,
 			Falsy:     body_falsy,
@@ -689,12 +725,14 @@ func ParseStatement(element IStatementNode) parser.BaseStatement {
 		condition := ParseBaseExpression(n.Condition)
 		body := ParseStatements(n.Body)
 		return parser.IfStatement{
+			Pos:       n.Filepos.Convert(),
 			Condition: condition,
 			Body:      body,
 		}
 	case "VarInitNode":
 		n := element.(VarInitNode)
 		return parser.TypedInitStatement{
+			Pos: n.Filepos.Convert(),
 			TypedDeclaration: ParseTypedDeclaration(TypedDeclNode{
 				Type:      n.Type,
 				Filepos:   n.Filepos,
@@ -706,6 +744,7 @@ func ParseStatement(element IStatementNode) parser.BaseStatement {
 	case "VarDeclNode":
 		n := element.(VarDeclNode)
 		return parser.DeclarationStatement{
+			Pos: n.Filepos.Convert(),
 			TypedDeclaration: ParseTypedDeclaration(TypedDeclNode{
 				Type:      n.Type,
 				Filepos:   n.Filepos,
@@ -716,81 +755,109 @@ func ParseStatement(element IStatementNode) parser.BaseStatement {
 	case "AssignNode":
 		n := element.(AssignNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "NotEqualNode":
 		n := element.(NotEqualNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "EqualNode":
 		n := element.(EqualNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "GreaterThanOrEqualNode":
 		n := element.(GreaterThanOrEqualNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "LessThanOrEqualNode":
 		n := element.(LessThanOrEqualNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "GreaterThanNode":
 		n := element.(GreaterThanNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "LessThanNode":
 		n := element.(LessThanNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "AddNode":
 		n := element.(AddNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "SubNode":
 		n := element.(SubNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "MulNode":
 		n := element.(MulNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "DivNode":
 		n := element.(DivNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "ModNode":
 		n := element.(ModNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "ExpNode":
 		n := element.(ExpNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "FuncCallNode":
 		n := element.(FuncCallNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
+			Expression: ParseBaseExpression(n),
+		}
+	case "SpawnNode":
+		n := element.(SpawnNode)
+		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
+			Expression: ParseBaseExpression(n),
+		}
+	case "JoinNode":
+		n := element.(JoinNode)
+		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "IntNode":
 		n := element.(IntNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	case "VarNode":
 		n := element.(VarNode)
 		return parser.ExpressionStatement{
+			Pos:        n.Filepos.Convert(),
 			Expression: ParseBaseExpression(n),
 		}
 	default:
@@ -929,6 +996,16 @@ func ParseBaseExpression(element IExpressionNode) parser.BaseExpression {
 			Identifier: ParseBaseExpression(n.Target),
 			Arguments:  ParseBaseExpressions(n.Args),
 		}
+	case "SpawnNode":
+		n := element.(SpawnNode)
+		return parser.SpawnExpression{
+			Call: ParseBaseExpression(n.Call).(parser.FuncCallExpression),
+		}
+	case "JoinNode":
+		n := element.(JoinNode)
+		return parser.JoinExpression{
+			Thread: ParseBaseExpression(n.Target),
+		}
 	case "IntNode":
 		n := element.(IntNode)
 		t := n.Token.Convert()
@@ -985,6 +1062,10 @@ func convertTokenType(tt string) parser.TokenType {
 	}
 }
 
+func (p Position) Convert() parser.Position {
+	return parser.Position{File: p.Filename, Line: p.Row, Col: p.Col}
+}
+
 func (t *Token) Convert() parser.Token {
 	intValue, _ := strconv.Atoi(t.Value)
 	return parser.Token{
@@ -0,0 +1,429 @@
+package bytecode
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Textual assembly of programs, the syntax is described in docs/eudasm.md.
+
+var typesByName = map[string]Type{
+	"u8": U8, "u16": U16, "u32": U32, "u64": U64,
+	"i8": I8, "i16": I16, "i32": I32, "i64": I64,
+	"f32": F32, "f64": F64, "char": CHAR, "usize": USIZE, "uptr": UPTR,
+}
+
+var comparisonsByName = map[string]InstructionType{
+	"CmpEqual":   CmpEqualInstruction,
+	"CmpInequal": CmpInequalInstruction,
+	"CmpLT":      CmpLTInstruction,
+	"CmpGT":      CmpGTInstruction,
+	"CmpLTE":     CmpLTEInstruction,
+	"CmpGTE":     CmpGTEInstruction,
+}
+
+// instructions taking a single type parameter and no operands
+var typedInstructions = map[string]func(Type) Instruction{
+	"Allocate":       func(t Type) Instruction { return Allocate{Type: t} },
+	"Deallocate":     func(t Type) Instruction { return Deallocate{Type: t} },
+	"Store":          func(t Type) Instruction { return Store{Type: t} },
+	"Load":           func(t Type) Instruction { return Load{Type: t} },
+	"DeclareLocal":   func(t Type) Instruction { return DeclareLocal{Type: t} },
+	"UndeclareLocal": func(t Type) Instruction { return UndeclareLocal{Type: t} },
+	"Pop":            func(t Type) Instruction { return Pop{Type: t} },
+	"Call":           func(t Type) Instruction { return Call{Type: t} },
+	"Return":         func(t Type) Instruction { return Return{Type: t} },
+	"Not":            func(t Type) Instruction { return Not{Type: t} },
+	"Add":            func(t Type) Instruction { return Add{Type: t} },
+	"Subtract":       func(t Type) Instruction { return Subtract{Type: t} },
+	"Multiply":       func(t Type) Instruction { return Multiply{Type: t} },
+	"Divide":         func(t Type) Instruction { return Divide{Type: t} },
+	"Modulus":        func(t Type) Instruction { return Modulus{Type: t} },
+	"Exponent":       func(t Type) Instruction { return Exponent{Type: t} },
+	"CmpEqual":       func(t Type) Instruction { return CmpEqual{Type: t} },
+	"CmpInequal":     func(t Type) Instruction { return CmpInequal{Type: t} },
+	"CmpLT":          func(t Type) Instruction { return CmpLT{Type: t} },
+	"CmpGT":          func(t Type) Instruction { return CmpGT{Type: t} },
+	"CmpLTE":         func(t Type) Instruction { return CmpLTE{Type: t} },
+	"CmpGTE":         func(t Type) Instruction { return CmpGTE{Type: t} },
+	"Or":             func(t Type) Instruction { return Or{Type: t} },
+	"And":            func(t Type) Instruction { return And{Type: t} },
+	"Xor":            func(t Type) Instruction { return Xor{Type: t} },
+	"Nor":            func(t Type) Instruction { return Nor{Type: t} },
+	"Nand":           func(t Type) Instruction { return Nand{Type: t} },
+	"Xnor":           func(t Type) Instruction { return Xnor{Type: t} },
+}
+
+// instructions taking neither type parameters nor operands
+var plainInstructions = map[string]Instruction{
+	"Jump":        Jump{},
+	"JumpIfZero":  JumpIfZero{},
+	"JumpNotZero": JumpNotZero{},
+	"Syscall":     Syscall{},
+}
+
+type assembler struct {
+	builder   *Builder
+	labels    map[string]Label
+	defined   map[string]bool
+	functions []openFunction
+	program   Program
+}
+
+type openFunction struct {
+	name  string
+	start Label
+}
+
+// one parsed line, `Mnemonic<params> operands`
+type asmLine struct {
+	mnemonic string
+	params   []string
+	operands []string
+}
+
+// Assemble parses the .eudasm source into a program.
+func Assemble(source string) (Program, error) {
+	ctx := assembler{
+		builder: NewBuilder(),
+		labels:  map[string]Label{},
+		defined: map[string]bool{},
+	}
+	for i, line := range strings.Split(source, "\n") {
+		if err := ctx.line(line); err != nil {
+			return Program{}, fmt.Errorf("line %d: %w", i+1, err)
+		}
+	}
+	if len(ctx.functions) > 0 {
+		return Program{}, fmt.Errorf(".func %s is never ended", ctx.functions[len(ctx.functions)-1].name)
+	}
+	names := []string{}
+	for name := range ctx.labels {
+		if !ctx.defined[name] {
+			names = append(names, name)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return Program{}, fmt.Errorf("undefined label %s", strings.Join(names, ", "))
+	}
+	program, err := ctx.builder.Finish()
+	if err != nil {
+		return Program{}, err
+	}
+	program.Preallocations = ctx.program.Preallocations
+	return program, nil
+}
+
+func (ctx *assembler) label(name string) Label {
+	if l, ok := ctx.labels[name]; ok {
+		return l
+	}
+	l := ctx.builder.NewLabel()
+	ctx.labels[name] = l
+	return l
+}
+
+func isLabelName(s string) bool {
+	if s == "" || (s[0] >= '0' && s[0] <= '9') || s[0] == '-' || s[0] == '+' {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c == '.' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+func (ctx *assembler) line(line string) error {
+	if i := strings.Index(line, ";"); i != -1 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+	if name, rest, ok := strings.Cut(line, ":"); ok && isLabelName(strings.TrimSpace(name)) && !strings.Contains(name, "<") {
+		name = strings.TrimSpace(name)
+		if ctx.defined[name] {
+			return fmt.Errorf("label %s defined twice", name)
+		}
+		ctx.defined[name] = true
+		ctx.builder.Label(ctx.label(name))
+		line = strings.TrimSpace(rest)
+		if line == "" {
+			return nil
+		}
+	}
+	if strings.HasPrefix(line, ".") {
+		return ctx.directive(strings.Fields(line))
+	}
+	parsed, err := parseAsmLine(line)
+	if err != nil {
+		return err
+	}
+	return ctx.instruction(parsed)
+}
+
+func parseAsmLine(line string) (asmLine, error) {
+	parsed := asmLine{}
+	rest := line
+	if open := strings.Index(line, "<"); open != -1 && !strings.ContainsAny(line[:open], " \t") {
+		close := strings.Index(line, ">")
+		if close < open {
+			return parsed, fmt.Errorf("missing '>' in %q", line)
+		}
+		parsed.mnemonic = line[:open]
+		for _, p := range strings.Split(line[open+1:close], ",") {
+			parsed.params = append(parsed.params, strings.TrimSpace(p))
+		}
+		rest = line[close+1:]
+	} else {
+		fields := strings.Fields(line)
+		parsed.mnemonic = fields[0]
+		rest = strings.TrimPrefix(line, fields[0])
+	}
+	parsed.operands = strings.Fields(rest)
+	return parsed, nil
+}
+
+func (ctx *assembler) directive(fields []string) error {
+	switch fields[0] {
+	case ".func":
+		if len(fields) != 2 {
+			return fmt.Errorf(".func takes a name")
+		}
+		ctx.functions = append(ctx.functions, openFunction{name: fields[1], start: ctx.builder.Here()})
+	case ".endfunc":
+		if len(fields) != 1 {
+			return fmt.Errorf(".endfunc takes no arguments")
+		}
+		if len(ctx.functions) == 0 {
+			return fmt.Errorf(".endfunc without .func")
+		}
+		f := ctx.functions[len(ctx.functions)-1]
+		ctx.functions = ctx.functions[:len(ctx.functions)-1]
+		ctx.builder.Function(f.name, f.start, ctx.builder.Here())
+	case ".prealloc":
+		return ctx.prealloc(fields[1:])
+	default:
+		return fmt.Errorf("unknown directive %s", fields[0])
+	}
+	return nil
+}
+
+// .prealloc handle [pack] type*amount...
+func (ctx *assembler) prealloc(fields []string) error {
+	if len(fields) == 0 {
+		return fmt.Errorf(".prealloc takes a handle")
+	}
+	handle, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return fmt.Errorf("invalid handle %q", fields[0])
+	}
+	alloc := AllocationStruct{Handle: handle, Components: []Allocation{}}
+	fields = fields[1:]
+	if len(fields) > 0 && fields[0] == "pack" {
+		alloc.Pack = true
+		fields = fields[1:]
+	}
+	for _, field := range fields {
+		name, amount, ok := strings.Cut(field, "*")
+		if !ok {
+			return fmt.Errorf("expected type*amount, got %q", field)
+		}
+		t, err := parseType(name)
+		if err != nil {
+			return err
+		}
+		n, err := strconv.ParseUint(amount, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid amount %q", amount)
+		}
+		alloc.Components = append(alloc.Components, Allocation{Type: t, Amount: uint(n)})
+	}
+	ctx.program.Preallocations = append(ctx.program.Preallocations, alloc)
+	return nil
+}
+
+func parseType(name string) (Type, error) {
+	if t, ok := typesByName[name]; ok {
+		return t, nil
+	}
+	return 0, fmt.Errorf("unknown type %q", name)
+}
+
+func parseComparison(name string) (InstructionType, error) {
+	if cmp, ok := comparisonsByName[name]; ok {
+		return cmp, nil
+	}
+	return 0, fmt.Errorf("unknown comparison %q", name)
+}
+
+func (l asmLine) expect(params int, operands int) error {
+	if len(l.params) != params {
+		return fmt.Errorf("%s takes %d type parameters, got %d", l.mnemonic, params, len(l.params))
+	}
+	if len(l.operands) != operands {
+		return fmt.Errorf("%s takes %d operands, got %d", l.mnemonic, operands, len(l.operands))
+	}
+	return nil
+}
+
+func (l asmLine) typeParam(i int) (Type, error) {
+	return parseType(l.params[i])
+}
+
+func (l asmLine) intOperand(i int) (int, error) {
+	v, err := strconv.Atoi(l.operands[i])
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer %q", l.operands[i])
+	}
+	return v, nil
+}
+
+func (l asmLine) uintOperand(i int) (uint, error) {
+	v, err := strconv.ParseUint(l.operands[i], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid unsigned integer %q", l.operands[i])
+	}
+	return uint(v), nil
+}
+
+func (ctx *assembler) instruction(l asmLine) error {
+	if construct, ok := typedInstructions[l.mnemonic]; ok {
+		if err := l.expect(1, 0); err != nil {
+			return err
+		}
+		t, err := l.typeParam(0)
+		if err != nil {
+			return err
+		}
+		ctx.builder.Emit(construct(t))
+		return nil
+	}
+	if i, ok := plainInstructions[l.mnemonic]; ok {
+		if err := l.expect(0, 0); err != nil {
+			return err
+		}
+		ctx.builder.Emit(i)
+		return nil
+	}
+	switch l.mnemonic {
+	case "StoreLocal", "LoadLocal", "StoreLocalKeep":
+		if err := l.expect(1, 1); err != nil {
+			return err
+		}
+		t, err := l.typeParam(0)
+		if err != nil {
+			return err
+		}
+		offset, err := l.uintOperand(0)
+		if err != nil {
+			return err
+		}
+		switch l.mnemonic {
+		case "StoreLocal":
+			ctx.builder.Emit(StoreLocal{Type: t, Offset: offset})
+		case "LoadLocal":
+			ctx.builder.Emit(LoadLocal{Type: t, Offset: offset})
+		default:
+			ctx.builder.Emit(StoreLocalKeep{Type: t, Offset: offset})
+		}
+	case "Push":
+		if err := l.expect(1, 1); err != nil {
+			return err
+		}
+		t, err := l.typeParam(0)
+		if err != nil {
+			return err
+		}
+		if t == UPTR && isLabelName(l.operands[0]) {
+			ctx.builder.PushAddress(ctx.label(l.operands[0]))
+			return nil
+		}
+		v, err := l.intOperand(0)
+		if err != nil {
+			return err
+		}
+		ctx.builder.Emit(Push{Type: t, Value: v})
+	case "Convert":
+		if err := l.expect(2, 0); err != nil {
+			return err
+		}
+		dst, err := l.typeParam(0)
+		if err != nil {
+			return err
+		}
+		src, err := l.typeParam(1)
+		if err != nil {
+			return err
+		}
+		ctx.builder.Emit(Convert{Dst: dst, Src: src})
+	case "JumpTo", "JumpIfZeroTo":
+		if err := l.expect(0, 1); err != nil {
+			return err
+		}
+		if isLabelName(l.operands[0]) {
+			if l.mnemonic == "JumpTo" {
+				ctx.builder.JumpTo(ctx.label(l.operands[0]))
+			} else {
+				ctx.builder.JumpIfZeroTo(ctx.label(l.operands[0]))
+			}
+			return nil
+		}
+		target, err := l.uintOperand(0)
+		if err != nil {
+			return err
+		}
+		if l.mnemonic == "JumpTo" {
+			ctx.builder.Emit(JumpTo{Target: target})
+		} else {
+			ctx.builder.Emit(JumpIfZeroTo{Target: target})
+		}
+	case "JumpIfNot":
+		if err := l.expect(2, 1); err != nil {
+			return err
+		}
+		cmp, err := parseComparison(l.params[0])
+		if err != nil {
+			return err
+		}
+		t, err := l.typeParam(1)
+		if err != nil {
+			return err
+		}
+		if isLabelName(l.operands[0]) {
+			ctx.builder.JumpIfNot(cmp, t, ctx.label(l.operands[0]))
+			return nil
+		}
+		target, err := l.uintOperand(0)
+		if err != nil {
+			return err
+		}
+		ctx.builder.Emit(JumpIfNot{Cmp: cmp, Type: t, Target: target})
+	case "IncrementLocal":
+		if err := l.expect(1, 2); err != nil {
+			return err
+		}
+		t, err := l.typeParam(0)
+		if err != nil {
+			return err
+		}
+		offset, err := l.uintOperand(0)
+		if err != nil {
+			return err
+		}
+		v, err := l.intOperand(1)
+		if err != nil {
+			return err
+		}
+		ctx.builder.Emit(IncrementLocal{Type: t, Offset: offset, Value: v})
+	default:
+		return fmt.Errorf("unknown instruction %q", l.mnemonic)
+	}
+	return nil
+}
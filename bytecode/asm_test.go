@@ -0,0 +1,130 @@
+package bytecode_test
+
+import (
+	"eud/bytecode"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAssembleFile(t *testing.T) {
+	source, err := os.ReadFile("testdata/sum.eudasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := bytecode.Assemble(string(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(program.Functions) != 1 || program.Functions[0] != (bytecode.FunctionSymbol{Name: "sum", Start: 1, End: 9}) {
+		t.Errorf("unexpected functions %v", program.Functions)
+	}
+	runtime := bytecode.Run(program)
+	if result := runtime.Locals[0].Value(); result != (bytecode.I32Value{Value: 8}) {
+		t.Errorf("expected 8, got %s", result)
+	}
+
+	// the file is written the way the disassembler prints it
+	text, err := bytecode.Disassemble(program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text != string(source) {
+		t.Errorf("disassembly differs from the source:\n%s", text)
+	}
+}
+
+func TestAssembleSyntax(t *testing.T) {
+	program, err := bytecode.Assemble(`
+		; labels can be used before they are defined
+		.prealloc 3 pack i32*2 u8*4
+		    DeclareLocal<i32>      ; a
+		loop: LoadLocal<i32> 0
+		    Push<i32> -10
+		    JumpIfNot<CmpGT, i32> end
+		    IncrementLocal<i32> 0 -1
+		    JumpTo loop
+		end:
+		    Convert<f64, i32>
+		    Push<uptr> 12
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectInstructions(t, program.Instructions, []bytecode.Instruction{
+		bytecode.DeclareLocal{Type: bytecode.I32},
+		bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
+		bytecode.Push{Type: bytecode.I32, Value: -10},
+		bytecode.JumpIfNot{Cmp: bytecode.CmpGTInstruction, Type: bytecode.I32, Target: 6},
+		bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: -1},
+		bytecode.JumpTo{Target: 1},
+		bytecode.Convert{Dst: bytecode.F64, Src: bytecode.I32},
+		bytecode.Push{Type: bytecode.UPTR, Value: 12},
+	})
+	if len(program.Preallocations) != 1 || !program.Preallocations[0].Pack || program.Preallocations[0].Handle != 3 ||
+		len(program.Preallocations[0].Components) != 2 ||
+		program.Preallocations[0].Components[1] != (bytecode.Allocation{Type: bytecode.U8, Amount: 4}) {
+		t.Errorf("unexpected preallocations %v", program.Preallocations)
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	for source, expected := range map[string]string{
+		"JumpTo nowhere":            "undefined label nowhere",
+		"Push<i32>\nPush<i33> 1":    "line 1: Push takes 1 operands, got 0",
+		"\nPush<i33> 1":             "line 2: unknown type \"i33\"",
+		"Frobnicate":                "line 1: unknown instruction \"Frobnicate\"",
+		"a:\na:":                    "line 2: label a defined twice",
+		".func f\nPop<i32>":         ".func f is never ended",
+		"StoreLocal<i32> somewhere": "line 1: invalid unsigned integer \"somewhere\"",
+		"JumpIfNot<CmpLOL, i32> 0":  "line 1: unknown comparison \"CmpLOL\"",
+		".endfunc":                  "line 1: .endfunc without .func",
+	} {
+		_, err := bytecode.Assemble(source)
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("assembling %q: expected error %q, got %v", source, expected, err)
+		}
+	}
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	for name, program := range map[string]bytecode.Program{
+		"while":      whileProgram(8),
+		"whileFused": whileProgramFused(8),
+		"optimized":  bytecode.Optimize(whileProgram(8), 2),
+	} {
+		text, err := bytecode.Disassemble(program)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		reassembled, err := bytecode.Assemble(text)
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		expectInstructions(t, reassembled.Instructions, program.Instructions)
+	}
+}
+
+func TestDisassembleUnrepresentable(t *testing.T) {
+	_, err := bytecode.Disassemble(bytecode.Program{
+		Instructions: []bytecode.Instruction{bytecode.Pop{Type: bytecode.I32}, bytecode.Pop{Type: bytecode.I32}},
+		Functions: []bytecode.FunctionSymbol{
+			{Name: "a", Start: 0, End: 1},
+			{Name: "c", Start: 1, End: 2},
+			{Name: "b", Start: 0, End: 2},
+		},
+	})
+	if err != nil {
+		t.Fatalf("nested functions should be representable: %s", err)
+	}
+	_, err = bytecode.Disassemble(bytecode.Program{
+		Instructions: []bytecode.Instruction{bytecode.Pop{Type: bytecode.I32}, bytecode.Pop{Type: bytecode.I32}},
+		Functions: []bytecode.FunctionSymbol{
+			{Name: "b", Start: 0, End: 2},
+			{Name: "a", Start: 0, End: 1},
+		},
+	})
+	if err == nil {
+		t.Error("expected an error for function symbols not ordered by their end")
+	}
+}
@@ -0,0 +1,182 @@
+package bytecode
+
+import "fmt"
+
+// A Label names a code address which may not be known yet. Labels are
+// created by NewLabel, placed with Label, and every jump or address referring
+// to them is resolved by Finish, so instructions can be emitted and inserted
+// without counting indices by hand.
+type Label int
+
+type Builder struct {
+	instructions []Instruction
+	// address of every label, -1 until it is placed
+	addresses []int
+	// instructions whose target or operand is the address of a label
+	references []labelReference
+	functions  []functionLabels
+	// line table, and the position of the instructions emitted next
+	lines    []LineEntry
+	position SourcePosition
+	err      error
+}
+
+type labelReference struct {
+	index int
+	label Label
+}
+
+type functionLabels struct {
+	name  string
+	start Label
+	end   Label
+}
+
+func NewBuilder() *Builder {
+	return &Builder{
+		instructions: []Instruction{},
+		addresses:    []int{},
+		references:   []labelReference{},
+		functions:    []functionLabels{},
+		lines:        []LineEntry{},
+	}
+}
+
+// Creates a label, which has to be placed before calling Finish.
+func (b *Builder) NewLabel() Label {
+	b.addresses = append(b.addresses, -1)
+	return Label(len(b.addresses) - 1)
+}
+
+// Places l at the address of the next emitted instruction.
+func (b *Builder) Label(l Label) {
+	if int(l) < 0 || int(l) >= len(b.addresses) {
+		b.fail(fmt.Errorf("label %d doesn't exist", l))
+		return
+	}
+	if b.addresses[l] != -1 {
+		b.fail(fmt.Errorf("label %d placed twice, at %d and %d", l, b.addresses[l], len(b.instructions)))
+		return
+	}
+	b.addresses[l] = len(b.instructions)
+}
+
+// Creates a label placed at the address of the next emitted instruction.
+func (b *Builder) Here() Label {
+	l := b.NewLabel()
+	b.Label(l)
+	return l
+}
+
+func (b *Builder) Emit(i Instruction) {
+	if b.position.Line > 0 && (len(b.lines) == 0 || b.lines[len(b.lines)-1].SourcePosition != b.position) {
+		b.lines = append(b.lines, LineEntry{Start: uintptr(len(b.instructions)), SourcePosition: b.position})
+	}
+	b.instructions = append(b.instructions, i)
+}
+
+// Sets the source position of the instructions emitted from now on, they
+// are recorded in the line table of the program if Line isn't zero.
+func (b *Builder) SetPosition(pos SourcePosition) {
+	b.position = pos
+}
+
+func (b *Builder) Position() SourcePosition {
+	return b.position
+}
+
+// Address of the next emitted instruction.
+func (b *Builder) Len() int {
+	return len(b.instructions)
+}
+
+func (b *Builder) JumpTo(l Label) {
+	b.emitReference(JumpTo{}, l)
+}
+
+func (b *Builder) JumpIfZeroTo(l Label) {
+	b.emitReference(JumpIfZeroTo{}, l)
+}
+
+func (b *Builder) JumpIfNot(cmp InstructionType, t Type, l Label) {
+	b.emitReference(JumpIfNot{Cmp: cmp, Type: t}, l)
+}
+
+// Emits Push<uptr> with the address of l, for Jump, JumpIfZero and Call.
+func (b *Builder) PushAddress(l Label) {
+	b.emitReference(Push{Type: UPTR}, l)
+}
+
+// Adds a function symbol for the body between the labels start and end.
+func (b *Builder) Function(name string, start Label, end Label) {
+	b.functions = append(b.functions, functionLabels{name: name, start: start, end: end})
+}
+
+func (b *Builder) emitReference(i Instruction, l Label) {
+	b.references = append(b.references, labelReference{index: len(b.instructions), label: l})
+	b.Emit(i)
+}
+
+func (b *Builder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+func (b *Builder) resolve(l Label) (int, error) {
+	if int(l) < 0 || int(l) >= len(b.addresses) {
+		return 0, fmt.Errorf("label %d doesn't exist", l)
+	}
+	if b.addresses[l] == -1 {
+		return 0, fmt.Errorf("label %d is never placed", l)
+	}
+	return b.addresses[l], nil
+}
+
+// Resolves all labels and returns the program. The builder shouldn't be
+// used anymore afterwards.
+func (b *Builder) Finish() (Program, error) {
+	if b.err != nil {
+		return Program{}, b.err
+	}
+	for _, r := range b.references {
+		addr, err := b.resolve(r.label)
+		if err != nil {
+			return Program{}, err
+		}
+		switch i := b.instructions[r.index].(type) {
+		case JumpTo:
+			i.Target = uint(addr)
+			b.instructions[r.index] = i
+		case JumpIfZeroTo:
+			i.Target = uint(addr)
+			b.instructions[r.index] = i
+		case JumpIfNot:
+			i.Target = uint(addr)
+			b.instructions[r.index] = i
+		case Push:
+			i.Value = addr
+			b.instructions[r.index] = i
+		}
+	}
+	functions := make([]FunctionSymbol, len(b.functions))
+	for i, f := range b.functions {
+		start, err := b.resolve(f.start)
+		if err != nil {
+			return Program{}, err
+		}
+		end, err := b.resolve(f.end)
+		if err != nil {
+			return Program{}, err
+		}
+		functions[i] = FunctionSymbol{Name: f.name, Start: uintptr(start), End: uintptr(end)}
+	}
+	program := Program{
+		Instructions: b.instructions,
+		Functions:    functions,
+	}
+	if len(b.lines) > 0 {
+		program.DebugInfo = &DebugInfo{Lines: b.lines}
+	}
+	return program, nil
+}
@@ -0,0 +1,61 @@
+package bytecode_test
+
+import (
+	"eud/bytecode"
+	"testing"
+)
+
+func TestBuilderResolvesLabels(t *testing.T) {
+	b := bytecode.NewBuilder()
+	end := b.NewLabel()
+	b.JumpTo(end)
+	f := b.Here()
+	b.Emit(bytecode.Return{Type: bytecode.I32})
+	b.Label(end)
+	b.Function("f", f, end)
+	loop := b.Here()
+	b.JumpIfZeroTo(loop)
+	b.JumpIfNot(bytecode.CmpLTInstruction, bytecode.I32, end)
+	b.PushAddress(f)
+	program, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectInstructions(t, program.Instructions, []bytecode.Instruction{
+		bytecode.JumpTo{Target: 2},
+		bytecode.Return{Type: bytecode.I32},
+		bytecode.JumpIfZeroTo{Target: 2},
+		bytecode.JumpIfNot{Cmp: bytecode.CmpLTInstruction, Type: bytecode.I32, Target: 2},
+		bytecode.Push{Type: bytecode.UPTR, Value: 1},
+	})
+	if len(program.Functions) != 1 || program.Functions[0] != (bytecode.FunctionSymbol{Name: "f", Start: 1, End: 2}) {
+		t.Errorf("unexpected functions %v", program.Functions)
+	}
+}
+
+func TestBuilderUnplacedLabel(t *testing.T) {
+	b := bytecode.NewBuilder()
+	b.JumpTo(b.NewLabel())
+	if _, err := b.Finish(); err == nil {
+		t.Error("expected an error for a label which is never placed")
+	}
+}
+
+func TestBuilderLabelPlacedTwice(t *testing.T) {
+	b := bytecode.NewBuilder()
+	l := b.Here()
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	b.Label(l)
+	if _, err := b.Finish(); err == nil {
+		t.Error("expected an error for a label placed twice")
+	}
+}
+
+func TestBuilderUnknownLabel(t *testing.T) {
+	b := bytecode.NewBuilder()
+	b.Label(bytecode.Label(3))
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	if _, err := b.Finish(); err == nil {
+		t.Error("expected an error for placing a label which doesn't exist")
+	}
+}
@@ -1,11 +1,116 @@
 package bytecode
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
 
 type Program struct {
 	Instructions   []Instruction
 	Preallocations []AllocationStruct
+	Functions      []FunctionSymbol
 	RunWithDebug   bool
+	// optional, nil for programs not compiled from source code
+	DebugInfo *DebugInfo
+}
+
+// Where a program was compiled from.
+type DebugInfo struct {
+	File   string
+	Source string
+	// sorted by Start, every entry covers the instructions up to the next one
+	Lines     []LineEntry
+	Variables []VariableEntry
+}
+
+type SourcePosition struct {
+	Line int
+	Col  int
+	// innermost function the source is in, main for the top level
+	Function string
+}
+
+// Source position of the instructions from Start up to the next entry of
+// the line table.
+type LineEntry struct {
+	Start uintptr
+	SourcePosition
+}
+
+// A local variable of the source, which is in scope while the program counter
+// is in [Start, End) and the innermost frame belongs to Function.
+type VariableEntry struct {
+	Name string
+	Type Type
+	// index of the local among the locals of its function's frame, the
+	// locals declared at the top level form a frame too
+	Index    int
+	Start    uintptr
+	End      uintptr
+	Function string
+}
+
+// Returns the variables in scope at pc, the innermost ones first.
+// d may be nil.
+func (d *DebugInfo) VariablesAt(pc uintptr, function string) []VariableEntry {
+	variables := []VariableEntry{}
+	if d == nil {
+		return variables
+	}
+	for i := len(d.Variables) - 1; i >= 0; i-- {
+		if v := d.Variables[i]; v.Function == function && pc >= v.Start && pc < v.End {
+			variables = append(variables, v)
+		}
+	}
+	return variables
+}
+
+// Returns the entry of the line table covering pc, false if there is none.
+// d may be nil.
+func (d *DebugInfo) LineAt(pc uintptr) (LineEntry, bool) {
+	if d == nil {
+		return LineEntry{}, false
+	}
+	i := sort.Search(len(d.Lines), func(i int) bool { return d.Lines[i].Start > pc })
+	if i == 0 {
+		return LineEntry{}, false
+	}
+	return d.Lines[i-1], true
+}
+
+// Returns the text of the 1-based line of the source, without the line
+// break, and "" if there is no such line.
+func (d *DebugInfo) SourceLine(line int) string {
+	if d == nil || line < 1 {
+		return ""
+	}
+	lines := strings.Split(d.Source, "\n")
+	if line > len(lines) {
+		return ""
+	}
+	return strings.TrimRight(lines[line-1], "\r")
+}
+
+type FunctionSymbol struct {
+	Name string
+	// first instruction of the body
+	Start uintptr
+	// one past the last instruction of the body
+	End uintptr
+}
+
+func (p Program) FunctionAt(pc uintptr) string {
+	// innermost function wins, nested functions are emitted inside their parent
+	name := "main"
+	var size uintptr = 0
+	for _, f := range p.Functions {
+		if pc >= f.Start && pc < f.End && (size == 0 || f.End-f.Start < size) {
+			name = f.Name
+			size = f.End - f.Start
+		}
+	}
+	return name
 }
 
 type Type int
@@ -76,6 +181,11 @@ const (
 	XnorInstruction
 	SyscallInstruction
 	ConvertInstruction
+	JumpToInstruction
+	JumpIfZeroToInstruction
+	JumpIfNotInstruction
+	StoreLocalKeepInstruction
+	IncrementLocalInstruction
 )
 
 type Instruction interface {
@@ -263,6 +373,44 @@ type Convert struct {
 	Src Type
 }
 
+// Superinstructions, each doing the work of a common sequence of the
+// instructions above in a single dispatch.
+
+// Push<uptr> Target, Jump
+type JumpTo struct {
+	Instruction
+	Target uint
+}
+
+// Push<uptr> Target, JumpIfZero
+type JumpIfZeroTo struct {
+	Instruction
+	Target uint
+}
+
+// Cmp<Type>, Push<uptr> Target, JumpIfZero
+type JumpIfNot struct {
+	Instruction
+	Cmp InstructionType
+	Type
+	Target uint
+}
+
+// StoreLocal<Type> Offset, LoadLocal<Type> Offset
+type StoreLocalKeep struct {
+	Instruction
+	Type
+	Offset uint
+}
+
+// LoadLocal<Type> Offset, Push<Type> Value, Add<Type>, StoreLocal<Type> Offset
+type IncrementLocal struct {
+	Instruction
+	Type
+	Offset uint
+	Value  int
+}
+
 func (t Type) String() string {
 	switch t {
 	case U8:
@@ -370,6 +518,16 @@ func (it InstructionType) String() string {
 		return "SyscallInstruction"
 	case ConvertInstruction:
 		return "ConvertInstruction"
+	case JumpToInstruction:
+		return "JumpToInstruction"
+	case JumpIfZeroToInstruction:
+		return "JumpIfZeroToInstruction"
+	case JumpIfNotInstruction:
+		return "JumpIfNotInstruction"
+	case StoreLocalKeepInstruction:
+		return "StoreLocalKeepInstruction"
+	case IncrementLocalInstruction:
+		return "IncrementLocalInstruction"
 	default:
 		panic("unknown")
 	}
@@ -411,6 +569,11 @@ func (n Nand) InstructionType() InstructionType           { return NandInstructi
 func (n Xnor) InstructionType() InstructionType           { return XnorInstruction }
 func (n Syscall) InstructionType() InstructionType        { return SyscallInstruction }
 func (n Convert) InstructionType() InstructionType        { return ConvertInstruction }
+func (n JumpTo) InstructionType() InstructionType         { return JumpToInstruction }
+func (n JumpIfZeroTo) InstructionType() InstructionType   { return JumpIfZeroToInstruction }
+func (n JumpIfNot) InstructionType() InstructionType      { return JumpIfNotInstruction }
+func (n StoreLocalKeep) InstructionType() InstructionType { return StoreLocalKeepInstruction }
+func (n IncrementLocal) InstructionType() InstructionType { return IncrementLocalInstruction }
 
 func (n Allocate) String() string       { return fmt.Sprintf("Allocate<%s>\t", n.Type) }
 func (n Deallocate) String() string     { return fmt.Sprintf("Deallocate<%s>\t", n.Type) }
@@ -448,3 +611,33 @@ func (n Nand) String() string           { return fmt.Sprintf("Nand<%s>\t", n.Typ
 func (n Xnor) String() string           { return fmt.Sprintf("Xnor<%s>\t", n.Type) }
 func (n Syscall) String() string        { return "Syscall\t" }
 func (n Convert) String() string        { return fmt.Sprintf("Convert<%s, %s>\t", n.Dst, n.Src) }
+func (n JumpTo) String() string         { return fmt.Sprintf("JumpTo %d\t", n.Target) }
+func (n JumpIfZeroTo) String() string   { return fmt.Sprintf("JumpIfZeroTo %d", n.Target) }
+func (n JumpIfNot) String() string {
+	return fmt.Sprintf("JumpIfNot<%s, %s> %d", cmpName(n.Cmp), n.Type, n.Target)
+}
+func (n StoreLocalKeep) String() string {
+	return fmt.Sprintf("StoreLocalKeep<%s> %d", n.Type, n.Offset)
+}
+func (n IncrementLocal) String() string {
+	return fmt.Sprintf("IncrementLocal<%s> %d %d", n.Type, n.Offset, n.Value)
+}
+
+func cmpName(cmp InstructionType) string {
+	switch cmp {
+	case CmpEqualInstruction:
+		return "CmpEqual"
+	case CmpInequalInstruction:
+		return "CmpInequal"
+	case CmpLTInstruction:
+		return "CmpLT"
+	case CmpGTInstruction:
+		return "CmpGT"
+	case CmpLTEInstruction:
+		return "CmpLTE"
+	case CmpGTEInstruction:
+		return "CmpGTE"
+	default:
+		panic("unknown")
+	}
+}
@@ -13,10 +13,14 @@ type Symbol struct {
 type SymbolTable struct {
 	parent  *SymbolTable
 	symbols map[string]Symbol
+	// types of the locals declared in the scope, in order, including the
+	// ones shadowed by a later declaration with the same name
+	declared []Type
 }
 
 func (s *SymbolTable) Set(name string, symbol Symbol) {
 	s.symbols[name] = symbol
+	s.declared = append(s.declared, symbol.Type)
 }
 
 func (s *SymbolTable) Get(name string) (Symbol, error) {
@@ -65,47 +69,129 @@ func (s *SymbolTable) DecreaseOffset() {
 }
 
 type Compiler struct {
-	instructions []Instruction
-	varId        uint
-	symtable     SymbolTable
-	globals      map[string]uintptr
-	lastType     Type
+	builder  *Builder
+	varId    uint
+	symtable SymbolTable
+	globals  map[string]Label
+	lastType Type
+	// file of the first statement with a position, and the function
+	// currently compiled
+	file     string
+	function string
+	// locals declared in the frame of the current function so far, and the
+	// variable table
+	locals    int
+	variables []VariableEntry
 }
 
 func Compile(ast []parser.BaseStatement) (Program, error) {
 	ctx := Compiler{
-		instructions: []Instruction{},
-		varId:        0,
+		builder: NewBuilder(),
+		varId:   0,
 		symtable: SymbolTable{
 			parent:  nil,
 			symbols: map[string]Symbol{},
 		},
-		globals: make(map[string]uintptr),
+		globals:  make(map[string]Label),
+		function: "main",
 	}
 	if err := compileStatements(&ctx, ast); err != nil {
 		return Program{}, err
 	}
-	return Program{
-		Instructions: ctx.instructions,
-	}, nil
+	program, err := ctx.builder.Finish()
+	if err != nil {
+		return Program{}, err
+	}
+	if len(ctx.variables) > 0 && program.DebugInfo == nil {
+		program.DebugInfo = &DebugInfo{}
+	}
+	if program.DebugInfo != nil {
+		program.DebugInfo.File = ctx.file
+		program.DebugInfo.Variables = ctx.variables
+	}
+	return program, nil
 }
 
 func compileStatements(ctx *Compiler, nodes []parser.BaseStatement) error {
+	_, err := compileScope(ctx, nodes)
+	return err
+}
+
+// Compiles the body of a while or an if. The locals declared in it are
+// dropped at its end, so that a loop declaring one doesn't pile them up.
+// Locals of functions are dropped by Return instead, and those of the
+// program are kept.
+func compileBlock(ctx *Compiler, nodes []parser.BaseStatement) error {
+	locals, err := compileScope(ctx, nodes)
+	if err != nil {
+		return err
+	}
+	for _, t := range locals {
+		ctx.builder.Emit(UndeclareLocal{Type: t})
+	}
+	ctx.locals -= len(locals)
+	return nil
+}
+
+// Compiles the statements in a new scope, and returns the types of the
+// locals declared in it, the last declared first.
+func compileScope(ctx *Compiler, nodes []parser.BaseStatement) ([]Type, error) {
 	symtable := ctx.symtable
 	ctx.symtable = SymbolTable{
 		parent:  &symtable,
 		symbols: map[string]Symbol{},
 	}
+	// instructions emitted after the statements belong to the statement
+	// containing them
+	position := ctx.builder.Position()
+	variables := len(ctx.variables)
 	for i := range nodes {
+		if pos := nodes[i].Position(); pos.Line > 0 {
+			if ctx.file == "" {
+				ctx.file = pos.File
+			}
+			ctx.builder.SetPosition(SourcePosition{Line: pos.Line, Col: pos.Col, Function: ctx.function})
+		}
 		if err := compileBaseStatement(ctx, nodes[i]); err != nil {
-			return err
+			return nil, err
 		}
 	}
-	for range ctx.symtable.symbols {
+	ctx.builder.SetPosition(position)
+	endScope(ctx, variables)
+	declared := ctx.symtable.declared
+	locals := make([]Type, len(declared))
+	for i := range declared {
+		locals[i] = declared[len(declared)-1-i]
+	}
+	for range declared {
 		ctx.symtable.DecreaseOffset()
 	}
 	ctx.symtable = symtable
-	return nil
+	return locals, nil
+}
+
+// Declares a local in the current scope and adds it to the variable table.
+func declareLocal(ctx *Compiler, name string, t Type) {
+	ctx.symtable.IncreaseOffset()
+	ctx.symtable.Set(name, Symbol{Type: t, Offset: 0})
+	ctx.builder.Emit(DeclareLocal{Type: t})
+	ctx.variables = append(ctx.variables, VariableEntry{
+		Name:     name,
+		Type:     t,
+		Index:    ctx.locals,
+		Start:    uintptr(ctx.builder.Len()),
+		Function: ctx.function,
+	})
+	ctx.locals++
+}
+
+// Ends the scope of the variables declared since the first one.
+func endScope(ctx *Compiler, first int) {
+	for i := first; i < len(ctx.variables); i++ {
+		if ctx.variables[i].End == 0 {
+			ctx.variables[i].End = uintptr(ctx.builder.Len())
+		}
+	}
 }
 
 func compileBaseStatement(ctx *Compiler, node parser.BaseStatement) error {
@@ -133,6 +219,9 @@ func compileBaseStatement(ctx *Compiler, node parser.BaseStatement) error {
 }
 
 func compileExpressionStatement(ctx *Compiler, node parser.BaseStatement) error {
+	if ok, err := compileIncrementStatement(ctx, node.(parser.ExpressionStatement).Expression); ok || err != nil {
+		return err
+	}
 	if err := compileBaseExpression(ctx, node.(parser.ExpressionStatement).Expression); err != nil {
 		return err
 	}
@@ -145,23 +234,56 @@ func compileExpressionStatement(ctx *Compiler, node parser.BaseStatement) error
 	//  But because of the stack value implementation we can just pop with any type.
 	//  Notice. This hack also assumes funccalls and assignments always return a value,
 	//  which isn't hard to enforce.
-	ctx.instructions = append(ctx.instructions, Pop{Type: ctx.lastType})
+	ctx.builder.Emit(Pop{Type: ctx.lastType})
 
 	return nil
 }
 
+// Compiles `a = a + <int>` and `a = <int> + a` as a single IncrementLocal.
+// Returns false if the expression isn't of that form.
+func compileIncrementStatement(ctx *Compiler, node parser.BaseExpression) (bool, error) {
+	assignment, ok := node.(parser.VarAssignExpression)
+	if !ok {
+		return false, nil
+	}
+	addition, ok := assignment.Value.(parser.AddExpression)
+	if !ok {
+		return false, nil
+	}
+	variable, ok := addition.Left.(parser.VarAccessExpression)
+	literal, isLiteral := addition.Right.(parser.IntLiteral)
+	if !ok || !isLiteral {
+		variable, ok = addition.Right.(parser.VarAccessExpression)
+		literal, isLiteral = addition.Left.(parser.IntLiteral)
+	}
+	if !ok || !isLiteral || variable.Identifier.StringValue != assignment.Identifier.StringValue {
+		return false, nil
+	}
+	if _, isGlobal := ctx.globals[variable.Identifier.StringValue]; isGlobal {
+		return false, nil
+	}
+	symbol, err := ctx.symtable.Get(assignment.Identifier.StringValue)
+	if err != nil {
+		return true, err
+	}
+	ctx.builder.Emit(IncrementLocal{
+		Type:   symbol.Type,
+		Offset: symbol.Offset,
+		Value:  literal.Tok.IntValue,
+	})
+	return true, nil
+}
+
 func compileTypedInitStatement(ctx *Compiler, node parser.TypedInitStatement) error {
 	t, err := compileType(ctx, node.DeclType)
 	if err != nil {
 		return err
 	}
-	ctx.symtable.IncreaseOffset()
-	ctx.symtable.Set(node.Identifier.StringValue, Symbol{Type: t, Offset: 0})
-	ctx.instructions = append(ctx.instructions, DeclareLocal{Type: t})
+	declareLocal(ctx, node.Identifier.StringValue, t)
 	if err := compileBaseExpression(ctx, node.Value); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, StoreLocal{Type: t, Offset: 0})
+	ctx.builder.Emit(StoreLocal{Type: t, Offset: 0})
 	return nil
 }
 
@@ -170,89 +292,135 @@ func compileDeclarationStatement(ctx *Compiler, node parser.DeclarationStatement
 	if err != nil {
 		return err
 	}
-	ctx.symtable.IncreaseOffset()
-	ctx.symtable.Set(node.Identifier.StringValue, Symbol{Type: t, Offset: 0})
-	ctx.instructions = append(ctx.instructions, DeclareLocal{Type: t})
+	declareLocal(ctx, node.Identifier.StringValue, t)
 	return nil
 }
 
 func compileFuncDefStatement(ctx *Compiler, node parser.FuncDefStatement) error {
-	start := len(ctx.instructions)
-	ctx.instructions = append(ctx.instructions, Push{Type: UPTR, Value: 0})
-	ctx.instructions = append(ctx.instructions, Jump{})
-	ctx.globals[node.Identifier.StringValue] = uintptr(start + 2)
+	end := ctx.builder.NewLabel()
+	ctx.builder.JumpTo(end)
+	start := ctx.builder.Here()
+	ctx.globals[node.Identifier.StringValue] = start
+	function, position, locals := ctx.function, ctx.builder.Position(), ctx.locals
+	variables := len(ctx.variables)
+	ctx.function, ctx.locals = node.Identifier.StringValue, 0
+	if position.Line > 0 {
+		ctx.builder.SetPosition(SourcePosition{Line: position.Line, Col: position.Col, Function: ctx.function})
+	}
+	// parameters are only visible inside the function, the locals they are
+	// stored in are declared when it is called
+	symtable := ctx.symtable
+	ctx.symtable = SymbolTable{
+		parent:  &symtable,
+		symbols: map[string]Symbol{},
+	}
 	for i := range node.Parameters {
 		t, err := compileType(ctx, node.Parameters[i].DeclType)
 		if err != nil {
 			return err
 		}
-		ctx.symtable.IncreaseOffset()
-		ctx.instructions = append(ctx.instructions, DeclareLocal{Type: t})
-		ctx.instructions = append(ctx.instructions, StoreLocal{Type: t, Offset: 0})
-		ctx.symtable.Set(node.Parameters[i].Identifier.StringValue, Symbol{Type: t, Offset: 0})
+		declareLocal(ctx, node.Parameters[i].Identifier.StringValue, t)
+		ctx.builder.Emit(StoreLocal{Type: t, Offset: 0})
+		// parameters are in scope once they hold the argument
+		ctx.variables[len(ctx.variables)-1].Start = uintptr(ctx.builder.Len())
 	}
 	if err := compileStatements(ctx, node.Body); err != nil {
 		return err
 	}
+	for range ctx.symtable.symbols {
+		ctx.symtable.DecreaseOffset()
+	}
+	ctx.symtable = symtable
 	t, err := compileType(ctx, node.ReturnType)
 	if err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Push{Type: USIZE, Value: 0})
-	ctx.instructions = append(ctx.instructions, Return{Type: t})
-	ctx.instructions[start] = Push{Type: UPTR, Value: len(ctx.instructions) - start}
+	ctx.builder.Emit(Push{Type: t, Value: 0})
+	ctx.builder.Emit(Return{Type: t})
+	endScope(ctx, variables)
+	ctx.function, ctx.locals = function, locals
+	ctx.builder.SetPosition(position)
+	ctx.builder.Label(end)
+	ctx.builder.Function(node.Identifier.StringValue, start, end)
+	return nil
+}
+
+// Compiles the condition followed by a jump to target taken when it is
+// false. Comparisons are fused with the jump.
+func compileConditionalJump(ctx *Compiler, condition parser.BaseExpression, target Label) error {
+	var cmp InstructionType
+	var left, right parser.BaseExpression
+	switch node := condition.(type) {
+	case parser.EqualExpression:
+		cmp, left, right = CmpEqualInstruction, node.Left, node.Right
+	case parser.NotEqualExpression:
+		cmp, left, right = CmpInequalInstruction, node.Left, node.Right
+	case parser.LessThanExpression:
+		cmp, left, right = CmpLTInstruction, node.Left, node.Right
+	case parser.GreaterThanExpression:
+		cmp, left, right = CmpGTInstruction, node.Left, node.Right
+	case parser.LTEExpression:
+		cmp, left, right = CmpLTEInstruction, node.Left, node.Right
+	case parser.GTEExpression:
+		cmp, left, right = CmpGTEInstruction, node.Left, node.Right
+	default:
+		if err := compileBaseExpression(ctx, condition); err != nil {
+			return err
+		}
+		ctx.builder.JumpIfZeroTo(target)
+		return nil
+	}
+	if err := compileBaseExpression(ctx, left); err != nil {
+		return err
+	}
+	if err := compileBaseExpression(ctx, right); err != nil {
+		return err
+	}
+	ctx.builder.JumpIfNot(cmp, I32, target)
 	return nil
 }
 
 func compileWhileStatementType(ctx *Compiler, node parser.WhileStatement) error {
-	condition_start := len(ctx.instructions)
-	if err := compileBaseExpression(ctx, node.Condition); err != nil {
+	condition := ctx.builder.Here()
+	end := ctx.builder.NewLabel()
+	if err := compileConditionalJump(ctx, node.Condition, end); err != nil {
 		return err
 	}
-	end_jpush_index := len(ctx.instructions)
-	ctx.instructions = append(ctx.instructions, Push{Type: UPTR, Value: 0})
-	ctx.instructions = append(ctx.instructions, JumpIfZero{})
-	if err := compileStatements(ctx, node.Body); err != nil {
+	if err := compileBlock(ctx, node.Body); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Push{Type: UPTR, Value: condition_start})
-	ctx.instructions = append(ctx.instructions, Jump{})
-	ctx.instructions[end_jpush_index] = Push{Type: UPTR, Value: len(ctx.instructions)}
+	ctx.builder.JumpTo(condition)
+	ctx.builder.Label(end)
 	return nil
 }
 
 func compileIfElseStatementType(ctx *Compiler, node parser.IfElseStatement) error {
-	if err := compileBaseExpression(ctx, node.Condition); err != nil {
+	falsy := ctx.builder.NewLabel()
+	end := ctx.builder.NewLabel()
+	if err := compileConditionalJump(ctx, node.Condition, falsy); err != nil {
 		return err
 	}
-	else_jpush_index := len(ctx.instructions)
-	ctx.instructions = append(ctx.instructions, Push{Type: UPTR, Value: 0})
-	ctx.instructions = append(ctx.instructions, JumpIfZero{})
-	if err := compileStatements(ctx, node.Truthy); err != nil {
+	if err := compileBlock(ctx, node.Truthy); err != nil {
 		return err
 	}
-	end_jpush_index := len(ctx.instructions)
-	ctx.instructions = append(ctx.instructions, Push{Type: UPTR, Value: 0})
-	ctx.instructions = append(ctx.instructions, JumpIfZero{})
-	ctx.instructions[else_jpush_index] = Push{Type: UPTR, Value: len(ctx.instructions)}
-	if err := compileStatements(ctx, node.Falsy); err != nil {
+	ctx.builder.JumpTo(end)
+	ctx.builder.Label(falsy)
+	if err := compileBlock(ctx, node.Falsy); err != nil {
 		return err
 	}
-	ctx.instructions[end_jpush_index] = Push{Type: UPTR, Value: len(ctx.instructions)}
+	ctx.builder.Label(end)
 	return nil
 }
 
 func compileIfStatementType(ctx *Compiler, node parser.IfStatement) error {
-	if err := compileBaseExpression(ctx, node.Condition); err != nil {
+	end := ctx.builder.NewLabel()
+	if err := compileConditionalJump(ctx, node.Condition, end); err != nil {
 		return err
 	}
-	end_jpush_index := len(ctx.instructions)
-	ctx.instructions = append(ctx.instructions, Push{Type: UPTR, Value: 0})
-	ctx.instructions = append(ctx.instructions, JumpIfZero{})
-	if err := compileStatements(ctx, node.Body); err != nil {
+	if err := compileBlock(ctx, node.Body); err != nil {
 		return err
 	}
-	ctx.instructions[end_jpush_index] = Push{Type: UPTR, Value: len(ctx.instructions)}
+	ctx.builder.Label(end)
 	return nil
 }
 
@@ -262,7 +430,7 @@ func compileReturnStatement(ctx *Compiler, node parser.ReturnStatement) error {
 	}
 
 	// HACK, type is hardcoded, should be inferred
-	ctx.instructions = append(ctx.instructions, Return{Type: I32})
+	ctx.builder.Emit(Return{Type: I32})
 	return nil
 }
 
@@ -327,6 +495,10 @@ func compileBaseExpression(ctx *Compiler, node parser.BaseExpression) error {
 		return compileExpExpression(ctx, node.(parser.ExpExpression))
 	case parser.FuncCallExpressionType:
 		return compileFuncCallExpression(ctx, node.(parser.FuncCallExpression))
+	case parser.SpawnExpressionType:
+		return compileSpawnExpression(ctx, node.(parser.SpawnExpression))
+	case parser.JoinExpressionType:
+		return compileJoinExpression(ctx, node.(parser.JoinExpression))
 	case parser.VarAccessExpressionType:
 		return compileVarAccessExpression(ctx, node.(parser.VarAccessExpression))
 	case parser.IntExpressionType:
@@ -344,8 +516,7 @@ func compileVarAssignExpression(ctx *Compiler, node parser.VarAssignExpression)
 	if err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, StoreLocal{Type: symbol.Type, Offset: symbol.Offset})
-	ctx.instructions = append(ctx.instructions, LoadLocal{Type: symbol.Type, Offset: symbol.Offset})
+	ctx.builder.Emit(StoreLocalKeep{Type: symbol.Type, Offset: symbol.Offset})
 	ctx.lastType = symbol.Type
 	return nil
 }
@@ -357,7 +528,7 @@ func compileNotEqualExpression(ctx *Compiler, node parser.NotEqualExpression) er
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, CmpInequal{Type: I32})
+	ctx.builder.Emit(CmpInequal{Type: I32})
 	return nil
 }
 
@@ -368,7 +539,7 @@ func compileEqualExpression(ctx *Compiler, node parser.EqualExpression) error {
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, CmpEqual{Type: I32})
+	ctx.builder.Emit(CmpEqual{Type: I32})
 	return nil
 }
 
@@ -379,7 +550,7 @@ func compileGreaterThanOrEqualExpression(ctx *Compiler, node parser.GTEExpressio
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, CmpGTE{Type: I32})
+	ctx.builder.Emit(CmpGTE{Type: I32})
 	return nil
 }
 
@@ -390,7 +561,7 @@ func compileLessThanOrEqualExpression(ctx *Compiler, node parser.LTEExpression)
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, CmpLTE{Type: I32})
+	ctx.builder.Emit(CmpLTE{Type: I32})
 	return nil
 }
 
@@ -401,7 +572,7 @@ func compileGreaterThanExpression(ctx *Compiler, node parser.GreaterThanExpressi
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, CmpGT{Type: I32})
+	ctx.builder.Emit(CmpGT{Type: I32})
 	return nil
 }
 
@@ -412,7 +583,7 @@ func compileLessThanExpression(ctx *Compiler, node parser.LessThanExpression) er
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, CmpLT{Type: I32})
+	ctx.builder.Emit(CmpLT{Type: I32})
 	return nil
 }
 
@@ -423,7 +594,7 @@ func compileAddExpression(ctx *Compiler, node parser.AddExpression) error {
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Add{Type: I32})
+	ctx.builder.Emit(Add{Type: I32})
 	return nil
 }
 
@@ -434,7 +605,7 @@ func compileSubExpression(ctx *Compiler, node parser.SubExpression) error {
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Subtract{Type: I32})
+	ctx.builder.Emit(Subtract{Type: I32})
 	return nil
 }
 
@@ -445,7 +616,7 @@ func compileMulExpression(ctx *Compiler, node parser.MulExpression) error {
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Multiply{Type: I32})
+	ctx.builder.Emit(Multiply{Type: I32})
 	return nil
 }
 
@@ -456,7 +627,7 @@ func compileDivExpression(ctx *Compiler, node parser.DivExpression) error {
 	if err := compileBaseExpression(ctx, node.Right); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Divide{Type: I32})
+	ctx.builder.Emit(Divide{Type: I32})
 	return nil
 }
 
@@ -470,7 +641,7 @@ func compileExpExpression(ctx *Compiler, node parser.ExpExpression) error {
 	if err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Exponent{Type: I32})
+	ctx.builder.Emit(Exponent{Type: I32})
 	return nil
 }
 
@@ -481,18 +652,46 @@ func compileFuncCallExpression(ctx *Compiler, node parser.FuncCallExpression) er
 		}
 	}
 
-	ctx.instructions = append(ctx.instructions, Push{Type: USIZE, Value: len(node.Arguments)})
+	ctx.builder.Emit(Push{Type: USIZE, Value: len(node.Arguments)})
 	if err := compileBaseExpression(ctx, node.Identifier); err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, Call{Type: UPTR}) // type is omittable
+	ctx.builder.Emit(Call{Type: UPTR}) // type is omittable
+	return nil
+}
+
+// Spawns a thread with syscall 1200, which takes the arguments like a call.
+func compileSpawnExpression(ctx *Compiler, node parser.SpawnExpression) error {
+	for i := range node.Call.Arguments {
+		if err := compileBaseExpression(ctx, node.Call.Arguments[i]); err != nil {
+			return err
+		}
+	}
+	ctx.builder.Emit(Push{Type: USIZE, Value: len(node.Call.Arguments)})
+	if err := compileBaseExpression(ctx, node.Call.Identifier); err != nil {
+		return err
+	}
+	ctx.builder.Emit(Push{Type: USIZE, Value: 1200})
+	ctx.builder.Emit(Syscall{})
+	ctx.lastType = USIZE
+	return nil
+}
+
+func compileJoinExpression(ctx *Compiler, node parser.JoinExpression) error {
+	if err := compileBaseExpression(ctx, node.Thread); err != nil {
+		return err
+	}
+	ctx.builder.Emit(Push{Type: USIZE, Value: 1201})
+	ctx.builder.Emit(Syscall{})
+	// HACK, functions return i32 like in compileReturnStatement
+	ctx.lastType = I32
 	return nil
 }
 
 func compileVarAccessExpression(ctx *Compiler, node parser.VarAccessExpression) error {
 	for i := range ctx.globals {
 		if i == node.Identifier.StringValue {
-			ctx.instructions = append(ctx.instructions, Push{Type: UPTR, Value: int(ctx.globals[i])})
+			ctx.builder.PushAddress(ctx.globals[i])
 			return nil
 		}
 	}
@@ -500,12 +699,12 @@ func compileVarAccessExpression(ctx *Compiler, node parser.VarAccessExpression)
 	if err != nil {
 		return err
 	}
-	ctx.instructions = append(ctx.instructions, LoadLocal{Type: symbol.Type, Offset: symbol.Offset})
+	ctx.builder.Emit(LoadLocal{Type: symbol.Type, Offset: symbol.Offset})
 	ctx.lastType = symbol.Type
 	return nil
 }
 
 func compileIntLiteral(ctx *Compiler, node parser.IntLiteral) error {
-	ctx.instructions = append(ctx.instructions, Push{Type: I32, Value: node.Tok.IntValue})
+	ctx.builder.Emit(Push{Type: I32, Value: node.Tok.IntValue})
 	return nil
 }
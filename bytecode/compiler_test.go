@@ -1,6 +1,7 @@
 package bytecode_test
 
 import (
+	"context"
 	"eud/bytecode"
 	"eud/parser"
 	"fmt"
@@ -98,7 +99,7 @@ func TestFunctions(t *testing.T) {
 	program.RunWithDebug = true
 	program.Instructions = append(program.Instructions, bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
 	runtime := bytecode.Run(program)
-	result := runtime.Stack[0].(bytecode.I32Value).Value
+	result := runtime.Stack[0].Value().(bytecode.I32Value).Value
 	if result != 8 {
 		t.Errorf("unexpected result %d", result)
 	}
@@ -154,7 +155,7 @@ func TestVariables(t *testing.T) {
 	program.RunWithDebug = true
 	program.Instructions = append(program.Instructions, bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
 	runtime := bytecode.Run(program)
-	result := runtime.Stack[0].(bytecode.I32Value).Value
+	result := runtime.Stack[0].Value().(bytecode.I32Value).Value
 	if result != 65 {
 		t.Errorf("unexpected result %d", result)
 	}
@@ -190,3 +191,354 @@ func TestMath(t *testing.T) {
 	program.RunWithDebug = true
 	bytecode.Run(program)
 }
+
+func TestWhileLoop(t *testing.T) {
+	// let a: i32
+	// a = 0
+	// while (a < 8) {
+	//     a = a + 1
+	// }
+	identifier := parser.Token{Type: parser.IdentifierToken, StringValue: "a", Next: nil}
+	program, err := bytecode.Compile([]parser.BaseStatement{
+		parser.DeclarationStatement{
+			TypedDeclaration: parser.TypedDeclaration{
+				DeclType: parser.Token{
+					Type: parser.KeywordToken, StringValue: "i32", Next: nil,
+				},
+				Identifier: identifier,
+			},
+		},
+		parser.ExpressionStatement{
+			Expression: parser.VarAssignExpression{
+				Identifier: identifier,
+				Value: parser.IntLiteral{
+					Tok: &parser.Token{
+						Type: parser.IntToken, IntValue: 0, StringValue: "0", Next: nil,
+					},
+				},
+			},
+		},
+		parser.WhileStatement{
+			Condition: parser.LessThanExpression{
+				Left: parser.VarAccessExpression{Identifier: identifier},
+				Right: parser.IntLiteral{
+					Tok: &parser.Token{
+						Type: parser.IntToken, IntValue: 8, StringValue: "8", Next: nil,
+					},
+				},
+			},
+			Body: []parser.BaseStatement{
+				parser.ExpressionStatement{
+					Expression: parser.VarAssignExpression{
+						Identifier: identifier,
+						Value: parser.AddExpression{
+							Left: parser.VarAccessExpression{Identifier: identifier},
+							Right: parser.IntLiteral{
+								Tok: &parser.Token{
+									Type: parser.IntToken, IntValue: 1, StringValue: "1", Next: nil,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []bytecode.InstructionType{
+		bytecode.DeclareLocalInstruction,
+		bytecode.PushInstruction,
+		bytecode.StoreLocalKeepInstruction,
+		bytecode.PopInstruction,
+		bytecode.LoadLocalInstruction,
+		bytecode.PushInstruction,
+		bytecode.JumpIfNotInstruction,
+		bytecode.IncrementLocalInstruction,
+		bytecode.JumpToInstruction,
+	}
+	if len(program.Instructions) != len(expected) {
+		t.Fatalf("expected %d instructions, got %d", len(expected), len(program.Instructions))
+	}
+	for i := range expected {
+		if program.Instructions[i].InstructionType() != expected[i] {
+			t.Errorf("instruction %d is %s, expected %s", i, program.Instructions[i].InstructionType(), expected[i])
+		}
+	}
+	runtime := bytecode.Run(program)
+	result := runtime.Locals[0].Value().(bytecode.I32Value).Value
+	if result != 8 {
+		t.Errorf("unexpected result %d", result)
+	}
+}
+
+func TestIfElse(t *testing.T) {
+	// let a: i32
+	// if (1) {
+	//     a = 1
+	// } else {
+	//     a = 2
+	// }
+	identifier := parser.Token{Type: parser.IdentifierToken, StringValue: "a", Next: nil}
+	assign := func(value int) parser.BaseStatement {
+		return parser.ExpressionStatement{
+			Expression: parser.VarAssignExpression{
+				Identifier: identifier,
+				Value: parser.IntLiteral{
+					Tok: &parser.Token{
+						Type: parser.IntToken, IntValue: value, StringValue: fmt.Sprint(value), Next: nil,
+					},
+				},
+			},
+		}
+	}
+	program, err := bytecode.Compile([]parser.BaseStatement{
+		parser.DeclarationStatement{
+			TypedDeclaration: parser.TypedDeclaration{
+				DeclType: parser.Token{
+					Type: parser.KeywordToken, StringValue: "i32", Next: nil,
+				},
+				Identifier: identifier,
+			},
+		},
+		parser.IfElseStatement{
+			Condition: parser.IntLiteral{
+				Tok: &parser.Token{
+					Type: parser.IntToken, IntValue: 1, StringValue: "1", Next: nil,
+				},
+			},
+			Truthy: []parser.BaseStatement{assign(1)},
+			Falsy:  []parser.BaseStatement{assign(2)},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the jump over the else branch must not pop a condition
+	runtime, err := bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := runtime.Locals[0].Value().(bytecode.I32Value).Value
+	if result != 1 || runtime.Sp != 0 {
+		t.Errorf("expected a = 1 and an empty stack, got %d with %d values", result, runtime.Sp)
+	}
+}
+
+func TestFunctionLocals(t *testing.T) {
+	// fn id(i32 a) -> i32 {
+	//     return a
+	// }
+	// let result: i32
+	// result = id(7)
+	parameter := parser.Token{Type: parser.IdentifierToken, StringValue: "a", Next: nil}
+	function := parser.Token{Type: parser.IdentifierToken, StringValue: "id", Next: nil}
+	result := parser.Token{Type: parser.IdentifierToken, StringValue: "result", Next: nil}
+	i32 := parser.Token{Type: parser.KeywordToken, StringValue: "i32", Next: nil}
+	program, err := bytecode.Compile([]parser.BaseStatement{
+		parser.FuncDefStatement{
+			Identifier: function,
+			ReturnType: i32,
+			Parameters: []parser.TypedDeclaration{{DeclType: i32, Identifier: parameter}},
+			Body: []parser.BaseStatement{
+				parser.ReturnStatement{Value: parser.VarAccessExpression{Identifier: parameter}},
+			},
+		},
+		parser.DeclarationStatement{
+			TypedDeclaration: parser.TypedDeclaration{DeclType: i32, Identifier: result},
+		},
+		parser.ExpressionStatement{
+			Expression: parser.VarAssignExpression{
+				Identifier: result,
+				Value: parser.FuncCallExpression{
+					Identifier: parser.VarAccessExpression{Identifier: function},
+					Arguments: []parser.BaseExpression{
+						parser.IntLiteral{
+							Tok: &parser.Token{
+								Type: parser.IntToken, IntValue: 7, StringValue: "7", Next: nil,
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parameter of id must not stay behind in the locals of the caller
+	runtime := bytecode.Run(program)
+	if len(runtime.Locals) != 1 || runtime.Locals[0].Value() != (bytecode.I32Value{Value: 7}) {
+		t.Errorf("expected only result = 7 in the locals, got %v", runtime.Locals)
+	}
+}
+
+func TestImplicitReturn(t *testing.T) {
+	// fn nothing() -> i32 {
+	// }
+	// let result: i32
+	// result = nothing()
+	function := parser.Token{Type: parser.IdentifierToken, StringValue: "nothing", Next: nil}
+	result := parser.Token{Type: parser.IdentifierToken, StringValue: "result", Next: nil}
+	i32 := parser.Token{Type: parser.KeywordToken, StringValue: "i32", Next: nil}
+	program, err := bytecode.Compile([]parser.BaseStatement{
+		parser.FuncDefStatement{
+			Identifier: function,
+			ReturnType: i32,
+			Parameters: []parser.TypedDeclaration{},
+			Body:       []parser.BaseStatement{},
+		},
+		parser.DeclarationStatement{
+			TypedDeclaration: parser.TypedDeclaration{DeclType: i32, Identifier: result},
+		},
+		parser.ExpressionStatement{
+			Expression: parser.VarAssignExpression{
+				Identifier: result,
+				Value: parser.FuncCallExpression{
+					Identifier: parser.VarAccessExpression{Identifier: function},
+					Arguments:  []parser.BaseExpression{},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// falling off the end returns a zero of the return type
+	runtime := bytecode.Run(program)
+	if value := runtime.Locals[0].Value(); value != (bytecode.I32Value{Value: 0}) {
+		t.Errorf("expected the i32 0, got %s", value)
+	}
+}
+
+func TestWhileLoopLocals(t *testing.T) {
+	// examples/while-let.eud
+	// let a: i32
+	// a = 0
+	// while (a < 3) {
+	//     let b: i32 = 1
+	//     a = a + b
+	// }
+	a := parser.Token{Type: parser.IdentifierToken, StringValue: "a", Next: nil}
+	b := parser.Token{Type: parser.IdentifierToken, StringValue: "b", Next: nil}
+	i32 := parser.Token{Type: parser.KeywordToken, StringValue: "i32", Next: nil}
+	literal := func(value int) parser.BaseExpression {
+		return parser.IntLiteral{
+			Tok: &parser.Token{
+				Type: parser.IntToken, IntValue: value, StringValue: fmt.Sprint(value), Next: nil,
+			},
+		}
+	}
+	program, err := bytecode.Compile([]parser.BaseStatement{
+		parser.DeclarationStatement{
+			TypedDeclaration: parser.TypedDeclaration{DeclType: i32, Identifier: a},
+		},
+		parser.ExpressionStatement{
+			Expression: parser.VarAssignExpression{Identifier: a, Value: literal(0)},
+		},
+		parser.WhileStatement{
+			Condition: parser.LessThanExpression{
+				Left:  parser.VarAccessExpression{Identifier: a},
+				Right: literal(3),
+			},
+			Body: []parser.BaseStatement{
+				parser.TypedInitStatement{
+					TypedDeclaration: parser.TypedDeclaration{DeclType: i32, Identifier: b},
+					Value:            literal(1),
+				},
+				parser.ExpressionStatement{
+					Expression: parser.VarAssignExpression{
+						Identifier: a,
+						Value: parser.AddExpression{
+							Left:  parser.VarAccessExpression{Identifier: a},
+							Right: parser.VarAccessExpression{Identifier: b},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// b is dropped at the end of every iteration, so a keeps its offset
+	runtime, err := bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{InstructionLimit: 1000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(runtime.Locals) != 1 || runtime.Locals[0].Value() != (bytecode.I32Value{Value: 3}) {
+		t.Errorf("expected only a = 3 in the locals, got %v", runtime.Locals)
+	}
+}
+
+func TestLineTable(t *testing.T) {
+	// let a: i32
+	// while (a < 8) {
+	//     a = a + 1
+	// }
+	identifier := parser.Token{Type: parser.IdentifierToken, StringValue: "a", Next: nil}
+	program, err := bytecode.Compile([]parser.BaseStatement{
+		parser.DeclarationStatement{
+			Pos: parser.Position{File: "while.eud", Line: 1, Col: 1},
+			TypedDeclaration: parser.TypedDeclaration{
+				DeclType: parser.Token{
+					Type: parser.KeywordToken, StringValue: "i32", Next: nil,
+				},
+				Identifier: identifier,
+			},
+		},
+		parser.WhileStatement{
+			Pos: parser.Position{File: "while.eud", Line: 2, Col: 1},
+			Condition: parser.LessThanExpression{
+				Left: parser.VarAccessExpression{Identifier: identifier},
+				Right: parser.IntLiteral{
+					Tok: &parser.Token{
+						Type: parser.IntToken, IntValue: 8, StringValue: "8", Next: nil,
+					},
+				},
+			},
+			Body: []parser.BaseStatement{
+				parser.ExpressionStatement{
+					Pos: parser.Position{File: "while.eud", Line: 3, Col: 5},
+					Expression: parser.VarAssignExpression{
+						Identifier: identifier,
+						Value: parser.AddExpression{
+							Left: parser.VarAccessExpression{Identifier: identifier},
+							Right: parser.IntLiteral{
+								Tok: &parser.Token{
+									Type: parser.IntToken, IntValue: 1, StringValue: "1", Next: nil,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if program.DebugInfo == nil || program.DebugInfo.File != "while.eud" {
+		t.Fatalf("expected debug info for while.eud, got %v", program.DebugInfo)
+	}
+	position := func(line int, col int) bytecode.SourcePosition {
+		return bytecode.SourcePosition{Line: line, Col: col, Function: "main"}
+	}
+	expected := []bytecode.LineEntry{
+		// DeclareLocal
+		{Start: 0, SourcePosition: position(1, 1)},
+		// LoadLocal, Push, JumpIfNot
+		{Start: 1, SourcePosition: position(2, 1)},
+		// IncrementLocal
+		{Start: 4, SourcePosition: position(3, 5)},
+		// the jump back to the condition
+		{Start: 5, SourcePosition: position(2, 1)},
+	}
+	if fmt.Sprint(program.DebugInfo.Lines) != fmt.Sprint(expected) {
+		t.Errorf("expected line table %v, got %v", expected, program.DebugInfo.Lines)
+	}
+	if entry, ok := program.DebugInfo.LineAt(3); !ok || entry.Line != 2 {
+		t.Errorf("expected instruction 3 on line 2, got %v", entry)
+	}
+}
@@ -0,0 +1,237 @@
+package bytecode
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"sort"
+	"strings"
+)
+
+// Coverage counts how often every instruction of a program is executed and
+// maps the counts to source lines through the line table. Record is called
+// before every instruction, for example as the predicate of
+// Runtime.RunUntil. Coverage of several runs of a program accumulates.
+type Coverage struct {
+	program Program
+	counts  []uint64
+	// instructions which can't be executed, such as the implicit return
+	// after an explicit one, are left out of the line coverage
+	unreachable []bool
+}
+
+type LineCoverage struct {
+	Line int
+	// the instructions compiled from the line and how many of them were
+	// executed, a line is covered partially if some of them weren't
+	Instructions int
+	Covered      int
+	// executions of the most executed instruction of the line
+	Hits uint64
+}
+
+type FunctionCoverage struct {
+	Name string
+	Line int
+	// calls of the function
+	Hits uint64
+}
+
+func NewCoverage(p Program) *Coverage {
+	unreachable := make([]bool, len(p.Instructions))
+	removeUnreachable(p.Instructions, findLeaders(p), unreachable)
+	return &Coverage{program: p, counts: make([]uint64, len(p.Instructions)), unreachable: unreachable}
+}
+
+func (c *Coverage) Record(r *Runtime) {
+	if r.Pc < uintptr(len(c.counts)) {
+		c.counts[r.Pc]++
+	}
+}
+
+// Returns the number of executions of every instruction.
+func (c *Coverage) Counts() []uint64 {
+	return append([]uint64{}, c.counts...)
+}
+
+// Returns the coverage of the lines in the line table, sorted by line.
+func (c *Coverage) Lines() []LineCoverage {
+	debug := c.program.DebugInfo
+	if debug == nil {
+		return []LineCoverage{}
+	}
+	lines := map[int]*LineCoverage{}
+	for i, entry := range debug.Lines {
+		end := len(c.program.Instructions)
+		if i+1 < len(debug.Lines) {
+			end = int(debug.Lines[i+1].Start)
+		}
+		for pc := int(entry.Start); pc < end; pc++ {
+			if c.unreachable[pc] {
+				continue
+			}
+			line := lines[entry.Line]
+			if line == nil {
+				line = &LineCoverage{Line: entry.Line}
+				lines[entry.Line] = line
+			}
+			line.Instructions++
+			if c.counts[pc] > 0 {
+				line.Covered++
+			}
+			if c.counts[pc] > line.Hits {
+				line.Hits = c.counts[pc]
+			}
+		}
+	}
+	sorted := make([]LineCoverage, 0, len(lines))
+	for _, line := range lines {
+		sorted = append(sorted, *line)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Line < sorted[j].Line })
+	return sorted
+}
+
+func (c *Coverage) Functions() []FunctionCoverage {
+	functions := []FunctionCoverage{}
+	for _, f := range c.program.Functions {
+		function := FunctionCoverage{Name: f.Name}
+		if entry, ok := c.program.DebugInfo.LineAt(f.Start); ok {
+			function.Line = entry.Line
+		}
+		if f.Start < uintptr(len(c.counts)) {
+			function.Hits = c.counts[f.Start]
+		}
+		functions = append(functions, function)
+	}
+	return functions
+}
+
+// Returns the number of lines in the line table and how many of them were
+// executed at least partially.
+func (c *Coverage) Summary() (lines int, covered int) {
+	for _, line := range c.Lines() {
+		lines++
+		if line.Covered > 0 {
+			covered++
+		}
+	}
+	return lines, covered
+}
+
+// Writes the share of covered lines and the lines which were never or only
+// partially executed.
+func (c *Coverage) WriteText(w io.Writer) error {
+	file := c.program.DebugInfo.fileName()
+	lines, covered := c.Summary()
+	fmt.Fprintf(w, "%s: %d of %d lines covered (%.1f%%)\n", file, covered, lines, percent(int64(covered), int64(lines)))
+	for _, line := range c.Lines() {
+		status := ""
+		switch {
+		case line.Covered == 0:
+			status = "not executed"
+		case line.Covered < line.Instructions:
+			status = fmt.Sprintf("partially executed, %d of %d instructions", line.Covered, line.Instructions)
+		default:
+			continue
+		}
+		source := strings.TrimSpace(c.program.DebugInfo.SourceLine(line.Line))
+		if _, err := fmt.Fprintf(w, "  %s:%d: %s: %s\n", file, line.Line, status, source); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a record in the LCOV tracefile format, as read by genhtml and most
+// CI coverage services.
+func (c *Coverage) WriteLCOV(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "TN:\nSF:%s\n", c.program.DebugInfo.fileName())
+	functions := c.Functions()
+	hit := 0
+	for _, f := range functions {
+		fmt.Fprintf(&b, "FN:%d,%s\n", f.Line, f.Name)
+	}
+	for _, f := range functions {
+		fmt.Fprintf(&b, "FNDA:%d,%s\n", f.Hits, f.Name)
+		if f.Hits > 0 {
+			hit++
+		}
+	}
+	fmt.Fprintf(&b, "FNF:%d\nFNH:%d\n", len(functions), hit)
+	for _, line := range c.Lines() {
+		fmt.Fprintf(&b, "DA:%d,%d\n", line.Line, line.Hits)
+	}
+	lines, covered := c.Summary()
+	fmt.Fprintf(&b, "LF:%d\nLH:%d\nend_of_record\n", lines, covered)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.File}} coverage</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; font-family: monospace; }
+td { padding: 0 8px; white-space: pre; }
+td.number, td.hits { text-align: right; color: #888; }
+tr.covered td.source { background: #d4f7d4; }
+tr.partial td.source { background: #fdf2c4; }
+tr.uncovered td.source { background: #f9d0d0; }
+</style>
+</head>
+<body>
+<h1>{{.File}}</h1>
+<p>{{.Covered}} of {{.Lines}} lines covered ({{printf "%.1f" .Percent}}%).
+Green lines were executed, yellow ones partially and red ones never,
+the counts are executions of the line.</p>
+<table>
+{{range .Source}}<tr class="{{.Class}}"><td class="number">{{.Number}}</td><td class="hits">{{if .Class}}{{.Hits}}{{end}}</td><td class="source">{{.Text}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// Writes the source as HTML, with every line colored by its coverage.
+func (c *Coverage) WriteHTML(w io.Writer) error {
+	type sourceLine struct {
+		Number int
+		Text   string
+		Class  string
+		Hits   uint64
+	}
+	coverage := map[int]LineCoverage{}
+	for _, line := range c.Lines() {
+		coverage[line.Line] = line
+	}
+	source := []sourceLine{}
+	if c.program.DebugInfo != nil {
+		for i, text := range strings.Split(strings.TrimRight(c.program.DebugInfo.Source, "\n"), "\n") {
+			line := sourceLine{Number: i + 1, Text: text}
+			if cover, ok := coverage[i+1]; ok {
+				line.Hits = cover.Hits
+				switch {
+				case cover.Covered == 0:
+					line.Class = "uncovered"
+				case cover.Covered < cover.Instructions:
+					line.Class = "partial"
+				default:
+					line.Class = "covered"
+				}
+			}
+			source = append(source, line)
+		}
+	}
+	lines, covered := c.Summary()
+	return coverageTemplate.Execute(w, map[string]interface{}{
+		"File":    c.program.DebugInfo.fileName(),
+		"Lines":   lines,
+		"Covered": covered,
+		"Percent": percent(int64(covered), int64(lines)),
+		"Source":  source,
+	})
+}
@@ -0,0 +1,117 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"eud/bytecode"
+	"strings"
+	"testing"
+)
+
+// if (0) { 1 } else { 2 }, recording the coverage of two runs
+func branchCoverage(t *testing.T) *bytecode.Coverage {
+	program, err := bytecode.Assemble(`
+		    Push<i32> 0
+		    JumpIfZeroTo else
+		    Push<i32> 1
+		    Pop<i32>
+		    JumpTo end
+		    ; unreachable
+		    Push<i32> 3
+		    Pop<i32>
+		else:
+		    Push<i32> 2
+		    Pop<i32>
+		end:
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.DebugInfo = &bytecode.DebugInfo{
+		File:   "branch.eud",
+		Source: "if (0) {\n    1\n} else {\n    2\n}\n",
+		Lines: []bytecode.LineEntry{
+			{Start: 0, SourcePosition: bytecode.SourcePosition{Line: 1, Col: 1, Function: "main"}},
+			{Start: 2, SourcePosition: bytecode.SourcePosition{Line: 2, Col: 5, Function: "main"}},
+			{Start: 7, SourcePosition: bytecode.SourcePosition{Line: 4, Col: 5, Function: "main"}},
+		},
+	}
+	coverage := bytecode.NewCoverage(program)
+	for run := 0; run < 2; run++ {
+		runtime := bytecode.NewRuntime(program, bytecode.RunOptions{})
+		if _, err := runtime.RunUntil(func(r *bytecode.Runtime) bool {
+			coverage.Record(r)
+			return false
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return coverage
+}
+
+func TestCoverageLines(t *testing.T) {
+	lines := branchCoverage(t).Lines()
+	expected := []bytecode.LineCoverage{
+		{Line: 1, Instructions: 2, Covered: 2, Hits: 2},
+		// without the unreachable instructions
+		{Line: 2, Instructions: 3, Covered: 0, Hits: 0},
+		{Line: 4, Instructions: 2, Covered: 2, Hits: 2},
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, lines)
+	}
+	for i := range expected {
+		if lines[i] != expected[i] {
+			t.Errorf("expected %v, got %v", expected[i], lines[i])
+		}
+	}
+}
+
+func TestCoverageReports(t *testing.T) {
+	coverage := branchCoverage(t)
+
+	var text bytes.Buffer
+	if err := coverage.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	expected := "branch.eud: 2 of 3 lines covered (66.7%)\n  branch.eud:2: not executed: 1\n"
+	if text.String() != expected {
+		t.Errorf("expected text\n%s\ngot\n%s", expected, text.String())
+	}
+
+	var lcov bytes.Buffer
+	if err := coverage.WriteLCOV(&lcov); err != nil {
+		t.Fatal(err)
+	}
+	expected = "TN:\nSF:branch.eud\nFNF:0\nFNH:0\nDA:1,2\nDA:2,0\nDA:4,2\nLF:3\nLH:2\nend_of_record\n"
+	if lcov.String() != expected {
+		t.Errorf("expected LCOV\n%s\ngot\n%s", expected, lcov.String())
+	}
+
+	var html bytes.Buffer
+	if err := coverage.WriteHTML(&html); err != nil {
+		t.Fatal(err)
+	}
+	for _, row := range []string{
+		`<tr class="covered"><td class="number">1</td><td class="hits">2</td><td class="source">if (0) {</td></tr>`,
+		`<tr class="uncovered"><td class="number">2</td><td class="hits">0</td><td class="source">    1</td></tr>`,
+		`<tr class=""><td class="number">3</td><td class="hits"></td><td class="source">} else {</td></tr>`,
+	} {
+		if !strings.Contains(html.String(), row) {
+			t.Errorf("expected %s in\n%s", row, html.String())
+		}
+	}
+}
+
+func TestCoverageFunctions(t *testing.T) {
+	program := sumProgram(t)
+	coverage := bytecode.NewCoverage(program)
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{})
+	runtime.RunUntil(func(r *bytecode.Runtime) bool {
+		coverage.Record(r)
+		return false
+	})
+	functions := coverage.Functions()
+	if len(functions) != 1 || functions[0] != (bytecode.FunctionCoverage{Name: "sum", Line: 5, Hits: 1}) {
+		t.Errorf("expected sum to be called once, got %v", functions)
+	}
+}
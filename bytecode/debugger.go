@@ -0,0 +1,554 @@
+package bytecode
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A Debugger runs a program under control. It stops at breakpoints and after
+// stepping over statements, and inspects the state of the stopped Runtime.
+// Stepping by statements and looking up variables need the DebugInfo of the
+// program, without it a statement is a single instruction.
+//
+// The debugger keeps a history of the run, so it also steps and runs
+// backwards, up to the oldest point the history goes back to.
+type Debugger struct {
+	Program Program
+	Runtime *Runtime
+
+	breakpoints []Breakpoint
+	watchpoints []Watchpoint
+	// the watchpoints which stopped the program
+	triggered []WatchEvent
+	nextID    int
+	history   *history
+}
+
+type Breakpoint struct {
+	ID int
+	Pc uintptr
+	// what the breakpoint was set on, a function name or file:line
+	Location string
+}
+
+// A Watchpoint stops the program when a watched heap range or local
+// variable changes. A watched local is the variable of the function it was
+// in scope in when the watchpoint was set, the watchpoint is deleted when the
+// function returns.
+type Watchpoint struct {
+	ID int
+	// the watched heap addresses, inclusive, for heap watchpoints
+	From, To uintptr
+	// the name of a watched local
+	Local string
+	// what the watchpoint was set on, a local name or the heap range
+	Location string
+	// called for every change instead of stopping the program, if set
+	Callback func(WatchEvent)
+	// the watched local in Runtime.Locals and the call depth of its frame
+	index, depth int
+}
+
+// A change of watched values by an instruction.
+type WatchEvent struct {
+	Watchpoint Watchpoint
+	// the instruction which made the change
+	Pc          uintptr
+	Position    LineEntry
+	HasPosition bool
+	// the changed heap address, for heap watchpoints
+	Addr     uintptr
+	Old, New Slot
+	// the allocation with the watched addresses in it was freed, from Addr,
+	// Old and New are unset
+	Freed bool
+}
+
+type StopReason int
+
+const (
+	// a step, next or finish completed
+	StopStep StopReason = iota
+	StopBreakpoint
+	// the program ran past its last instruction
+	StopExited
+	// running backwards reached the oldest point of the history
+	StopStart
+	// a watched value changed, see Debugger.Triggered
+	StopWatchpoint
+)
+
+func (r StopReason) String() string {
+	switch r {
+	case StopStep:
+		return "step"
+	case StopBreakpoint:
+		return "breakpoint"
+	case StopExited:
+		return "exited"
+	case StopStart:
+		return "start"
+	case StopWatchpoint:
+		return "watchpoint"
+	default:
+		return fmt.Sprintf("StopReason(%d)", int(r))
+	}
+}
+
+// A local variable of the source and its current value.
+type Variable struct {
+	Name  string
+	Type  Type
+	Value RuntimeValue
+}
+
+// A function on the call stack, innermost first in a backtrace.
+type StackFrame struct {
+	Function string
+	// the current instruction, or the Call instruction of the frame above
+	Pc       uintptr
+	Position LineEntry
+	// false if the instruction has no entry in the line table
+	HasPosition bool
+}
+
+// Returns a debugger stopped before the first instruction of p.
+func NewDebugger(p Program, options RunOptions) *Debugger {
+	runtime := NewRuntime(p, options)
+	runtime.Debug = false
+	return &Debugger{Program: p, Runtime: runtime, nextID: 1,
+		history: newHistory(runtime, defaultHistoryInterval, defaultHistoryCheckpoints)}
+}
+
+func (d *Debugger) Exited() bool {
+	return d.Runtime.Done()
+}
+
+// Sets a breakpoint on the instruction at pc.
+func (d *Debugger) BreakAt(pc uintptr, location string) (Breakpoint, error) {
+	if pc >= uintptr(len(d.Program.Instructions)) {
+		return Breakpoint{}, fmt.Errorf("no instruction at %d", pc)
+	}
+	if location == "" {
+		location = fmt.Sprintf("pc %d", pc)
+	}
+	b := Breakpoint{ID: d.nextID, Pc: pc, Location: location}
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, b)
+	return b, nil
+}
+
+// Sets a breakpoint on the first instruction of a line. Lines without code
+// move the breakpoint to the next line with code.
+func (d *Debugger) BreakAtLine(line int) (Breakpoint, error) {
+	debug := d.Program.DebugInfo
+	if debug == nil || len(debug.Lines) == 0 {
+		return Breakpoint{}, fmt.Errorf("no line table, the program wasn't compiled from source code")
+	}
+	best := -1
+	for i, entry := range debug.Lines {
+		if entry.Line < line {
+			continue
+		}
+		if best == -1 || entry.Line < debug.Lines[best].Line {
+			best = i
+		}
+	}
+	if best == -1 {
+		return Breakpoint{}, fmt.Errorf("no code at or after line %d", line)
+	}
+	entry := debug.Lines[best]
+	return d.BreakAt(entry.Start, fmt.Sprintf("%s:%d", debug.File, entry.Line))
+}
+
+// Sets a breakpoint on the first instruction of a function.
+func (d *Debugger) BreakAtFunction(name string) (Breakpoint, error) {
+	for _, f := range d.Program.Functions {
+		if f.Name == name {
+			return d.BreakAt(f.Start, name)
+		}
+	}
+	return Breakpoint{}, fmt.Errorf("no function named %s", name)
+}
+
+// Watches the heap addresses from to to, inclusive, for stores and for the
+// allocation they are in being freed. callback is called with the changes
+// instead of stopping the program, if it isn't nil.
+func (d *Debugger) WatchHeap(from, to uintptr, callback func(WatchEvent)) (Watchpoint, error) {
+	if to < from {
+		return Watchpoint{}, fmt.Errorf("heap address range %d..%d is empty", from, to)
+	}
+	w := Watchpoint{ID: d.nextID, From: from, To: to, Location: fmt.Sprintf("heap %d..%d", from, to), Callback: callback, index: -1}
+	if from == to {
+		w.Location = fmt.Sprintf("heap %d", from)
+	}
+	d.nextID++
+	d.watchpoints = append(d.watchpoints, w)
+	return w, nil
+}
+
+// Watches a local variable of the innermost frame for stores. callback is
+// called with the changes instead of stopping the program, if it isn't nil.
+func (d *Debugger) WatchLocal(name string, callback func(WatchEvent)) (Watchpoint, error) {
+	index, ok := d.localIndex(name)
+	if !ok {
+		return Watchpoint{}, fmt.Errorf("no local %s in scope", name)
+	}
+	w := Watchpoint{ID: d.nextID, Local: name, Location: name, Callback: callback, index: index, depth: d.depth()}
+	d.nextID++
+	d.watchpoints = append(d.watchpoints, w)
+	return w, nil
+}
+
+// Deletes a breakpoint or watchpoint.
+func (d *Debugger) Delete(id int) error {
+	for i, b := range d.breakpoints {
+		if b.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+	for i, w := range d.watchpoints {
+		if w.ID == id {
+			d.watchpoints = append(d.watchpoints[:i], d.watchpoints[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("no breakpoint %d", id)
+}
+
+func (d *Debugger) Watchpoints() []Watchpoint {
+	return append([]Watchpoint{}, d.watchpoints...)
+}
+
+// Returns the changes which stopped the program with StopWatchpoint.
+func (d *Debugger) Triggered() []WatchEvent {
+	return append([]WatchEvent{}, d.triggered...)
+}
+
+// Reports the changes of watched values by the instruction of e, which was
+// executed last, and calls the callbacks of their watchpoints. The others
+// are kept in d.triggered, true if there are any. Going forward, watched
+// locals of functions which returned and of blocks which ended are deleted.
+func (d *Debugger) watch(e undoEntry, forward bool) bool {
+	d.triggered = d.triggered[:0]
+	if len(d.watchpoints) == 0 {
+		return false
+	}
+	ctx := d.Runtime
+	entry, ok := d.Program.DebugInfo.LineAt(e.pc)
+	event := WatchEvent{Pc: e.pc, Position: entry, HasPosition: ok}
+	events := []WatchEvent{}
+	watchpoints := d.watchpoints[:0]
+	for _, w := range d.watchpoints {
+		event.Watchpoint = w
+		switch {
+		case w.Local != "":
+			if forward && (len(ctx.Frames) < w.depth || w.index >= len(ctx.Locals)) {
+				continue
+			}
+			if e.local == w.index && e.frames == w.depth {
+				event.Old, event.New = e.oldLocal, ctx.Locals[w.index]
+				events = append(events, event)
+			}
+		case e.heap:
+			if e.addr >= w.From && e.addr <= w.To {
+				event.Addr, event.Old, event.New = e.addr, e.oldHeap, ctx.Heap[e.addr]
+				events = append(events, event)
+			}
+		case e.allocs != nil:
+			for _, alloc := range freed(e.allocs, ctx.Allocs) {
+				if alloc.From <= w.To && alloc.To >= w.From {
+					freedEvent := event
+					freedEvent.Addr, freedEvent.Freed = alloc.From, true
+					events = append(events, freedEvent)
+				}
+			}
+		}
+		watchpoints = append(watchpoints, w)
+	}
+	d.watchpoints = watchpoints
+	for _, event := range events {
+		if event.Watchpoint.Callback != nil {
+			event.Watchpoint.Callback(event)
+		} else {
+			d.triggered = append(d.triggered, event)
+		}
+	}
+	return len(d.triggered) > 0
+}
+
+// Returns the allocations of before which aren't in after.
+func freed(before, after []AllocationEntry) []AllocationEntry {
+	live := map[AllocationEntry]bool{}
+	for _, alloc := range after {
+		live[alloc] = true
+	}
+	allocs := []AllocationEntry{}
+	for _, alloc := range before {
+		if !live[alloc] {
+			allocs = append(allocs, alloc)
+		}
+	}
+	return allocs
+}
+
+func (d *Debugger) Breakpoints() []Breakpoint {
+	return append([]Breakpoint{}, d.breakpoints...)
+}
+
+func (d *Debugger) breakpointAt(pc uintptr) bool {
+	for _, b := range d.breakpoints {
+		if b.Pc == pc {
+			return true
+		}
+	}
+	return false
+}
+
+// Executes a single instruction. A failing instruction leaves the program
+// stopped before it.
+func (d *Debugger) StepInstruction() error {
+	return d.history.step()
+}
+
+// Undoes the previous instruction, StopStart if the history doesn't go back
+// further.
+func (d *Debugger) StepBackInstruction() (StopReason, error) {
+	ok, err := d.history.back()
+	if err != nil || !ok {
+		return StopStart, err
+	}
+	return StopStep, nil
+}
+
+// Runs until stop reports true after an instruction, a breakpoint is reached
+// or the program exits. The breakpoint at the current instruction, which is
+// usually where the previous run stopped, is passed.
+func (d *Debugger) runUntil(stop func() bool) (StopReason, error) {
+	for {
+		if d.Exited() {
+			return StopExited, nil
+		}
+		if err := d.StepInstruction(); err != nil {
+			return StopStep, err
+		}
+		switch {
+		case d.watch(d.history.log[len(d.history.log)-1], true):
+			return StopWatchpoint, nil
+		case d.Exited():
+			return StopExited, nil
+		case d.breakpointAt(d.Runtime.Pc):
+			return StopBreakpoint, nil
+		case stop():
+			return StopStep, nil
+		}
+	}
+}
+
+// Runs backwards until stop reports true after undoing an instruction, a
+// breakpoint is reached, a watched value is changed back or the start of
+// the history. stop gets the undo entry of the instruction.
+func (d *Debugger) reverseUntil(stop func(undoEntry) bool) (StopReason, error) {
+	for {
+		e, ok := d.history.last()
+		if !ok {
+			return StopStart, nil
+		}
+		watched := d.watch(e, false)
+		if _, err := d.history.back(); err != nil {
+			return StopStep, err
+		}
+		switch {
+		case watched:
+			return StopWatchpoint, nil
+		case d.breakpointAt(d.Runtime.Pc):
+			return StopBreakpoint, nil
+		case stop(e):
+			return StopStep, nil
+		}
+	}
+}
+
+func (d *Debugger) Continue() (StopReason, error) {
+	return d.runUntil(func() bool { return false })
+}
+
+func (d *Debugger) depth() int {
+	return d.Runtime.CallDepth()
+}
+
+// Reports if the current instruction is the first of a statement on another
+// line than line, or the same line in another call.
+func (d *Debugger) atNewStatement(line int, depth int) bool {
+	entry, ok := d.Program.DebugInfo.LineAt(d.Runtime.Pc)
+	return ok && entry.Start == d.Runtime.Pc && (entry.Line != line || d.depth() != depth)
+}
+
+// Runs to the next statement, entering called functions.
+func (d *Debugger) Step() (StopReason, error) {
+	entry, ok := d.Position()
+	if !ok {
+		return d.runUntil(func() bool { return true })
+	}
+	depth := d.depth()
+	return d.runUntil(func() bool { return d.atNewStatement(entry.Line, depth) })
+}
+
+// Runs to the next statement of the current function or a caller, running
+// called functions to completion.
+func (d *Debugger) Next() (StopReason, error) {
+	entry, ok := d.Position()
+	if !ok {
+		depth := d.depth()
+		return d.runUntil(func() bool { return d.depth() <= depth })
+	}
+	depth := d.depth()
+	return d.runUntil(func() bool { return d.depth() <= depth && d.atNewStatement(entry.Line, depth) })
+}
+
+// Runs until the current function returns. At the top level the program runs
+// to its end.
+func (d *Debugger) Finish() (StopReason, error) {
+	depth := d.depth()
+	return d.runUntil(func() bool { return d.depth() < depth })
+}
+
+// Runs backwards until a breakpoint or the start of the history.
+func (d *Debugger) ReverseContinue() (StopReason, error) {
+	return d.reverseUntil(func(undoEntry) bool { return false })
+}
+
+// Runs backwards to the start of the previous statement, entering the
+// functions it returned from.
+func (d *Debugger) StepBack() (StopReason, error) {
+	entry, ok := d.Position()
+	if !ok {
+		return d.reverseUntil(func(undoEntry) bool { return true })
+	}
+	depth := d.depth()
+	return d.reverseUntil(func(undoEntry) bool { return d.atNewStatement(entry.Line, depth) })
+}
+
+// Runs backwards to the start of the previous statement of the current
+// function or a caller, running backwards over called functions.
+func (d *Debugger) ReverseNext() (StopReason, error) {
+	entry, ok := d.Position()
+	depth := d.depth()
+	if !ok {
+		return d.reverseUntil(func(undoEntry) bool { return d.depth() <= depth })
+	}
+	return d.reverseUntil(func(undoEntry) bool { return d.depth() <= depth && d.atNewStatement(entry.Line, depth) })
+}
+
+// Runs backwards to the call of the current function.
+func (d *Debugger) ReverseFinish() (StopReason, error) {
+	depth := d.depth()
+	return d.reverseUntil(func(undoEntry) bool { return d.depth() < depth })
+}
+
+// Runs backwards to the instruction which last wrote the local variable name
+// of the innermost frame, stopping before it, so the variable has the value
+// it had before the write. Without a write since it was declared, the run
+// stops at its declaration.
+func (d *Debugger) ReverseToWrite(name string) (StopReason, error) {
+	index, ok := d.localIndex(name)
+	if !ok {
+		return StopStep, fmt.Errorf("no local %s in scope", name)
+	}
+	return d.reverseUntil(func(e undoEntry) bool { return e.local == index || e.locals <= index })
+}
+
+// Returns the index in Runtime.Locals of a local of the innermost frame.
+func (d *Debugger) localIndex(name string) (int, bool) {
+	base := 0
+	if frames := d.Runtime.Frames; len(frames) > 0 {
+		base = frames[len(frames)-1].LocalsBase
+	}
+	for _, v := range d.Program.DebugInfo.VariablesAt(d.Runtime.Pc, d.Function()) {
+		if v.Name == name && base+v.Index < len(d.Runtime.Locals) {
+			return base + v.Index, true
+		}
+	}
+	return 0, false
+}
+
+// Returns the line table entry of the current instruction.
+func (d *Debugger) Position() (LineEntry, bool) {
+	return d.Program.DebugInfo.LineAt(d.Runtime.Pc)
+}
+
+// Returns the name of the function the current instruction belongs to.
+func (d *Debugger) Function() string {
+	return d.Program.FunctionAt(d.Runtime.Pc)
+}
+
+// Returns the variables in scope in the innermost frame, sorted by name.
+// Shadowed variables are left out.
+func (d *Debugger) Locals() []Variable {
+	return d.FrameLocals(0)
+}
+
+// Returns the variables in scope in a frame of the backtrace, 0 is the
+// innermost one.
+func (d *Debugger) FrameLocals(frame int) []Variable {
+	frames := d.Runtime.Frames
+	if frame < 0 || frame > len(frames) {
+		return []Variable{}
+	}
+	pc, base := d.Runtime.Pc, 0
+	if frame > 0 {
+		pc = frames[len(frames)-frame].Call
+	}
+	if frame < len(frames) {
+		base = frames[len(frames)-frame-1].LocalsBase
+	}
+	// locals of the frame are followed by the ones of the frames it called
+	end := len(d.Runtime.Locals)
+	if frame > 0 {
+		end = frames[len(frames)-frame].LocalsBase
+	}
+	seen := map[string]bool{}
+	variables := []Variable{}
+	for _, v := range d.Program.DebugInfo.VariablesAt(pc, d.Program.FunctionAt(pc)) {
+		i := base + v.Index
+		if seen[v.Name] || i >= end {
+			continue
+		}
+		seen[v.Name] = true
+		variables = append(variables, Variable{Name: v.Name, Type: v.Type, Value: d.Runtime.Locals[i].Value()})
+	}
+	sort.Slice(variables, func(i, j int) bool { return variables[i].Name < variables[j].Name })
+	return variables
+}
+
+func (d *Debugger) Local(name string) (Variable, bool) {
+	for _, v := range d.Locals() {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Variable{}, false
+}
+
+// Returns the call stack, the current function first.
+func (d *Debugger) Backtrace() []StackFrame {
+	pcs := []uintptr{d.Runtime.Pc}
+	for i := len(d.Runtime.Frames) - 1; i >= 0; i-- {
+		pcs = append(pcs, d.Runtime.Frames[i].Call)
+	}
+	frames := make([]StackFrame, len(pcs))
+	for i, pc := range pcs {
+		entry, ok := d.Program.DebugInfo.LineAt(pc)
+		frames[i] = StackFrame{Function: d.Program.FunctionAt(pc), Pc: pc, Position: entry, HasPosition: ok}
+	}
+	return frames
+}
+
+// Returns count values of the heap starting at addr.
+func (d *Debugger) Heap(addr uintptr, count int) ([]Slot, error) {
+	if count < 0 || addr+uintptr(count) > uintptr(len(d.Runtime.Heap)) {
+		return nil, fmt.Errorf("heap address range %d..%d out of range, the heap has %d values", addr, addr+uintptr(count), len(d.Runtime.Heap))
+	}
+	return append([]Slot{}, d.Runtime.Heap[addr:addr+uintptr(count)]...), nil
+}
@@ -0,0 +1,422 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"errors"
+	"eud/bytecode"
+	"eud/internal/parsetest"
+	"strings"
+	"testing"
+)
+
+// testdata/debug.eud, compiled without optimizations
+func debugProgram(t *testing.T) bytecode.Program {
+	return compileSource(t, "testdata/debug.eud")
+}
+
+func compileSource(t *testing.T, file string) bytecode.Program {
+	t.Helper()
+	program, err := bytecode.Compile(parsetest.Parse(t, file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return program
+}
+
+func expectStop(t *testing.T, d *bytecode.Debugger, reason bytecode.StopReason, err error, expected bytecode.StopReason, line int, function string) {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason != expected {
+		t.Fatalf("expected to stop for %s, stopped for %s at %d", expected, reason, d.Runtime.Pc)
+	}
+	if reason == bytecode.StopExited {
+		return
+	}
+	entry, ok := d.Position()
+	if !ok || entry.Line != line || d.Function() != function {
+		t.Fatalf("expected to stop at line %d in %s, stopped at %v in %s", line, function, entry, d.Function())
+	}
+}
+
+func expectLocals(t *testing.T, d *bytecode.Debugger, expected map[string]int32) {
+	t.Helper()
+	locals := d.Locals()
+	if len(locals) != len(expected) {
+		t.Fatalf("expected locals %v, got %v", expected, locals)
+	}
+	for _, v := range locals {
+		value, ok := v.Value.(bytecode.I32Value)
+		if !ok || value.Value != expected[v.Name] {
+			t.Errorf("expected %s = %d, got %s", v.Name, expected[v.Name], v.Value)
+		}
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	d := bytecode.NewDebugger(debugProgram(t), bytecode.RunOptions{})
+
+	reason, err := d.Step()
+	expectStop(t, d, reason, err, bytecode.StopStep, 6, "main")
+	reason, err = d.Next()
+	expectStop(t, d, reason, err, bytecode.StopStep, 7, "main")
+	reason, err = d.Next()
+	expectStop(t, d, reason, err, bytecode.StopStep, 8, "main")
+	expectLocals(t, d, map[string]int32{"x": 4, "y": 0})
+
+	reason, err = d.Step()
+	expectStop(t, d, reason, err, bytecode.StopStep, 1, "add")
+	reason, err = d.Step()
+	expectStop(t, d, reason, err, bytecode.StopStep, 2, "add")
+	expectLocals(t, d, map[string]int32{"a": 4, "b": 3})
+	reason, err = d.Next()
+	expectStop(t, d, reason, err, bytecode.StopStep, 3, "add")
+	if c, ok := d.Local("c"); !ok || c.Value != (bytecode.I32Value{Value: 7}) {
+		t.Errorf("expected c = 7, got %v", c)
+	}
+
+	trace := d.Backtrace()
+	if len(trace) != 2 || trace[0].Function != "add" || trace[0].Position.Line != 3 ||
+		trace[1].Function != "main" || trace[1].Position.Line != 8 {
+		t.Errorf("unexpected backtrace %+v", trace)
+	}
+	if caller := d.FrameLocals(1); len(caller) != 2 || caller[0].Name != "x" || caller[1].Name != "y" {
+		t.Errorf("expected x and y in the frame of main, got %v", caller)
+	}
+
+	reason, err = d.Finish()
+	expectStop(t, d, reason, err, bytecode.StopStep, 8, "main")
+	reason, err = d.Next()
+	expectStop(t, d, reason, err, bytecode.StopStep, 9, "main")
+	expectLocals(t, d, map[string]int32{"x": 4, "y": 7})
+	reason, err = d.Next()
+	expectStop(t, d, reason, err, bytecode.StopExited, 0, "")
+	if !d.Exited() {
+		t.Errorf("expected the program to have exited")
+	}
+}
+
+func TestDebuggerBreakpoints(t *testing.T) {
+	d := bytecode.NewDebugger(debugProgram(t), bytecode.RunOptions{})
+
+	if _, err := d.BreakAtFunction("add"); err != nil {
+		t.Fatal(err)
+	}
+	// line 5 is empty, the breakpoint moves to line 6
+	moved, err := d.BreakAtLine(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	last, err := d.BreakAtLine(9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.BreakAtFunction("missing"); err == nil {
+		t.Errorf("expected an error for a breakpoint on a missing function")
+	}
+	if _, err := d.BreakAtLine(10); err == nil {
+		t.Errorf("expected an error for a breakpoint after the last line")
+	}
+
+	reason, err := d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 6, "main")
+	reason, err = d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 1, "add")
+
+	if err := d.Delete(last.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Delete(last.ID); err == nil {
+		t.Errorf("expected an error for deleting a breakpoint twice")
+	}
+	if breakpoints := d.Breakpoints(); len(breakpoints) != 2 || breakpoints[1] != moved {
+		t.Errorf("unexpected breakpoints %v", breakpoints)
+	}
+	reason, err = d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopExited, 0, "")
+}
+
+func TestDebuggerHeap(t *testing.T) {
+	program, err := bytecode.Assemble(`
+		Push<usize> 1
+		Allocate<i32>
+		Pop<uptr>
+		Push<i32> 42
+		Push<uptr> 0
+		Store<i32>
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := bytecode.NewDebugger(program, bytecode.RunOptions{})
+	if reason, err := d.Continue(); err != nil || reason != bytecode.StopExited {
+		t.Fatalf("expected the program to exit, got %s, %v", reason, err)
+	}
+	values, err := d.Heap(0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values[0].Value() != (bytecode.I32Value{Value: 42}) {
+		t.Errorf("expected 42 at address 0, got %s", values[0])
+	}
+	if _, err := d.Heap(uintptr(len(d.Runtime.Heap)), 1); err == nil {
+		t.Errorf("expected an error for an address past the heap")
+	}
+}
+
+func TestDebuggerRuntimeError(t *testing.T) {
+	program, err := bytecode.Assemble(`
+		Push<i32> 7
+		Push<i32> 0
+		Divide<i32>
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := bytecode.NewDebugger(program, bytecode.RunOptions{})
+	for i := 0; i < 2; i++ {
+		if err := d.StepInstruction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the division fails and leaves the program stopped before it
+	for i := 0; i < 2; i++ {
+		var divisionErr bytecode.DivisionByZeroError
+		if err := d.StepInstruction(); !errors.As(err, &divisionErr) {
+			t.Fatalf("expected a division by zero, got %v", err)
+		}
+		if d.Runtime.Pc != 2 || d.Runtime.Sp != 2 {
+			t.Fatalf("expected to stay at pc 2 with 2 values, got pc %d with %d", d.Runtime.Pc, d.Runtime.Sp)
+		}
+	}
+	if reason, err := d.StepBackInstruction(); err != nil || reason != bytecode.StopStep || d.Runtime.Pc != 1 {
+		t.Fatalf("expected to step back to pc 1, got %s, %v at %d", reason, err, d.Runtime.Pc)
+	}
+}
+
+func TestDebuggerReverse(t *testing.T) {
+	d := bytecode.NewDebugger(debugProgram(t), bytecode.RunOptions{})
+	bytecode.SetHistory(d, 4, 64)
+
+	for _, line := range []int{6, 7, 8, 9} {
+		reason, err := d.Next()
+		expectStop(t, d, reason, err, bytecode.StopStep, line, "main")
+	}
+	expectLocals(t, d, map[string]int32{"x": 4, "y": 7})
+
+	reason, err := d.StepBack()
+	expectStop(t, d, reason, err, bytecode.StopStep, 3, "add")
+	expectLocals(t, d, map[string]int32{"a": 4, "b": 3, "c": 7})
+	reason, err = d.ReverseFinish()
+	expectStop(t, d, reason, err, bytecode.StopStep, 8, "main")
+	expectLocals(t, d, map[string]int32{"x": 4, "y": 0})
+	reason, err = d.ReverseNext()
+	expectStop(t, d, reason, err, bytecode.StopStep, 7, "main")
+	reason, err = d.StepBackInstruction()
+	if err != nil || reason != bytecode.StopStep || d.Function() != "main" {
+		t.Fatalf("expected to step back an instruction in main, got %s, %v in %s", reason, err, d.Function())
+	}
+
+	if _, err := d.BreakAtFunction("add"); err != nil {
+		t.Fatal(err)
+	}
+	reason, err = d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 1, "add")
+	reason, err = d.Next()
+	expectStop(t, d, reason, err, bytecode.StopStep, 2, "add")
+	reason, err = d.ReverseContinue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 1, "add")
+	reason, err = d.ReverseContinue()
+	if err != nil || reason != bytecode.StopStart || d.Runtime.Executed != 0 {
+		t.Fatalf("expected to run back to the start, got %s, %v after %d instructions", reason, err, d.Runtime.Executed)
+	}
+	if reason, err := d.StepBackInstruction(); err != nil || reason != bytecode.StopStart {
+		t.Errorf("expected no instruction before the start, got %s, %v", reason, err)
+	}
+}
+
+func TestDebuggerReverseToWrite(t *testing.T) {
+	d := bytecode.NewDebugger(compileSource(t, "testdata/loop.eud"), bytecode.RunOptions{})
+	bytecode.SetHistory(d, 8, 64)
+	if _, err := d.BreakAtLine(7); err != nil {
+		t.Fatal(err)
+	}
+	reason, err := d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 7, "main")
+	expectLocals(t, d, map[string]int32{"i": 5, "total": 10})
+
+	// the last iteration added 4 to total, the one before incremented i to 4
+	reason, err = d.ReverseToWrite("total")
+	expectStop(t, d, reason, err, bytecode.StopStep, 4, "main")
+	expectLocals(t, d, map[string]int32{"i": 4, "total": 6})
+	reason, err = d.ReverseToWrite("i")
+	expectStop(t, d, reason, err, bytecode.StopStep, 5, "main")
+	expectLocals(t, d, map[string]int32{"i": 3, "total": 6})
+	if _, err := d.ReverseToWrite("missing"); err == nil {
+		t.Errorf("expected an error for a variable which isn't in scope")
+	}
+
+	reason, err = d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 7, "main")
+	expectLocals(t, d, map[string]int32{"i": 5, "total": 10})
+}
+
+func TestDebuggerReverseSyscalls(t *testing.T) {
+	program, err := bytecode.Assemble(readingProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	d := bytecode.NewDebugger(program, bytecode.RunOptions{Stdin: strings.NewReader("xy"), Stdout: &out})
+	bytecode.SetHistory(d, 4, 1)
+	reason, err := d.Continue()
+	if err != nil || reason != bytecode.StopExited {
+		t.Fatalf("expected the program to exit, got %s, %v", reason, err)
+	}
+	// only the latest checkpoint is kept
+	reason, err = d.ReverseContinue()
+	if err != nil || reason != bytecode.StopStart || d.Runtime.Executed != 8 {
+		t.Fatalf("expected to run back to the checkpoint after 8 instructions, got %s, %v after %d", reason, err, d.Runtime.Executed)
+	}
+	d = bytecode.NewDebugger(program, bytecode.RunOptions{Stdin: strings.NewReader("xy"), Stdout: &out})
+	out.Reset()
+	for i := 0; i < 2; i++ {
+		if reason, err := d.Continue(); err != nil || reason != bytecode.StopExited {
+			t.Fatalf("expected the program to exit, got %s, %v", reason, err)
+		}
+		if reason, err := d.ReverseContinue(); err != nil || reason != bytecode.StopStart {
+			t.Fatalf("expected to run back to the start, got %s, %v", reason, err)
+		}
+	}
+	// running again replays the input and doesn't print twice
+	if out.String() != "x" {
+		t.Errorf("expected the output x, got %q", out.String())
+	}
+}
+
+func TestDebuggerWatchLocals(t *testing.T) {
+	d := bytecode.NewDebugger(compileSource(t, "testdata/loop.eud"), bytecode.RunOptions{})
+	if _, err := d.WatchLocal("i", nil); err == nil {
+		t.Errorf("expected an error for watching a variable which isn't declared yet")
+	}
+	for _, line := range []int{2, 3} {
+		reason, err := d.Next()
+		expectStop(t, d, reason, err, bytecode.StopStep, line, "main")
+	}
+	increments := []bytecode.WatchEvent{}
+	if _, err := d.WatchLocal("i", func(e bytecode.WatchEvent) { increments = append(increments, e) }); err != nil {
+		t.Fatal(err)
+	}
+	total, err := d.WatchLocal("total", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []struct{ old, new int32 }{{0, 0}, {0, 1}} {
+		reason, err := d.Continue()
+		expectStop(t, d, reason, err, bytecode.StopWatchpoint, 4, "main")
+		events := d.Triggered()
+		if len(events) != 1 || events[0].Watchpoint.ID != total.ID || !events[0].HasPosition || events[0].Position.Line != 4 ||
+			events[0].Old != bytecode.IntSlot(bytecode.I32, int64(expected.old)) || events[0].New != bytecode.IntSlot(bytecode.I32, int64(expected.new)) {
+			t.Fatalf("expected total to change from %d to %d on line 4, got %+v", expected.old, expected.new, events)
+		}
+	}
+	if len(increments) != 1 || increments[0].Old != bytecode.IntSlot(bytecode.I32, 0) || increments[0].New != bytecode.IntSlot(bytecode.I32, 1) {
+		t.Errorf("expected the callback to be called for i changing from 0 to 1, got %+v", increments)
+	}
+
+	if err := d.Delete(total.ID); err != nil {
+		t.Fatal(err)
+	}
+	reason, err := d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopExited, 0, "")
+	if len(increments) != 5 || increments[4].New != bytecode.IntSlot(bytecode.I32, 5) {
+		t.Errorf("expected the callback to be called for 5 increments of i, got %+v", increments)
+	}
+
+	// going backwards stops at the last change of total, before it
+	if _, err := d.WatchLocal("total", nil); err == nil {
+		t.Errorf("expected an error for watching a variable after the program exited")
+	}
+	d = bytecode.NewDebugger(compileSource(t, "testdata/loop.eud"), bytecode.RunOptions{})
+	if _, err := d.BreakAtLine(7); err != nil {
+		t.Fatal(err)
+	}
+	reason, err = d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 7, "main")
+	if _, err := d.WatchLocal("total", nil); err != nil {
+		t.Fatal(err)
+	}
+	reason, err = d.ReverseContinue()
+	expectStop(t, d, reason, err, bytecode.StopWatchpoint, 4, "main")
+	expectLocals(t, d, map[string]int32{"i": 4, "total": 6})
+	if events := d.Triggered(); len(events) != 1 || events[0].New != bytecode.IntSlot(bytecode.I32, 10) {
+		t.Errorf("expected total to have changed to 10, got %+v", events)
+	}
+}
+
+func TestDebuggerWatchBlockLocal(t *testing.T) {
+	d := bytecode.NewDebugger(compileSource(t, "testdata/scopes.eud"), bytecode.RunOptions{})
+	if _, err := d.BreakAtLine(4); err != nil {
+		t.Fatal(err)
+	}
+	reason, err := d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopBreakpoint, 4, "main")
+	if _, err := d.WatchLocal("b", nil); err != nil {
+		t.Fatal(err)
+	}
+	// c takes the place of b once the if ends, its changes aren't b's
+	reason, err = d.Continue()
+	expectStop(t, d, reason, err, bytecode.StopExited, 0, "")
+	if watchpoints := d.Watchpoints(); len(watchpoints) != 0 {
+		t.Errorf("expected the watchpoint to be deleted with b, got %+v", watchpoints)
+	}
+}
+
+func TestDebuggerWatchHeap(t *testing.T) {
+	program, err := bytecode.Assemble(`
+		Push<usize> 1
+		Allocate<i32>
+		Pop<uptr>
+		Push<i32> 42
+		Push<uptr> 2
+		Store<i32>
+		Push<i32> 7
+		Push<uptr> 0
+		Store<i32>
+		Push<uptr> 0
+		Deallocate<i32>
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := bytecode.NewDebugger(program, bytecode.RunOptions{})
+	if _, err := d.WatchHeap(1, 0, nil); err == nil {
+		t.Errorf("expected an error for an empty range")
+	}
+	w, err := d.WatchHeap(0, 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reason, err := d.Continue(); err != nil || reason != bytecode.StopWatchpoint {
+		t.Fatalf("expected to stop at the watchpoint, got %s, %v", reason, err)
+	}
+	events := d.Triggered()
+	if len(events) != 1 || events[0].Watchpoint.ID != w.ID || events[0].Pc != 8 || events[0].Addr != 0 ||
+		events[0].Old != (bytecode.Slot{}) || events[0].New.Value() != (bytecode.I32Value{Value: 7}) {
+		t.Fatalf("expected the store of 7 at address 0, got %+v", events)
+	}
+	if reason, err := d.Continue(); err != nil || reason != bytecode.StopWatchpoint {
+		t.Fatalf("expected to stop at the watchpoint, got %s, %v", reason, err)
+	}
+	if events := d.Triggered(); len(events) != 1 || !events[0].Freed || events[0].Addr != 0 || events[0].Pc != 10 {
+		t.Fatalf("expected the allocation at 0 to be freed, got %+v", events)
+	}
+	if reason, err := d.Continue(); err != nil || reason != bytecode.StopExited {
+		t.Fatalf("expected the program to exit, got %s, %v", reason, err)
+	}
+	if watchpoints := d.Watchpoints(); len(watchpoints) != 1 || watchpoints[0].Location != "heap 0..1" {
+		t.Errorf("unexpected watchpoints %+v", watchpoints)
+	}
+}
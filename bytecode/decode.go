@@ -0,0 +1,122 @@
+package bytecode
+
+import "fmt"
+
+// The runtime doesn't execute Program.Instructions directly. Before running,
+// every instruction is decoded into this flat struct, so the dispatch loop
+// only switches on an integer opcode instead of calling through the
+// Instruction interface and type asserting on every step.
+type decodedInstruction struct {
+	code InstructionType
+	// operand type, and destination type for Convert
+	typ Type
+	// source type for Convert
+	src Type
+	// local offset, immediate value or jump target
+	operand int
+	// increment of IncrementLocal
+	value int
+	// comparison of JumpIfNot
+	cmp InstructionType
+}
+
+func decode(instructions []Instruction) []decodedInstruction {
+	code := make([]decodedInstruction, len(instructions))
+	for i := range instructions {
+		code[i] = decodeInstruction(instructions[i])
+	}
+	return code
+}
+
+func decodeInstruction(i Instruction) decodedInstruction {
+	d := decodedInstruction{code: i.InstructionType()}
+	switch i := i.(type) {
+	case Allocate:
+		d.typ = i.Type
+	case Deallocate:
+		d.typ = i.Type
+	case Store:
+		d.typ = i.Type
+	case Load:
+		d.typ = i.Type
+	case DeclareLocal:
+		d.typ = i.Type
+	case UndeclareLocal:
+		d.typ = i.Type
+	case StoreLocal:
+		d.typ = i.Type
+		d.operand = int(i.Offset)
+	case LoadLocal:
+		d.typ = i.Type
+		d.operand = int(i.Offset)
+	case Push:
+		d.typ = i.Type
+		d.operand = i.Value
+	case Pop:
+		d.typ = i.Type
+	case Jump, JumpIfZero, JumpNotZero, Syscall:
+	case Call:
+		d.typ = i.Type
+	case Return:
+		d.typ = i.Type
+	case Not:
+		d.typ = i.Type
+	case Add:
+		d.typ = i.Type
+	case Subtract:
+		d.typ = i.Type
+	case Multiply:
+		d.typ = i.Type
+	case Divide:
+		d.typ = i.Type
+	case Modulus:
+		d.typ = i.Type
+	case Exponent:
+		d.typ = i.Type
+	case CmpEqual:
+		d.typ = i.Type
+	case CmpInequal:
+		d.typ = i.Type
+	case CmpLT:
+		d.typ = i.Type
+	case CmpGT:
+		d.typ = i.Type
+	case CmpLTE:
+		d.typ = i.Type
+	case CmpGTE:
+		d.typ = i.Type
+	case Or:
+		d.typ = i.Type
+	case And:
+		d.typ = i.Type
+	case Xor:
+		d.typ = i.Type
+	case Nor:
+		d.typ = i.Type
+	case Nand:
+		d.typ = i.Type
+	case Xnor:
+		d.typ = i.Type
+	case Convert:
+		d.typ = i.Dst
+		d.src = i.Src
+	case JumpTo:
+		d.operand = int(i.Target)
+	case JumpIfZeroTo:
+		d.operand = int(i.Target)
+	case JumpIfNot:
+		d.typ = i.Type
+		d.cmp = i.Cmp
+		d.operand = int(i.Target)
+	case StoreLocalKeep:
+		d.typ = i.Type
+		d.operand = int(i.Offset)
+	case IncrementLocal:
+		d.typ = i.Type
+		d.operand = int(i.Offset)
+		d.value = i.Value
+	default:
+		panic(fmt.Sprintf("instruction '%s' not implemented", i.InstructionType()))
+	}
+	return d
+}
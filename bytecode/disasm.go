@@ -0,0 +1,154 @@
+package bytecode
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Disassemble prints p in the .eudasm syntax, such that assembling the text
+// gives back exactly p. Jump targets and the addresses pushed for Jump,
+// JumpIfZero, JumpNotZero and Call are printed as labels named after the
+// address. Programs which can't be represented, such as ones with function
+// symbols that aren't nested in each other or not ordered by their end,
+// return an error.
+func Disassemble(p Program) (string, error) {
+	n := len(p.Instructions)
+	labels := make([]bool, n+1)
+	isAddress := func(target int) bool {
+		return target >= 0 && target <= n
+	}
+	for i, instruction := range p.Instructions {
+		switch instruction := instruction.(type) {
+		case JumpTo:
+			if isAddress(int(instruction.Target)) {
+				labels[instruction.Target] = true
+			}
+		case JumpIfZeroTo:
+			if isAddress(int(instruction.Target)) {
+				labels[instruction.Target] = true
+			}
+		case JumpIfNot:
+			if isAddress(int(instruction.Target)) {
+				labels[instruction.Target] = true
+			}
+		case Push:
+			if pushesCodeAddress(p, i) && isAddress(instruction.Value) {
+				labels[instruction.Value] = true
+			}
+		}
+	}
+
+	out := strings.Builder{}
+	for _, alloc := range p.Preallocations {
+		out.WriteString(fmt.Sprintf(".prealloc %d", alloc.Handle))
+		if alloc.Pack {
+			out.WriteString(" pack")
+		}
+		for _, c := range alloc.Components {
+			out.WriteString(fmt.Sprintf(" %s*%d", c.Type, c.Amount))
+		}
+		out.WriteString("\n")
+	}
+	for pos := 0; pos <= n; pos++ {
+		// inner functions end first and start last
+		ends := functionsWhere(p.Functions, func(f FunctionSymbol) bool { return int(f.End) == pos })
+		sort.SliceStable(ends, func(a, b int) bool { return ends[a].Start > ends[b].Start })
+		for range ends {
+			out.WriteString(".endfunc\n")
+		}
+		starts := functionsWhere(p.Functions, func(f FunctionSymbol) bool { return int(f.Start) == pos })
+		sort.SliceStable(starts, func(a, b int) bool { return starts[a].End > starts[b].End })
+		for _, f := range starts {
+			out.WriteString(fmt.Sprintf(".func %s\n", f.Name))
+		}
+		if labels[pos] {
+			out.WriteString(fmt.Sprintf("L%d:\n", pos))
+		}
+		if pos < n {
+			out.WriteString("    " + disassembleInstruction(p, pos, labels) + "\n")
+		}
+	}
+	text := out.String()
+
+	reassembled, err := Assemble(text)
+	if err != nil {
+		return "", fmt.Errorf("program can't be represented as text: %w", err)
+	}
+	if !programsEqual(p, reassembled) {
+		return "", fmt.Errorf("program can't be represented as text, function symbols have to be nested and ordered by their end")
+	}
+	return text, nil
+}
+
+// reports if the Push at i is the address operand of a jump or call
+func pushesCodeAddress(p Program, i int) bool {
+	if push, ok := p.Instructions[i].(Push); !ok || push.Type != UPTR || i+1 >= len(p.Instructions) {
+		return false
+	}
+	switch p.Instructions[i+1].InstructionType() {
+	case JumpInstruction, JumpIfZeroInstruction, JumpNotZeroInstruction, CallInstruction:
+		return true
+	}
+	return false
+}
+
+func functionsWhere(functions []FunctionSymbol, predicate func(FunctionSymbol) bool) []FunctionSymbol {
+	matching := []FunctionSymbol{}
+	for _, f := range functions {
+		if predicate(f) {
+			matching = append(matching, f)
+		}
+	}
+	return matching
+}
+
+func disassembleInstruction(p Program, i int, labels []bool) string {
+	label := func(target int) string {
+		if target >= 0 && target < len(labels) && labels[target] {
+			return fmt.Sprintf("L%d", target)
+		}
+		return fmt.Sprint(target)
+	}
+	switch instruction := p.Instructions[i].(type) {
+	case JumpTo:
+		return "JumpTo " + label(int(instruction.Target))
+	case JumpIfZeroTo:
+		return "JumpIfZeroTo " + label(int(instruction.Target))
+	case JumpIfNot:
+		return fmt.Sprintf("JumpIfNot<%s, %s> %s", cmpName(instruction.Cmp), instruction.Type, label(int(instruction.Target)))
+	case Push:
+		if pushesCodeAddress(p, i) {
+			return "Push<uptr> " + label(instruction.Value)
+		}
+	}
+	return strings.TrimSpace(p.Instructions[i].String())
+}
+
+func programsEqual(a Program, b Program) bool {
+	if len(a.Instructions) != len(b.Instructions) || len(a.Functions) != len(b.Functions) || len(a.Preallocations) != len(b.Preallocations) {
+		return false
+	}
+	for i := range a.Instructions {
+		if a.Instructions[i] != b.Instructions[i] {
+			return false
+		}
+	}
+	for i := range a.Functions {
+		if a.Functions[i] != b.Functions[i] {
+			return false
+		}
+	}
+	for i := range a.Preallocations {
+		x, y := a.Preallocations[i], b.Preallocations[i]
+		if x.Handle != y.Handle || x.Pack != y.Pack || len(x.Components) != len(y.Components) {
+			return false
+		}
+		for j := range x.Components {
+			if x.Components[j] != y.Components[j] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,430 @@
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Binary encoding of programs, written to .eudc files.
+//
+// A file starts with the magic bytes "EUDC" and the format version as a
+// little endian uint16, followed by the sections. Each
+// section is a tag byte, the length of its payload as a uvarint, and the
+// payload. The last section is followed by a zero byte, which marks the
+// end of the file so that files truncated between sections are rejected
+// too. Integers in payloads are varints, unsigned ones uvarints, types
+// and opcodes single bytes.
+//
+//	instructions    count, then per instruction its opcode and operands
+//	preallocations  count, then handle, pack, component count, type and amount
+//	symbols         count, then name, start and end of every function
+//	debug           file name and source text, optional
+//	lines           count, then start, line, column and function of every
+//	                entry of the line table, optional
+//	variables       count, then name, type, index, start, end and function
+//	                of every local variable, optional
+//
+// Strings are a uvarint length followed by the bytes. The instructions
+// section is required, the others may be left out when empty. Version 1
+// files have no lines and variables sections, they are rejected like files
+// of any other version, as are newer files by older readers.
+
+const FormatVersion = 2
+
+var formatMagic = []byte("EUDC")
+
+const (
+	endOfFile byte = iota
+	instructionsSection
+	preallocationsSection
+	symbolsSection
+	debugSection
+	linesSection
+	variablesSection
+)
+
+var ErrTruncated = errors.New("truncated bytecode file")
+var ErrNotBytecode = errors.New("not a bytecode file")
+
+type VersionError struct {
+	Version uint16
+}
+
+func (e VersionError) Error() string {
+	return fmt.Sprintf("bytecode file has format version %d, expected %d", e.Version, FormatVersion)
+}
+
+func Marshal(p Program) ([]byte, error) {
+	out := bytes.Buffer{}
+	out.Write(formatMagic)
+	binary.Write(&out, binary.LittleEndian, uint16(FormatVersion))
+
+	section := encoder{}
+	section.uint(uint64(len(p.Instructions)))
+	for _, i := range p.Instructions {
+		if err := section.instruction(i); err != nil {
+			return nil, err
+		}
+	}
+	section.writeTo(&out, instructionsSection)
+
+	if len(p.Preallocations) > 0 {
+		section.uint(uint64(len(p.Preallocations)))
+		for _, alloc := range p.Preallocations {
+			section.int(int64(alloc.Handle))
+			section.bool(alloc.Pack)
+			section.uint(uint64(len(alloc.Components)))
+			for _, c := range alloc.Components {
+				section.typ(c.Type)
+				section.uint(uint64(c.Amount))
+			}
+		}
+		section.writeTo(&out, preallocationsSection)
+	}
+
+	if len(p.Functions) > 0 {
+		section.uint(uint64(len(p.Functions)))
+		for _, f := range p.Functions {
+			section.string(f.Name)
+			section.uint(uint64(f.Start))
+			section.uint(uint64(f.End))
+		}
+		section.writeTo(&out, symbolsSection)
+	}
+
+	if p.DebugInfo != nil {
+		section.string(p.DebugInfo.File)
+		section.string(p.DebugInfo.Source)
+		section.writeTo(&out, debugSection)
+
+		if len(p.DebugInfo.Lines) > 0 {
+			section.uint(uint64(len(p.DebugInfo.Lines)))
+			for _, entry := range p.DebugInfo.Lines {
+				section.uint(uint64(entry.Start))
+				section.uint(uint64(entry.Line))
+				section.uint(uint64(entry.Col))
+				section.string(entry.Function)
+			}
+			section.writeTo(&out, linesSection)
+		}
+
+		if len(p.DebugInfo.Variables) > 0 {
+			section.uint(uint64(len(p.DebugInfo.Variables)))
+			for _, v := range p.DebugInfo.Variables {
+				section.string(v.Name)
+				section.typ(v.Type)
+				section.uint(uint64(v.Index))
+				section.uint(uint64(v.Start))
+				section.uint(uint64(v.End))
+				section.string(v.Function)
+			}
+			section.writeTo(&out, variablesSection)
+		}
+	}
+	out.WriteByte(endOfFile)
+	return out.Bytes(), nil
+}
+
+func Unmarshal(data []byte) (Program, error) {
+	if len(data) < len(formatMagic)+2 {
+		if bytes.HasPrefix(formatMagic, data) {
+			return Program{}, ErrTruncated
+		}
+		return Program{}, ErrNotBytecode
+	}
+	if !bytes.Equal(data[:len(formatMagic)], formatMagic) {
+		return Program{}, ErrNotBytecode
+	}
+	if version := binary.LittleEndian.Uint16(data[len(formatMagic):]); version != FormatVersion {
+		return Program{}, VersionError{Version: version}
+	}
+
+	p := Program{}
+	in := decoder{data: data[len(formatMagic)+2:]}
+	seen := map[byte]bool{}
+	for {
+		tag := in.byte()
+		if tag == endOfFile && in.err == nil {
+			break
+		}
+		length := in.uint()
+		if in.err != nil {
+			return Program{}, in.err
+		}
+		if length > uint64(len(in.data)) {
+			return Program{}, ErrTruncated
+		}
+		if seen[tag] {
+			return Program{}, fmt.Errorf("duplicate section %d", tag)
+		}
+		seen[tag] = true
+		section := decoder{data: in.data[:length]}
+		in.data = in.data[length:]
+		if err := section.section(tag, &p); err != nil {
+			return Program{}, err
+		}
+		if len(section.data) > 0 {
+			return Program{}, fmt.Errorf("%d trailing bytes in section %d", len(section.data), tag)
+		}
+	}
+	if len(in.data) > 0 {
+		return Program{}, fmt.Errorf("%d trailing bytes after the end of the file", len(in.data))
+	}
+	if !seen[instructionsSection] {
+		return Program{}, fmt.Errorf("bytecode file has no instructions")
+	}
+	return p, nil
+}
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) writeTo(out *bytes.Buffer, tag byte) {
+	out.WriteByte(tag)
+	length := [binary.MaxVarintLen64]byte{}
+	out.Write(length[:binary.PutUvarint(length[:], uint64(e.Len()))])
+	out.Write(e.Bytes())
+	e.Reset()
+}
+
+func (e *encoder) uint(v uint64) {
+	buf := [binary.MaxVarintLen64]byte{}
+	e.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (e *encoder) int(v int64) {
+	buf := [binary.MaxVarintLen64]byte{}
+	e.Write(buf[:binary.PutVarint(buf[:], v)])
+}
+
+func (e *encoder) bool(v bool) {
+	if v {
+		e.WriteByte(1)
+	} else {
+		e.WriteByte(0)
+	}
+}
+
+func (e *encoder) typ(t Type) {
+	e.WriteByte(byte(t))
+}
+
+func (e *encoder) string(s string) {
+	e.uint(uint64(len(s)))
+	e.WriteString(s)
+}
+
+func (e *encoder) instruction(i Instruction) error {
+	d := decodeInstruction(i)
+	e.WriteByte(byte(d.code))
+	switch d.code {
+	case JumpInstruction, JumpIfZeroInstruction, JumpNotZeroInstruction, SyscallInstruction:
+	case StoreLocalInstruction, LoadLocalInstruction, StoreLocalKeepInstruction:
+		e.typ(d.typ)
+		e.uint(uint64(d.operand))
+	case PushInstruction:
+		e.typ(d.typ)
+		e.int(int64(d.operand))
+	case ConvertInstruction:
+		e.typ(d.typ)
+		e.typ(d.src)
+	case JumpToInstruction, JumpIfZeroToInstruction:
+		e.uint(uint64(d.operand))
+	case JumpIfNotInstruction:
+		e.WriteByte(byte(d.cmp))
+		e.typ(d.typ)
+		e.uint(uint64(d.operand))
+	case IncrementLocalInstruction:
+		e.typ(d.typ)
+		e.uint(uint64(d.operand))
+		e.int(int64(d.value))
+	default:
+		if _, ok := typedInstructions[opName(d.code)]; !ok {
+			return fmt.Errorf("cannot encode instruction '%s'", i)
+		}
+		e.typ(d.typ)
+	}
+	return nil
+}
+
+// Reads from data, the first error is kept and every read after it returns
+// zero values.
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.data = nil
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+func (d *decoder) uint() uint64 {
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *decoder) int() int64 {
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+// a count of elements, each taking at least one byte
+func (d *decoder) count() int {
+	n := d.uint()
+	if n > uint64(len(d.data)) {
+		d.fail(ErrTruncated)
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) bool() bool {
+	return d.byte() != 0
+}
+
+func (d *decoder) typ() Type {
+	t := Type(d.byte())
+	if d.err == nil && (t < U8 || t > UPTR) {
+		d.fail(fmt.Errorf("invalid type %d", t))
+	}
+	return t
+}
+
+func (d *decoder) string() string {
+	n := d.uint()
+	if n > uint64(len(d.data)) {
+		d.fail(ErrTruncated)
+		return ""
+	}
+	s := string(d.data[:n])
+	d.data = d.data[n:]
+	return s
+}
+
+func (d *decoder) section(tag byte, p *Program) error {
+	switch tag {
+	case instructionsSection:
+		n := d.count()
+		p.Instructions = make([]Instruction, 0, n)
+		for i := 0; i < n && d.err == nil; i++ {
+			p.Instructions = append(p.Instructions, d.instruction())
+		}
+	case preallocationsSection:
+		n := d.count()
+		for i := 0; i < n && d.err == nil; i++ {
+			alloc := AllocationStruct{Handle: int(d.int()), Pack: d.bool(), Components: []Allocation{}}
+			components := d.count()
+			for j := 0; j < components && d.err == nil; j++ {
+				alloc.Components = append(alloc.Components, Allocation{Type: d.typ(), Amount: uint(d.uint())})
+			}
+			p.Preallocations = append(p.Preallocations, alloc)
+		}
+	case symbolsSection:
+		n := d.count()
+		for i := 0; i < n && d.err == nil; i++ {
+			p.Functions = append(p.Functions, FunctionSymbol{Name: d.string(), Start: uintptr(d.uint()), End: uintptr(d.uint())})
+		}
+	case debugSection:
+		if p.DebugInfo == nil {
+			p.DebugInfo = &DebugInfo{}
+		}
+		p.DebugInfo.File, p.DebugInfo.Source = d.string(), d.string()
+	case linesSection:
+		if p.DebugInfo == nil {
+			p.DebugInfo = &DebugInfo{}
+		}
+		n := d.count()
+		for i := 0; i < n && d.err == nil; i++ {
+			entry := LineEntry{Start: uintptr(d.uint())}
+			entry.Line, entry.Col, entry.Function = int(d.uint()), int(d.uint()), d.string()
+			p.DebugInfo.Lines = append(p.DebugInfo.Lines, entry)
+		}
+	case variablesSection:
+		if p.DebugInfo == nil {
+			p.DebugInfo = &DebugInfo{}
+		}
+		n := d.count()
+		for i := 0; i < n && d.err == nil; i++ {
+			v := VariableEntry{Name: d.string(), Type: d.typ(), Index: int(d.uint())}
+			v.Start, v.End, v.Function = uintptr(d.uint()), uintptr(d.uint()), d.string()
+			p.DebugInfo.Variables = append(p.DebugInfo.Variables, v)
+		}
+	default:
+		return fmt.Errorf("unknown section %d", tag)
+	}
+	return d.err
+}
+
+func (d *decoder) instruction() Instruction {
+	code := InstructionType(d.byte())
+	if d.err != nil {
+		return nil
+	}
+	switch code {
+	case JumpInstruction, JumpIfZeroInstruction, JumpNotZeroInstruction, SyscallInstruction:
+		return plainInstructions[opName(code)]
+	case StoreLocalInstruction:
+		return StoreLocal{Type: d.typ(), Offset: uint(d.uint())}
+	case LoadLocalInstruction:
+		return LoadLocal{Type: d.typ(), Offset: uint(d.uint())}
+	case StoreLocalKeepInstruction:
+		return StoreLocalKeep{Type: d.typ(), Offset: uint(d.uint())}
+	case PushInstruction:
+		return Push{Type: d.typ(), Value: int(d.int())}
+	case ConvertInstruction:
+		return Convert{Dst: d.typ(), Src: d.typ()}
+	case JumpToInstruction:
+		return JumpTo{Target: uint(d.uint())}
+	case JumpIfZeroToInstruction:
+		return JumpIfZeroTo{Target: uint(d.uint())}
+	case JumpIfNotInstruction:
+		cmp := InstructionType(d.byte())
+		if _, ok := comparisonsByName[opName(cmp)]; !ok && d.err == nil {
+			d.fail(fmt.Errorf("invalid comparison %d", cmp))
+		}
+		return JumpIfNot{Cmp: cmp, Type: d.typ(), Target: uint(d.uint())}
+	case IncrementLocalInstruction:
+		return IncrementLocal{Type: d.typ(), Offset: uint(d.uint()), Value: int(d.int())}
+	}
+	construct, ok := typedInstructions[opName(code)]
+	if !ok {
+		d.fail(fmt.Errorf("invalid opcode %d", code))
+		return nil
+	}
+	return construct(d.typ())
+}
+
+// name of the instruction in the assembly syntax, "" for unknown opcodes
+func opName(code InstructionType) string {
+	if code < AllocateInstruction || code > IncrementLocalInstruction {
+		return ""
+	}
+	name := code.String()
+	return name[:len(name)-len("Instruction")]
+}
@@ -0,0 +1,102 @@
+package bytecode_test
+
+import (
+	"errors"
+	"eud/bytecode"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func sumProgram(t *testing.T) bytecode.Program {
+	source, err := os.ReadFile("testdata/sum.eudasm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	program, err := bytecode.Assemble(".prealloc 2 pack i32*4 u8*2\n" + string(source))
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.DebugInfo = &bytecode.DebugInfo{
+		File:   "testdata/sum.eudasm",
+		Source: string(source),
+		Lines: []bytecode.LineEntry{
+			{Start: 0, SourcePosition: bytecode.SourcePosition{Line: 2, Col: 5, Function: "main"}},
+			{Start: 1, SourcePosition: bytecode.SourcePosition{Line: 5, Col: 5, Function: "sum"}},
+		},
+		Variables: []bytecode.VariableEntry{
+			{Name: "a", Type: bytecode.I32, Index: 0, Start: 2, End: 6, Function: "sum"},
+		},
+	}
+	return program
+}
+
+func TestEncodingRoundTrip(t *testing.T) {
+	for _, program := range []bytecode.Program{sumProgram(t), whileProgram(10), whileProgramFused(10)} {
+		data, err := bytecode.Marshal(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := bytecode.Unmarshal(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected, err := bytecode.Disassemble(program)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := bytecode.Disassemble(decoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != expected {
+			t.Errorf("decoded program differs, expected\n%s\ngot\n%s", expected, got)
+		}
+		if !reflect.DeepEqual(program.DebugInfo, decoded.DebugInfo) {
+			t.Errorf("expected debug info %v, got %v", program.DebugInfo, decoded.DebugInfo)
+		}
+	}
+}
+
+func TestEncodingRejectsTruncatedFiles(t *testing.T) {
+	data, err := bytecode.Marshal(sumProgram(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		if _, err := bytecode.Unmarshal(data[:n]); err == nil {
+			t.Errorf("accepted file truncated to %d of %d bytes", n, len(data))
+		}
+	}
+}
+
+func TestEncodingRejectsInvalidFiles(t *testing.T) {
+	data, err := bytecode.Marshal(whileProgram(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	modified := func(i int, b byte) []byte {
+		copied := append([]byte{}, data...)
+		copied[i] = b
+		return copied
+	}
+
+	if _, err := bytecode.Unmarshal(modified(0, 'X')); !errors.Is(err, bytecode.ErrNotBytecode) {
+		t.Errorf("expected ErrNotBytecode for a wrong magic, got %v", err)
+	}
+	// the version before the lines and variables sections, and the next one
+	for _, version := range []byte{1, bytecode.FormatVersion + 1} {
+		var versionErr bytecode.VersionError
+		if _, err := bytecode.Unmarshal(modified(4, version)); !errors.As(err, &versionErr) || versionErr.Version != uint16(version) {
+			t.Errorf("expected a VersionError for version %d, got %v", version, err)
+		}
+	}
+	// magic, version, section tag, section length, instruction count
+	firstOpcode := 4 + 2 + 1 + 1 + 1
+	if _, err := bytecode.Unmarshal(modified(firstOpcode, 0xff)); err == nil {
+		t.Errorf("accepted an unknown opcode")
+	}
+	if _, err := bytecode.Unmarshal(append(append([]byte{}, data...), 0x7f, 0)); err == nil {
+		t.Errorf("accepted an unknown section")
+	}
+}
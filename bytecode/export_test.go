@@ -0,0 +1,21 @@
+package bytecode
+
+// Runs p the way the runtime did before decoding programs ahead of time,
+// going through the Instruction interface on every step. Only used to
+// benchmark the decoded dispatch loop against.
+func RunUndecoded(p Program) Runtime {
+	ctx := newRuntime(p, RunOptions{})
+	for ctx.Pc < uintptr(len(p.Instructions)) {
+		i := decodeInstruction(p.Instructions[ctx.Pc])
+		execute(&ctx, &i)
+		ctx.Pc++
+		ctx.Executed++
+	}
+	return ctx
+}
+
+// Replaces the history of a debugger which hasn't run yet by one taking
+// snapshots every interval instructions, so tests go back past them.
+func SetHistory(d *Debugger, interval uint64, maxCheckpoints int) {
+	d.history = newHistory(d.Runtime, interval, maxCheckpoints)
+}
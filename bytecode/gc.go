@@ -0,0 +1,124 @@
+package bytecode
+
+import "sort"
+
+// With RunOptions.GC the heap is managed: allocations which the program can
+// no longer reach are freed, so it doesn't need to deallocate them.
+//
+// The collector marks and sweeps. Every UPTR value on the stack, in the
+// locals and globals keeps the allocation it points into alive, as do the
+// UPTR values stored in live allocations. The stacks and locals of all
+// threads count, as do the results of returned threads, which can be joined
+// at any time. The other allocations are freed. Values are told apart by
+// their tags, so an address computed as another type doesn't keep its
+// allocation alive. Freed values aren't cleared, stale UPTR values in a
+// reused block may keep allocations alive until they are overwritten.
+//
+// A collection runs when an allocation doesn't fit into the heap, before
+// growing it. Allocations are placed into the first free block which has
+// room for them, rather than after the last one.
+
+type GCStats struct {
+	Collections int `json:"collections"`
+	// allocations and heap values freed by all collections
+	Freed       int `json:"freed"`
+	FreedValues int `json:"freed_values"`
+	// allocations and heap values alive after the last collection
+	Live       int `json:"live"`
+	LiveValues int `json:"live_values"`
+}
+
+func (ctx *Runtime) GCStats() GCStats {
+	return ctx.gcStats
+}
+
+// Frees the allocations which are no longer reachable, with or without
+// RunOptions.GC, and returns the stats of all collections.
+func (ctx *Runtime) Collect() GCStats {
+	marked := make([]bool, len(ctx.Allocs))
+	work := []int{}
+	mark := func(s Slot) {
+		if s.Tag != UPTR {
+			return
+		}
+		if i := ctx.allocationAt(uintptr(s.Bits)); i >= 0 && !marked[i] {
+			marked[i] = true
+			work = append(work, i)
+		}
+	}
+	for _, s := range ctx.Stack[:ctx.Sp] {
+		mark(s)
+	}
+	for _, s := range ctx.Locals {
+		mark(s)
+	}
+	for _, v := range ctx.Globals {
+		mark(SlotOf(v))
+	}
+	for i, t := range ctx.threads {
+		if i == ctx.current {
+			continue
+		}
+		for _, s := range t.stack[:t.sp] {
+			mark(s)
+		}
+		for _, s := range t.locals {
+			mark(s)
+		}
+		mark(t.result)
+	}
+	for len(work) > 0 {
+		alloc := ctx.Allocs[work[len(work)-1]]
+		work = work[:len(work)-1]
+		for addr := alloc.From; addr <= alloc.To && addr < uintptr(len(ctx.Heap)); addr++ {
+			mark(ctx.Heap[addr])
+		}
+	}
+
+	stats := &ctx.gcStats
+	stats.Collections++
+	stats.Live, stats.LiveValues = 0, 0
+	live := ctx.Allocs[:0]
+	for i, alloc := range ctx.Allocs {
+		size := int(alloc.To-alloc.From) + 1
+		if marked[i] {
+			live = append(live, alloc)
+			stats.Live++
+			stats.LiveValues += size
+		} else {
+			stats.Freed++
+			stats.FreedValues += size
+		}
+	}
+	ctx.Allocs = live
+	return *stats
+}
+
+// Returns the index of the allocation addr is in, -1 if there is none.
+func (ctx *Runtime) allocationAt(addr uintptr) int {
+	i := sort.Search(len(ctx.Allocs), func(i int) bool { return ctx.Allocs[i].To >= addr })
+	if i < len(ctx.Allocs) && ctx.Allocs[i].From <= addr {
+		return i
+	}
+	return -1
+}
+
+// Returns the address of the first free block of the heap with room for an
+// allocation of size, and the index of the allocations it goes to. Garbage
+// is collected when the heap has no such block, without one after that the
+// allocation goes after the last one and the heap has to grow.
+func (ctx *Runtime) place(size uint64) (uintptr, int) {
+	for collected := false; ; collected = true {
+		start := uintptr(0)
+		for i, alloc := range ctx.Allocs {
+			if uint64(start)+size < uint64(alloc.From) {
+				return start, i
+			}
+			start = alloc.To + 1
+		}
+		if uint64(start)+size < uint64(len(ctx.Heap)) || collected {
+			return start, len(ctx.Allocs)
+		}
+		ctx.Collect()
+	}
+}
@@ -0,0 +1,154 @@
+package bytecode_test
+
+import (
+	"errors"
+	"eud/bytecode"
+	"testing"
+)
+
+// keeps an allocation with 42 in a local and allocates 100 more, which are
+// dropped right away
+const garbageProgram = `
+	DeclareLocal<uptr>
+	Push<usize> 1
+	Allocate<i32>
+	StoreLocal<uptr> 0
+	Push<i32> 42
+	LoadLocal<uptr> 0
+	Store<i32>
+	DeclareLocal<i32>
+	Push<i32> 0
+	StoreLocal<i32> 0
+L1:
+	LoadLocal<i32> 0
+	Push<i32> 100
+	CmpLT<i32>
+	JumpIfZeroTo L2
+	Push<usize> 1
+	Allocate<i32>
+	Pop<uptr>
+	LoadLocal<i32> 0
+	Push<i32> 1
+	Add<i32>
+	StoreLocal<i32> 0
+	JumpTo L1
+L2:
+	LoadLocal<uptr> 1
+	Load<i32>
+`
+
+func TestGC(t *testing.T) {
+	program, err := bytecode.Assemble(garbageProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{MaxHeapSize: 256})
+	_, err = runtime.RunUntil(func(*bytecode.Runtime) bool { return false })
+	var exhausted bytecode.HeapExhaustedError
+	if !errors.As(err, &exhausted) {
+		t.Fatalf("expected the heap to be exhausted without collecting garbage, got %v", err)
+	}
+
+	runtime = bytecode.NewRuntime(program, bytecode.RunOptions{MaxHeapSize: 256, GC: true})
+	if _, err := runtime.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if top, err := runtime.Peek(0); err != nil || top != (bytecode.I32Value{Value: 42}) {
+		t.Errorf("expected the kept allocation to hold 42, got %v, %v", top, err)
+	}
+	stats := runtime.GCStats()
+	if stats.Collections == 0 || stats.Freed+len(runtime.Allocations()) != 101 || stats.FreedValues != 33*stats.Freed {
+		t.Errorf("expected collections freeing the dropped allocations, got %+v with %d allocations left", stats, len(runtime.Allocations()))
+	}
+	if allocs := runtime.Allocations(); allocs[0].From != 0 {
+		t.Errorf("expected the kept allocation to stay at address 0, got %+v", allocs)
+	}
+}
+
+func TestGCReplay(t *testing.T) {
+	program, err := bytecode.Assemble(garbageProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := bytecode.RunOptions{MaxHeapSize: 256, GC: true}
+	rec := bytecode.NewRecording(program, options)
+	options.Record = rec
+	runtime := bytecode.NewRuntime(program, options)
+	_, err = runtime.RunUntil(func(*bytecode.Runtime) bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.Finish(runtime, err)
+	data, err := rec.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bytecode.UnmarshalRecording(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// without collecting garbage the replay would exhaust the heap
+	if _, err := replay(decoded, decoded.Program); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestGCSnapshot(t *testing.T) {
+	program, err := bytecode.Assemble(garbageProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := bytecode.NewRuntime(program, bytecode.RunOptions{MaxHeapSize: 256, GC: true})
+	if _, err := original.RunUntil(func(r *bytecode.Runtime) bool { return r.Pc == 11 }); err != nil {
+		t.Fatal(err)
+	}
+	data, err := original.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// garbage is collected like before the snapshot, without the option
+	restored, err := bytecode.RestoreRuntime(program, data, bytecode.RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := restored.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if top, err := restored.Peek(0); err != nil || top != (bytecode.I32Value{Value: 42}) {
+		t.Errorf("expected the kept allocation to hold 42, got %v, %v", top, err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	// a local points to an allocation which points to another one
+	program, err := bytecode.Assemble(`
+		DeclareLocal<uptr>
+		Push<usize> 1
+		Allocate<uptr>
+		StoreLocal<uptr> 0
+		Push<usize> 1
+		Allocate<i32>
+		LoadLocal<uptr> 0
+		Store<uptr>
+		Push<usize> 1
+		Allocate<i32>
+		Pop<uptr>
+		UndeclareLocal<uptr>
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{})
+	if _, err := runtime.RunUntil(func(r *bytecode.Runtime) bool { return r.Pc == 11 }); err != nil {
+		t.Fatal(err)
+	}
+	if stats := runtime.Collect(); stats.Collections != 1 || stats.Live != 2 || stats.Freed != 1 {
+		t.Errorf("expected the pointed to allocations to stay alive, got %+v", stats)
+	}
+	if _, err := runtime.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if stats := runtime.Collect(); stats.Live != 0 || stats.Freed != 3 || len(runtime.Allocations()) != 0 {
+		t.Errorf("expected all allocations to be freed, got %+v", stats)
+	}
+}
@@ -0,0 +1,148 @@
+package bytecode
+
+import (
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+)
+
+// A HeapDump describes the heap of a runtime, to be written as JSON for
+// hunting leaks and pointer bugs.
+type HeapDump struct {
+	// the number of values in the heap
+	Size        int              `json:"size"`
+	Allocations []AllocationDump `json:"allocations"`
+	Stats       HeapStats        `json:"stats"`
+	// left out unless the heap is managed
+	GC *GCStats `json:"gc,omitempty"`
+}
+
+type AllocationDump struct {
+	From uintptr `json:"from"`
+	To   uintptr `json:"to"`
+	// the number of values from From to To
+	Size int    `json:"size"`
+	Type string `json:"type"`
+	Site Site   `json:"site"`
+	// the values of the allocation decoded as its element type, as numbers
+	Values []interface{} `json:"values"`
+}
+
+// Where an instruction is in the program.
+type Site struct {
+	Pc       uintptr `json:"pc"`
+	Function string  `json:"function"`
+	// left out without a line table
+	Line int `json:"line,omitempty"`
+}
+
+// Statistics of the allocator. Allocations are placed after the last one,
+// the space freed between them is only reused once the allocations after it
+// are freed as well.
+type HeapStats struct {
+	Allocations int `json:"allocations"`
+	Used        int `json:"used"`
+	Free        int `json:"free"`
+	// the ranges of unallocated values, and the largest of them
+	FreeBlocks       int `json:"free_blocks"`
+	LargestFreeBlock int `json:"largest_free_block"`
+	// the share of the free values outside of the largest free block, 0
+	// when all free values are in one block
+	Fragmentation float64 `json:"fragmentation"`
+}
+
+// Returns a dump of the heap of ctx, with the live allocations ordered by
+// address.
+func (ctx *Runtime) DumpHeap() HeapDump {
+	dump := HeapDump{Size: len(ctx.Heap), Allocations: []AllocationDump{}}
+	stats := &dump.Stats
+	free := func(from, to uintptr) {
+		if to <= from {
+			return
+		}
+		size := int(to - from)
+		stats.FreeBlocks++
+		stats.Free += size
+		if size > stats.LargestFreeBlock {
+			stats.LargestFreeBlock = size
+		}
+	}
+	next := uintptr(0)
+	for _, alloc := range ctx.Allocs {
+		free(next, alloc.From)
+		a := AllocationDump{From: alloc.From, To: alloc.To, Size: int(alloc.To-alloc.From) + 1, Type: alloc.Type.String(),
+			Site: ctx.site(alloc.Site), Values: []interface{}{}}
+		for addr := alloc.From; addr <= alloc.To && addr < uintptr(len(ctx.Heap)); addr++ {
+			a.Values = append(a.Values, jsonValue(Slot{Bits: ctx.Heap[addr].Bits, Tag: alloc.Type}.Value()))
+		}
+		dump.Allocations = append(dump.Allocations, a)
+		stats.Allocations++
+		stats.Used += a.Size
+		next = alloc.To + 1
+	}
+	free(next, uintptr(len(ctx.Heap)))
+	if stats.Free > 0 {
+		stats.Fragmentation = 1 - float64(stats.LargestFreeBlock)/float64(stats.Free)
+	}
+	if ctx.gc {
+		gc := ctx.gcStats
+		dump.GC = &gc
+	}
+	return dump
+}
+
+func (dump HeapDump) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dump)
+}
+
+func (ctx *Runtime) site(pc uintptr) Site {
+	site := Site{Pc: pc, Function: ctx.program.FunctionAt(pc)}
+	if entry, ok := ctx.program.DebugInfo.LineAt(pc); ok {
+		site.Line = entry.Line
+	}
+	return site
+}
+
+func jsonValue(v RuntimeValue) interface{} {
+	switch v := v.(type) {
+	case F32Value:
+		return jsonFloat(float64(v.Value))
+	case F64Value:
+		return jsonFloat(v.Value)
+	case U8Value:
+		return v.Value
+	case U16Value:
+		return v.Value
+	case U32Value:
+		return v.Value
+	case U64Value:
+		return v.Value
+	case I8Value:
+		return v.Value
+	case I16Value:
+		return v.Value
+	case I32Value:
+		return v.Value
+	case I64Value:
+		return v.Value
+	case UsizeValue:
+		return v.Value
+	case UptrValue:
+		return v.Value
+	case CharValue:
+		return v.Value
+	default:
+		return v.String()
+	}
+}
+
+// JSON has no NaN or infinities, they are written as strings.
+func jsonFloat(f float64) interface{} {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	return f
+}
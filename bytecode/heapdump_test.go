@@ -0,0 +1,109 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"eud/bytecode"
+	"testing"
+)
+
+// allocates an i32 and a char, stores 42 in the i32 and frees it again
+const allocatingProgram = `
+	Push<usize> 1
+	Allocate<i32>
+	Pop<uptr>
+	Push<usize> 1
+	Allocate<char>
+	Pop<uptr>
+	Push<i32> 42
+	Push<uptr> 2
+	Store<i32>
+	Push<char> 65
+	Push<uptr> 33
+	Store<char>
+`
+
+func runAssembly(t *testing.T, source string) (*bytecode.Runtime, error) {
+	t.Helper()
+	program, err := bytecode.Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{})
+	_, err = runtime.RunUntil(func(*bytecode.Runtime) bool { return false })
+	return runtime, err
+}
+
+func TestDumpHeap(t *testing.T) {
+	runtime, err := runAssembly(t, allocatingProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := runtime.DumpHeap()
+	if len(dump.Allocations) != 2 || dump.Size != runtime.HeapSize() {
+		t.Fatalf("expected 2 allocations in a heap of %d, got %+v", runtime.HeapSize(), dump)
+	}
+	i32, char := dump.Allocations[0], dump.Allocations[1]
+	if i32.From != 0 || i32.To != 32 || i32.Size != 33 || i32.Type != "i32" || i32.Site.Pc != 1 || i32.Site.Function != "main" {
+		t.Errorf("unexpected allocation of the i32 %+v", i32)
+	}
+	if i32.Values[2] != int32(42) || i32.Values[0] != int32(0) {
+		t.Errorf("expected 42 at address 2, got %v", i32.Values)
+	}
+	if char.From != 33 || char.Type != "char" || char.Site.Pc != 4 || char.Values[0] != int8('A') {
+		t.Errorf("unexpected allocation of the char %+v", char)
+	}
+	stats := dump.Stats
+	if stats.Allocations != 2 || stats.Used != 42 || stats.Free != runtime.HeapSize()-42 || stats.FreeBlocks != 1 || stats.Fragmentation != 0 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+
+	var out bytes.Buffer
+	if err := dump.WriteJSON(&out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct {
+		Allocations []struct {
+			Type   string    `json:"type"`
+			Values []float64 `json:"values"`
+		} `json:"allocations"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if len(decoded.Allocations) != 2 || decoded.Allocations[0].Values[2] != 42 {
+		t.Errorf("unexpected JSON %s", out.String())
+	}
+}
+
+func TestDeallocate(t *testing.T) {
+	runtime, err := runAssembly(t, allocatingProgram+`
+		Push<uptr> 2
+		Deallocate<i32>
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	allocs := runtime.Allocations()
+	if len(allocs) != 1 || allocs[0].From != 33 {
+		t.Fatalf("expected only the char to be allocated, got %+v", allocs)
+	}
+	stats := runtime.DumpHeap().Stats
+	if stats.FreeBlocks != 2 || stats.LargestFreeBlock != runtime.HeapSize()-42 || stats.Fragmentation <= 0 {
+		t.Errorf("expected the freed i32 to fragment the heap, got %+v", stats)
+	}
+}
+
+func TestSegmentationFault(t *testing.T) {
+	_, err := runAssembly(t, allocatingProgram+`
+		Push<uptr> 0
+		Deallocate<i32>
+		Push<uptr> 2
+		Load<i32>
+	`)
+	var fault bytecode.SegmentationFaultError
+	if !errors.As(err, &fault) || fault.Addr != 2 {
+		t.Errorf("expected a segmentation fault at address 2, got %v", err)
+	}
+}
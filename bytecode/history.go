@@ -0,0 +1,320 @@
+package bytecode
+
+import (
+	"io"
+	"sort"
+)
+
+// A history of a run lets it be executed backwards. Every executed
+// instruction adds an entry to an undo log with the state it overwrites:
+// the values it pops, the local or heap value it writes, and the locals and
+// frame a return drops. Undoing the entries steps backwards.
+//
+// To bound the memory used, a snapshot of the runtime is taken every
+// interval instructions and the undo log only goes back to the latest one.
+// Going back further restores an earlier snapshot and executes forward again
+// to the wanted instruction, which recreates the undo log of that part of
+// the run. Only the latest maxCheckpoints snapshots are kept, the run can't
+// go back before the oldest one.
+//
+// Executing forward again gives syscalls which depend on the world outside
+// the program the results they had the first time, and discards the output
+// which was already written, so the run doesn't change by going back and
+// forth.
+type history struct {
+	runtime        *Runtime
+	interval       uint64
+	maxCheckpoints int
+	checkpoints    []checkpoint
+	log            []undoEntry
+	// the popped values and dropped locals of the entries in log
+	slots []Slot
+	// the external syscalls since the oldest checkpoint
+	syscalls Recording
+	// the most instructions executed so far, instructions before it are
+	// executed again
+	frontier uint64
+	stdout   io.Writer
+}
+
+type checkpoint struct {
+	executed uint64
+	snapshot []byte
+}
+
+type undoEntry struct {
+	executed uint64
+	pc       uintptr
+	sp       uint
+	// the values at the top of the stack before the instruction, in slots
+	stack, stackCount int
+	locals            int
+	// the local the instruction wrote and its previous value, -1 if none
+	local    int
+	oldLocal Slot
+	// locals dropped by the instruction, in slots
+	dropped, droppedCount int
+	frames                int
+	// the frame dropped by a return
+	returned bool
+	frame    Frame
+	// the allocation table and heap size before an allocation or
+	// deallocation
+	allocs   []AllocationEntry
+	heapSize int
+	// the heap value written by a store
+	heap    bool
+	addr    uintptr
+	oldHeap Slot
+	// the running thread with its time slice and the thread it waited for,
+	// and the number of threads, 0 before the first spawn
+	thread, joining, threads int
+	slice                    uint
+	// whether the running thread waited for input and the input which
+	// arrived for it, and the thread input was given to next, -1 if none
+	reading, arrived bool
+	char             Slot
+	reader           int
+}
+
+const (
+	defaultHistoryInterval    = 4096
+	defaultHistoryCheckpoints = 256
+)
+
+func newHistory(r *Runtime, interval uint64, maxCheckpoints int) *history {
+	return &history{runtime: r, interval: interval, maxCheckpoints: maxCheckpoints, frontier: r.Executed, stdout: r.stdout}
+}
+
+// Returns the number of executed instructions the run can go back to.
+func (h *history) start() uint64 {
+	if len(h.checkpoints) == 0 {
+		return h.runtime.Executed
+	}
+	return h.checkpoints[0].executed
+}
+
+// Executes the instruction at the program counter. A failing instruction
+// leaves the state as it was before it.
+func (h *history) step() error {
+	ctx := h.runtime
+	if ctx.Done() {
+		return nil
+	}
+	if err := h.checkpoint(); err != nil {
+		return err
+	}
+	if ctx.Executed < h.frontier {
+		ctx.record, ctx.replay, ctx.stdout = nil, &h.syscalls, io.Discard
+	} else {
+		ctx.record, ctx.replay, ctx.stdout = &h.syscalls, nil, h.stdout
+	}
+	h.log = append(h.log, h.entry())
+	recorded := len(h.syscalls.Syscalls)
+	if _, err := ctx.Step(); err != nil {
+		h.undo()
+		if ctx.record != nil {
+			h.syscalls.Syscalls = h.syscalls.Syscalls[:recorded]
+		}
+		h.resync()
+		return err
+	}
+	if ctx.Executed > h.frontier {
+		h.frontier = ctx.Executed
+	}
+	return nil
+}
+
+// Takes a snapshot every interval instructions, if there is none yet, and
+// starts a new undo log.
+func (h *history) checkpoint() error {
+	ctx := h.runtime
+	if ctx.Executed%h.interval != 0 && len(h.checkpoints) > 0 {
+		return nil
+	}
+	i := sort.Search(len(h.checkpoints), func(i int) bool { return h.checkpoints[i].executed >= ctx.Executed })
+	if i == len(h.checkpoints) {
+		snapshot, err := ctx.Snapshot()
+		if err != nil {
+			return err
+		}
+		h.checkpoints = append(h.checkpoints, checkpoint{executed: ctx.Executed, snapshot: snapshot})
+		if len(h.checkpoints) > h.maxCheckpoints {
+			h.checkpoints = append(h.checkpoints[:0], h.checkpoints[1:]...)
+			first := h.checkpoints[0].executed
+			events := h.syscalls.Syscalls
+			n := sort.Search(len(events), func(i int) bool { return events[i].Step >= first })
+			h.syscalls.Syscalls = append(events[:0], events[n:]...)
+		}
+	}
+	h.log = h.log[:0]
+	h.slots = h.slots[:0]
+	return nil
+}
+
+// Returns the undo entry of the instruction at the program counter.
+func (h *history) entry() undoEntry {
+	ctx := h.runtime
+	i := &ctx.decoded()[ctx.Pc]
+	e := undoEntry{
+		executed: ctx.Executed,
+		pc:       ctx.Pc,
+		sp:       ctx.Sp,
+		locals:   len(ctx.Locals),
+		local:    -1,
+		frames:   len(ctx.Frames),
+	}
+	if ctx.threads != nil {
+		t := &ctx.threads[ctx.current]
+		e.thread, e.joining, e.threads, e.slice = ctx.current, t.joining, len(ctx.threads), ctx.slice
+		e.reading, e.arrived, e.char, e.reader = t.reading, t.arrived, t.char, ctx.reader()
+	}
+	// instructions pop at most two values, except for calls and spawns,
+	// which move their arguments as well
+	n := uint(2)
+	if i.code == CallInstruction && ctx.Sp >= 2 {
+		n += uint(ctx.Stack[ctx.Sp-2].Bits)
+	}
+	if i.code == SyscallInstruction && ctx.Sp >= 3 && ctx.Stack[ctx.Sp-1].Bits == 1200 {
+		n += 1 + uint(ctx.Stack[ctx.Sp-3].Bits)
+	}
+	if n > ctx.Sp {
+		n = ctx.Sp
+	}
+	e.stack, e.stackCount = len(h.slots), int(n)
+	h.slots = append(h.slots, ctx.Stack[ctx.Sp-n:ctx.Sp]...)
+
+	switch i.code {
+	case StoreLocalInstruction, StoreLocalKeepInstruction, IncrementLocalInstruction:
+		if local := len(ctx.Locals) - i.operand - 1; local >= 0 && local < len(ctx.Locals) {
+			e.local, e.oldLocal = local, ctx.Locals[local]
+		}
+	case UndeclareLocalInstruction:
+		if len(ctx.Locals) > 0 {
+			e.dropped, e.droppedCount = len(h.slots), 1
+			h.slots = append(h.slots, ctx.Locals[len(ctx.Locals)-1])
+		}
+	case ReturnInstruction:
+		if len(ctx.Frames) > 0 {
+			e.returned, e.frame = true, ctx.Frames[len(ctx.Frames)-1]
+			e.dropped, e.droppedCount = len(h.slots), len(ctx.Locals)-e.frame.LocalsBase
+			h.slots = append(h.slots, ctx.Locals[e.frame.LocalsBase:]...)
+		}
+	case AllocateInstruction, DeallocateInstruction:
+		e.allocs, e.heapSize = append([]AllocationEntry{}, ctx.Allocs...), len(ctx.Heap)
+	case StoreInstruction:
+		if ctx.Sp >= 1 {
+			if addr := uintptr(ctx.Stack[ctx.Sp-1].Bits); addr < uintptr(len(ctx.Heap)) {
+				e.heap, e.addr, e.oldHeap = true, addr, ctx.Heap[addr]
+			}
+		}
+	}
+	return e
+}
+
+// Undoes the last instruction of the undo log.
+func (h *history) undo() {
+	ctx := h.runtime
+	e := h.log[len(h.log)-1]
+	h.log = h.log[:len(h.log)-1]
+
+	if ctx.threads != nil {
+		// the instruction may have switched threads, or spawned the first
+		ctx.switchTo(e.thread)
+		ctx.slice = e.slice
+		t := &ctx.threads[e.thread]
+		t.done, t.result, t.joining = false, Slot{}, e.joining
+		t.reading, t.arrived, t.char = e.reading, e.arrived, e.char
+		// the scheduler may have given input to the waiting thread
+		if e.reader >= 0 && e.reader != e.thread {
+			ctx.threads[e.reader].arrived, ctx.threads[e.reader].char = false, Slot{}
+		}
+		if e.threads == 0 {
+			ctx.threads = nil
+		} else {
+			ctx.threads = ctx.threads[:e.threads]
+		}
+	}
+	ctx.Pc = e.pc
+	ctx.Executed = e.executed
+	ctx.Sp = e.sp
+	copy(ctx.Stack[e.sp-uint(e.stackCount):e.sp], h.slots[e.stack:e.stack+e.stackCount])
+	ctx.Locals = append(ctx.Locals[:e.locals-e.droppedCount], h.slots[e.dropped:e.dropped+e.droppedCount]...)
+	if e.local >= 0 {
+		ctx.Locals[e.local] = e.oldLocal
+	}
+	if e.returned {
+		ctx.Frames = append(ctx.Frames[:e.frames-1], e.frame)
+	} else {
+		ctx.Frames = ctx.Frames[:e.frames]
+	}
+	if e.allocs != nil {
+		ctx.Allocs = e.allocs
+		ctx.Heap = ctx.Heap[:e.heapSize]
+	}
+	if e.heap {
+		ctx.Heap[e.addr] = e.oldHeap
+	}
+	h.slots = h.slots[:e.stack]
+}
+
+// Returns the undo entry of the previous instruction, false at the start of
+// the history.
+func (h *history) last() (undoEntry, bool) {
+	if len(h.log) == 0 {
+		if err := h.rewind(); err != nil {
+			return undoEntry{}, false
+		}
+	}
+	if len(h.log) == 0 {
+		return undoEntry{}, false
+	}
+	return h.log[len(h.log)-1], true
+}
+
+// Undoes the previous instruction, false at the start of the history.
+func (h *history) back() (bool, error) {
+	if len(h.log) == 0 {
+		if err := h.rewind(); err != nil {
+			return false, err
+		}
+		if len(h.log) == 0 {
+			return false, nil
+		}
+	}
+	h.undo()
+	h.resync()
+	return true, nil
+}
+
+// Fills the empty undo log with the instructions since the previous
+// checkpoint, by restoring it and executing forward to the current
+// instruction again.
+func (h *history) rewind() error {
+	ctx := h.runtime
+	target := ctx.Executed
+	i := sort.Search(len(h.checkpoints), func(i int) bool { return h.checkpoints[i].executed >= target })
+	if i == 0 {
+		return nil
+	}
+	if err := ctx.restore(h.checkpoints[i-1].snapshot); err != nil {
+		return err
+	}
+	h.log = h.log[:0]
+	h.slots = h.slots[:0]
+	h.resync()
+	for ctx.Executed < target {
+		if err := h.step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Points the runtime at the recorded syscall which comes next after moving
+// backwards.
+func (h *history) resync() {
+	ctx := h.runtime
+	events := h.syscalls.Syscalls
+	ctx.replayed = sort.Search(len(events), func(i int) bool { return events[i].Step >= ctx.Executed })
+}
@@ -0,0 +1,344 @@
+package bytecode
+
+// Optimize rewrites the instructions of p without changing what it computes.
+//
+//	level 0: p is returned unchanged
+//	level 1: constant folding and removal of redundant stack and local traffic
+//	level 2: level 1, jumps to jumps are threaded and unreachable code dropped
+//
+// Removing instructions moves the ones after them, so all absolute code
+// addresses are relocated: the targets of JumpTo, JumpIfZeroTo and JumpIfNot,
+// the operands of Push<uptr>, which is how the compiler pushes function
+// addresses and targets for Jump, Call and JumpIfZero, the function symbols
+// and the line and variable tables. Addresses computed at runtime can't be relocated, so
+// programs building them from anything but Push<uptr> must not be optimized.
+func Optimize(p Program, level int) Program {
+	passes := []func([]Instruction, []bool, []bool) bool{}
+	if level >= 1 {
+		passes = append(passes, foldConstants, removeRoundTrips)
+	}
+	if level >= 2 {
+		passes = append(passes, threadJumps, removeUnreachable)
+	}
+	p.Instructions = append([]Instruction{}, p.Instructions...)
+	p.Functions = append([]FunctionSymbol{}, p.Functions...)
+	if p.DebugInfo != nil {
+		debug := *p.DebugInfo
+		debug.Lines = append([]LineEntry{}, debug.Lines...)
+		debug.Variables = append([]VariableEntry{}, debug.Variables...)
+		p.DebugInfo = &debug
+	}
+	for changed := true; changed; {
+		changed = false
+		for _, pass := range passes {
+			removed := make([]bool, len(p.Instructions))
+			if pass(p.Instructions, findLeaders(p), removed) {
+				p = compact(p, removed)
+				changed = true
+			}
+		}
+	}
+	return p
+}
+
+// Marks every instruction that may be executed without the one before it
+// having been executed right before, so a sequence of instructions can only
+// be rewritten as a whole if nothing but its first instruction is a leader.
+func findLeaders(p Program) []bool {
+	leaders := make([]bool, len(p.Instructions)+1)
+	mark := func(addr int) {
+		if addr >= 0 && addr < len(leaders) {
+			leaders[addr] = true
+		}
+	}
+	for i, instruction := range p.Instructions {
+		switch instruction := instruction.(type) {
+		case JumpTo:
+			mark(int(instruction.Target))
+		case JumpIfZeroTo:
+			mark(int(instruction.Target))
+		case JumpIfNot:
+			mark(int(instruction.Target))
+		case Push:
+			if instruction.Type == UPTR {
+				mark(instruction.Value)
+			}
+		case Call:
+			// return address
+			mark(i + 1)
+		}
+	}
+	for _, f := range p.Functions {
+		mark(int(f.Start))
+		mark(int(f.End))
+	}
+	return leaders
+}
+
+// reports if the n instructions starting at i can be rewritten together
+func isWindow(code []Instruction, leaders []bool, i int, n int) bool {
+	if i+n > len(code) {
+		return false
+	}
+	for j := i + 1; j < i+n; j++ {
+		if leaders[j] {
+			return false
+		}
+	}
+	return true
+}
+
+// Drops the removed instructions and relocates all code addresses. Addresses
+// of removed instructions move to the next instruction which is kept.
+func compact(p Program, removed []bool) Program {
+	relocated := make([]int, len(p.Instructions)+1)
+	kept := []Instruction{}
+	for i := range p.Instructions {
+		relocated[i] = len(kept)
+		if !removed[i] {
+			kept = append(kept, p.Instructions[i])
+		}
+	}
+	relocated[len(p.Instructions)] = len(kept)
+
+	for i, instruction := range kept {
+		switch instruction := instruction.(type) {
+		case JumpTo:
+			instruction.Target = uint(relocated[instruction.Target])
+			kept[i] = instruction
+		case JumpIfZeroTo:
+			instruction.Target = uint(relocated[instruction.Target])
+			kept[i] = instruction
+		case JumpIfNot:
+			instruction.Target = uint(relocated[instruction.Target])
+			kept[i] = instruction
+		case Push:
+			if instruction.Type == UPTR && instruction.Value >= 0 && instruction.Value < len(relocated) {
+				instruction.Value = relocated[instruction.Value]
+				kept[i] = instruction
+			}
+		}
+	}
+	for i := range p.Functions {
+		p.Functions[i].Start = uintptr(relocated[p.Functions[i].Start])
+		p.Functions[i].End = uintptr(relocated[p.Functions[i].End])
+	}
+	if p.DebugInfo != nil {
+		// entries whose instructions were all removed are dropped
+		lines := []LineEntry{}
+		for _, entry := range p.DebugInfo.Lines {
+			entry.Start = uintptr(relocated[entry.Start])
+			if len(lines) > 0 && lines[len(lines)-1].Start == entry.Start {
+				lines = lines[:len(lines)-1]
+			}
+			if len(lines) == 0 || lines[len(lines)-1].SourcePosition != entry.SourcePosition {
+				lines = append(lines, entry)
+			}
+		}
+		if len(lines) > 0 && int(lines[len(lines)-1].Start) == len(kept) {
+			lines = lines[:len(lines)-1]
+		}
+		p.DebugInfo.Lines = lines
+		for i := range p.DebugInfo.Variables {
+			v := &p.DebugInfo.Variables[i]
+			v.Start, v.End = uintptr(relocated[v.Start]), uintptr(relocated[v.End])
+		}
+	}
+	p.Instructions = kept
+	return p
+}
+
+func isBinaryOperation(code InstructionType) bool {
+	return code >= AddInstruction && code <= XnorInstruction
+}
+
+// Returns the Push instruction producing s, if there is one.
+func pushOf(s Slot) (Push, bool) {
+	var v int64
+	if isFloat(s.Tag) {
+		v = int64(s.float(s.Tag))
+	} else {
+		v = int64(s.Bits)
+	}
+	if IntSlot(s.Tag, v) != s {
+		return Push{}, false
+	}
+	return Push{Type: s.Tag, Value: int(v)}, true
+}
+
+func pushedSlot(i Instruction) (Slot, bool) {
+	push, ok := i.(Push)
+	if !ok || push.Type == UPTR {
+		return Slot{}, false
+	}
+	return IntSlot(push.Type, int64(push.Value)), true
+}
+
+// Evaluates operations on pushed constants at compile time, and conditional
+// jumps on constants into either an unconditional jump or nothing.
+func foldConstants(code []Instruction, leaders []bool, removed []bool) bool {
+	changed := false
+	for i := 0; i < len(code); i++ {
+		a, ok := pushedSlot(code[i])
+		if !ok {
+			continue
+		}
+		if isWindow(code, leaders, i, 2) {
+			switch next := code[i+1].(type) {
+			case Not:
+				if push, ok := pushOf(Slot{Bits: normalize(next.Type, ^a.Bits), Tag: next.Type}); ok {
+					code[i], removed[i+1] = push, true
+					changed = true
+					i++
+					continue
+				}
+			case JumpIfZeroTo:
+				if a.Bits == 0 {
+					// the jump always happens and nothing is left to pop
+					code[i], removed[i+1] = JumpTo{Target: next.Target}, true
+				} else {
+					removed[i], removed[i+1] = true, true
+				}
+				changed = true
+				i++
+				continue
+			}
+		}
+		if !isWindow(code, leaders, i, 3) {
+			continue
+		}
+		b, ok := pushedSlot(code[i+1])
+		if !ok {
+			continue
+		}
+		op := decodeInstruction(code[i+2])
+		switch {
+		case op.code == JumpIfNotInstruction:
+			jump := code[i+2].(JumpIfNot)
+			if comparisonHolds(jump.Cmp, compareSlots(jump.Type, a, b)) {
+				removed[i] = true
+			} else {
+				code[i] = JumpTo{Target: jump.Target}
+			}
+			removed[i+1], removed[i+2] = true, true
+			changed = true
+			i += 2
+		case isBinaryOperation(op.code):
+			// dividing by zero is left to fail at runtime
+			if (op.code == DivideInstruction || op.code == ModulusInstruction) && !isFloat(op.typ) && b.Bits == 0 {
+				continue
+			}
+			if push, ok := pushOf(EvalBinary(op.code, op.typ, a, b)); ok {
+				code[i], removed[i+1], removed[i+2] = push, true, true
+				changed = true
+				i += 2
+			}
+		}
+	}
+	return changed
+}
+
+// Removes values which are pushed only to be popped again, and locals which
+// are stored only to be loaded again.
+func removeRoundTrips(code []Instruction, leaders []bool, removed []bool) bool {
+	changed := false
+	for i := 0; i+1 < len(code); i++ {
+		if !isWindow(code, leaders, i, 2) {
+			continue
+		}
+		if _, ok := code[i+1].(Pop); ok {
+			switch first := code[i].(type) {
+			case Push, LoadLocal:
+				removed[i], removed[i+1] = true, true
+			case StoreLocalKeep:
+				code[i], removed[i+1] = StoreLocal{Type: first.Type, Offset: first.Offset}, true
+			default:
+				continue
+			}
+			changed = true
+			i++
+			continue
+		}
+		switch first := code[i].(type) {
+		case StoreLocal:
+			if load, ok := code[i+1].(LoadLocal); ok && load.Offset == first.Offset {
+				code[i], removed[i+1] = StoreLocalKeep{Type: first.Type, Offset: first.Offset}, true
+				changed = true
+				i++
+			}
+		case LoadLocal:
+			if store, ok := code[i+1].(StoreLocal); ok && store.Offset == first.Offset {
+				removed[i], removed[i+1] = true, true
+				changed = true
+				i++
+			}
+		}
+	}
+	return changed
+}
+
+// Points jumps whose target is a JumpTo at the final target instead, and
+// removes jumps to the next instruction.
+func threadJumps(code []Instruction, leaders []bool, removed []bool) bool {
+	final := func(target uint) uint {
+		seen := map[uint]bool{}
+		end := target
+		for int(end) < len(code) {
+			jump, ok := code[end].(JumpTo)
+			if !ok {
+				return end
+			}
+			if seen[end] {
+				// jumps in a cycle are left alone
+				return target
+			}
+			seen[end] = true
+			end = jump.Target
+		}
+		return end
+	}
+	changed := false
+	for i := range code {
+		switch jump := code[i].(type) {
+		case JumpTo:
+			if jump.Target == uint(i+1) {
+				removed[i] = true
+				changed = true
+			} else if target := final(jump.Target); target != jump.Target {
+				code[i] = JumpTo{Target: target}
+				changed = true
+			}
+		case JumpIfZeroTo:
+			if target := final(jump.Target); target != jump.Target {
+				code[i] = JumpIfZeroTo{Target: target}
+				changed = true
+			}
+		case JumpIfNot:
+			if target := final(jump.Target); target != jump.Target {
+				jump.Target = target
+				code[i] = jump
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+// Removes instructions following an unconditional jump or return, which
+// nothing jumps to.
+func removeUnreachable(code []Instruction, leaders []bool, removed []bool) bool {
+	changed := false
+	for i := 0; i < len(code); i++ {
+		switch code[i].InstructionType() {
+		case JumpToInstruction, JumpInstruction, ReturnInstruction:
+		default:
+			continue
+		}
+		for i+1 < len(code) && !leaders[i+1] {
+			i++
+			removed[i] = true
+			changed = true
+		}
+	}
+	return changed
+}
@@ -0,0 +1,233 @@
+package bytecode_test
+
+import (
+	"eud/bytecode"
+	"eud/parser"
+	"fmt"
+	"testing"
+)
+
+func expectInstructions(t *testing.T, got []bytecode.Instruction, expected []bytecode.Instruction) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d instructions, got %d: %s", len(expected), len(got), got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("instruction %d: expected %s, got %s", i, expected[i], got[i])
+		}
+	}
+}
+
+func TestOptimizeFoldsConstants(t *testing.T) {
+	// let a: i32 = 2 + 3 + 4
+	literal := func(v int) parser.IntLiteral {
+		return parser.IntLiteral{Tok: &parser.Token{Type: parser.IntToken, IntValue: v, Next: nil}}
+	}
+	program, err := bytecode.Compile([]parser.BaseStatement{
+		parser.TypedInitStatement{
+			TypedDeclaration: parser.TypedDeclaration{
+				DeclType: parser.Token{
+					Type: parser.KeywordToken, StringValue: "i32", Next: nil,
+				},
+				Identifier: parser.Token{
+					Type: parser.IdentifierToken, StringValue: "a", Next: nil,
+				},
+			},
+			Value: parser.AddExpression{
+				Left:  parser.AddExpression{Left: literal(2), Right: literal(3)},
+				Right: literal(4),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	optimized := bytecode.Optimize(program, 1)
+	expectInstructions(t, optimized.Instructions, []bytecode.Instruction{
+		bytecode.DeclareLocal{Type: bytecode.I32},
+		bytecode.Push{Type: bytecode.I32, Value: 9},
+		bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
+	})
+	if len(program.Instructions) != 7 {
+		t.Errorf("optimizing modified the original program")
+	}
+}
+
+func TestOptimizeFoldsConstantJumps(t *testing.T) {
+	// the jump on 0 is taken and must not pop 42, the one on 1 isn't
+	for _, c := range []struct {
+		condition int
+		result    int32
+	}{{0, 42}, {1, 7}} {
+		program, err := bytecode.Assemble(fmt.Sprintf(`
+			Push<i32> 42
+			Push<i32> %d
+			JumpIfZeroTo L1
+			Pop<i32>
+			Push<i32> 7
+		L1:
+		`, c.condition))
+		if err != nil {
+			t.Fatal(err)
+		}
+		optimized := bytecode.Optimize(program, 1)
+		if err := bytecode.Verify(optimized); err != nil {
+			t.Fatal(err)
+		}
+		runtime := bytecode.NewRuntime(optimized, bytecode.RunOptions{})
+		if _, err := runtime.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+		if top, err := runtime.Peek(0); err != nil || top != (bytecode.I32Value{Value: c.result}) || runtime.Sp != 1 {
+			t.Errorf("condition %d: expected only %d on the stack, got %v, %v with %d values", c.condition, c.result, top, err, runtime.Sp)
+		}
+	}
+}
+
+func TestOptimizeLevelZero(t *testing.T) {
+	program := whileProgram(10)
+	optimized := bytecode.Optimize(program, 0)
+	expectInstructions(t, optimized.Instructions, program.Instructions)
+}
+
+func TestOptimizeRelocatesPushedAddresses(t *testing.T) {
+	program := bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.Push{Type: bytecode.UPTR, Value: 10}, // start
+			bytecode.Jump{},
+			// sum: adds the arguments and jumps back to the return address below them
+			bytecode.Push{Type: bytecode.I32, Value: 1},
+			bytecode.Push{Type: bytecode.I32, Value: 1},
+			bytecode.Add{Type: bytecode.I32},
+			bytecode.Pop{Type: bytecode.I32},
+			bytecode.Add{Type: bytecode.I32},
+			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
+			bytecode.Jump{},
+			bytecode.Push{Type: bytecode.I32, Value: 99},
+			// start:
+			bytecode.DeclareLocal{Type: bytecode.I32},
+			bytecode.Push{Type: bytecode.UPTR, Value: 16}, // return address
+			bytecode.Push{Type: bytecode.I32, Value: 5},
+			bytecode.Push{Type: bytecode.I32, Value: 3},
+			bytecode.Push{Type: bytecode.UPTR, Value: 2}, // sum
+			bytecode.Jump{},
+			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
+		},
+	}
+	optimized := bytecode.Optimize(program, 2)
+	expectInstructions(t, optimized.Instructions, []bytecode.Instruction{
+		bytecode.Push{Type: bytecode.UPTR, Value: 5},
+		bytecode.Jump{},
+		bytecode.Add{Type: bytecode.I32},
+		bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
+		bytecode.Jump{},
+		bytecode.DeclareLocal{Type: bytecode.I32},
+		bytecode.Push{Type: bytecode.UPTR, Value: 11},
+		bytecode.Push{Type: bytecode.I32, Value: 5},
+		bytecode.Push{Type: bytecode.I32, Value: 3},
+		bytecode.Push{Type: bytecode.UPTR, Value: 2},
+		bytecode.Jump{},
+		bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
+	})
+	for _, p := range []bytecode.Program{program, optimized} {
+		runtime := bytecode.Run(p)
+		if runtime.Sp != 1 || runtime.Stack[0].Value() != (bytecode.I32Value{Value: 8}) {
+			t.Errorf("expected the stack to be [I32(8)], got %s", runtime.Stack[:runtime.Sp])
+		}
+	}
+}
+
+func TestOptimizeThreadsJumps(t *testing.T) {
+	program := bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.DeclareLocal{Type: bytecode.I32},
+			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
+			bytecode.JumpIfZeroTo{Target: 4},
+			bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: 1},
+			bytecode.JumpTo{Target: 6},
+			bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: 100},
+			bytecode.JumpTo{Target: 8},
+			bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: 1000},
+			bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: 2},
+		},
+	}
+	optimized := bytecode.Optimize(program, 2)
+	expectInstructions(t, optimized.Instructions, []bytecode.Instruction{
+		bytecode.DeclareLocal{Type: bytecode.I32},
+		bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
+		bytecode.JumpIfZeroTo{Target: 4},
+		bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: 1},
+		bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: 2},
+	})
+	runtime := bytecode.Run(optimized)
+	if runtime.Locals[0].Value() != (bytecode.I32Value{Value: 2}) {
+		t.Errorf("expected local to be 2, got %s", runtime.Locals[0])
+	}
+}
+
+func TestOptimizeRoundTrips(t *testing.T) {
+	program := bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.DeclareLocal{Type: bytecode.I32},
+			bytecode.DeclareLocal{Type: bytecode.I32},
+			bytecode.Push{Type: bytecode.I32, Value: 4},
+			bytecode.StoreLocal{Type: bytecode.I32, Offset: 1},
+			bytecode.LoadLocal{Type: bytecode.I32, Offset: 1},
+			bytecode.StoreLocalKeep{Type: bytecode.I32, Offset: 0},
+			bytecode.Pop{Type: bytecode.I32},
+			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
+			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
+			bytecode.LoadLocal{Type: bytecode.I32, Offset: 1},
+			bytecode.Pop{Type: bytecode.I32},
+		},
+	}
+	optimized := bytecode.Optimize(program, 1)
+	expectInstructions(t, optimized.Instructions, []bytecode.Instruction{
+		bytecode.DeclareLocal{Type: bytecode.I32},
+		bytecode.DeclareLocal{Type: bytecode.I32},
+		bytecode.Push{Type: bytecode.I32, Value: 4},
+		bytecode.StoreLocalKeep{Type: bytecode.I32, Offset: 1},
+		bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
+	})
+	runtime := bytecode.Run(optimized)
+	if runtime.Sp != 0 {
+		t.Errorf("expected an empty stack, got %s", runtime.Stack[:runtime.Sp])
+	}
+	for i := range runtime.Locals {
+		if runtime.Locals[i].Value() != (bytecode.I32Value{Value: 4}) {
+			t.Errorf("expected local %d to be 4, got %s", i, runtime.Locals[i])
+		}
+	}
+}
+
+func TestOptimizeRelocatesLineTable(t *testing.T) {
+	b := bytecode.NewBuilder()
+	b.SetPosition(bytecode.SourcePosition{Line: 1, Function: "main"})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 2})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 3})
+	b.Emit(bytecode.Add{Type: bytecode.I32})
+	b.SetPosition(bytecode.SourcePosition{Line: 2, Function: "main"})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 1})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	b.SetPosition(bytecode.SourcePosition{Line: 3, Function: "main"})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 4})
+	program := finish(b)
+
+	optimized := bytecode.Optimize(program, 1)
+	expectInstructions(t, optimized.Instructions, []bytecode.Instruction{
+		bytecode.Push{Type: bytecode.I32, Value: 5},
+		bytecode.Push{Type: bytecode.I32, Value: 4},
+	})
+	// line 2 is optimized away entirely
+	expected := []bytecode.LineEntry{
+		{Start: 0, SourcePosition: bytecode.SourcePosition{Line: 1, Function: "main"}},
+		{Start: 1, SourcePosition: bytecode.SourcePosition{Line: 3, Function: "main"}},
+	}
+	if fmt.Sprint(optimized.DebugInfo.Lines) != fmt.Sprint(expected) {
+		t.Errorf("expected line table %v, got %v", expected, optimized.DebugInfo.Lines)
+	}
+	if len(program.DebugInfo.Lines) != 3 {
+		t.Errorf("the line table of the original program was changed")
+	}
+}
@@ -0,0 +1,375 @@
+package bytecode
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A Profiler counts the executed instructions and the wall time spent per
+// call stack. Sample is called before every instruction, for example as the
+// predicate of Runtime.RunUntil, and Stop after the last one:
+//
+//	profiler := NewProfiler(p)
+//	_, err := runtime.RunUntil(func(r *Runtime) bool {
+//		profiler.Sample(r)
+//		return false
+//	})
+//	profiler.Stop()
+type Profiler struct {
+	program Program
+	samples map[string]*profileSample
+	// the sample of the instruction executing since last
+	current *profileSample
+	last    time.Time
+	start   time.Time
+	end     time.Time
+	key     []byte
+}
+
+type profileSample struct {
+	// the instruction, then the Call instructions of the active calls,
+	// innermost first
+	stack        []uintptr
+	instructions int64
+	time         time.Duration
+}
+
+func NewProfiler(p Program) *Profiler {
+	return &Profiler{program: p, samples: map[string]*profileSample{}}
+}
+
+// Attributes the instruction at the program counter of r to its call stack,
+// and the time since the previous sample to the previous instruction.
+func (pr *Profiler) Sample(r *Runtime) {
+	now := time.Now()
+	if pr.current != nil {
+		pr.current.time += now.Sub(pr.last)
+	} else {
+		pr.start = now
+	}
+	pr.last = now
+
+	// the key is looked up without allocating, only new stacks are copied
+	pr.key = pr.key[:0]
+	pr.key = appendUvarint(pr.key, uint64(r.Pc))
+	for i := len(r.Frames) - 1; i >= 0; i-- {
+		pr.key = appendUvarint(pr.key, uint64(r.Frames[i].Call))
+	}
+	sample, ok := pr.samples[string(pr.key)]
+	if !ok {
+		stack := []uintptr{r.Pc}
+		for i := len(r.Frames) - 1; i >= 0; i-- {
+			stack = append(stack, r.Frames[i].Call)
+		}
+		sample = &profileSample{stack: stack}
+		pr.samples[string(pr.key)] = sample
+	}
+	sample.instructions++
+	pr.current = sample
+}
+
+// Attributes the time since the last sample to the last instruction.
+func (pr *Profiler) Stop() {
+	now := time.Now()
+	if pr.current != nil {
+		pr.current.time += now.Sub(pr.last)
+		pr.current = nil
+	}
+	pr.end = now
+}
+
+// the samples in a deterministic order
+func (pr *Profiler) sortedSamples() []*profileSample {
+	samples := make([]*profileSample, 0, len(pr.samples))
+	for _, sample := range pr.samples {
+		samples = append(samples, sample)
+	}
+	// callers first
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].stack, samples[j].stack
+		for k := 1; k <= len(a) && k <= len(b); k++ {
+			if x, y := a[len(a)-k], b[len(b)-k]; x != y {
+				return x < y
+			}
+		}
+		return len(a) < len(b)
+	})
+	return samples
+}
+
+// Returns the function and line of the instruction at pc, line is 0 if the
+// instruction has no entry in the line table.
+func (pr *Profiler) location(pc uintptr) (string, int) {
+	line := 0
+	if entry, ok := pr.program.DebugInfo.LineAt(pc); ok {
+		line = entry.Line
+	}
+	return pr.program.FunctionAt(pc), line
+}
+
+// Writes the stacks in the folded format of flame graph tools, one line per
+// stack of functions with the callers first and the executed instructions.
+func (pr *Profiler) WriteFolded(w io.Writer) error {
+	counts := map[string]int64{}
+	for _, sample := range pr.samples {
+		functions := make([]string, len(sample.stack))
+		for i, pc := range sample.stack {
+			functions[len(functions)-i-1], _ = pr.location(pc)
+		}
+		counts[strings.Join(functions, ";")] += sample.instructions
+	}
+	stacks := make([]string, 0, len(counts))
+	for stack := range counts {
+		stacks = append(stacks, stack)
+	}
+	sort.Strings(stacks)
+	for _, stack := range stacks {
+		if _, err := fmt.Fprintf(w, "%s %d\n", stack, counts[stack]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type profileEntry struct {
+	name              string
+	flat, cumulative  int64
+	flatTime, cumTime time.Duration
+}
+
+// Writes the functions and lines with the most executed instructions. Flat
+// counts are of the instructions of a function or line itself, cumulative
+// ones include the functions it called.
+func (pr *Profiler) WriteSummary(w io.Writer, top int) error {
+	functions := map[string]*profileEntry{}
+	lines := map[string]*profileEntry{}
+	entry := func(entries map[string]*profileEntry, name string) *profileEntry {
+		if entries[name] == nil {
+			entries[name] = &profileEntry{name: name}
+		}
+		return entries[name]
+	}
+	var total int64
+	var totalTime time.Duration
+	for _, sample := range pr.samples {
+		total += sample.instructions
+		totalTime += sample.time
+		seen := map[*profileEntry]bool{}
+		for i, pc := range sample.stack {
+			function, line := pr.location(pc)
+			name := fmt.Sprintf("%s:%d", pr.program.DebugInfo.fileName(), line)
+			if line == 0 {
+				name = fmt.Sprintf("%s pc %d", function, pc)
+			}
+			for _, e := range []*profileEntry{entry(functions, function), entry(lines, name)} {
+				if i == 0 {
+					e.flat += sample.instructions
+					e.flatTime += sample.time
+				}
+				// recursive calls are counted once
+				if !seen[e] {
+					seen[e] = true
+					e.cumulative += sample.instructions
+					e.cumTime += sample.time
+				}
+			}
+		}
+	}
+
+	fmt.Fprintf(w, "%d instructions in %s\n", total, totalTime)
+	for _, table := range []struct {
+		title   string
+		entries map[string]*profileEntry
+	}{{"function", functions}, {"line", lines}} {
+		sorted := make([]*profileEntry, 0, len(table.entries))
+		for _, e := range table.entries {
+			sorted = append(sorted, e)
+		}
+		sort.Slice(sorted, func(i, j int) bool {
+			if sorted[i].flat != sorted[j].flat {
+				return sorted[i].flat > sorted[j].flat
+			}
+			return sorted[i].name < sorted[j].name
+		})
+		if top > 0 && len(sorted) > top {
+			sorted = sorted[:top]
+		}
+		fmt.Fprintf(w, "\n%12s %6s %12s %6s %12s %12s  %s\n", "flat", "flat%", "cum", "cum%", "flat time", "cum time", table.title)
+		for _, e := range sorted {
+			_, err := fmt.Fprintf(w, "%12d %5.1f%% %12d %5.1f%% %12s %12s  %s\n",
+				e.flat, percent(e.flat, total), e.cumulative, percent(e.cumulative, total),
+				e.flatTime.Round(time.Microsecond), e.cumTime.Round(time.Microsecond), e.name)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func percent(n int64, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(total)
+}
+
+// the name of the source file, or "?" if it isn't known
+func (d *DebugInfo) fileName() string {
+	if d == nil || d.File == "" {
+		return "?"
+	}
+	return d.File
+}
+
+// Writes the profile in the gzipped protobuf format of pprof, with the sample
+// types instructions/count, the default, and time/nanoseconds. Every instruction is a
+// location, with the function and source line it belongs to.
+func (pr *Profiler) WritePprof(w io.Writer) error {
+	strs := []string{""}
+	index := map[string]int64{"": 0}
+	str := func(s string) int64 {
+		if i, ok := index[s]; ok {
+			return i
+		}
+		index[s] = int64(len(strs))
+		strs = append(strs, s)
+		return index[s]
+	}
+	var profile protobuf
+
+	valueType := func(field int, typ string, unit string) {
+		var v protobuf
+		v.int(1, str(typ))
+		v.int(2, str(unit))
+		profile.message(field, v)
+	}
+	valueType(1, "instructions", "count")
+	valueType(1, "time", "nanoseconds")
+
+	samples := pr.sortedSamples()
+	locations := map[uintptr]bool{}
+	for _, sample := range samples {
+		var s protobuf
+		ids := make([]uint64, len(sample.stack))
+		for i, pc := range sample.stack {
+			// ids can't be 0
+			ids[i] = uint64(pc) + 1
+			locations[pc] = true
+		}
+		s.packed(1, ids)
+		s.packed(2, []uint64{uint64(sample.instructions), uint64(sample.time.Nanoseconds())})
+		profile.message(2, s)
+	}
+
+	pcs := make([]uintptr, 0, len(locations))
+	for pc := range locations {
+		pcs = append(pcs, pc)
+	}
+	sort.Slice(pcs, func(i, j int) bool { return pcs[i] < pcs[j] })
+	functionIDs := map[string]uint64{}
+	functionNames := []string{}
+	for _, pc := range pcs {
+		function, line := pr.location(pc)
+		if functionIDs[function] == 0 {
+			functionNames = append(functionNames, function)
+			functionIDs[function] = uint64(len(functionNames))
+		}
+		var l, location protobuf
+		l.uint(1, functionIDs[function])
+		l.int(2, int64(line))
+		location.uint(1, uint64(pc)+1)
+		location.uint(3, uint64(pc))
+		location.message(4, l)
+		profile.message(4, location)
+	}
+	file := pr.program.DebugInfo.fileName()
+	for i, name := range functionNames {
+		var f protobuf
+		f.uint(1, uint64(i)+1)
+		f.int(2, str(name))
+		f.int(3, str(name))
+		f.int(4, str(file))
+		f.int(5, int64(pr.functionLine(name)))
+		profile.message(5, f)
+	}
+
+	var period protobuf
+	period.int(1, str("instructions"))
+	period.int(2, str("count"))
+	// instruction counts are exact, so they are shown by default
+	profile.int(14, str("instructions"))
+
+	// the string table is complete once everything else is encoded
+	for _, s := range strs {
+		profile.bytes(6, []byte(s))
+	}
+	profile.int(9, pr.start.UnixNano())
+	profile.int(10, pr.end.Sub(pr.start).Nanoseconds())
+	profile.message(11, period)
+	profile.int(12, 1)
+
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(profile.Bytes()); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Returns the source line a function starts at, 0 if it isn't known.
+func (pr *Profiler) functionLine(name string) int {
+	for _, f := range pr.program.Functions {
+		if f.Name == name {
+			if entry, ok := pr.program.DebugInfo.LineAt(f.Start); ok {
+				return entry.Line
+			}
+		}
+	}
+	return 0
+}
+
+// the protocol buffer wire format, as far as pprof needs it
+type protobuf struct{ bytes.Buffer }
+
+func appendUvarint(data []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(data, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (b *protobuf) varint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	b.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func (b *protobuf) uint(field int, v uint64) {
+	b.varint(uint64(field) << 3)
+	b.varint(v)
+}
+
+func (b *protobuf) int(field int, v int64) {
+	b.uint(field, uint64(v))
+}
+
+func (b *protobuf) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.Write(data)
+}
+
+func (b *protobuf) message(field int, m protobuf) {
+	b.bytes(field, m.Bytes())
+}
+
+func (b *protobuf) packed(field int, values []uint64) {
+	var p protobuf
+	for _, v := range values {
+		p.varint(v)
+	}
+	b.bytes(field, p.Bytes())
+}
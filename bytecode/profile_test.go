@@ -0,0 +1,121 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"eud/bytecode"
+	"io"
+	"strings"
+	"testing"
+)
+
+func profileSum(t *testing.T) *bytecode.Profiler {
+	program := sumProgram(t)
+	profiler := bytecode.NewProfiler(program)
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{})
+	if _, err := runtime.RunUntil(func(r *bytecode.Runtime) bool {
+		profiler.Sample(r)
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	profiler.Stop()
+	return profiler
+}
+
+func TestProfileFolded(t *testing.T) {
+	var out bytes.Buffer
+	if err := profileSum(t).WriteFolded(&out); err != nil {
+		t.Fatal(err)
+	}
+	// the JumpTo and 7 instructions of main, 8 of sum
+	if expected := "main 8\nmain;sum 8\n"; out.String() != expected {
+		t.Errorf("expected\n%s\ngot\n%s", expected, out.String())
+	}
+}
+
+func TestProfileSummary(t *testing.T) {
+	var out bytes.Buffer
+	if err := profileSum(t).WriteSummary(&out, 0); err != nil {
+		t.Fatal(err)
+	}
+	summary := out.String()
+	if !strings.HasPrefix(summary, "16 instructions in ") {
+		t.Errorf("expected 16 instructions in total, got\n%s", summary)
+	}
+	for _, row := range []string{
+		"           8  50.0%           16 100.0%  ",
+		"           8  50.0%            8  50.0%  ",
+	} {
+		if !strings.Contains(summary, row) {
+			t.Errorf("expected a row starting with %q in\n%s", row, summary)
+		}
+	}
+}
+
+// the fields of a protocol buffer message, varints and bytes
+func protoFields(t *testing.T, data []byte) map[int][][]byte {
+	fields := map[int][][]byte{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			_, n = binary.Uvarint(data)
+			fields[int(key>>3)] = append(fields[int(key>>3)], data[:n])
+			data = data[n:]
+		case 2:
+			length, n := binary.Uvarint(data)
+			data = data[n:]
+			fields[int(key>>3)] = append(fields[int(key>>3)], data[:length])
+			data = data[length:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&7)
+		}
+	}
+	return fields
+}
+
+func TestProfilePprof(t *testing.T) {
+	var out bytes.Buffer
+	if err := profileSum(t).WritePprof(&out); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := protoFields(t, data)
+
+	strs := []string{}
+	for _, s := range profile[6] {
+		strs = append(strs, string(s))
+	}
+	if strs[0] != "" {
+		t.Errorf("expected the string table to start with an empty string, got %q", strs)
+	}
+	for _, s := range []string{"instructions", "count", "time", "nanoseconds", "main", "sum", "testdata/sum.eudasm"} {
+		if !strings.Contains(strings.Join(strs, "\n")+"\n", "\n"+s+"\n") {
+			t.Errorf("expected %q in the string table %q", s, strs)
+		}
+	}
+
+	// every instruction executed once, with the stack it was executed in
+	instructions := uint64(0)
+	for _, sample := range profile[2] {
+		values := protoFields(t, sample)[2][0]
+		count, _ := binary.Uvarint(values)
+		instructions += count
+	}
+	if len(profile[2]) != 16 || instructions != 16 {
+		t.Errorf("expected 16 samples of 1 instruction, got %d samples of %d", len(profile[2]), instructions)
+	}
+	if len(profile[4]) != 16 || len(profile[5]) != 2 {
+		t.Errorf("expected 16 locations and 2 functions, got %d and %d", len(profile[4]), len(profile[5]))
+	}
+}
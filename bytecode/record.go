@@ -0,0 +1,208 @@
+package bytecode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// A Recording holds the results of the syscalls of a run which depend on the
+// world outside the program, such as input, the clock and random numbers,
+// so the run can be repeated exactly. A run records into a Recording given
+// as RunOptions.Record, and a run with it as RunOptions.Replay gets the
+// recorded results instead of asking the world again.
+//
+// Replaying checks that every recorded syscall is executed by the same
+// instruction after the same number of instructions, so a replay which
+// diverges from the recorded run fails at its next syscall with a
+// DivergenceError, or at the end in Verify.
+//
+// Recordings are stored in files starting with the magic bytes "EUDR" and
+// the format version as a little endian uint16, followed by uvarints and
+// strings as in bytecode files:
+//
+//	program    length and the program in the bytecode file format
+//	options    the maximum stack and heap size, the thread quantum and 1 if
+//	           garbage was collected, else 0
+//	syscalls   count, then step, pc, id and result of every recorded
+//	           syscall, the result is its type byte and bits
+//	outcome    instructions executed and the error the run ended with, ""
+//	           if it succeeded
+type Recording struct {
+	Program      Program
+	MaxStackSize uint
+	MaxHeapSize  uint
+	// threads are scheduled like in the recorded run only with the same
+	// quantum
+	ThreadQuantum uint
+	// allocations are freed like in the recorded run only with the same
+	// setting
+	GC       bool
+	Syscalls []SyscallEvent
+	// how the recorded run ended, set by Finish
+	Executed uint64
+	Error    string
+}
+
+type SyscallEvent struct {
+	// instructions executed before the syscall
+	Step   uint64
+	Pc     uintptr
+	ID     uint64
+	Result Slot
+}
+
+const RecordingVersion = 3
+
+var recordingMagic = []byte("EUDR")
+
+var ErrNotRecording = errors.New("not a recording")
+
+// The replayed run did something else than the recorded one.
+type DivergenceError struct {
+	Executed uint64
+	Pc       uintptr
+	Reason   string
+}
+
+func (e DivergenceError) Error() string {
+	return fmt.Sprintf("replay diverged at pc %d after %d instructions: %s", e.Pc, e.Executed, e.Reason)
+}
+
+// Returns an empty recording of a run of p with options.
+func NewRecording(p Program, options RunOptions) *Recording {
+	return &Recording{Program: p, MaxStackSize: options.MaxStackSize, MaxHeapSize: options.MaxHeapSize, ThreadQuantum: options.ThreadQuantum, GC: options.GC}
+}
+
+// Returns the options to replay the recording with.
+func (rec *Recording) RunOptions() RunOptions {
+	return RunOptions{MaxStackSize: rec.MaxStackSize, MaxHeapSize: rec.MaxHeapSize, ThreadQuantum: rec.ThreadQuantum, GC: rec.GC, Replay: rec}
+}
+
+// Records how the run r ended, err is the error it returned.
+func (rec *Recording) Finish(r *Runtime, err error) {
+	rec.Executed = r.Executed
+	rec.Error = ""
+	if err != nil {
+		rec.Error = err.Error()
+	}
+}
+
+// Checks that the replayed run r ended like the recorded one, err is the
+// error it returned. A DivergenceError of the run is returned as is.
+func (rec *Recording) Verify(r *Runtime, err error) error {
+	var diverged DivergenceError
+	if errors.As(err, &diverged) {
+		return err
+	}
+	if r.replayed < len(rec.Syscalls) {
+		next := rec.Syscalls[r.replayed]
+		return DivergenceError{Executed: r.Executed, Pc: r.Pc,
+			Reason: fmt.Sprintf("the program ended before syscall %d at pc %d after %d instructions", next.ID, next.Pc, next.Step)}
+	}
+	if r.Executed != rec.Executed {
+		return DivergenceError{Executed: r.Executed, Pc: r.Pc,
+			Reason: fmt.Sprintf("the recorded run ended after %d instructions", rec.Executed)}
+	}
+	message := ""
+	if err != nil {
+		message = err.Error()
+	}
+	if message != rec.Error {
+		return DivergenceError{Executed: r.Executed, Pc: r.Pc,
+			Reason: fmt.Sprintf("expected the error %q, got %q", rec.Error, message)}
+	}
+	return nil
+}
+
+// Returns the result of a syscall which depends on the world outside the
+// program. When replaying it is taken from the recording instead of calling
+// result, when recording it is added to the recording.
+func (ctx *Runtime) external(id uint64, result func() Slot) Slot {
+	if ctx.replay != nil {
+		if ctx.replayed >= len(ctx.replay.Syscalls) {
+			panic(DivergenceError{Executed: ctx.Executed, Pc: ctx.Pc,
+				Reason: fmt.Sprintf("syscall %d wasn't recorded, the recording has no more syscalls", id)})
+		}
+		event := ctx.replay.Syscalls[ctx.replayed]
+		if event.Step != ctx.Executed || event.Pc != ctx.Pc || event.ID != id {
+			panic(DivergenceError{Executed: ctx.Executed, Pc: ctx.Pc,
+				Reason: fmt.Sprintf("expected syscall %d at pc %d after %d instructions, got syscall %d", event.ID, event.Pc, event.Step, id)})
+		}
+		ctx.replayed++
+		return event.Result
+	}
+	s := result()
+	if ctx.record != nil {
+		ctx.record.Syscalls = append(ctx.record.Syscalls, SyscallEvent{Step: ctx.Executed, Pc: ctx.Pc, ID: id, Result: s})
+	}
+	return s
+}
+
+func (rec *Recording) Marshal() ([]byte, error) {
+	program, err := Marshal(rec.Program)
+	if err != nil {
+		return nil, err
+	}
+	out := encoder{}
+	out.Write(recordingMagic)
+	binary.Write(&out, binary.LittleEndian, uint16(RecordingVersion))
+	out.uint(uint64(len(program)))
+	out.Write(program)
+	out.uint(uint64(rec.MaxStackSize))
+	out.uint(uint64(rec.MaxHeapSize))
+	out.uint(uint64(rec.ThreadQuantum))
+	out.bool(rec.GC)
+	out.uint(uint64(len(rec.Syscalls)))
+	for _, event := range rec.Syscalls {
+		out.uint(event.Step)
+		out.uint(uint64(event.Pc))
+		out.uint(event.ID)
+		out.slot(event.Result)
+	}
+	out.uint(rec.Executed)
+	out.string(rec.Error)
+	return out.Bytes(), nil
+}
+
+func UnmarshalRecording(data []byte) (*Recording, error) {
+	if len(data) < len(recordingMagic)+2 || !bytes.Equal(data[:len(recordingMagic)], recordingMagic) {
+		return nil, ErrNotRecording
+	}
+	if version := binary.LittleEndian.Uint16(data[len(recordingMagic):]); version != RecordingVersion {
+		return nil, fmt.Errorf("recording has format version %d, expected %d", version, RecordingVersion)
+	}
+	in := decoder{data: data[len(recordingMagic)+2:]}
+	n := in.uint()
+	if in.err == nil && n > uint64(len(in.data)) {
+		in.fail(ErrTruncated)
+	}
+	if in.err != nil {
+		return nil, in.err
+	}
+	program, err := Unmarshal(in.data[:n])
+	if err != nil {
+		return nil, fmt.Errorf("recorded program: %w", err)
+	}
+	in.data = in.data[n:]
+
+	rec := &Recording{Program: program}
+	rec.MaxStackSize = uint(in.uint())
+	rec.MaxHeapSize = uint(in.uint())
+	rec.ThreadQuantum = uint(in.uint())
+	rec.GC = in.bool()
+	rec.Syscalls = make([]SyscallEvent, in.count())
+	for i := range rec.Syscalls {
+		rec.Syscalls[i] = SyscallEvent{Step: in.uint(), Pc: uintptr(in.uint()), ID: in.uint(), Result: in.slot()}
+	}
+	rec.Executed = in.uint()
+	rec.Error = in.string()
+	if in.err != nil {
+		return nil, in.err
+	}
+	if len(in.data) > 0 {
+		return nil, fmt.Errorf("%d trailing bytes after the end of the recording", len(in.data))
+	}
+	return rec, nil
+}
@@ -0,0 +1,116 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"errors"
+	"eud/bytecode"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// echoes a character of the input, then reads the clock and a random number
+const readingProgram = `
+	Push<usize> 1023
+	Syscall
+	Push<usize> 1022
+	Syscall
+	Push<usize> 1100
+	Syscall
+	Pop<i64>
+	Push<usize> 1110
+	Syscall
+	Pop<u64>
+`
+
+func record(t *testing.T, source string, input string) (*bytecode.Recording, string) {
+	program, err := bytecode.Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bytecode.Verify(program); err != nil {
+		t.Fatal(err)
+	}
+	rec := bytecode.NewRecording(program, bytecode.RunOptions{})
+	var out bytes.Buffer
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{Stdin: strings.NewReader(input), Stdout: &out, Record: rec})
+	_, err = runtime.RunUntil(func(*bytecode.Runtime) bool { return false })
+	rec.Finish(runtime, err)
+	return rec, out.String()
+}
+
+func replay(rec *bytecode.Recording, p bytecode.Program) (string, error) {
+	var out bytes.Buffer
+	options := rec.RunOptions()
+	// input is taken from the recording
+	options.Stdin = strings.NewReader("not read")
+	options.Stdout = &out
+	runtime := bytecode.NewRuntime(p, options)
+	_, err := runtime.RunUntil(func(*bytecode.Runtime) bool { return false })
+	return out.String(), rec.Verify(runtime, err)
+}
+
+func TestRecordReplay(t *testing.T) {
+	rec, output := record(t, readingProgram, "x")
+	if output != "x" {
+		t.Errorf("expected the input to be echoed, got %q", output)
+	}
+	if len(rec.Syscalls) != 3 || rec.Syscalls[0].Result != bytecode.IntSlot(bytecode.I32, 'x') || rec.Executed != 10 {
+		t.Fatalf("expected 3 recorded syscalls and 10 instructions, got %+v", rec)
+	}
+
+	data, err := rec.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := bytecode.UnmarshalRecording(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(decoded.Syscalls, rec.Syscalls) || decoded.Executed != rec.Executed || len(decoded.Program.Instructions) != 10 {
+		t.Errorf("expected\n%+v\ngot\n%+v", rec, decoded)
+	}
+
+	output, err = replay(decoded, decoded.Program)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if output != "x" {
+		t.Errorf("expected the recorded input to be echoed, got %q", output)
+	}
+
+	if _, err := bytecode.UnmarshalRecording(data[:len(data)-1]); err == nil {
+		t.Errorf("expected an error for a truncated recording")
+	}
+	if _, err := bytecode.UnmarshalRecording([]byte("EUDC")); err != bytecode.ErrNotRecording {
+		t.Errorf("expected ErrNotRecording, got %v", err)
+	}
+}
+
+func TestReplayDivergence(t *testing.T) {
+	rec, _ := record(t, readingProgram, "")
+	if rec.Syscalls[0].Result != bytecode.IntSlot(bytecode.I32, -1) {
+		t.Errorf("expected -1 at the end of the input, got %s", rec.Syscalls[0].Result)
+	}
+	cases := []struct {
+		name   string
+		source string
+		reason string
+	}{
+		{"moved syscall", "Push<i32> 0\nPop<i32>\n" + readingProgram, "expected syscall 1023 at pc 1 after 1 instructions"},
+		{"other syscall", strings.Replace(readingProgram, "1100", "1110", 1), "expected syscall 1100"},
+		{"missing syscall", strings.TrimSuffix(strings.TrimSpace(readingProgram), "Push<usize> 1110\n\tSyscall\n\tPop<u64>"), "the program ended before syscall 1110"},
+		{"longer run", readingProgram + "Push<i32> 0\n", "the recorded run ended after 10 instructions"},
+	}
+	for _, c := range cases {
+		program, err := bytecode.Assemble(c.source)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		_, err = replay(rec, program)
+		var diverged bytecode.DivergenceError
+		if !errors.As(err, &diverged) || !strings.Contains(diverged.Reason, c.reason) {
+			t.Errorf("%s: expected a divergence with %q, got %v", c.name, c.reason, err)
+		}
+	}
+}
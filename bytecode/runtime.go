@@ -1,9 +1,13 @@
 package bytecode
 
 import (
+	"bufio"
+	"context"
 	"fmt"
-	"math"
+	"io"
+	"math/rand"
 	"os"
+	"time"
 )
 
 type RuntimeValue interface {
@@ -56,20 +60,167 @@ func (v UptrValue) String() string  { return fmt.Sprintf("UPTR(%d)", v.Value) }
 type AllocationEntry struct {
 	From uintptr
 	To   uintptr
+	// the element type and the Allocate instruction
+	Type Type
+	Site uintptr
+}
+
+type Frame struct {
+	// first instruction of the called function
+	Function uintptr
+	// the Call instruction which created the frame
+	Call uintptr
+	// length of Locals at the call, the locals declared by the called
+	// function are dropped when it returns
+	LocalsBase int
 }
 
 type Runtime struct {
-	Stack   []RuntimeValue
-	Locals  []RuntimeValue
-	Globals map[uintptr]RuntimeValue
-	Pc      uintptr
-	Sp      uint
-	Heap    []RuntimeValue
-	Allocs  []AllocationEntry
-	Files   []os.File
-	Debug   bool
+	Stack    []Slot
+	Locals   []Slot
+	Frames   []Frame
+	Globals  map[uintptr]RuntimeValue
+	Pc       uintptr
+	Sp       uint
+	Heap     []Slot
+	Allocs   []AllocationEntry
+	Debug    bool
+	Executed uint64
+
+	maxStackSize uint
+	maxHeapSize  uint
+	code         []decodedInstruction
+	stdout       io.Writer
+	stdin        io.Reader
+	input        *bufio.Reader
+	random       *rand.Rand
+	program      Program
+	record       *Recording
+	replay       *Recording
+	// the syscalls of replay which were executed
+	replayed    int
+	programHash []byte
+	// collect garbage, see gc.go
+	gc      bool
+	gcStats GCStats
+	// the threads once one is spawned, see threads.go, the running one and
+	// the instructions left of its time slice
+	threads []thread
+	current int
+	quantum uint
+	slice   uint
+	yielded bool
+	// the character read in the background for a thread waiting for input,
+	// nil if no read is going on
+	incoming chan Slot
+}
+
+type RunOptions struct {
+	// zero means unlimited
+	InstructionLimit uint64
+	// sizes are counted in values for the stack and in bytes for the heap,
+	// zero means the default
+	InitialStackSize uint
+	MaxStackSize     uint
+	InitialHeapSize  uint
+	MaxHeapSize      uint
+	// where syscalls print to, nil means os.Stdout
+	Stdout io.Writer
+	// where syscalls read input from, nil means os.Stdin
+	Stdin io.Reader
+	// add the results of syscalls which depend on the world outside the
+	// program to Record, or take them from Replay
+	Record *Recording
+	Replay *Recording
+	// free allocations which are no longer reachable automatically, see
+	// Runtime.Collect
+	GC bool
+	// the instructions a thread runs before the next one is scheduled, zero
+	// means the default
+	ThreadQuantum uint
+}
+
+const (
+	defaultInitialStackSize = 256
+	defaultMaxStackSize     = 1 << 20
+	defaultInitialHeapSize  = 256
+	defaultMaxHeapSize      = 1 << 26
+)
+
+type StackOverflowError struct {
+	Depth    uint
+	Function string
+}
+
+func (e StackOverflowError) Error() string {
+	return fmt.Sprintf("stack overflow at depth %d in function %s", e.Depth, e.Function)
+}
+
+type HeapExhaustedError struct {
+	Requested uint64
+	Max       uint
+}
+
+func (e HeapExhaustedError) Error() string {
+	return fmt.Sprintf("heap exhausted: %d bytes needed but the maximum heap size is %d bytes", e.Requested, e.Max)
 }
 
+// An instruction accessed a heap address outside of the allocations.
+type SegmentationFaultError struct {
+	Addr uintptr
+}
+
+func (e SegmentationFaultError) Error() string {
+	return fmt.Sprintf("segmentation fault: heap address %d isn't allocated", e.Addr)
+}
+
+// An integer Divide or Modulus by zero.
+type DivisionByZeroError struct {
+	Type Type
+}
+
+func (e DivisionByZeroError) Error() string {
+	return fmt.Sprintf("integer division by zero of %s values", e.Type)
+}
+
+// An instruction popped more values than the stack holds.
+type StackUnderflowError struct{}
+
+func (e StackUnderflowError) Error() string {
+	return "stack underflow"
+}
+
+type UnknownSyscallError struct {
+	ID uint64
+}
+
+func (e UnknownSyscallError) Error() string {
+	return fmt.Sprintf("no syscall with id %d", e.ID)
+}
+
+type InstructionLimitError struct {
+	Limit    uint64
+	Executed uint64
+}
+
+func (e InstructionLimitError) Error() string {
+	return fmt.Sprintf("instruction limit of %d reached after %d instructions", e.Limit, e.Executed)
+}
+
+type CancelledError struct {
+	Executed uint64
+	Err      error
+}
+
+func (e CancelledError) Error() string {
+	return fmt.Sprintf("execution cancelled after %d instructions: %s", e.Executed, e.Err)
+}
+
+func (e CancelledError) Unwrap() error { return e.Err }
+
+// how many instructions to run between checks for cancellation
+const cancellationCheckInterval = 1024
+
 func (r *Runtime) String() string {
 	stack_string := "["
 	first := true
@@ -85,77 +236,263 @@ func (r *Runtime) String() string {
 }
 
 func (ctx *Runtime) Push(v RuntimeValue) {
+	ctx.push(SlotOf(v))
+}
+
+func (ctx *Runtime) Pop() RuntimeValue {
+	return ctx.pop().Value()
+}
+
+func (ctx *Runtime) push(s Slot) {
 	if ctx.Sp >= uint(len(ctx.Stack)) {
-		panic("stack overflow")
+		ctx.growStack()
 	}
-	ctx.Stack[ctx.Sp] = v
+	ctx.Stack[ctx.Sp] = s
 	ctx.Sp++
 }
 
-func (ctx *Runtime) Pop() RuntimeValue {
+func (ctx *Runtime) pop() Slot {
 	if ctx.Sp <= 0 {
-		panic("stack underflow")
+		panic(StackUnderflowError{})
 	}
 	ctx.Sp--
 	return ctx.Stack[ctx.Sp]
 }
 
+func (ctx *Runtime) growStack() {
+	size := uint(len(ctx.Stack))
+	if size >= ctx.maxStackSize {
+		// the function name is filled in by recoverRuntimeError, where the
+		// program counter is known
+		panic(StackOverflowError{Depth: ctx.Sp})
+	}
+	size = growSize(size, size+1, ctx.maxStackSize)
+	stack := make([]Slot, size)
+	copy(stack, ctx.Stack)
+	ctx.Stack = stack
+}
+
+func (ctx *Runtime) growHeap(needed uint64) {
+	if needed > uint64(ctx.maxHeapSize) {
+		panic(HeapExhaustedError{Requested: needed, Max: ctx.maxHeapSize})
+	}
+	heap := make([]Slot, growSize(uint(len(ctx.Heap)), uint(needed), ctx.maxHeapSize))
+	copy(heap, ctx.Heap)
+	ctx.Heap = heap
+}
+
+func growSize(current uint, needed uint, max uint) uint {
+	size := current
+	if size == 0 {
+		size = 1
+	}
+	for size < needed {
+		size *= 2
+	}
+	return capSize(size, max)
+}
+
+func capSize(size uint, max uint) uint {
+	if size > max {
+		return max
+	}
+	return size
+}
+
+func orDefault(value uint, fallback uint) uint {
+	if value == 0 {
+		return fallback
+	}
+	return value
+}
+
 func Run(p Program) Runtime {
-	ctx := Runtime{
-		Stack:   make([]RuntimeValue, 8192),
-		Locals:  []RuntimeValue{},
-		Globals: make(map[uintptr]RuntimeValue),
-		Pc:      0,
-		Sp:      0,
-		Heap:    make([]RuntimeValue, 8192),
-		Allocs:  []AllocationEntry{},
-		Files:   []os.File{},
-		Debug:   p.RunWithDebug || false,
+	ctx, _ := RunWithContext(context.Background(), p, RunOptions{})
+	return ctx
+}
+
+func RunWithContext(c context.Context, p Program, options RunOptions) (Runtime, error) {
+	ctx := newRuntime(p, options)
+	err := Resume(c, &ctx, options)
+	return ctx, err
+}
+
+// Returns a runtime stopped before the first instruction of p, which runs p
+// with Step and RunUntil.
+func NewRuntime(p Program, options RunOptions) *Runtime {
+	ctx := newRuntime(p, options)
+	return &ctx
+}
+
+func newRuntime(p Program, options RunOptions) Runtime {
+	maxStackSize := orDefault(options.MaxStackSize, defaultMaxStackSize)
+	maxHeapSize := orDefault(options.MaxHeapSize, defaultMaxHeapSize)
+	return Runtime{
+		Stack:        make([]Slot, capSize(orDefault(options.InitialStackSize, defaultInitialStackSize), maxStackSize)),
+		Locals:       []Slot{},
+		Frames:       []Frame{},
+		Globals:      make(map[uintptr]RuntimeValue),
+		Pc:           0,
+		Sp:           0,
+		Heap:         make([]Slot, capSize(orDefault(options.InitialHeapSize, defaultInitialHeapSize), maxHeapSize)),
+		Allocs:       []AllocationEntry{},
+		Debug:        p.RunWithDebug || false,
+		maxStackSize: maxStackSize,
+		maxHeapSize:  maxHeapSize,
+		stdout:       options.Stdout,
+		stdin:        options.Stdin,
+		program:      p,
+		record:       options.Record,
+		replay:       options.Replay,
+		gc:           options.GC,
+		quantum:      orDefault(options.ThreadQuantum, defaultThreadQuantum),
 	}
-	for ctx.Pc < uintptr(len(p.Instructions)) {
+}
+
+// Continues execution of ctx, which may have been stopped by an
+// InstructionLimitError or a CancelledError, with a fresh limit. ctx runs
+// the program it was created for.
+func Resume(c context.Context, ctx *Runtime, options RunOptions) (err error) {
+	defer ctx.recoverRuntimeError(&err)
+	code := ctx.decoded()
+	done := c.Done()
+	var executed uint64 = 0
+	for ctx.Pc < uintptr(len(code)) {
+		if options.InstructionLimit != 0 && executed >= options.InstructionLimit {
+			return InstructionLimitError{Limit: options.InstructionLimit, Executed: ctx.Executed}
+		}
+		if done != nil && executed%cancellationCheckInterval == 0 {
+			select {
+			case <-done:
+				return CancelledError{Executed: ctx.Executed, Err: c.Err()}
+			default:
+			}
+		}
 		if ctx.Debug {
-			fmt.Printf("  %s\t%s\n", p.Instructions[ctx.Pc].String(), ctx.String())
+			fmt.Printf("  %s\t%s\n", ctx.program.Instructions[ctx.Pc].String(), ctx.String())
 		}
-		runInstruction(&ctx, p.Instructions[ctx.Pc])
+		execute(ctx, &code[ctx.Pc])
 		ctx.Pc++
+		ctx.Executed++
+		executed++
+		if ctx.threads != nil {
+			ctx.schedule()
+		}
 	}
-	return ctx
+	return nil
+}
+
+// Executes the instruction at Pc. done reports if the program has ended,
+// either before or by this instruction.
+func (ctx *Runtime) Step() (done bool, err error) {
+	if ctx.Done() {
+		return true, nil
+	}
+	if err := ctx.step(); err != nil {
+		return ctx.Done(), err
+	}
+	return ctx.Done(), nil
+}
+
+// Executes instructions until predicate reports true before an instruction,
+// the program ends or an instruction fails.
+func (ctx *Runtime) RunUntil(predicate func(*Runtime) bool) (done bool, err error) {
+	for !ctx.Done() && !predicate(ctx) {
+		if _, err := ctx.Step(); err != nil {
+			return ctx.Done(), err
+		}
+	}
+	return ctx.Done(), nil
+}
+
+// Executes the single instruction at ctx.Pc.
+func (ctx *Runtime) step() (err error) {
+	defer ctx.recoverRuntimeError(&err)
+	code := ctx.decoded()
+	if ctx.Debug {
+		fmt.Printf("  %s\t%s\n", ctx.program.Instructions[ctx.Pc].String(), ctx.String())
+	}
+	execute(ctx, &code[ctx.Pc])
+	ctx.Pc++
+	ctx.Executed++
+	if ctx.threads != nil {
+		ctx.schedule()
+	}
+	return nil
 }
 
-func runInstruction(ctx *Runtime, i Instruction) {
-	switch i.InstructionType() {
+// Returns the program decoded, which is done once, before its first
+// instruction runs.
+func (ctx *Runtime) decoded() []decodedInstruction {
+	if ctx.code == nil {
+		ctx.code = decode(ctx.program.Instructions)
+	}
+	return ctx.code
+}
+
+// Turns the panics of instructions which are errors of the program into err.
+func (ctx *Runtime) recoverRuntimeError(err *error) {
+	if r := recover(); r != nil {
+		switch e := r.(type) {
+		case StackOverflowError:
+			e.Function = ctx.program.FunctionAt(ctx.Pc)
+			*err = e
+		case HeapExhaustedError:
+			*err = e
+		case SegmentationFaultError:
+			*err = e
+		case DivisionByZeroError:
+			*err = e
+		case StackUnderflowError:
+			*err = e
+		case UnknownSyscallError:
+			*err = e
+		case DivergenceError:
+			*err = e
+		case DeadlockError:
+			*err = e
+		case InvalidThreadError:
+			*err = e
+		default:
+			panic(r)
+		}
+	}
+}
+
+func execute(ctx *Runtime, i *decodedInstruction) {
+	switch i.code {
 	case AllocateInstruction:
-		runAllocate(ctx, i.(Allocate))
+		runAllocate(ctx, i)
 	case DeallocateInstruction:
-		runDeallocate(ctx, i.(Deallocate))
+		runDeallocate(ctx, i)
 	case StoreInstruction:
-		runStore(ctx, i.(Store))
+		runStore(ctx, i)
 	case LoadInstruction:
-		runLoad(ctx, i.(Load))
+		runLoad(ctx, i)
 	case DeclareLocalInstruction:
-		runDeclareLocal(ctx, i.(DeclareLocal))
+		runDeclareLocal(ctx, i)
 	case UndeclareLocalInstruction:
-		runUndeclareLocal(ctx, i.(UndeclareLocal))
+		runUndeclareLocal(ctx, i)
 	case StoreLocalInstruction:
-		runStoreLocal(ctx, i.(StoreLocal))
+		runStoreLocal(ctx, i)
 	case LoadLocalInstruction:
-		runLoadLocal(ctx, i.(LoadLocal))
+		runLoadLocal(ctx, i)
 	case PushInstruction:
-		runPush(ctx, i.(Push))
+		runPush(ctx, i)
 	case PopInstruction:
-		runPop(ctx, i.(Pop))
+		runPop(ctx, i)
 	case JumpInstruction:
-		runJump(ctx, i.(Jump))
+		runJump(ctx, i)
 	case JumpIfZeroInstruction:
-		runJumpIfZero(ctx, i.(JumpIfZero))
+		runJumpIfZero(ctx, i)
 	case JumpNotZeroInstruction:
-		runJumpNotZero(ctx, i.(JumpNotZero))
+		runJumpNotZero(ctx, i)
 	case CallInstruction:
-		runCall(ctx, i.(Call))
+		runCall(ctx, i)
 	case ReturnInstruction:
-		runReturn(ctx, i.(Return))
+		runReturn(ctx, i)
 	case NotInstruction:
-		runNot(ctx, i.(Not))
+		runNot(ctx, i)
 	case AddInstruction:
 		runAdd(ctx, i)
 	case SubtractInstruction:
@@ -193,28 +530,49 @@ func runInstruction(ctx *Runtime, i Instruction) {
 	case XnorInstruction:
 		runXnor(ctx, i)
 	case SyscallInstruction:
-		runSyscall(ctx, i.(Syscall))
+		runSyscall(ctx, i)
 	case ConvertInstruction:
-		runConvert(ctx, i.(Convert))
+		runConvert(ctx, i)
+	case JumpToInstruction:
+		runJumpTo(ctx, i)
+	case JumpIfZeroToInstruction:
+		runJumpIfZeroTo(ctx, i)
+	case JumpIfNotInstruction:
+		runJumpIfNot(ctx, i)
+	case StoreLocalKeepInstruction:
+		runStoreLocalKeep(ctx, i)
+	case IncrementLocalInstruction:
+		runIncrementLocal(ctx, i)
 	default:
-		panic(fmt.Sprintf("instruction '%s' not implemented", i.InstructionType()))
+		panic(fmt.Sprintf("instruction '%s' not implemented", i.code))
 	}
 }
 
-func runAllocate(ctx *Runtime, i Allocate) {
-	amount := ctx.Pop().(UsizeValue).Value
-	size := amount * byteSizeOfType(i.Type)
+func runAllocate(ctx *Runtime, i *decodedInstruction) {
+	amount := ctx.pop().Bits
+	size := amount * byteSizeOfType(i.typ)
 	var addr uintptr
-	if len(ctx.Allocs) > 0 {
+	at := len(ctx.Allocs)
+	if ctx.gc {
+		addr, at = ctx.place(size)
+	} else if len(ctx.Allocs) > 0 {
 		addr = ctx.Allocs[len(ctx.Allocs)-1].To + 1
 	} else {
 		addr = 0
 	}
-	ctx.Allocs = append(ctx.Allocs, AllocationEntry{
+	if uint64(addr)+size >= uint64(len(ctx.Heap)) {
+		ctx.growHeap(uint64(addr) + size + 1)
+	}
+	// allocations stay ordered by address
+	ctx.Allocs = append(ctx.Allocs, AllocationEntry{})
+	copy(ctx.Allocs[at+1:], ctx.Allocs[at:])
+	ctx.Allocs[at] = AllocationEntry{
 		From: addr,
 		To:   addr + uintptr(size),
-	})
-	ctx.Push(UptrValue{Value: addr})
+		Type: i.typ,
+		Site: ctx.Pc,
+	}
+	ctx.push(Slot{Bits: uint64(addr), Tag: UPTR})
 }
 
 func byteSizeOfType(t Type) uint64 {
@@ -251,1009 +609,328 @@ func byteSizeOfType(t Type) uint64 {
 	}
 }
 
-func runDeallocate(ctx *Runtime, i Deallocate) {
-	addr := ctx.Pop().(UptrValue).Value
+func runDeallocate(ctx *Runtime, i *decodedInstruction) {
+	addr := uintptr(ctx.pop().Bits)
 	for i := range ctx.Allocs {
-		if ctx.Allocs[i].From >= addr && ctx.Allocs[i].To <= addr {
+		if addr >= ctx.Allocs[i].From && addr <= ctx.Allocs[i].To {
 			ctx.Allocs = append(ctx.Allocs[:i], ctx.Allocs[i+1:]...)
 			break
 		}
 	}
 }
 
-func runStore(ctx *Runtime, i Store) {
-	addr := ctx.Pop().(UptrValue).Value
-	allocated := false
+func checkAllocated(ctx *Runtime, addr uintptr) {
 	for i := range ctx.Allocs {
 		if addr >= ctx.Allocs[i].From && addr <= ctx.Allocs[i].To {
-			allocated = true
-			break
+			return
 		}
 	}
-	if !allocated {
-		print("Segmentation fault")
-		os.Exit(1)
-	}
-	ctx.Heap[addr] = ctx.Pop()
+	panic(SegmentationFaultError{Addr: addr})
 }
-func runLoad(ctx *Runtime, i Load) {
-	addr := ctx.Pop().(UptrValue).Value
-	allocated := false
-	for i := range ctx.Allocs {
-		if addr >= ctx.Allocs[i].From && addr <= ctx.Allocs[i].To {
-			allocated = true
-			break
-		}
-	}
-	if !allocated {
-		print("Segmentation fault")
-		os.Exit(1)
-	}
-	ctx.Push(ctx.Heap[addr])
+
+func runStore(ctx *Runtime, i *decodedInstruction) {
+	addr := uintptr(ctx.pop().Bits)
+	checkAllocated(ctx, addr)
+	ctx.Heap[addr] = ctx.pop()
 }
 
-func runDeclareLocal(ctx *Runtime, i DeclareLocal) {
-	switch i.Type {
-	case U8:
-		ctx.Locals = append(ctx.Locals, U8Value{})
-	case U16:
-		ctx.Locals = append(ctx.Locals, U16Value{})
-	case U32:
-		ctx.Locals = append(ctx.Locals, U32Value{})
-	case U64:
-		ctx.Locals = append(ctx.Locals, U64Value{})
-	case I8:
-		ctx.Locals = append(ctx.Locals, I8Value{})
-	case I16:
-		ctx.Locals = append(ctx.Locals, I16Value{})
-	case I32:
-		ctx.Locals = append(ctx.Locals, I32Value{})
-	case I64:
-		ctx.Locals = append(ctx.Locals, I64Value{})
-	case CHAR:
-		ctx.Locals = append(ctx.Locals, CharValue{})
-	case USIZE:
-		ctx.Locals = append(ctx.Locals, UsizeValue{})
-	case UPTR:
-		ctx.Locals = append(ctx.Locals, UptrValue{})
-	}
+func runLoad(ctx *Runtime, i *decodedInstruction) {
+	addr := uintptr(ctx.pop().Bits)
+	checkAllocated(ctx, addr)
+	ctx.push(ctx.Heap[addr])
 }
 
-func runUndeclareLocal(ctx *Runtime, i UndeclareLocal) {
-	ctx.Locals = ctx.Locals[:len(ctx.Locals)-2]
+func runDeclareLocal(ctx *Runtime, i *decodedInstruction) {
+	ctx.Locals = append(ctx.Locals, Slot{Tag: i.typ})
 }
 
-func runStoreLocal(ctx *Runtime, i StoreLocal) {
-	ctx.Locals[len(ctx.Locals)-int(i.Offset)-1] = ctx.Pop()
+func runUndeclareLocal(ctx *Runtime, i *decodedInstruction) {
+	ctx.Locals = ctx.Locals[:len(ctx.Locals)-1]
 }
 
-func runLoadLocal(ctx *Runtime, i LoadLocal) {
-	ctx.Push(ctx.Locals[len(ctx.Locals)-int(i.Offset)-1])
+func runStoreLocal(ctx *Runtime, i *decodedInstruction) {
+	ctx.Locals[len(ctx.Locals)-i.operand-1] = ctx.pop()
 }
 
-func runJump(ctx *Runtime, i Jump) {
-	ctx.Pc = ctx.Pop().(UptrValue).Value - 1 // compensate for iterating ctx.Pc++
+func runLoadLocal(ctx *Runtime, i *decodedInstruction) {
+	ctx.push(ctx.Locals[len(ctx.Locals)-i.operand-1])
 }
 
-func getIntValue(v RuntimeValue) int {
-	switch v.Type() {
-	case U8:
-		return int(v.(U8Value).Value)
-	case U16:
-		return int(v.(U16Value).Value)
-	case U32:
-		return int(v.(U32Value).Value)
-	case U64:
-		return int(v.(U64Value).Value)
-	case I8:
-		return int(v.(I8Value).Value)
-	case I16:
-		return int(v.(I16Value).Value)
-	case I32:
-		return int(v.(I32Value).Value)
-	case I64:
-		return int(v.(I64Value).Value)
-	case CHAR:
-		return int(v.(CharValue).Value)
-	case USIZE:
-		return int(v.(UsizeValue).Value)
-	case UPTR:
-		return int(v.(UptrValue).Value)
-	}
-	panic("unreachable")
+func runJump(ctx *Runtime, i *decodedInstruction) {
+	ctx.Pc = uintptr(ctx.pop().Bits) - 1 // compensate for iterating ctx.Pc++
 }
 
-func runJumpIfZero(ctx *Runtime, i JumpIfZero) {
-	addr := ctx.Pop().(UptrValue).Value
-	condition := getIntValue(ctx.Pop())
-	if condition == 0 {
+func runJumpIfZero(ctx *Runtime, i *decodedInstruction) {
+	addr := uintptr(ctx.pop().Bits)
+	if ctx.pop().Bits == 0 {
 		ctx.Pc = addr - 1 // compensate for iterating ctx.Pc++
 	}
 }
 
-func runJumpNotZero(ctx *Runtime, i JumpNotZero) {
-	addr := ctx.Pop().(UptrValue).Value
-	condition := getIntValue(ctx.Pop())
-	if condition != 0 {
+func runJumpNotZero(ctx *Runtime, i *decodedInstruction) {
+	addr := uintptr(ctx.pop().Bits)
+	if ctx.pop().Bits != 0 {
 		ctx.Pc = addr - 1 // compensate for iterating ctx.Pc++
 	}
 }
 
-func runCall(ctx *Runtime, i Call) {
-	addr := ctx.Pop().(UptrValue).Value
-	argc := ctx.Pop().(UsizeValue).Value
-	argv := []RuntimeValue{}
-	for i := 0; i < int(argc); i++ {
-		argv = append(argv, ctx.Pop())
-	}
-	ctx.Push(UptrValue{Value: ctx.Pc + 1})
-	for i := range argv {
-		ctx.Push(argv[i])
+func runCall(ctx *Runtime, i *decodedInstruction) {
+	addr := uintptr(ctx.pop().Bits)
+	argc := uint(ctx.pop().Bits)
+	// the return address goes below the arguments
+	ctx.push(Slot{})
+	args := ctx.Stack[ctx.Sp-argc-1 : ctx.Sp]
+	copy(args[1:], args[:argc])
+	// arguments are passed in reverse order
+	for i, j := 1, int(argc); i < j; i, j = i+1, j-1 {
+		args[i], args[j] = args[j], args[i]
 	}
+	args[0] = Slot{Bits: uint64(ctx.Pc + 1), Tag: UPTR}
+	ctx.Frames = append(ctx.Frames, Frame{Function: addr, Call: ctx.Pc, LocalsBase: len(ctx.Locals)})
 	ctx.Pc = addr - 1
 }
 
-func runReturn(ctx *Runtime, i Return) {
-	value := ctx.Pop()
-	addr := ctx.Pop().(UptrValue).Value
-	ctx.Push(value)
+func runReturn(ctx *Runtime, i *decodedInstruction) {
+	value := ctx.pop()
+	addr := uintptr(ctx.pop().Bits)
+	ctx.push(value)
+	if len(ctx.Frames) > 0 {
+		frame := ctx.Frames[len(ctx.Frames)-1]
+		ctx.Locals = ctx.Locals[:frame.LocalsBase]
+		ctx.Frames = ctx.Frames[:len(ctx.Frames)-1]
+	}
 	ctx.Pc = addr - 1
 }
 
-func runPush(ctx *Runtime, i Push) {
-	switch i.Type {
-	case U8:
-		ctx.Push(U8Value{Value: uint8(i.Value)})
-	case U16:
-		ctx.Push(U16Value{Value: uint16(i.Value)})
-	case U32:
-		ctx.Push(U32Value{Value: uint32(i.Value)})
-	case U64:
-		ctx.Push(U64Value{Value: uint64(i.Value)})
-	case I8:
-		ctx.Push(I8Value{Value: int8(i.Value)})
-	case I16:
-		ctx.Push(I16Value{Value: int16(i.Value)})
-	case I32:
-		ctx.Push(I32Value{Value: int32(i.Value)})
-	case I64:
-		ctx.Push(I64Value{Value: int64(i.Value)})
-	case F32:
-		ctx.Push(F32Value{Value: float32(i.Value)})
-	case F64:
-		ctx.Push(F64Value{Value: float64(i.Value)})
-	case CHAR:
-		ctx.Push(CharValue{Value: int8(i.Value)})
-	case USIZE:
-		ctx.Push(UsizeValue{Value: uint64(i.Value)})
-	case UPTR:
-		ctx.Push(UptrValue{Value: uintptr(i.Value)})
-	default:
-		panic(fmt.Sprintf("Push<%s> not implemented", i.Type))
-	}
+func runPush(ctx *Runtime, i *decodedInstruction) {
+	ctx.push(IntSlot(i.typ, int64(i.operand)))
 }
 
-func runPop(ctx *Runtime, i Pop) {
-	ctx.Pop()
+func runPop(ctx *Runtime, i *decodedInstruction) {
+	ctx.pop()
 }
 
-func runNot(ctx *Runtime, i Not) {
-	a := ctx.Pop()
-	switch i.Type {
-	case U8:
-		ctx.Push(U8Value{Value: ^a.(U8Value).Value})
-	case U16:
-		ctx.Push(U16Value{Value: ^a.(U16Value).Value})
-	case U32:
-		ctx.Push(U32Value{Value: ^a.(U32Value).Value})
-	case U64:
-		ctx.Push(U64Value{Value: ^a.(U64Value).Value})
-	case I8:
-		ctx.Push(I8Value{Value: ^a.(I8Value).Value})
-	case I16:
-		ctx.Push(I16Value{Value: ^a.(I16Value).Value})
-	case I32:
-		ctx.Push(I32Value{Value: ^a.(I32Value).Value})
-	case I64:
-		ctx.Push(I64Value{Value: ^a.(I64Value).Value})
-	case CHAR:
-		ctx.Push(CharValue{Value: ^a.(CharValue).Value})
-	case USIZE:
-		ctx.Push(UsizeValue{Value: ^a.(UsizeValue).Value})
-	case UPTR:
-		ctx.Push(UptrValue{Value: ^a.(UptrValue).Value})
-	}
+func runNot(ctx *Runtime, i *decodedInstruction) {
+	a := ctx.pop()
+	ctx.push(Slot{Bits: normalize(i.typ, ^a.Bits), Tag: i.typ})
 }
 
-func runAdd(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Add).Type,
-		func(a, b uint8) uint8 { return a + b },
-		func(a, b uint16) uint16 { return a + b },
-		func(a, b uint32) uint32 { return a + b },
-		func(a, b uint64) uint64 { return a + b },
-		func(a, b int8) int8 { return a + b },
-		func(a, b int16) int16 { return a + b },
-		func(a, b int32) int32 { return a + b },
-		func(a, b int64) int64 { return a + b },
-		func(a, b int8) int8 { return a + b },
-		func(a, b uint64) uint64 { return a + b },
-		func(a, b uintptr) uintptr { return a + b },
-	)
-}
-
-func runSubtract(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Subtract).Type,
-		func(a, b uint8) uint8 { return a - b },
-		func(a, b uint16) uint16 { return a - b },
-		func(a, b uint32) uint32 { return a - b },
-		func(a, b uint64) uint64 { return a - b },
-		func(a, b int8) int8 { return a - b },
-		func(a, b int16) int16 { return a - b },
-		func(a, b int32) int32 { return a - b },
-		func(a, b int64) int64 { return a - b },
-		func(a, b int8) int8 { return a - b },
-		func(a, b uint64) uint64 { return a - b },
-		func(a, b uintptr) uintptr { return a - b },
-	)
-}
-
-func runMultiply(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Multiply).Type,
-		func(a, b uint8) uint8 { return a * b },
-		func(a, b uint16) uint16 { return a * b },
-		func(a, b uint32) uint32 { return a * b },
-		func(a, b uint64) uint64 { return a * b },
-		func(a, b int8) int8 { return a * b },
-		func(a, b int16) int16 { return a * b },
-		func(a, b int32) int32 { return a * b },
-		func(a, b int64) int64 { return a * b },
-		func(a, b int8) int8 { return a * b },
-		func(a, b uint64) uint64 { return a * b },
-		func(a, b uintptr) uintptr { return a * b },
-	)
-}
-
-func runDivide(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Divide).Type,
-		func(a, b uint8) uint8 { return a / b },
-		func(a, b uint16) uint16 { return a / b },
-		func(a, b uint32) uint32 { return a / b },
-		func(a, b uint64) uint64 { return a / b },
-		func(a, b int8) int8 { return a / b },
-		func(a, b int16) int16 { return a / b },
-		func(a, b int32) int32 { return a / b },
-		func(a, b int64) int64 { return a / b },
-		func(a, b int8) int8 { return a / b },
-		func(a, b uint64) uint64 { return a / b },
-		func(a, b uintptr) uintptr { return a / b },
-	)
-}
-
-func runModulus(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Modulus).Type,
-		func(a, b uint8) uint8 { return a % b },
-		func(a, b uint16) uint16 { return a % b },
-		func(a, b uint32) uint32 { return a % b },
-		func(a, b uint64) uint64 { return a % b },
-		func(a, b int8) int8 { return a % b },
-		func(a, b int16) int16 { return a % b },
-		func(a, b int32) int32 { return a % b },
-		func(a, b int64) int64 { return a % b },
-		func(a, b int8) int8 { return a % b },
-		func(a, b uint64) uint64 { return a % b },
-		func(a, b uintptr) uintptr { return a % b },
-	)
-}
-
-func runExponent(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Exponent).Type,
-		func(a, b uint8) uint8 { return uint8(math.Pow(float64(a), float64(b))) },
-		func(a, b uint16) uint16 { return uint16(math.Pow(float64(a), float64(b))) },
-		func(a, b uint32) uint32 { return uint32(math.Pow(float64(a), float64(b))) },
-		func(a, b uint64) uint64 { return uint64(math.Pow(float64(a), float64(b))) },
-		func(a, b int8) int8 { return int8(math.Pow(float64(a), float64(b))) },
-		func(a, b int16) int16 { return int16(math.Pow(float64(a), float64(b))) },
-		func(a, b int32) int32 { return int32(math.Pow(float64(a), float64(b))) },
-		func(a, b int64) int64 { return int64(math.Pow(float64(a), float64(b))) },
-		func(a, b int8) int8 { return int8(math.Pow(float64(a), float64(b))) },
-		func(a, b uint64) uint64 { return uint64(math.Pow(float64(a), float64(b))) },
-		func(a, b uintptr) uintptr { return uintptr(math.Pow(float64(a), float64(b))) },
-	)
-}
-
-func runCmpEqual(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(CmpEqual).Type,
-		func(a, b uint8) uint8 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint16) uint16 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint32) uint32 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int16) int16 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int32) int32 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int64) int64 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uintptr) uintptr {
-			if a == b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-	)
-}
-
-func runCmpInequal(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(CmpInequal).Type,
-		func(a, b uint8) uint8 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint16) uint16 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint32) uint32 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int16) int16 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int32) int32 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int64) int64 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uintptr) uintptr {
-			if a != b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-	)
-}
-
-func runCmpLT(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(CmpLT).Type,
-		func(a, b uint8) uint8 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint16) uint16 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint32) uint32 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int16) int16 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int32) int32 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int64) int64 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uintptr) uintptr {
-			if a < b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-	)
-}
-
-func runCmpGT(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(CmpGT).Type,
-		func(a, b uint8) uint8 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint16) uint16 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint32) uint32 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int16) int16 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int32) int32 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int64) int64 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uintptr) uintptr {
-			if a > b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-	)
-}
-
-func runCmpLTE(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(CmpLTE).Type,
-		func(a, b uint8) uint8 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint16) uint16 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint32) uint32 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int16) int16 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int32) int32 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int64) int64 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uintptr) uintptr {
-			if a <= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-	)
-}
-
-func runCmpGTE(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(CmpGTE).Type,
-		func(a, b uint8) uint8 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint16) uint16 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint32) uint32 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int16) int16 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int32) int32 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int64) int64 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b int8) int8 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uint64) uint64 {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-		func(a, b uintptr) uintptr {
-			if a >= b {
-				return 1
-			} else {
-				return 0
-			}
-		},
-	)
-}
-
-func runOr(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Or).Type,
-		func(a, b uint8) uint8 { return a | b },
-		func(a, b uint16) uint16 { return a | b },
-		func(a, b uint32) uint32 { return a | b },
-		func(a, b uint64) uint64 { return a | b },
-		func(a, b int8) int8 { return a | b },
-		func(a, b int16) int16 { return a | b },
-		func(a, b int32) int32 { return a | b },
-		func(a, b int64) int64 { return a | b },
-		func(a, b int8) int8 { return a | b },
-		func(a, b uint64) uint64 { return a | b },
-		func(a, b uintptr) uintptr { return a | b },
-	)
-}
-
-func runAnd(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(And).Type,
-		func(a, b uint8) uint8 { return a & b },
-		func(a, b uint16) uint16 { return a & b },
-		func(a, b uint32) uint32 { return a & b },
-		func(a, b uint64) uint64 { return a & b },
-		func(a, b int8) int8 { return a & b },
-		func(a, b int16) int16 { return a & b },
-		func(a, b int32) int32 { return a & b },
-		func(a, b int64) int64 { return a & b },
-		func(a, b int8) int8 { return a & b },
-		func(a, b uint64) uint64 { return a & b },
-		func(a, b uintptr) uintptr { return a & b },
-	)
-}
-
-func runXor(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Xor).Type,
-		func(a, b uint8) uint8 { return a ^ b },
-		func(a, b uint16) uint16 { return a ^ b },
-		func(a, b uint32) uint32 { return a ^ b },
-		func(a, b uint64) uint64 { return a ^ b },
-		func(a, b int8) int8 { return a ^ b },
-		func(a, b int16) int16 { return a ^ b },
-		func(a, b int32) int32 { return a ^ b },
-		func(a, b int64) int64 { return a ^ b },
-		func(a, b int8) int8 { return a ^ b },
-		func(a, b uint64) uint64 { return a ^ b },
-		func(a, b uintptr) uintptr { return a ^ b },
-	)
-}
-
-func runNor(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Nor).Type,
-		func(a, b uint8) uint8 { return ^(a | b) },
-		func(a, b uint16) uint16 { return ^(a | b) },
-		func(a, b uint32) uint32 { return ^(a | b) },
-		func(a, b uint64) uint64 { return ^(a | b) },
-		func(a, b int8) int8 { return ^(a | b) },
-		func(a, b int16) int16 { return ^(a | b) },
-		func(a, b int32) int32 { return ^(a | b) },
-		func(a, b int64) int64 { return ^(a | b) },
-		func(a, b int8) int8 { return ^(a | b) },
-		func(a, b uint64) uint64 { return ^(a | b) },
-		func(a, b uintptr) uintptr { return ^(a | b) },
-	)
-}
-
-func runNand(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Nand).Type,
-		func(a, b uint8) uint8 { return ^(a & b) },
-		func(a, b uint16) uint16 { return ^(a & b) },
-		func(a, b uint32) uint32 { return ^(a & b) },
-		func(a, b uint64) uint64 { return ^(a & b) },
-		func(a, b int8) int8 { return ^(a & b) },
-		func(a, b int16) int16 { return ^(a & b) },
-		func(a, b int32) int32 { return ^(a & b) },
-		func(a, b int64) int64 { return ^(a & b) },
-		func(a, b int8) int8 { return ^(a & b) },
-		func(a, b uint64) uint64 { return ^(a & b) },
-		func(a, b uintptr) uintptr { return ^(a & b) },
-	)
-}
-
-func runXnor(ctx *Runtime, i Instruction) {
-	runBinaryOperationInstruction(
-		ctx, i.(Xnor).Type,
-		func(a, b uint8) uint8 { return ^(a ^ b) },
-		func(a, b uint16) uint16 { return ^(a ^ b) },
-		func(a, b uint32) uint32 { return ^(a ^ b) },
-		func(a, b uint64) uint64 { return ^(a ^ b) },
-		func(a, b int8) int8 { return ^(a ^ b) },
-		func(a, b int16) int16 { return ^(a ^ b) },
-		func(a, b int32) int32 { return ^(a ^ b) },
-		func(a, b int64) int64 { return ^(a ^ b) },
-		func(a, b int8) int8 { return ^(a ^ b) },
-		func(a, b uint64) uint64 { return ^(a ^ b) },
-		func(a, b uintptr) uintptr { return ^(a ^ b) },
-	)
-}
-
-func runBinaryOperationInstruction(
-	ctx *Runtime,
-	t Type,
-	u8Op func(uint8, uint8) uint8,
-	u16Op func(uint16, uint16) uint16,
-	u32Op func(uint32, uint32) uint32,
-	u64Op func(uint64, uint64) uint64,
-	i8Op func(int8, int8) int8,
-	i16Op func(int16, int16) int16,
-	i32Op func(int32, int32) int32,
-	i64Op func(int64, int64) int64,
-	charOp func(int8, int8) int8,
-	usizeOp func(uint64, uint64) uint64,
-	uptrOp func(uintptr, uintptr) uintptr,
-) {
-	switch t {
-	case U8:
-		b := ctx.Pop().(U8Value).Value
-		a := ctx.Pop().(U8Value).Value
-		ctx.Push(U8Value{Value: u8Op(a, b)})
-	case U16:
-		b := ctx.Pop().(U16Value).Value
-		a := ctx.Pop().(U16Value).Value
-		ctx.Push(U16Value{Value: u16Op(a, b)})
-	case U32:
-		b := ctx.Pop().(U32Value).Value
-		a := ctx.Pop().(U32Value).Value
-		ctx.Push(U32Value{Value: u32Op(a, b)})
-	case U64:
-		b := ctx.Pop().(U64Value).Value
-		a := ctx.Pop().(U64Value).Value
-		ctx.Push(U64Value{Value: u64Op(a, b)})
-	case I8:
-		b := ctx.Pop().(I8Value).Value
-		a := ctx.Pop().(I8Value).Value
-		ctx.Push(I8Value{Value: i8Op(a, b)})
-		return
-	case I16:
-		b := ctx.Pop().(I16Value).Value
-		a := ctx.Pop().(I16Value).Value
-		ctx.Push(I16Value{Value: i16Op(a, b)})
-	case I32:
-		b := ctx.Pop().(I32Value).Value
-		a := ctx.Pop().(I32Value).Value
-		ctx.Push(I32Value{Value: i32Op(a, b)})
-	case I64:
-		b := ctx.Pop().(I64Value).Value
-		a := ctx.Pop().(I64Value).Value
-		ctx.Push(I64Value{Value: i64Op(a, b)})
-	case CHAR:
-		b := ctx.Pop().(CharValue).Value
-		a := ctx.Pop().(CharValue).Value
-		ctx.Push(CharValue{Value: charOp(a, b)})
-	case USIZE:
-		b := ctx.Pop().(UsizeValue).Value
-		a := ctx.Pop().(UsizeValue).Value
-		ctx.Push(UsizeValue{Value: usizeOp(a, b)})
-	case UPTR:
-		b := ctx.Pop().(UptrValue).Value
-		a := ctx.Pop().(UptrValue).Value
-		ctx.Push(UptrValue{Value: uptrOp(a, b)})
+func runAdd(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(addSlots(i.typ, a, b))
+}
+
+func runSubtract(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(subtractSlots(i.typ, a, b))
+}
+
+func runMultiply(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(multiplySlots(i.typ, a, b))
+}
+
+func runDivide(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	checkDivisor(i.typ, b)
+	ctx.push(divideSlots(i.typ, a, b))
+}
+
+func runModulus(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	checkDivisor(i.typ, b)
+	ctx.push(modulusSlots(i.typ, a, b))
+}
+
+// Floats divide by zero to infinity or NaN, integers can't.
+func checkDivisor(t Type, b Slot) {
+	if !isFloat(t) && b.Bits == 0 {
+		panic(DivisionByZeroError{Type: t})
 	}
 }
 
-func runSyscall(ctx *Runtime, i Syscall) {
-	id := ctx.Pop().(UsizeValue).Value
+func runExponent(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(exponentSlots(i.typ, a, b))
+}
+
+func runCmpEqual(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(cmpEqualSlots(i.typ, a, b))
+}
+
+func runCmpInequal(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(cmpInequalSlots(i.typ, a, b))
+}
+
+func runCmpLT(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(cmpLTSlots(i.typ, a, b))
+}
+
+func runCmpGT(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(cmpGTSlots(i.typ, a, b))
+}
+
+func runCmpLTE(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(cmpLTESlots(i.typ, a, b))
+}
+
+func runCmpGTE(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(cmpGTESlots(i.typ, a, b))
+}
+
+func runOr(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(orSlots(i.typ, a, b))
+}
+
+func runAnd(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(andSlots(i.typ, a, b))
+}
+
+func runXor(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(xorSlots(i.typ, a, b))
+}
+
+func runNor(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(norSlots(i.typ, a, b))
+}
+
+func runNand(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(nandSlots(i.typ, a, b))
+}
+
+func runXnor(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	ctx.push(xnorSlots(i.typ, a, b))
+}
+
+func runSyscall(ctx *Runtime, i *decodedInstruction) {
+	id := ctx.pop().Bits
 	switch id {
 	case 1000:
-		ctx.Push(UptrValue{Value: ctx.Pc})
+		ctx.push(Slot{Bits: uint64(ctx.Pc), Tag: UPTR})
 	case 1012:
-		fmt.Printf("%d", ctx.Pop().(I32Value).Value)
+		fmt.Fprintf(ctx.output(), "%d", int32(ctx.pop().Bits))
 	case 1022:
-		fmt.Printf("%c", rune(ctx.Pop().(I32Value).Value))
+		fmt.Fprintf(ctx.output(), "%c", rune(int32(ctx.pop().Bits)))
+	case 1023:
+		if ctx.threads != nil {
+			ctx.readInput()
+		} else {
+			ctx.push(ctx.external(id, ctx.readChar))
+		}
+	case 1100:
+		ctx.push(ctx.external(id, func() Slot {
+			return Slot{Bits: uint64(time.Now().UnixNano()), Tag: I64}
+		}))
+	case 1110:
+		ctx.push(ctx.external(id, func() Slot {
+			if ctx.random == nil {
+				ctx.random = rand.New(rand.NewSource(time.Now().UnixNano()))
+			}
+			return Slot{Bits: ctx.random.Uint64(), Tag: U64}
+		}))
+	case 1200:
+		ctx.push(ctx.spawn())
+	case 1201:
+		ctx.join()
+	case 1202:
+		ctx.yield()
 	default:
-		panic(fmt.Sprintf("no syscall with id %d", id))
+		panic(UnknownSyscallError{ID: id})
 	}
 }
 
-func runConvert(ctx *Runtime, i Convert) {
-	switch i.Src {
-	case I32:
-		switch i.Dst {
-		case USIZE:
-			ctx.Push(UsizeValue{Value: uint64(ctx.Pop().(I32Value).Value)})
-			return
+// Reads a character of the input as an i32, -1 at the end of the input.
+func (ctx *Runtime) readChar() Slot {
+	return readChar(ctx.inputReader())
+}
+
+func (ctx *Runtime) inputReader() *bufio.Reader {
+	if ctx.input == nil {
+		if ctx.stdin == nil {
+			ctx.input = bufio.NewReader(os.Stdin)
+		} else {
+			ctx.input = bufio.NewReader(ctx.stdin)
 		}
 	}
-	panic(fmt.Sprintf("conversion from %s to %s not implemented", i.Src, i.Dst))
+	return ctx.input
+}
+
+func readChar(input *bufio.Reader) Slot {
+	c, _, err := input.ReadRune()
+	if err != nil {
+		return IntSlot(I32, -1)
+	}
+	return IntSlot(I32, int64(c))
+}
+
+func (ctx *Runtime) output() io.Writer {
+	if ctx.stdout == nil {
+		return os.Stdout
+	}
+	return ctx.stdout
+}
+
+func runConvert(ctx *Runtime, i *decodedInstruction) {
+	ctx.push(convertSlot(ctx.pop(), i.src, i.typ))
+}
+
+func runJumpTo(ctx *Runtime, i *decodedInstruction) {
+	ctx.Pc = uintptr(i.operand) - 1 // compensate for iterating ctx.Pc++
+}
+
+func runJumpIfZeroTo(ctx *Runtime, i *decodedInstruction) {
+	if ctx.pop().Bits == 0 {
+		ctx.Pc = uintptr(i.operand) - 1 // compensate for iterating ctx.Pc++
+	}
+}
+
+func runJumpIfNot(ctx *Runtime, i *decodedInstruction) {
+	b := ctx.pop()
+	a := ctx.pop()
+	if !comparisonHolds(i.cmp, compareSlots(i.typ, a, b)) {
+		ctx.Pc = uintptr(i.operand) - 1 // compensate for iterating ctx.Pc++
+	}
+}
 
+func runStoreLocalKeep(ctx *Runtime, i *decodedInstruction) {
+	ctx.Locals[len(ctx.Locals)-i.operand-1] = ctx.Stack[ctx.Sp-1]
+}
+
+func runIncrementLocal(ctx *Runtime, i *decodedInstruction) {
+	index := len(ctx.Locals) - i.operand - 1
+	if isFloat(i.typ) {
+		ctx.Locals[index] = floatSlot(i.typ, ctx.Locals[index].float(i.typ)+float64(i.value))
+		return
+	}
+	ctx.Locals[index] = Slot{Bits: normalize(i.typ, ctx.Locals[index].Bits+uint64(i.value)), Tag: i.typ}
 }
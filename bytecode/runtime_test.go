@@ -1,6 +1,8 @@
 package bytecode_test
 
 import (
+	"context"
+	"errors"
 	"eud/bytecode"
 	"testing"
 )
@@ -51,19 +53,25 @@ func TestSubroutine(t *testing.T) {
 			Push uptr sum
 			Call
 	*/
-	runtime := bytecode.Run(bytecode.Program{
-		Instructions: []bytecode.Instruction{
-			bytecode.Push{Type: bytecode.UPTR, Value: 4}, // 4 = start
-			bytecode.Jump{},
-			bytecode.Add{Type: bytecode.I32},
-			bytecode.Return{Type: bytecode.I32},
-			bytecode.Push{Type: bytecode.I32, Value: 5},
-			bytecode.Push{Type: bytecode.I32, Value: 3},
-			bytecode.Push{Type: bytecode.USIZE, Value: 2},
-			bytecode.Push{Type: bytecode.UPTR, Value: 2}, // 2 = sum
-			bytecode.Call{},
-		},
-		RunWithDebug: true})
+	b := bytecode.NewBuilder()
+	start := b.NewLabel()
+	b.PushAddress(start)
+	b.Emit(bytecode.Jump{})
+	sum := b.Here()
+	b.Emit(bytecode.Add{Type: bytecode.I32})
+	b.Emit(bytecode.Return{Type: bytecode.I32})
+	b.Label(start)
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 5})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 3})
+	b.Emit(bytecode.Push{Type: bytecode.USIZE, Value: 2})
+	b.PushAddress(sum)
+	b.Emit(bytecode.Call{})
+	program, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	program.RunWithDebug = true
+	runtime := bytecode.Run(program)
 	result := runtime.Pop().(bytecode.I32Value).Value
 	if result != 8 {
 		t.Errorf("unexpected result %d", result)
@@ -114,43 +122,49 @@ func TestJumpFunction(t *testing.T) {
 			StoreLocal i32 2
 			LoadLocal i32 2
 	*/
-	runtime := bytecode.Run(bytecode.Program{
-		Instructions: []bytecode.Instruction{
-			bytecode.Push{Type: bytecode.UPTR, Value: 16}, // 16 = start
-			bytecode.Jump{},
-			bytecode.DeclareLocal{Type: bytecode.UPTR}, // 3
-			bytecode.DeclareLocal{Type: bytecode.I32},  // 4
-			bytecode.DeclareLocal{Type: bytecode.I32},  // 5
-			bytecode.DeclareLocal{Type: bytecode.I32},  // 6
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 1},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 2},
-			bytecode.StoreLocal{Type: bytecode.UPTR, Offset: 3},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 2},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 1},
-			bytecode.Add{Type: bytecode.I32},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
-			bytecode.LoadLocal{Type: bytecode.UPTR, Offset: 3},
-			bytecode.Jump{},
-			bytecode.DeclareLocal{Type: bytecode.I32}, // 0
-			bytecode.DeclareLocal{Type: bytecode.I32}, // 1
-			bytecode.DeclareLocal{Type: bytecode.I32}, // 2
-			bytecode.Push{Type: bytecode.I32, Value: 5},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 2},
-			bytecode.Push{Type: bytecode.I32, Value: 3},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 1},
-			bytecode.Push{Type: bytecode.USIZE, Value: 1000}, // program_counter
-			bytecode.Syscall{},
-			bytecode.Push{Type: bytecode.UPTR, Value: 7},
-			bytecode.Add{Type: bytecode.UPTR},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 1},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 2},
-			bytecode.Push{Type: bytecode.UPTR, Value: 2}, // 2 = sum
-			bytecode.Jump{},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
-		},
-	})
+	b := bytecode.NewBuilder()
+	start := b.NewLabel()
+	b.PushAddress(start)
+	b.Emit(bytecode.Jump{})
+	sum := b.Here()
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.UPTR}) // 3
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})  // 4
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})  // 5
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})  // 6
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 2})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.UPTR, Offset: 3})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 2})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Add{Type: bytecode.I32})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.UPTR, Offset: 3})
+	b.Emit(bytecode.Jump{})
+	b.Label(start)
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32}) // 0
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32}) // 1
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32}) // 2
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 5})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 2})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 3})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Push{Type: bytecode.USIZE, Value: 1000}) // program_counter
+	b.Emit(bytecode.Syscall{})
+	// the return address is relative to the program counter pushed above
+	b.Emit(bytecode.Push{Type: bytecode.UPTR, Value: 7})
+	b.Emit(bytecode.Add{Type: bytecode.UPTR})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 2})
+	b.PushAddress(sum)
+	b.Emit(bytecode.Jump{})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	program, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := bytecode.Run(program)
 	result := runtime.Pop().(bytecode.I32Value).Value
 	if result != 8 {
 		t.Errorf("unexpected result %d", result)
@@ -182,23 +196,29 @@ func TestJump(t *testing.T) {
 		.end:
 			LoadLocal 1
 	*/
-	runtime := bytecode.Run(bytecode.Program{
-		Instructions: []bytecode.Instruction{
-			bytecode.DeclareLocal{Type: bytecode.I32},
-			bytecode.Push{Type: bytecode.I32, Value: 0},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
-			bytecode.Push{Type: bytecode.UPTR, Value: 10},
-			bytecode.JumpIfZero{},
-			bytecode.Push{Type: bytecode.I32, Value: 4},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
-			bytecode.Push{Type: bytecode.UPTR, Value: 12},
-			bytecode.Jump{},
-			bytecode.Push{Type: bytecode.I32, Value: 5},
-			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
-			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
-		},
-	})
+	b := bytecode.NewBuilder()
+	falsy := b.NewLabel()
+	end := b.NewLabel()
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 0})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	b.PushAddress(falsy)
+	b.Emit(bytecode.JumpIfZero{})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 4})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 0})
+	b.PushAddress(end)
+	b.Emit(bytecode.Jump{})
+	b.Label(falsy)
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 5})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 0})
+	b.Label(end)
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	program, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	runtime := bytecode.Run(program)
 	result := runtime.Pop().(bytecode.I32Value).Value
 	if result != 5 {
 		t.Errorf("unexpected result %d", result)
@@ -227,6 +247,24 @@ func TestLocals(t *testing.T) {
 	}
 }
 
+func TestUndeclareLocal(t *testing.T) {
+	runtime := bytecode.Run(bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.DeclareLocal{Type: bytecode.I32},
+			bytecode.Push{Type: bytecode.I32, Value: 7},
+			bytecode.StoreLocal{Type: bytecode.I32, Offset: 0},
+			bytecode.DeclareLocal{Type: bytecode.I32},
+			bytecode.UndeclareLocal{Type: bytecode.I32},
+			bytecode.LoadLocal{Type: bytecode.I32, Offset: 0},
+		},
+	})
+	// only the local declared last is dropped
+	result := runtime.Pop().(bytecode.I32Value).Value
+	if len(runtime.Locals) != 1 || result != 7 {
+		t.Errorf("expected 1 local holding 7, got %d locals and %d", len(runtime.Locals), result)
+	}
+}
+
 func TestMath1(t *testing.T) {
 	runtime := bytecode.Run(bytecode.Program{
 		Instructions: []bytecode.Instruction{
@@ -258,3 +296,434 @@ func TestMath2(t *testing.T) {
 		t.Errorf("(3 * 4) + 5 != %d", result)
 	}
 }
+
+func TestInstructionLimit(t *testing.T) {
+	// while (1) {}
+	program := bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.Push{Type: bytecode.UPTR, Value: 0},
+			bytecode.Jump{},
+		},
+	}
+	runtime, err := bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{InstructionLimit: 100})
+	var limitErr bytecode.InstructionLimitError
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected instruction limit error, got %v", err)
+	}
+	if limitErr.Executed != 100 || runtime.Executed != 100 {
+		t.Errorf("unexpected instruction count %d", limitErr.Executed)
+	}
+	err = bytecode.Resume(context.Background(), &runtime, bytecode.RunOptions{InstructionLimit: 50})
+	if !errors.As(err, &limitErr) {
+		t.Fatalf("expected instruction limit error, got %v", err)
+	}
+	if limitErr.Executed != 150 {
+		t.Errorf("unexpected instruction count %d", limitErr.Executed)
+	}
+}
+
+func TestResumeToCompletion(t *testing.T) {
+	program := bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.Push{Type: bytecode.I32, Value: 5},
+			bytecode.Push{Type: bytecode.I32, Value: 4},
+			bytecode.Multiply{Type: bytecode.I32},
+			bytecode.Push{Type: bytecode.I32, Value: 3},
+			bytecode.Add{Type: bytecode.I32},
+		},
+	}
+	runtime, err := bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{InstructionLimit: 3})
+	if err == nil {
+		t.Fatal("expected instruction limit error")
+	}
+	if err := bytecode.Resume(context.Background(), &runtime, bytecode.RunOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	result := runtime.Pop().(bytecode.I32Value).Value
+	if result != 3+4*5 {
+		t.Errorf("3 + 4 * 5 != %d", result)
+	}
+}
+
+func TestCancellation(t *testing.T) {
+	c, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := bytecode.RunWithContext(c, bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.Push{Type: bytecode.UPTR, Value: 0},
+			bytecode.Jump{},
+		},
+	}, bytecode.RunOptions{})
+	var cancelledErr bytecode.CancelledError
+	if !errors.As(err, &cancelledErr) || !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected cancellation error, got %v", err)
+	}
+}
+
+func TestStackGrowth(t *testing.T) {
+	instructions := []bytecode.Instruction{}
+	for i := 0; i < 10000; i++ {
+		instructions = append(instructions, bytecode.Push{Type: bytecode.I32, Value: i})
+	}
+	runtime, err := bytecode.RunWithContext(context.Background(), bytecode.Program{
+		Instructions: instructions,
+	}, bytecode.RunOptions{InitialStackSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.Sp != 10000 {
+		t.Errorf("unexpected stack pointer %d", runtime.Sp)
+	}
+	result := runtime.Pop().(bytecode.I32Value).Value
+	if result != 9999 {
+		t.Errorf("unexpected result %d", result)
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	/*
+		func f(): i32
+			return f()
+		end
+		f()
+	*/
+	b := bytecode.NewBuilder()
+	start := b.NewLabel()
+	b.PushAddress(start)
+	b.Emit(bytecode.Jump{})
+	f := b.Here()
+	b.Emit(bytecode.Push{Type: bytecode.USIZE, Value: 0})
+	b.PushAddress(f)
+	b.Emit(bytecode.Call{})
+	b.Label(start)
+	b.Function("f", f, start)
+	b.Emit(bytecode.Push{Type: bytecode.USIZE, Value: 0})
+	b.PushAddress(f)
+	b.Emit(bytecode.Call{})
+	_, err := bytecode.RunWithContext(context.Background(), finish(b), bytecode.RunOptions{InitialStackSize: 8, MaxStackSize: 64})
+	var overflowErr bytecode.StackOverflowError
+	if !errors.As(err, &overflowErr) {
+		t.Fatalf("expected stack overflow, got %v", err)
+	}
+	if err.Error() != "stack overflow at depth 64 in function f" {
+		t.Errorf("unexpected error %q", err)
+	}
+}
+
+func TestRuntimeErrors(t *testing.T) {
+	// unverified programs fail with an error instead of a panic
+	for _, c := range []struct {
+		source   string
+		expected error
+	}{
+		{"Push<i32> 1\nPush<i32> 0\nDivide<i32>", bytecode.DivisionByZeroError{Type: bytecode.I32}},
+		{"Push<u8> 1\nPush<u8> 0\nModulus<u8>", bytecode.DivisionByZeroError{Type: bytecode.U8}},
+		{"Pop<i32>", bytecode.StackUnderflowError{}},
+		{"Push<usize> 9999\nSyscall", bytecode.UnknownSyscallError{ID: 9999}},
+	} {
+		program, err := bytecode.Assemble(c.source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{}); err != c.expected {
+			t.Errorf("%q: expected %v, got %v", c.source, c.expected, err)
+		}
+	}
+	program, err := bytecode.Assemble("Push<f64> 1\nPush<f64> 0\nDivide<f64>")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{}); err != nil {
+		t.Errorf("expected a float division by zero to succeed, got %v", err)
+	}
+}
+
+func TestHeapGrowth(t *testing.T) {
+	program := bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.Push{Type: bytecode.USIZE, Value: 1000},
+			bytecode.Allocate{Type: bytecode.I32},
+			bytecode.Push{Type: bytecode.UPTR, Value: 31000},
+			bytecode.Add{Type: bytecode.UPTR},
+			bytecode.DeclareLocal{Type: bytecode.UPTR},
+			bytecode.StoreLocal{Type: bytecode.UPTR, Offset: 0},
+			bytecode.Push{Type: bytecode.I32, Value: 7},
+			bytecode.LoadLocal{Type: bytecode.UPTR, Offset: 0},
+			bytecode.Store{Type: bytecode.I32},
+			bytecode.LoadLocal{Type: bytecode.UPTR, Offset: 0},
+			bytecode.Load{Type: bytecode.I32},
+		},
+	}
+	runtime, err := bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{InitialHeapSize: 64})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := runtime.Pop().(bytecode.I32Value).Value
+	if result != 7 {
+		t.Errorf("unexpected result %d", result)
+	}
+	_, err = bytecode.RunWithContext(context.Background(), program, bytecode.RunOptions{MaxHeapSize: 1024})
+	var heapErr bytecode.HeapExhaustedError
+	if !errors.As(err, &heapErr) {
+		t.Fatalf("expected heap exhaustion, got %v", err)
+	}
+}
+
+func finish(b *bytecode.Builder) bytecode.Program {
+	program, err := b.Finish()
+	if err != nil {
+		panic(err)
+	}
+	return program
+}
+
+// examples/while.eud with the loop bound raised to iterations
+func whileProgram(iterations int) bytecode.Program {
+	b := bytecode.NewBuilder()
+	end := b.NewLabel()
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 0})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 2})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	condition := b.Here()
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: iterations})
+	b.Emit(bytecode.CmpLT{Type: bytecode.I32})
+	b.PushAddress(end)
+	b.Emit(bytecode.JumpIfZero{})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 2})
+	b.Emit(bytecode.Multiply{Type: bytecode.I32})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 1})
+	b.Emit(bytecode.Add{Type: bytecode.I32})
+	b.Emit(bytecode.StoreLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	b.PushAddress(condition)
+	b.Emit(bytecode.Jump{})
+	b.Label(end)
+	return finish(b)
+}
+
+func TestWhile(t *testing.T) {
+	runtime := bytecode.Run(whileProgram(8))
+	if a := runtime.Locals[0].Value().(bytecode.I32Value).Value; a != 8 {
+		t.Errorf("unexpected a %d", a)
+	}
+	if b := runtime.Locals[1].Value().(bytecode.I32Value).Value; b != 512 {
+		t.Errorf("unexpected b %d", b)
+	}
+}
+
+func BenchmarkWhile(b *testing.B) {
+	program := whileProgram(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bytecode.Run(program)
+	}
+}
+
+func TestTypedArithmetic(t *testing.T) {
+	runtime := bytecode.Run(bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.Push{Type: bytecode.U8, Value: 250},
+			bytecode.Push{Type: bytecode.U8, Value: 10},
+			bytecode.Add{Type: bytecode.U8},
+			bytecode.Push{Type: bytecode.I32, Value: -7},
+			bytecode.Push{Type: bytecode.I32, Value: 2},
+			bytecode.Divide{Type: bytecode.I32},
+			bytecode.Push{Type: bytecode.I32, Value: -1},
+			bytecode.Push{Type: bytecode.I32, Value: 1},
+			bytecode.CmpLT{Type: bytecode.I32},
+			bytecode.Push{Type: bytecode.I32, Value: 3},
+			bytecode.Convert{Dst: bytecode.USIZE, Src: bytecode.I32},
+		},
+	})
+	if result := runtime.Pop().(bytecode.UsizeValue).Value; result != 3 {
+		t.Errorf("unexpected conversion result %d", result)
+	}
+	if result := runtime.Pop().(bytecode.I32Value).Value; result != 1 {
+		t.Errorf("-1 < 1 != %d", result)
+	}
+	if result := runtime.Pop().(bytecode.I32Value).Value; result != -3 {
+		t.Errorf("-7 / 2 != %d", result)
+	}
+	if result := runtime.Pop().(bytecode.U8Value).Value; result != 4 {
+		t.Errorf("250 + 10 != %d in u8", result)
+	}
+}
+
+func BenchmarkWhileUndecoded(b *testing.B) {
+	program := whileProgram(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bytecode.RunUndecoded(program)
+	}
+}
+
+func TestSuperinstructions(t *testing.T) {
+	/*
+		let a: i32 = 0
+		let b: i32 = 0
+		while (a < 5) {
+			a = a + 1
+			b = b + a
+		}
+	*/
+	b := bytecode.NewBuilder()
+	end := b.NewLabel()
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})
+	condition := b.Here()
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 5})
+	b.JumpIfNot(bytecode.CmpLTInstruction, bytecode.I32, end)
+	b.Emit(bytecode.IncrementLocal{Type: bytecode.I32, Offset: 1, Value: 1})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Add{Type: bytecode.I32})
+	b.Emit(bytecode.StoreLocalKeep{Type: bytecode.I32, Offset: 0})
+	b.JumpTo(condition)
+	b.Label(end)
+	skip := b.NewLabel()
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 0})
+	b.JumpIfZeroTo(skip)
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 100})
+	b.Label(skip)
+	runtime := bytecode.Run(finish(b))
+	if a := runtime.Locals[0].Value().(bytecode.I32Value).Value; a != 5 {
+		t.Errorf("unexpected a %d", a)
+	}
+	if b := runtime.Locals[1].Value().(bytecode.I32Value).Value; b != 15 {
+		t.Errorf("unexpected b %d", b)
+	}
+	// every StoreLocalKeep leaves its value on the stack
+	if runtime.Sp != 5 {
+		t.Errorf("unexpected stack pointer %d", runtime.Sp)
+	}
+}
+
+// whileProgram using superinstructions, as the compiler emits it
+func whileProgramFused(iterations int) bytecode.Program {
+	b := bytecode.NewBuilder()
+	end := b.NewLabel()
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})
+	b.Emit(bytecode.DeclareLocal{Type: bytecode.I32})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 0})
+	b.Emit(bytecode.StoreLocalKeep{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 2})
+	b.Emit(bytecode.StoreLocalKeep{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	condition := b.Here()
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 1})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: iterations})
+	b.JumpIfNot(bytecode.CmpLTInstruction, bytecode.I32, end)
+	b.Emit(bytecode.LoadLocal{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.Push{Type: bytecode.I32, Value: 2})
+	b.Emit(bytecode.Multiply{Type: bytecode.I32})
+	b.Emit(bytecode.StoreLocalKeep{Type: bytecode.I32, Offset: 0})
+	b.Emit(bytecode.Pop{Type: bytecode.I32})
+	b.Emit(bytecode.IncrementLocal{Type: bytecode.I32, Offset: 1, Value: 1})
+	b.JumpTo(condition)
+	b.Label(end)
+	return finish(b)
+}
+
+func BenchmarkWhileFused(b *testing.B) {
+	program := whileProgramFused(10000)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		bytecode.Run(program)
+	}
+}
+
+func TestStep(t *testing.T) {
+	runtime := bytecode.NewRuntime(bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.Push{Type: bytecode.I32, Value: 5},
+			bytecode.Push{Type: bytecode.I32, Value: 4},
+			bytecode.Multiply{Type: bytecode.I32},
+		},
+	}, bytecode.RunOptions{})
+	for i := 0; i < 2; i++ {
+		if done, err := runtime.Step(); done || err != nil {
+			t.Fatalf("step %d: done %v, err %v", i, done, err)
+		}
+	}
+	if runtime.StackSize() != 2 || runtime.ProgramCounter() != 2 {
+		t.Fatalf("expected 2 values on the stack at pc 2, got %d at %d", runtime.StackSize(), runtime.ProgramCounter())
+	}
+	// 5 * 4 becomes 5 * 7
+	if err := runtime.SetStackValue(0, bytecode.I32Value{Value: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if done, err := runtime.Step(); !done || err != nil {
+		t.Fatalf("expected the program to end, done %v, err %v", done, err)
+	}
+	if v, err := runtime.Peek(0); err != nil || v != (bytecode.I32Value{Value: 35}) {
+		t.Errorf("expected 35, got %v, %v", v, err)
+	}
+	if done, err := runtime.Step(); !done || err != nil || runtime.InstructionCount() != 3 {
+		t.Errorf("expected steps after the end to do nothing")
+	}
+	if _, err := runtime.Peek(1); err == nil {
+		t.Errorf("expected an error for a value below the stack")
+	}
+}
+
+func TestRunUntil(t *testing.T) {
+	// x = 0; while (1) { x += 1 }
+	program := bytecode.Program{
+		Instructions: []bytecode.Instruction{
+			bytecode.DeclareLocal{Type: bytecode.I32},
+			bytecode.IncrementLocal{Type: bytecode.I32, Offset: 0, Value: 1},
+			bytecode.JumpTo{Target: 1},
+		},
+	}
+	// two runtimes interleaved by the host
+	a, b := bytecode.NewRuntime(program, bytecode.RunOptions{}), bytecode.NewRuntime(program, bytecode.RunOptions{})
+	for round := 0; round < 3; round++ {
+		for _, runtime := range []*bytecode.Runtime{a, b} {
+			target := runtime.InstructionCount() + 10
+			done, err := runtime.RunUntil(func(r *bytecode.Runtime) bool { return r.InstructionCount() >= target })
+			if done || err != nil {
+				t.Fatalf("done %v, err %v", done, err)
+			}
+		}
+	}
+	x, err := a.LocalValue(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if y, _ := b.LocalValue(0); x != y || x != (bytecode.I32Value{Value: 15}) {
+		t.Errorf("expected both runtimes to count to 15, got %v and %v", x, y)
+	}
+
+	if err := a.SetLocalValue(0, bytecode.I32Value{Value: 100}); err != nil {
+		t.Fatal(err)
+	}
+	a.RunUntil(func(r *bytecode.Runtime) bool {
+		x, _ := r.LocalValue(0)
+		return x == bytecode.I32Value{Value: 103}
+	})
+	if instruction, ok := a.CurrentInstruction(); !ok || instruction != (bytecode.JumpTo{Target: 1}) {
+		t.Errorf("expected to stop after the increment, got %v", instruction)
+	}
+	if err := a.SetProgramCounter(3); err != nil || !a.Done() {
+		t.Errorf("expected moving past the last instruction to end the program")
+	}
+	if err := a.SetProgramCounter(4); err == nil {
+		t.Errorf("expected an error for a program counter out of range")
+	}
+}
@@ -0,0 +1,330 @@
+package bytecode
+
+import (
+	"fmt"
+	"math"
+)
+
+// A Slot holds any runtime value unboxed. Integers are stored truncated to
+// the width of their type, signed integers sign extended, and floats as
+// their IEEE 754 bits. Instructions take the type from their operand, not
+// from the tag, but the garbage collector only follows slots tagged UPTR, so
+// every instruction producing a pointer has to tag it as one, or the
+// allocation it points to is freed while still in use.
+type Slot struct {
+	Bits uint64
+	Tag  Type
+}
+
+func (s Slot) String() string { return s.Value().String() }
+
+func (s Slot) Value() RuntimeValue {
+	switch s.Tag {
+	case U8:
+		return U8Value{Value: uint8(s.Bits)}
+	case U16:
+		return U16Value{Value: uint16(s.Bits)}
+	case U32:
+		return U32Value{Value: uint32(s.Bits)}
+	case U64:
+		return U64Value{Value: s.Bits}
+	case I8:
+		return I8Value{Value: int8(s.Bits)}
+	case I16:
+		return I16Value{Value: int16(s.Bits)}
+	case I32:
+		return I32Value{Value: int32(s.Bits)}
+	case I64:
+		return I64Value{Value: int64(s.Bits)}
+	case F32:
+		return F32Value{Value: math.Float32frombits(uint32(s.Bits))}
+	case F64:
+		return F64Value{Value: math.Float64frombits(s.Bits)}
+	case CHAR:
+		return CharValue{Value: int8(s.Bits)}
+	case USIZE:
+		return UsizeValue{Value: s.Bits}
+	case UPTR:
+		return UptrValue{Value: uintptr(s.Bits)}
+	default:
+		panic(fmt.Sprintf("slot with unknown tag %d", s.Tag))
+	}
+}
+
+func SlotOf(v RuntimeValue) Slot {
+	switch v := v.(type) {
+	case U8Value:
+		return Slot{Bits: uint64(v.Value), Tag: U8}
+	case U16Value:
+		return Slot{Bits: uint64(v.Value), Tag: U16}
+	case U32Value:
+		return Slot{Bits: uint64(v.Value), Tag: U32}
+	case U64Value:
+		return Slot{Bits: v.Value, Tag: U64}
+	case I8Value:
+		return Slot{Bits: uint64(int64(v.Value)), Tag: I8}
+	case I16Value:
+		return Slot{Bits: uint64(int64(v.Value)), Tag: I16}
+	case I32Value:
+		return Slot{Bits: uint64(int64(v.Value)), Tag: I32}
+	case I64Value:
+		return Slot{Bits: uint64(v.Value), Tag: I64}
+	case F32Value:
+		return Slot{Bits: uint64(math.Float32bits(v.Value)), Tag: F32}
+	case F64Value:
+		return Slot{Bits: math.Float64bits(v.Value), Tag: F64}
+	case CharValue:
+		return Slot{Bits: uint64(int64(v.Value)), Tag: CHAR}
+	case UsizeValue:
+		return Slot{Bits: v.Value, Tag: USIZE}
+	case UptrValue:
+		return Slot{Bits: uint64(v.Value), Tag: UPTR}
+	default:
+		panic(fmt.Sprintf("unknown runtime value %s", v))
+	}
+}
+
+func isSigned(t Type) bool {
+	switch t {
+	case I8, I16, I32, I64, CHAR:
+		return true
+	}
+	return false
+}
+
+func isFloat(t Type) bool {
+	return t == F32 || t == F64
+}
+
+// truncates and sign extends bits to the width of t
+func normalize(t Type, bits uint64) uint64 {
+	switch t {
+	case U8:
+		return uint64(uint8(bits))
+	case U16:
+		return uint64(uint16(bits))
+	case U32:
+		return uint64(uint32(bits))
+	case I8, CHAR:
+		return uint64(int64(int8(bits)))
+	case I16:
+		return uint64(int64(int16(bits)))
+	case I32:
+		return uint64(int64(int32(bits)))
+	case F32:
+		return uint64(uint32(bits))
+	default:
+		return bits
+	}
+}
+
+// Creates a slot of type t holding v, converted like Push<t> v would.
+func IntSlot(t Type, v int64) Slot {
+	switch t {
+	case F32:
+		return Slot{Bits: uint64(math.Float32bits(float32(v))), Tag: t}
+	case F64:
+		return Slot{Bits: math.Float64bits(float64(v)), Tag: t}
+	default:
+		return Slot{Bits: normalize(t, uint64(v)), Tag: t}
+	}
+}
+
+func floatSlot(t Type, v float64) Slot {
+	switch t {
+	case F32:
+		return Slot{Bits: uint64(math.Float32bits(float32(v))), Tag: t}
+	case F64:
+		return Slot{Bits: math.Float64bits(v), Tag: t}
+	case U8, U16, U32, U64, USIZE, UPTR:
+		return Slot{Bits: normalize(t, uint64(v)), Tag: t}
+	default:
+		return Slot{Bits: normalize(t, uint64(int64(v))), Tag: t}
+	}
+}
+
+func boolSlot(t Type, v bool) Slot {
+	if v {
+		return IntSlot(t, 1)
+	}
+	return IntSlot(t, 0)
+}
+
+func (s Slot) float(t Type) float64 {
+	switch t {
+	case F32:
+		return float64(math.Float32frombits(uint32(s.Bits)))
+	case F64:
+		return math.Float64frombits(s.Bits)
+	default:
+		if isSigned(t) {
+			return float64(int64(s.Bits))
+		}
+		return float64(s.Bits)
+	}
+}
+
+// converts a slot holding a value of type src into a slot of type dst
+func convertSlot(s Slot, src Type, dst Type) Slot {
+	if isFloat(src) {
+		return floatSlot(dst, s.float(src))
+	}
+	if isFloat(dst) {
+		return floatSlot(dst, s.float(src))
+	}
+	// integers are already sign extended, so truncating is enough
+	return Slot{Bits: normalize(dst, s.Bits), Tag: dst}
+}
+
+// Evaluates a binary instruction, such as AddInstruction or CmpLTInstruction,
+// on the values a and b of type t, the same way the runtime does.
+func EvalBinary(op InstructionType, t Type, a Slot, b Slot) Slot {
+	switch op {
+	case AddInstruction:
+		return addSlots(t, a, b)
+	case SubtractInstruction:
+		return subtractSlots(t, a, b)
+	case MultiplyInstruction:
+		return multiplySlots(t, a, b)
+	case DivideInstruction:
+		return divideSlots(t, a, b)
+	case ModulusInstruction:
+		return modulusSlots(t, a, b)
+	case ExponentInstruction:
+		return exponentSlots(t, a, b)
+	case CmpEqualInstruction, CmpInequalInstruction, CmpLTInstruction, CmpGTInstruction, CmpLTEInstruction, CmpGTEInstruction:
+		return boolSlot(t, comparisonHolds(op, compareSlots(t, a, b)))
+	case OrInstruction:
+		return orSlots(t, a, b)
+	case AndInstruction:
+		return andSlots(t, a, b)
+	case XorInstruction:
+		return xorSlots(t, a, b)
+	case NorInstruction:
+		return norSlots(t, a, b)
+	case NandInstruction:
+		return nandSlots(t, a, b)
+	case XnorInstruction:
+		return xnorSlots(t, a, b)
+	default:
+		panic(fmt.Sprintf("'%s' is not a binary operation", op))
+	}
+}
+
+// Integer addition, subtraction, multiplication and bitwise operations give
+// the same bits for signed and unsigned values in two's complement, so only
+// the result has to be normalized to the width of the type.
+
+func addSlots(t Type, a Slot, b Slot) Slot {
+	if isFloat(t) {
+		return floatSlot(t, a.float(t)+b.float(t))
+	}
+	return Slot{Bits: normalize(t, a.Bits+b.Bits), Tag: t}
+}
+
+func subtractSlots(t Type, a Slot, b Slot) Slot {
+	if isFloat(t) {
+		return floatSlot(t, a.float(t)-b.float(t))
+	}
+	return Slot{Bits: normalize(t, a.Bits-b.Bits), Tag: t}
+}
+
+func multiplySlots(t Type, a Slot, b Slot) Slot {
+	if isFloat(t) {
+		return floatSlot(t, a.float(t)*b.float(t))
+	}
+	return Slot{Bits: normalize(t, a.Bits*b.Bits), Tag: t}
+}
+
+func divideSlots(t Type, a Slot, b Slot) Slot {
+	switch {
+	case isFloat(t):
+		return floatSlot(t, a.float(t)/b.float(t))
+	case isSigned(t):
+		return IntSlot(t, int64(a.Bits)/int64(b.Bits))
+	default:
+		return Slot{Bits: normalize(t, a.Bits/b.Bits), Tag: t}
+	}
+}
+
+func modulusSlots(t Type, a Slot, b Slot) Slot {
+	switch {
+	case isFloat(t):
+		return floatSlot(t, math.Mod(a.float(t), b.float(t)))
+	case isSigned(t):
+		return IntSlot(t, int64(a.Bits)%int64(b.Bits))
+	default:
+		return Slot{Bits: normalize(t, a.Bits%b.Bits), Tag: t}
+	}
+}
+
+func exponentSlots(t Type, a Slot, b Slot) Slot {
+	return floatSlot(t, math.Pow(a.float(t), b.float(t)))
+}
+
+// compares a and b as values of type t, returning -1, 0 or 1
+func compareSlots(t Type, a Slot, b Slot) int {
+	switch {
+	case isFloat(t):
+		x, y := a.float(t), b.float(t)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	case isSigned(t):
+		x, y := int64(a.Bits), int64(b.Bits)
+		if x < y {
+			return -1
+		} else if x > y {
+			return 1
+		}
+		return 0
+	default:
+		if a.Bits < b.Bits {
+			return -1
+		} else if a.Bits > b.Bits {
+			return 1
+		}
+		return 0
+	}
+}
+
+func comparisonHolds(cmp InstructionType, order int) bool {
+	switch cmp {
+	case CmpEqualInstruction:
+		return order == 0
+	case CmpInequalInstruction:
+		return order != 0
+	case CmpLTInstruction:
+		return order < 0
+	case CmpGTInstruction:
+		return order > 0
+	case CmpLTEInstruction:
+		return order <= 0
+	case CmpGTEInstruction:
+		return order >= 0
+	default:
+		panic(fmt.Sprintf("'%s' is not a comparison", cmp))
+	}
+}
+
+func cmpEqualSlots(t Type, a Slot, b Slot) Slot   { return boolSlot(t, compareSlots(t, a, b) == 0) }
+func cmpInequalSlots(t Type, a Slot, b Slot) Slot { return boolSlot(t, compareSlots(t, a, b) != 0) }
+func cmpLTSlots(t Type, a Slot, b Slot) Slot      { return boolSlot(t, compareSlots(t, a, b) < 0) }
+func cmpGTSlots(t Type, a Slot, b Slot) Slot      { return boolSlot(t, compareSlots(t, a, b) > 0) }
+func cmpLTESlots(t Type, a Slot, b Slot) Slot     { return boolSlot(t, compareSlots(t, a, b) <= 0) }
+func cmpGTESlots(t Type, a Slot, b Slot) Slot     { return boolSlot(t, compareSlots(t, a, b) >= 0) }
+func orSlots(t Type, a Slot, b Slot) Slot         { return Slot{Bits: normalize(t, a.Bits|b.Bits), Tag: t} }
+func andSlots(t Type, a Slot, b Slot) Slot        { return Slot{Bits: normalize(t, a.Bits&b.Bits), Tag: t} }
+func xorSlots(t Type, a Slot, b Slot) Slot        { return Slot{Bits: normalize(t, a.Bits^b.Bits), Tag: t} }
+func norSlots(t Type, a Slot, b Slot) Slot {
+	return Slot{Bits: normalize(t, ^(a.Bits | b.Bits)), Tag: t}
+}
+func nandSlots(t Type, a Slot, b Slot) Slot {
+	return Slot{Bits: normalize(t, ^(a.Bits & b.Bits)), Tag: t}
+}
+func xnorSlots(t Type, a Slot, b Slot) Slot {
+	return Slot{Bits: normalize(t, ^(a.Bits ^ b.Bits)), Tag: t}
+}
@@ -0,0 +1,319 @@
+package bytecode
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Snapshots hold the state of a paused Runtime, so a run can be continued
+// later, by another process or on another machine, with the same program.
+//
+// A snapshot starts with the magic bytes "EUDS" and the format version as a
+// little endian uint16, followed by uvarints, varints and strings as in
+// bytecode files. Slots are their type byte and bits.
+//
+//	program     SHA-256 of the instructions, as a string
+//	counters    pc and the number of executed instructions
+//	limits      the maximum stack and heap size, and 1 if garbage is
+//	            collected, else 0
+//	stack       count, then the slots from the bottom
+//	locals      count, then the slots
+//	frames      count, then function, call and locals base of every frame
+//	heap        size, count of the stored slots, then the slots, slots past
+//	            the last non-zero one aren't stored
+//	allocations count, then from, to, element type byte and the pc of the
+//	            Allocate instruction of every allocation
+//	globals     count, then address and slot of every global
+//	threads     count, 0 before the first spawn, then the quantum, the
+//	            running thread and the rest of its time slice, and for
+//	            every thread the handle it waits for, if it returned, its
+//	            result, if it waits for input, if the input arrived and
+//	            the character, and unless it is the running one, whose
+//	            registers are above, its pc, stack, locals and frames
+//
+// The output and input of the runtime aren't part of a snapshot, they are
+// given when it is restored.
+
+const SnapshotVersion = 6
+
+var snapshotMagic = []byte("EUDS")
+
+var ErrNotSnapshot = errors.New("not a snapshot")
+
+// The snapshot was taken of a run of another program.
+var ErrSnapshotProgram = errors.New("snapshot was taken of a different program")
+
+// Returns the state of ctx between two instructions, to be restored with
+// RestoreRuntime.
+func (ctx *Runtime) Snapshot() ([]byte, error) {
+	hash, err := ctx.hash()
+	if err != nil {
+		return nil, err
+	}
+	out := encoder{}
+	out.Write(snapshotMagic)
+	binary.Write(&out, binary.LittleEndian, uint16(SnapshotVersion))
+	out.string(string(hash))
+	out.uint(uint64(ctx.Pc))
+	out.uint(ctx.Executed)
+	out.uint(uint64(ctx.maxStackSize))
+	out.uint(uint64(ctx.maxHeapSize))
+	out.bool(ctx.gc)
+
+	out.slots(ctx.Stack[:ctx.Sp])
+	out.slots(ctx.Locals)
+	out.frames(ctx.Frames)
+
+	used := len(ctx.Heap)
+	for used > 0 && ctx.Heap[used-1] == (Slot{}) {
+		used--
+	}
+	out.uint(uint64(len(ctx.Heap)))
+	out.slots(ctx.Heap[:used])
+	out.uint(uint64(len(ctx.Allocs)))
+	for _, alloc := range ctx.Allocs {
+		out.uint(uint64(alloc.From))
+		out.uint(uint64(alloc.To))
+		out.typ(alloc.Type)
+		out.uint(uint64(alloc.Site))
+	}
+
+	globals := make([]uintptr, 0, len(ctx.Globals))
+	for addr := range ctx.Globals {
+		globals = append(globals, addr)
+	}
+	sort.Slice(globals, func(i, j int) bool { return globals[i] < globals[j] })
+	out.uint(uint64(len(globals)))
+	for _, addr := range globals {
+		out.uint(uint64(addr))
+		out.slot(SlotOf(ctx.Globals[addr]))
+	}
+
+	out.uint(uint64(len(ctx.threads)))
+	if ctx.threads != nil {
+		out.uint(uint64(ctx.quantum))
+		out.uint(uint64(ctx.current))
+		out.uint(uint64(ctx.slice))
+	}
+	for i, t := range ctx.threads {
+		out.uint(uint64(t.joining))
+		out.bool(t.done)
+		out.slot(t.result)
+		out.bool(t.reading)
+		out.bool(t.arrived)
+		out.slot(t.char)
+		if i != ctx.current {
+			out.uint(uint64(t.pc))
+			out.slots(t.stack[:t.sp])
+			out.slots(t.locals)
+			out.frames(t.frames)
+		}
+	}
+	return out.Bytes(), nil
+}
+
+// Returns a runtime in the state of a snapshot of a run of p, which
+// continues the run with Resume, Step or RunUntil. The limits of the stack
+// and the heap, whether garbage is collected and the thread quantum are
+// those of the snapshot, the other options apply.
+func RestoreRuntime(p Program, data []byte, options RunOptions) (*Runtime, error) {
+	ctx := NewRuntime(p, options)
+	if err := ctx.restore(data); err != nil {
+		return nil, err
+	}
+	return ctx, nil
+}
+
+// Replaces the state of ctx by the one of a snapshot, ctx is left unchanged
+// if the snapshot is invalid.
+func (ctx *Runtime) restore(data []byte) error {
+	if len(data) < len(snapshotMagic)+2 || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return ErrNotSnapshot
+	}
+	if version := binary.LittleEndian.Uint16(data[len(snapshotMagic):]); version != SnapshotVersion {
+		return fmt.Errorf("snapshot has format version %d, expected %d", version, SnapshotVersion)
+	}
+	hash, err := ctx.hash()
+	if err != nil {
+		return err
+	}
+	in := decoder{data: data[len(snapshotMagic)+2:]}
+	if in.string() != string(hash) && in.err == nil {
+		return ErrSnapshotProgram
+	}
+
+	pc := uintptr(in.uint())
+	executed := in.uint()
+	maxStackSize := uint(orDefault(uint(in.uint()), defaultMaxStackSize))
+	maxHeapSize := uint(orDefault(uint(in.uint()), defaultMaxHeapSize))
+	gc := in.bool()
+
+	stack := in.slots()
+	if uint(len(stack)) > maxStackSize && in.err == nil {
+		in.fail(fmt.Errorf("stack of %d values exceeds the maximum of %d", len(stack), maxStackSize))
+	}
+	locals := in.slots()
+	frames := in.frames(len(locals))
+
+	size := in.uint()
+	if size > uint64(maxHeapSize) && in.err == nil {
+		in.fail(fmt.Errorf("heap of %d values exceeds the maximum of %d", size, maxHeapSize))
+	}
+	heap := in.slots()
+	if uint64(len(heap)) > size && in.err == nil {
+		in.fail(fmt.Errorf("%d heap values stored for a heap of %d", len(heap), size))
+	}
+	if in.err != nil {
+		return in.err
+	}
+	allocs := make([]AllocationEntry, in.count())
+	for i := range allocs {
+		allocs[i] = AllocationEntry{From: uintptr(in.uint()), To: uintptr(in.uint()), Type: in.typ(), Site: uintptr(in.uint())}
+	}
+
+	globals := map[uintptr]RuntimeValue{}
+	for n := in.count(); n > 0; n-- {
+		addr := uintptr(in.uint())
+		// the tag is checked by the decoder, Value panics on an invalid one
+		slot := in.slot()
+		if in.err != nil {
+			return in.err
+		}
+		globals[addr] = slot.Value()
+	}
+
+	threads := make([]thread, in.count())
+	quantum, current, slice := ctx.quantum, 0, uint(0)
+	if len(threads) > 0 {
+		quantum, current, slice = uint(in.uint()), int(in.uint()), uint(in.uint())
+		if current >= len(threads) && in.err == nil {
+			in.fail(fmt.Errorf("running thread %d out of range, there are %d threads", current, len(threads)))
+		}
+	}
+	for i := range threads {
+		t := &threads[i]
+		t.joining, t.done, t.result = int(in.uint()), in.bool(), in.slot()
+		t.reading, t.arrived, t.char = in.bool(), in.bool(), in.slot()
+		if t.joining >= len(threads) && in.err == nil {
+			in.fail(fmt.Errorf("thread %d waits for thread %d out of range", i, t.joining))
+		}
+		if i == current {
+			continue
+		}
+		t.pc = uintptr(in.uint())
+		stack := in.slots()
+		if uint(len(stack)) > maxStackSize && in.err == nil {
+			in.fail(fmt.Errorf("stack of thread %d of %d values exceeds the maximum of %d", i, len(stack), maxStackSize))
+		}
+		t.stack = make([]Slot, growSize(capSize(defaultThreadStackSize, maxStackSize), uint(len(stack)), maxStackSize))
+		t.sp = uint(copy(t.stack, stack))
+		t.locals = in.slots()
+		t.frames = in.frames(len(t.locals))
+		if t.pc > uintptr(len(ctx.program.Instructions)) && in.err == nil {
+			in.fail(fmt.Errorf("program counter %d of thread %d out of range", t.pc, i))
+		}
+	}
+	if in.err != nil {
+		return in.err
+	}
+	if len(in.data) > 0 {
+		return fmt.Errorf("%d trailing bytes after the end of the snapshot", len(in.data))
+	}
+	if pc > uintptr(len(ctx.program.Instructions)) {
+		return fmt.Errorf("program counter %d out of range, the program has %d instructions", pc, len(ctx.program.Instructions))
+	}
+	ctx.Pc = pc
+	ctx.Executed = executed
+	ctx.maxStackSize = maxStackSize
+	ctx.maxHeapSize = maxHeapSize
+	ctx.gc = gc
+	stackSize := capSize(uint(len(ctx.Stack)), maxStackSize)
+	if uint(len(stack)) > stackSize {
+		stackSize = growSize(stackSize, uint(len(stack)), maxStackSize)
+	}
+	ctx.Stack = make([]Slot, stackSize)
+	ctx.Sp = uint(copy(ctx.Stack, stack))
+	ctx.Locals = locals
+	ctx.Frames = frames
+	ctx.Heap = make([]Slot, size)
+	copy(ctx.Heap, heap)
+	ctx.Allocs = allocs
+	ctx.Globals = globals
+	ctx.threads, ctx.current, ctx.quantum, ctx.slice, ctx.yielded = nil, current, quantum, slice, false
+	if len(threads) > 0 {
+		ctx.threads = threads
+	}
+	return nil
+}
+
+// Returns the hash of the program of ctx, which is computed once.
+func (ctx *Runtime) hash() ([]byte, error) {
+	if ctx.programHash == nil {
+		hash, err := programHash(ctx.program)
+		if err != nil {
+			return nil, err
+		}
+		ctx.programHash = hash
+	}
+	return ctx.programHash, nil
+}
+
+// Programs are identified by their instructions, so a snapshot can be
+// restored with a build of the program with other debug information.
+func programHash(p Program) ([]byte, error) {
+	data, err := Marshal(Program{Instructions: p.Instructions})
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(data)
+	return hash[:], nil
+}
+
+func (e *encoder) slot(s Slot) {
+	e.typ(s.Tag)
+	e.uint(s.Bits)
+}
+
+func (e *encoder) slots(slots []Slot) {
+	e.uint(uint64(len(slots)))
+	for _, s := range slots {
+		e.slot(s)
+	}
+}
+
+func (e *encoder) frames(frames []Frame) {
+	e.uint(uint64(len(frames)))
+	for _, frame := range frames {
+		e.uint(uint64(frame.Function))
+		e.uint(uint64(frame.Call))
+		e.uint(uint64(frame.LocalsBase))
+	}
+}
+
+func (d *decoder) slot() Slot {
+	return Slot{Tag: d.typ(), Bits: d.uint()}
+}
+
+func (d *decoder) slots() []Slot {
+	slots := make([]Slot, d.count())
+	for i := range slots {
+		slots[i] = d.slot()
+	}
+	return slots
+}
+
+// Decodes frames of a stack with the given number of locals.
+func (d *decoder) frames(locals int) []Frame {
+	frames := make([]Frame, d.count())
+	for i := range frames {
+		frames[i] = Frame{Function: uintptr(d.uint()), Call: uintptr(d.uint()), LocalsBase: int(d.uint())}
+		if frames[i].LocalsBase > locals && d.err == nil {
+			d.fail(fmt.Errorf("frame %d starts past the %d locals", i, locals))
+		}
+	}
+	return frames
+}
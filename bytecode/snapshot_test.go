@@ -0,0 +1,154 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"eud/bytecode"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	program := sumProgram(t)
+	original := bytecode.NewRuntime(program, bytecode.RunOptions{MaxStackSize: 64})
+	// inside sum, with its locals declared
+	if _, err := original.RunUntil(func(r *bytecode.Runtime) bool { return r.Pc == 7 }); err != nil {
+		t.Fatal(err)
+	}
+	data, err := original.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := bytecode.RestoreRuntime(program, data, bytecode.RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored.Pc != 7 || restored.Executed != original.Executed || restored.CallDepth() != 1 {
+		t.Errorf("expected pc 7 after %d instructions in a call, got pc %d after %d at depth %d",
+			original.Executed, restored.Pc, restored.Executed, restored.CallDepth())
+	}
+	again, err := restored.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(again, data) {
+		t.Errorf("expected the snapshot of the restored runtime to be the same")
+	}
+
+	for _, r := range []*bytecode.Runtime{original, restored} {
+		if _, err := r.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(restored.Locals, original.Locals) || restored.Executed != original.Executed {
+		t.Errorf("expected the restored run to end with %v after %d instructions, got %v after %d",
+			original.Locals, original.Executed, restored.Locals, restored.Executed)
+	}
+}
+
+func TestSnapshotHeap(t *testing.T) {
+	program, err := bytecode.Assemble(`
+		Push<usize> 2
+		Allocate<i32>
+		Pop<uptr>
+		Push<i32> 42
+		Push<uptr> 1
+		Store<i32>
+		Push<uptr> 1
+		Load<i32>
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := bytecode.NewRuntime(program, bytecode.RunOptions{})
+	if _, err := original.RunUntil(func(r *bytecode.Runtime) bool { return r.Pc == 6 }); err != nil {
+		t.Fatal(err)
+	}
+	data, err := original.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restored, err := bytecode.RestoreRuntime(program, data, bytecode.RunOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(restored.Allocations(), original.Allocations()) || restored.HeapSize() != original.HeapSize() {
+		t.Errorf("expected the allocations %v, got %v", original.Allocations(), restored.Allocations())
+	}
+	if _, err := restored.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if top, err := restored.Peek(0); err != nil || top != (bytecode.I32Value{Value: 42}) {
+		t.Errorf("expected 42 to be loaded from the restored heap, got %v, %v", top, err)
+	}
+}
+
+func TestSnapshotErrors(t *testing.T) {
+	program := sumProgram(t)
+	data, err := bytecode.NewRuntime(program, bytecode.RunOptions{}).Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := bytecode.Assemble("Push<i32> 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bytecode.RestoreRuntime(other, data, bytecode.RunOptions{}); err != bytecode.ErrSnapshotProgram {
+		t.Errorf("expected ErrSnapshotProgram, got %v", err)
+	}
+	// other debug information doesn't matter
+	program.DebugInfo = nil
+	if _, err := bytecode.RestoreRuntime(program, data, bytecode.RunOptions{}); err != nil {
+		t.Errorf("expected the snapshot to restore without debug information, got %v", err)
+	}
+	if _, err := bytecode.RestoreRuntime(program, data[:len(data)-1], bytecode.RunOptions{}); err == nil {
+		t.Errorf("expected an error for a truncated snapshot")
+	}
+	if _, err := bytecode.RestoreRuntime(program, []byte("EUDC"), bytecode.RunOptions{}); err != bytecode.ErrNotSnapshot {
+		t.Errorf("expected ErrNotSnapshot, got %v", err)
+	}
+}
+
+func TestSnapshotRejectsCorruption(t *testing.T) {
+	program, err := bytecode.Assemble(threadsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := bytecode.NewRuntime(program, bytecode.RunOptions{Stdout: &bytes.Buffer{}})
+	if _, err := original.RunUntil(func(r *bytecode.Runtime) bool { return r.Thread() == 2 }); err != nil {
+		t.Fatal(err)
+	}
+	original.Globals[3] = bytecode.I32Value{Value: 7}
+	data, err := original.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := func(data []byte) (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		_, err = bytecode.RestoreRuntime(program, data, bytecode.RunOptions{})
+		return err
+	}
+	if err := restore(data); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < len(data); n++ {
+		if err := restore(data[:n]); err == nil || strings.HasPrefix(err.Error(), "panic") {
+			t.Errorf("expected an error for the snapshot truncated to %d of %d bytes, got %v", n, len(data), err)
+		}
+	}
+	// corrupt bytes may still decode to a valid state, but must not panic
+	for i := 6; i < len(data); i++ {
+		for _, b := range []byte{0x00, 0x0e, 0x7f, 0xff} {
+			corrupt := append([]byte{}, data...)
+			corrupt[i] = b
+			if err := restore(corrupt); err != nil && strings.HasPrefix(err.Error(), "panic") {
+				t.Errorf("byte %d set to %#x: %s", i, b, err)
+			}
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package bytecode
+
+import "fmt"
+
+// Accessors for the state of a Runtime between steps. Indices out of range
+// are errors instead of panics, so the state can be inspected and modified
+// without touching the exported slices.
+
+// Reports if the program counter is past the last instruction.
+func (ctx *Runtime) Done() bool {
+	return ctx.Pc >= uintptr(len(ctx.program.Instructions))
+}
+
+func (ctx *Runtime) Program() Program {
+	return ctx.program
+}
+
+func (ctx *Runtime) ProgramCounter() uintptr {
+	return ctx.Pc
+}
+
+// Moves execution to pc, which may be one past the last instruction to end
+// the program.
+func (ctx *Runtime) SetProgramCounter(pc uintptr) error {
+	if pc > uintptr(len(ctx.program.Instructions)) {
+		return fmt.Errorf("program counter %d out of range, the program has %d instructions", pc, len(ctx.program.Instructions))
+	}
+	ctx.Pc = pc
+	return nil
+}
+
+// Returns the instruction at the program counter, false once the program
+// has ended.
+func (ctx *Runtime) CurrentInstruction() (Instruction, bool) {
+	if ctx.Done() {
+		return nil, false
+	}
+	return ctx.program.Instructions[ctx.Pc], true
+}
+
+func (ctx *Runtime) InstructionCount() uint64 {
+	return ctx.Executed
+}
+
+func (ctx *Runtime) StackSize() int {
+	return int(ctx.Sp)
+}
+
+// Returns a value of the stack, depth 0 is the top.
+func (ctx *Runtime) Peek(depth int) (RuntimeValue, error) {
+	i, err := ctx.stackIndex(depth)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.Stack[i].Value(), nil
+}
+
+// Replaces a value of the stack, depth 0 is the top.
+func (ctx *Runtime) SetStackValue(depth int, v RuntimeValue) error {
+	i, err := ctx.stackIndex(depth)
+	if err != nil {
+		return err
+	}
+	ctx.Stack[i] = SlotOf(v)
+	return nil
+}
+
+func (ctx *Runtime) stackIndex(depth int) (int, error) {
+	if depth < 0 || depth >= int(ctx.Sp) {
+		return 0, fmt.Errorf("stack depth %d out of range, the stack holds %d values", depth, ctx.Sp)
+	}
+	return int(ctx.Sp) - depth - 1, nil
+}
+
+// Returns the number of declared locals of all frames.
+func (ctx *Runtime) LocalCount() int {
+	return len(ctx.Locals)
+}
+
+// Returns a local by its index among the locals of all frames, the locals of
+// a frame start at its LocalsBase.
+func (ctx *Runtime) LocalValue(i int) (RuntimeValue, error) {
+	if i < 0 || i >= len(ctx.Locals) {
+		return nil, fmt.Errorf("local %d out of range, %d locals are declared", i, len(ctx.Locals))
+	}
+	return ctx.Locals[i].Value(), nil
+}
+
+func (ctx *Runtime) SetLocalValue(i int, v RuntimeValue) error {
+	if i < 0 || i >= len(ctx.Locals) {
+		return fmt.Errorf("local %d out of range, %d locals are declared", i, len(ctx.Locals))
+	}
+	ctx.Locals[i] = SlotOf(v)
+	return nil
+}
+
+// Returns the number of active calls.
+func (ctx *Runtime) CallDepth() int {
+	return len(ctx.Frames)
+}
+
+// Returns the frames of the active calls, the innermost last.
+func (ctx *Runtime) CallFrames() []Frame {
+	return append([]Frame{}, ctx.Frames...)
+}
+
+func (ctx *Runtime) HeapSize() int {
+	return len(ctx.Heap)
+}
+
+func (ctx *Runtime) HeapValue(addr uintptr) (RuntimeValue, error) {
+	if addr >= uintptr(len(ctx.Heap)) {
+		return nil, fmt.Errorf("heap address %d out of range, the heap has %d values", addr, len(ctx.Heap))
+	}
+	return ctx.Heap[addr].Value(), nil
+}
+
+func (ctx *Runtime) SetHeapValue(addr uintptr, v RuntimeValue) error {
+	if addr >= uintptr(len(ctx.Heap)) {
+		return fmt.Errorf("heap address %d out of range, the heap has %d values", addr, len(ctx.Heap))
+	}
+	ctx.Heap[addr] = SlotOf(v)
+	return nil
+}
+
+// Returns the live allocations, ordered by address.
+func (ctx *Runtime) Allocations() []AllocationEntry {
+	return append([]AllocationEntry{}, ctx.Allocs...)
+}
@@ -0,0 +1,270 @@
+package bytecode
+
+import "fmt"
+
+// Threads run functions concurrently inside one runtime. Syscall 1200
+// spawns a thread running a function, taking the arguments, the argument
+// count and the address of the function like Call, and pushes a usize
+// handle of the thread. Syscall 1201 pops a handle and pushes the value the
+// function of the thread returned, waiting for it to return first. Syscall
+// 1202 gives up the rest of the time slice of the running thread.
+//
+// Every thread has its own stack, locals, frames and program counter, the
+// heap and the globals are shared. Only one thread runs at a time: the
+// exported registers of the runtime are those of the running thread, the
+// others are kept in threads until they run again.
+//
+// The scheduler is deterministic. Threads take turns in the order they were
+// spawned, the main program being the first, and a thread runs until it
+// has executed quantum instructions, yields, waits in a join or for input,
+// or returns. A join waiting for a thread executes the syscall again once
+// the thread has returned. The program ends when the main program does,
+// threads still running are dropped.
+//
+// Once a thread is spawned, reading input doesn't block the runtime. The
+// reading thread waits while the character is read in the background, and
+// the other threads run. Whether the character has arrived is only looked
+// at when a time slice ends, and it is given to the waiting thread with the
+// lowest handle, which executes the syscall again to take it. Only if no
+// thread can run, the scheduler waits for the read to return. When input
+// arrives depends on the world outside the program, so it is recorded like
+// the result of a syscall, at the instruction after which it arrived, and a
+// replay, or the history of a debugger running forward again, gives it to
+// the thread at the same instruction.
+
+type thread struct {
+	// the registers of the thread while another one runs
+	stack  []Slot
+	sp     uint
+	locals []Slot
+	frames []Frame
+	pc     uintptr
+	// the handle of the thread it waits for in a join, 0 if none
+	joining int
+	// the function of the thread returned result
+	done   bool
+	result Slot
+	// the thread waits for input, which arrived as char
+	reading bool
+	arrived bool
+	char    Slot
+}
+
+const (
+	defaultThreadQuantum   = 1024
+	defaultThreadStackSize = 64
+)
+
+// Every thread waits for another one to return.
+type DeadlockError struct {
+	Threads int
+}
+
+func (e DeadlockError) Error() string {
+	return fmt.Sprintf("deadlock: all %d threads are waiting in a join", e.Threads)
+}
+
+// A join was given a handle no spawn returned.
+type InvalidThreadError struct {
+	Handle uint64
+}
+
+func (e InvalidThreadError) Error() string {
+	return fmt.Sprintf("join of an invalid thread: no thread with handle %d", e.Handle)
+}
+
+// Returns the handle of the running thread, 0 for the main program.
+func (ctx *Runtime) Thread() int {
+	return ctx.current
+}
+
+// Returns the number of spawned threads, including the ones which returned.
+func (ctx *Runtime) ThreadCount() int {
+	if ctx.threads == nil {
+		return 0
+	}
+	return len(ctx.threads) - 1
+}
+
+// Creates a thread for the function and arguments on the stack, which
+// starts like a called function. Its return address is the end of the
+// program, returning there ends the thread.
+func (ctx *Runtime) spawn() Slot {
+	target := uintptr(ctx.pop().Bits)
+	argc := uint(ctx.pop().Bits)
+	if argc > ctx.Sp {
+		panic(StackUnderflowError{})
+	}
+	if argc+1 > ctx.maxStackSize {
+		panic(StackOverflowError{Depth: argc + 1})
+	}
+	stack := make([]Slot, growSize(capSize(defaultThreadStackSize, ctx.maxStackSize), argc+1, ctx.maxStackSize))
+	stack[0] = Slot{Bits: uint64(len(ctx.program.Instructions)), Tag: UPTR}
+	// arguments are passed in reverse order
+	for i := uint(1); i <= argc; i++ {
+		stack[i] = ctx.pop()
+	}
+	if ctx.threads == nil {
+		ctx.threads = []thread{{}}
+		ctx.slice = ctx.quantum
+	}
+	ctx.threads = append(ctx.threads, thread{
+		stack:  stack,
+		sp:     argc + 1,
+		locals: []Slot{},
+		frames: []Frame{{Function: target, Call: ctx.Pc, LocalsBase: 0}},
+		pc:     target,
+	})
+	return Slot{Bits: uint64(len(ctx.threads) - 1), Tag: USIZE}
+}
+
+// Pushes the result of the thread with the handle on the stack, or waits
+// for the thread to return.
+func (ctx *Runtime) join() {
+	handle := ctx.pop().Bits
+	if handle == 0 || handle >= uint64(len(ctx.threads)) {
+		panic(InvalidThreadError{Handle: handle})
+	}
+	t := &ctx.threads[handle]
+	if t.done {
+		ctx.threads[ctx.current].joining = 0
+		ctx.push(t.result)
+		return
+	}
+	// the syscall is executed again once the thread is scheduled
+	ctx.push(Slot{Bits: handle, Tag: USIZE})
+	ctx.push(Slot{Bits: 1201, Tag: USIZE})
+	ctx.threads[ctx.current].joining = int(handle)
+	ctx.Pc--
+}
+
+// Pushes the character which arrived for the running thread, or makes it
+// wait for input. The syscall is executed again once input arrived.
+func (ctx *Runtime) readInput() {
+	t := &ctx.threads[ctx.current]
+	if t.arrived {
+		ctx.push(t.char)
+		t.reading, t.arrived, t.char = false, false, Slot{}
+		return
+	}
+	ctx.push(Slot{Bits: 1023, Tag: USIZE})
+	t.reading = true
+	ctx.Pc--
+}
+
+// Returns the thread input is given to next, -1 if no thread waits for
+// input.
+func (ctx *Runtime) reader() int {
+	for i := range ctx.threads {
+		if t := &ctx.threads[i]; t.reading && !t.arrived {
+			return i
+		}
+	}
+	return -1
+}
+
+// Gives the input which arrived to the thread waiting for it, reporting if
+// there was any. With wait, the scheduler has no other thread to run and
+// waits for the read to return.
+func (ctx *Runtime) deliverInput(wait bool) bool {
+	i := ctx.reader()
+	if i < 0 {
+		return false
+	}
+	var c Slot
+	if ctx.replay != nil {
+		// input arrives after the instruction it arrived after when recorded
+		if ctx.replayed < len(ctx.replay.Syscalls) {
+			event := ctx.replay.Syscalls[ctx.replayed]
+			if event.ID == 1023 && event.Step == ctx.Executed && event.Pc == ctx.Pc {
+				ctx.replayed++
+				c = event.Result
+			}
+		}
+		if c.Tag == 0 {
+			if wait {
+				panic(DivergenceError{Executed: ctx.Executed, Pc: ctx.Pc,
+					Reason: "all threads wait for input, which didn't arrive here in the recorded run"})
+			}
+			return false
+		}
+	} else {
+		if ctx.incoming == nil {
+			incoming, input := make(chan Slot, 1), ctx.inputReader()
+			go func() { incoming <- readChar(input) }()
+			ctx.incoming = incoming
+		}
+		if wait {
+			c = <-ctx.incoming
+		} else {
+			select {
+			case c = <-ctx.incoming:
+			default:
+				return false
+			}
+		}
+		ctx.incoming = nil
+		if ctx.record != nil {
+			ctx.record.Syscalls = append(ctx.record.Syscalls, SyscallEvent{Step: ctx.Executed, Pc: ctx.Pc, ID: 1023, Result: c})
+		}
+	}
+	t := &ctx.threads[i]
+	t.arrived, t.char = true, c
+	return true
+}
+
+// Ends the time slice of the running thread after the instruction.
+func (ctx *Runtime) yield() {
+	if ctx.threads != nil {
+		ctx.yielded = true
+	}
+}
+
+// Switches to the next runnable thread after an instruction, when the
+// running one has used up its time slice, yielded, waits or returned.
+func (ctx *Runtime) schedule() {
+	if ctx.current == 0 && ctx.Done() {
+		return
+	}
+	t := &ctx.threads[ctx.current]
+	if ctx.Done() {
+		t.done, t.result = true, ctx.Stack[ctx.Sp-1]
+	}
+	if ctx.slice > 0 {
+		ctx.slice--
+	}
+	if !t.done && t.joining == 0 && !t.reading && !ctx.yielded && ctx.slice > 0 {
+		return
+	}
+	ctx.yielded = false
+	ctx.deliverInput(false)
+	for {
+		// the running thread comes last
+		for n := 1; n <= len(ctx.threads); n++ {
+			if next := (ctx.current + n) % len(ctx.threads); ctx.runnable(next) {
+				ctx.switchTo(next)
+				return
+			}
+		}
+		if !ctx.deliverInput(true) {
+			panic(DeadlockError{Threads: len(ctx.threads)})
+		}
+	}
+}
+
+func (ctx *Runtime) runnable(i int) bool {
+	t := &ctx.threads[i]
+	return !t.done && (t.joining == 0 || ctx.threads[t.joining].done) && (!t.reading || t.arrived)
+}
+
+// Makes thread i the running one with a new time slice.
+func (ctx *Runtime) switchTo(i int) {
+	if i != ctx.current {
+		t := &ctx.threads[ctx.current]
+		t.stack, t.sp, t.locals, t.frames, t.pc = ctx.Stack, ctx.Sp, ctx.Locals, ctx.Frames, ctx.Pc
+		t = &ctx.threads[i]
+		ctx.Stack, ctx.Sp, ctx.Locals, ctx.Frames, ctx.Pc = t.stack, t.sp, t.locals, t.frames, t.pc
+		ctx.current = i
+	}
+	ctx.slice = ctx.quantum
+}
@@ -0,0 +1,377 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"errors"
+	"eud/bytecode"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// two threads print their character n times, yielding after every one, and
+// return it, the main program adds up what they returned
+const threadsProgram = `
+	JumpTo L9
+.func worker
+L1:
+	DeclareLocal<i32>
+	StoreLocal<i32> 0
+	DeclareLocal<i32>
+	StoreLocal<i32> 0
+L2:
+	LoadLocal<i32> 0
+	Push<i32> 0
+	CmpGT<i32>
+	JumpIfZeroTo L3
+	LoadLocal<i32> 1
+	Push<usize> 1022
+	Syscall
+	Push<usize> 1202
+	Syscall
+	LoadLocal<i32> 0
+	Push<i32> 1
+	Subtract<i32>
+	StoreLocal<i32> 0
+	JumpTo L2
+L3:
+	LoadLocal<i32> 1
+	Return<i32>
+.endfunc
+L9:
+	DeclareLocal<usize>
+	DeclareLocal<usize>
+	Push<i32> 97
+	Push<i32> 3
+	Push<usize> 2
+	Push<uptr> L1
+	Push<usize> 1200
+	Syscall
+	StoreLocal<usize> 1
+	Push<i32> 98
+	Push<i32> 2
+	Push<usize> 2
+	Push<uptr> L1
+	Push<usize> 1200
+	Syscall
+	StoreLocal<usize> 0
+	LoadLocal<usize> 1
+	Push<usize> 1201
+	Syscall
+	LoadLocal<usize> 0
+	Push<usize> 1201
+	Syscall
+	Add<i32>
+`
+
+func runThreads(t *testing.T, source string, options bytecode.RunOptions) (*bytecode.Runtime, string, error) {
+	t.Helper()
+	program, err := bytecode.Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	options.Stdout = &out
+	runtime := bytecode.NewRuntime(program, options)
+	_, err = runtime.RunUntil(func(*bytecode.Runtime) bool { return false })
+	return runtime, out.String(), err
+}
+
+func TestThreads(t *testing.T) {
+	program, err := bytecode.Assemble(threadsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bytecode.Verify(program); err != nil {
+		t.Fatal(err)
+	}
+	withoutYield := strings.Replace(threadsProgram, "Push<usize> 1202\n\tSyscall\n", "", 1)
+	cases := []struct {
+		name    string
+		source  string
+		quantum uint
+		output  string
+	}{
+		{"yield", threadsProgram, 0, "ababa"},
+		{"quantum", withoutYield, 0, "aaabb"},
+		{"preempted", withoutYield, 1, "ababa"},
+	}
+	for _, c := range cases {
+		runtime, output, err := runThreads(t, c.source, bytecode.RunOptions{ThreadQuantum: c.quantum})
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		if output != c.output {
+			t.Errorf("%s: expected the output %q, got %q", c.name, c.output, output)
+		}
+		if result, _ := runtime.Peek(0); result != (bytecode.I32Value{Value: 'a' + 'b'}) || runtime.ThreadCount() != 2 {
+			t.Errorf("%s: expected the joined results added up after 2 threads, got %s after %d", c.name, result, runtime.ThreadCount())
+		}
+	}
+}
+
+func TestThreadsDeadlock(t *testing.T) {
+	// the thread joins itself, its handle is 1
+	_, _, err := runThreads(t, `
+		JumpTo L9
+	.func wait
+	L1:
+		Push<usize> 1201
+		Syscall
+		Return<i32>
+	.endfunc
+	L9:
+		Push<usize> 1
+		Push<usize> 1
+		Push<uptr> L1
+		Push<usize> 1200
+		Syscall
+		Push<usize> 1201
+		Syscall
+	`, bytecode.RunOptions{})
+	var deadlock bytecode.DeadlockError
+	if !errors.As(err, &deadlock) || deadlock.Threads != 2 {
+		t.Errorf("expected a deadlock of 2 threads, got %v", err)
+	}
+}
+
+func TestThreadsInvalidJoin(t *testing.T) {
+	// the main program has handle 0, but can't be joined
+	_, _, err := runThreads(t, `
+		Push<usize> 0
+		Push<usize> 1201
+		Syscall
+	`, bytecode.RunOptions{})
+	var invalid bytecode.InvalidThreadError
+	if !errors.As(err, &invalid) || invalid.Handle != 0 {
+		t.Errorf("expected a join of an invalid thread, got %v", err)
+	}
+}
+
+func TestThreadsVerify(t *testing.T) {
+	// the handle of a join has to come from a spawn
+	program, err := bytecode.Assemble(strings.Replace(threadsProgram, "LoadLocal<usize> 0\n\tPush<usize> 1201", "Push<usize> 2\n\tPush<usize> 1201", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var verifyErr bytecode.VerifyError
+	if err := bytecode.Verify(program); !errors.As(err, &verifyErr) || !strings.Contains(verifyErr.Reason, "thread handle") {
+		t.Errorf("expected a join of an unknown thread to be rejected, got %v", err)
+	}
+}
+
+func TestThreadsSnapshot(t *testing.T) {
+	program, err := bytecode.Assemble(threadsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original := bytecode.NewRuntime(program, bytecode.RunOptions{Stdout: &bytes.Buffer{}})
+	// in the second thread, with the first one and the main program waiting
+	if _, err := original.RunUntil(func(r *bytecode.Runtime) bool { return r.Thread() == 2 }); err != nil {
+		t.Fatal(err)
+	}
+	data, err := original.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	restored, err := bytecode.RestoreRuntime(program, data, bytecode.RunOptions{Stdout: &out})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, err := restored.Snapshot(); err != nil || !reflect.DeepEqual(again, data) {
+		t.Errorf("expected the snapshot of the restored runtime to be the same, %v", err)
+	}
+	if _, err := restored.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	if result, _ := restored.Peek(0); out.String() != "baba" || result != (bytecode.I32Value{Value: 'a' + 'b'}) {
+		t.Errorf("expected the rest of the output and the result, got %q and %s", out.String(), result)
+	}
+}
+
+func TestThreadsHistory(t *testing.T) {
+	program, err := bytecode.Assemble(threadsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	d := bytecode.NewDebugger(program, bytecode.RunOptions{Stdout: &out})
+	bytecode.SetHistory(d, 8, 100)
+	snapshots := [][]byte{}
+	for !d.Exited() {
+		data, err := d.Runtime.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, data)
+		if err := d.StepInstruction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// every instruction is undone, switches and spawns included
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if reason, err := d.StepBackInstruction(); err != nil || reason == bytecode.StopStart {
+			t.Fatalf("expected to step back to instruction %d, got %s, %v", i, reason, err)
+		}
+		data, err := d.Runtime.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, snapshots[i]) {
+			t.Fatalf("expected the state after %d instructions to be restored, at pc %d in thread %d", i, d.Runtime.Pc, d.Runtime.Thread())
+		}
+	}
+	if reason, err := d.Continue(); err != nil || reason != bytecode.StopExited {
+		t.Fatalf("expected the program to exit, got %s, %v", reason, err)
+	}
+	if out.String() != "ababa" {
+		t.Errorf("expected the output once, got %q", out.String())
+	}
+}
+
+// a thread prints w three times, yielding after every one, while the main
+// program reads a character, prints it and joins the thread
+const readingThreadsProgram = `
+	JumpTo L9
+.func worker
+L1:
+	DeclareLocal<i32>
+	StoreLocal<i32> 0
+L2:
+	LoadLocal<i32> 0
+	Push<i32> 0
+	CmpGT<i32>
+	JumpIfZeroTo L3
+	Push<i32> 119
+	Push<usize> 1022
+	Syscall
+	Push<usize> 1202
+	Syscall
+	LoadLocal<i32> 0
+	Push<i32> 1
+	Subtract<i32>
+	StoreLocal<i32> 0
+	JumpTo L2
+L3:
+	Push<i32> 0
+	Return<i32>
+.endfunc
+L9:
+	Push<i32> 3
+	Push<usize> 1
+	Push<uptr> L1
+	Push<usize> 1200
+	Syscall
+	Push<usize> 1023
+	Syscall
+	Push<usize> 1022
+	Syscall
+	Push<usize> 1201
+	Syscall
+`
+
+// Writes the input to the pipe once the output shows the thread made
+// progress.
+type inputAfter struct {
+	out   bytes.Buffer
+	input *io.PipeWriter
+}
+
+func (w *inputAfter) Write(p []byte) (int, error) {
+	if w.input != nil && bytes.Contains(p, []byte("w")) {
+		go w.input.Write([]byte("x"))
+		w.input = nil
+	}
+	return w.out.Write(p)
+}
+
+func TestThreadsReading(t *testing.T) {
+	program, err := bytecode.Assemble(readingThreadsProgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bytecode.Verify(program); err != nil {
+		t.Fatal(err)
+	}
+	// the input only arrives when the thread runs while the main program
+	// waits for it
+	stdin, input := io.Pipe()
+	out := &inputAfter{input: input}
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{Stdin: stdin, Stdout: out})
+	done := make(chan error, 1)
+	go func() {
+		_, err := runtime.RunUntil(func(*bytecode.Runtime) bool { return false })
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the thread to run while the main program waits for input")
+	}
+	if output := out.out.String(); !strings.HasPrefix(output, "w") || strings.Count(output, "w") != 3 || strings.Count(output, "x") != 1 {
+		t.Errorf("expected the thread to print before the input is echoed, got %q", output)
+	}
+
+	// when the input arrived is recorded, so the threads run the same way
+	rec, output := record(t, readingThreadsProgram, "x")
+	if replayed, err := replay(rec, program); err != nil || replayed != output {
+		t.Errorf("expected the replay to print %q, got %q, %v", output, replayed, err)
+	}
+
+	// and the history gives the input at the same instruction when running
+	// forward again
+	var debugged bytes.Buffer
+	d := bytecode.NewDebugger(program, bytecode.RunOptions{Stdin: strings.NewReader("x"), Stdout: &debugged})
+	bytecode.SetHistory(d, 8, 100)
+	snapshots := [][]byte{}
+	for !d.Exited() {
+		data, err := d.Runtime.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshots = append(snapshots, data)
+		if err := d.StepInstruction(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := debugged.String()
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if reason, err := d.StepBackInstruction(); err != nil || reason == bytecode.StopStart {
+			t.Fatalf("expected to step back to instruction %d, got %s, %v", i, reason, err)
+		}
+		data, err := d.Runtime.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(data, snapshots[i]) {
+			t.Fatalf("expected the state after %d instructions to be restored, at pc %d in thread %d", i, d.Runtime.Pc, d.Runtime.Thread())
+		}
+	}
+	if reason, err := d.Continue(); err != nil || reason != bytecode.StopExited {
+		t.Fatalf("expected the program to exit, got %s, %v", reason, err)
+	}
+	if debugged.String() != first {
+		t.Errorf("expected the output %q once, got %q", first, debugged.String())
+	}
+}
+
+func TestCompileThreads(t *testing.T) {
+	program := compileSource(t, "testdata/threads.eud")
+	if err := bytecode.Verify(program); err != nil {
+		t.Fatal(err)
+	}
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{ThreadQuantum: 3})
+	if _, err := runtime.RunUntil(func(*bytecode.Runtime) bool { return false }); err != nil {
+		t.Fatal(err)
+	}
+	total, err := runtime.LocalValue(0)
+	if err != nil || total != (bytecode.I32Value{Value: 6 + 10}) || runtime.ThreadCount() != 2 {
+		t.Errorf("expected the sums of both threads after 2 threads, got %s, %v after %d", total, err, runtime.ThreadCount())
+	}
+}
@@ -0,0 +1,229 @@
+package bytecode
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// A Tracer writes one JSON object per executed instruction, in the JSON Lines
+// format, with what the instruction did to the stack, the locals and the
+// heap. Record is called before every instruction, for example as the
+// predicate of Runtime.RunUntil, and Stop after the last one:
+//
+//	tracer := NewTracer(w, p, TraceFilter{Function: "sum"})
+//	_, err := runtime.RunUntil(func(r *Runtime) bool {
+//		tracer.Record(r)
+//		return false
+//	})
+//	err = tracer.Stop(runtime, err)
+//
+// An instruction is only known to have finished once the next one is about
+// to execute, so its record is written by the following Record or by Stop.
+type Tracer struct {
+	encoder *json.Encoder
+	program Program
+	filter  TraceFilter
+	// the record of the instruction executing since the last Record, nil if
+	// it didn't pass the filter
+	pending *TraceRecord
+	// the state before the pending instruction
+	stack  []Slot
+	locals []Slot
+	base   int
+	err    error
+}
+
+// Selects the traced instructions, the zero value traces everything.
+type TraceFilter struct {
+	// instructions with From <= pc < To, To 0 means up to the end
+	From uintptr
+	To   uintptr
+	// instructions of the function with this name, "main" is the top level
+	Function string
+}
+
+type TraceRecord struct {
+	// number of instructions executed before this one
+	Step     uint64  `json:"step"`
+	Pc       uintptr `json:"pc"`
+	Function string  `json:"function"`
+	// 0 if the instruction has no entry in the line table
+	Line int    `json:"line,omitempty"`
+	Op   string `json:"op"`
+	// the parameters in angle brackets and the operands after them, as in
+	// the assembly syntax
+	Params   []string `json:"params,omitempty"`
+	Operands []int    `json:"operands,omitempty"`
+	// the values the instruction removed from the top of the stack and the
+	// ones it put there instead, values it left in place are in neither
+	Pop  []string `json:"pop,omitempty"`
+	Push []string `json:"push,omitempty"`
+	// size of the stack after the instruction
+	Sp     uint         `json:"sp"`
+	Locals []TraceLocal `json:"locals,omitempty"`
+	// number of locals dropped, by a return or UndeclareLocal
+	Dropped int          `json:"dropped,omitempty"`
+	Heap    []TraceWrite `json:"heap,omitempty"`
+	Syscall uint64       `json:"syscall,omitempty"`
+	// the runtime error the instruction failed with
+	Error string `json:"error,omitempty"`
+}
+
+// A local which was declared or assigned.
+type TraceLocal struct {
+	// index among the locals of all frames, as in Runtime.LocalValue
+	Index int `json:"index"`
+	// "" if the variable table doesn't name the local
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value"`
+}
+
+type TraceWrite struct {
+	Addr  uintptr `json:"addr"`
+	Value string  `json:"value"`
+}
+
+func NewTracer(w io.Writer, p Program, filter TraceFilter) *Tracer {
+	return &Tracer{encoder: json.NewEncoder(w), program: p, filter: filter}
+}
+
+func (f TraceFilter) matches(p Program, pc uintptr) bool {
+	if pc < f.From || (f.To != 0 && pc >= f.To) {
+		return false
+	}
+	return f.Function == "" || p.FunctionAt(pc) == f.Function
+}
+
+// Writes the record of the previous instruction and remembers the state
+// before the instruction at the program counter of r.
+func (t *Tracer) Record(r *Runtime) {
+	t.flush(r)
+	if r.Done() || !t.filter.matches(t.program, r.Pc) {
+		return
+	}
+	code := decodeInstruction(t.program.Instructions[r.Pc])
+	record := &TraceRecord{
+		Step:     r.Executed,
+		Pc:       r.Pc,
+		Function: t.program.FunctionAt(r.Pc),
+		Op:       opName(code.code),
+	}
+	if entry, ok := t.program.DebugInfo.LineAt(r.Pc); ok {
+		record.Line = entry.Line
+	}
+	record.Params, record.Operands = traceOperands(code)
+
+	// a store writes the value below the address on the stack, a syscall
+	// takes its id from the top
+	switch code.code {
+	case StoreInstruction:
+		if r.Sp >= 2 {
+			record.Heap = []TraceWrite{{Addr: uintptr(r.Stack[r.Sp-1].Bits), Value: r.Stack[r.Sp-2].String()}}
+		}
+	case SyscallInstruction:
+		if r.Sp >= 1 {
+			record.Syscall = r.Stack[r.Sp-1].Bits
+		}
+	}
+
+	t.pending = record
+	t.stack = append(t.stack[:0], r.Stack[:r.Sp]...)
+	t.locals = append(t.locals[:0], r.Locals...)
+	t.base = 0
+	if len(r.Frames) > 0 {
+		t.base = r.Frames[len(r.Frames)-1].LocalsBase
+	}
+}
+
+// Writes the record of the last instruction, with err if it failed. Returns
+// err, or the first error writing the trace if there was none.
+func (t *Tracer) Stop(r *Runtime, err error) error {
+	if t.pending != nil && err != nil {
+		t.pending.Error = err.Error()
+		// a failed instruction doesn't write to the heap
+		t.pending.Heap = nil
+	}
+	t.flush(r)
+	if err != nil {
+		return err
+	}
+	return t.err
+}
+
+// Completes the pending record with the state after its instruction.
+func (t *Tracer) flush(r *Runtime) {
+	record := t.pending
+	if record == nil {
+		return
+	}
+	t.pending = nil
+
+	stack := r.Stack[:r.Sp]
+	same := 0
+	for same < len(t.stack) && same < len(stack) && t.stack[same] == stack[same] {
+		same++
+	}
+	record.Pop = slotStrings(t.stack[same:])
+	record.Push = slotStrings(stack[same:])
+	record.Sp = r.Sp
+
+	for i, local := range r.Locals {
+		if i < len(t.locals) && t.locals[i] == local {
+			continue
+		}
+		// the declared value of a new local is its type's zero value, which
+		// is reported as well
+		record.Locals = append(record.Locals, TraceLocal{Index: i, Name: t.localName(record, i), Value: local.String()})
+	}
+	if len(r.Locals) < len(t.locals) {
+		record.Dropped = len(t.locals) - len(r.Locals)
+	}
+
+	if err := t.encoder.Encode(record); err != nil && t.err == nil {
+		t.err = err
+	}
+}
+
+// Returns the name of local i of the frame the record's instruction executed
+// in. Parameters and declared variables come into scope right after the
+// instruction assigning them, so the scope is checked after the instruction.
+func (t *Tracer) localName(record *TraceRecord, i int) string {
+	if i < t.base {
+		return ""
+	}
+	for _, v := range t.program.DebugInfo.VariablesAt(record.Pc+1, record.Function) {
+		if v.Index == i-t.base {
+			return v.Name
+		}
+	}
+	return ""
+}
+
+func traceOperands(d decodedInstruction) ([]string, []int) {
+	switch d.code {
+	case JumpInstruction, JumpIfZeroInstruction, JumpNotZeroInstruction, SyscallInstruction:
+		return nil, nil
+	case StoreLocalInstruction, LoadLocalInstruction, StoreLocalKeepInstruction, PushInstruction:
+		return []string{d.typ.String()}, []int{d.operand}
+	case ConvertInstruction:
+		return []string{d.typ.String(), d.src.String()}, nil
+	case JumpToInstruction, JumpIfZeroToInstruction:
+		return nil, []int{d.operand}
+	case JumpIfNotInstruction:
+		return []string{cmpName(d.cmp), d.typ.String()}, []int{d.operand}
+	case IncrementLocalInstruction:
+		return []string{d.typ.String()}, []int{d.operand, d.value}
+	}
+	return []string{d.typ.String()}, nil
+}
+
+func slotStrings(slots []Slot) []string {
+	if len(slots) == 0 {
+		return nil
+	}
+	strs := make([]string, len(slots))
+	for i, s := range slots {
+		strs[i] = s.String()
+	}
+	return strs
+}
@@ -0,0 +1,106 @@
+package bytecode_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"eud/bytecode"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func trace(t *testing.T, program bytecode.Program, filter bytecode.TraceFilter) []bytecode.TraceRecord {
+	var out bytes.Buffer
+	tracer := bytecode.NewTracer(&out, program, filter)
+	runtime := bytecode.NewRuntime(program, bytecode.RunOptions{Stdout: &bytes.Buffer{}})
+	_, err := runtime.RunUntil(func(r *bytecode.Runtime) bool {
+		tracer.Record(r)
+		return false
+	})
+	if err := tracer.Stop(runtime, err); err != nil {
+		t.Fatal(err)
+	}
+	records := []bytecode.TraceRecord{}
+	for _, line := range strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+		var record bytecode.TraceRecord
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("invalid trace line %q: %s", line, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestTrace(t *testing.T) {
+	records := trace(t, sumProgram(t), bytecode.TraceFilter{})
+	if len(records) != 16 {
+		t.Fatalf("expected a record per executed instruction, got %d", len(records))
+	}
+	for i, record := range records {
+		if record.Step != uint64(i) {
+			t.Errorf("expected step %d, got %d", i, record.Step)
+		}
+	}
+	expected := []bytecode.TraceRecord{
+		{Step: 6, Pc: 14, Function: "main", Line: 5, Op: "Call", Params: []string{"uptr"},
+			Pop:  []string{"I32(5)", "I32(3)", "USIZE(2)", "UPTR(1)"},
+			Push: []string{"UPTR(15)", "I32(3)", "I32(5)"}, Sp: 3},
+		{Step: 8, Pc: 2, Function: "sum", Line: 5, Op: "StoreLocal", Params: []string{"i32"}, Operands: []int{0},
+			Pop: []string{"I32(5)"}, Sp: 2,
+			Locals: []bytecode.TraceLocal{{Index: 1, Name: "a", Value: "I32(5)"}}},
+		{Step: 14, Pc: 8, Function: "sum", Line: 5, Op: "Return", Params: []string{"i32"},
+			Pop: []string{"UPTR(15)", "I32(8)"}, Push: []string{"I32(8)"}, Sp: 1, Dropped: 2},
+	}
+	for _, e := range expected {
+		if !reflect.DeepEqual(records[e.Step], e) {
+			t.Errorf("expected\n%+v\ngot\n%+v", e, records[e.Step])
+		}
+	}
+}
+
+func TestTraceFilter(t *testing.T) {
+	program := sumProgram(t)
+	pcs := func(records []bytecode.TraceRecord) []uintptr {
+		pcs := []uintptr{}
+		for _, record := range records {
+			pcs = append(pcs, record.Pc)
+		}
+		return pcs
+	}
+	if got := pcs(trace(t, program, bytecode.TraceFilter{Function: "sum"})); !reflect.DeepEqual(got, []uintptr{1, 2, 3, 4, 5, 6, 7, 8}) {
+		t.Errorf("expected the instructions of sum, got %v", got)
+	}
+	if got := pcs(trace(t, program, bytecode.TraceFilter{From: 7, To: 10})); !reflect.DeepEqual(got, []uintptr{9, 7, 8}) {
+		t.Errorf("expected pcs 7 to 9 in execution order, got %v", got)
+	}
+}
+
+func TestTraceHeapAndSyscalls(t *testing.T) {
+	program, err := bytecode.Assemble(`
+		Push<usize> 1
+		Allocate<i32>
+		Pop<uptr>
+		Push<i32> 42
+		Push<uptr> 0
+		Store<i32>
+		Push<i32> 7
+		Push<u64> 1012
+		Syscall
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records := trace(t, program, bytecode.TraceFilter{From: 5})
+	if len(records) != 4 {
+		t.Fatalf("expected 4 records, got %v", records)
+	}
+	if expected := []bytecode.TraceWrite{{Addr: 0, Value: "I32(42)"}}; !reflect.DeepEqual(records[0].Heap, expected) {
+		t.Errorf("expected the heap write %v, got %v", expected, records[0].Heap)
+	}
+	if records[3].Syscall != 1012 || !reflect.DeepEqual(records[3].Pop, []string{"I32(7)", "U64(1012)"}) {
+		t.Errorf("expected syscall 1012 printing 7, got %+v", records[3])
+	}
+}
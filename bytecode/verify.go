@@ -0,0 +1,484 @@
+package bytecode
+
+import "fmt"
+
+// Verify statically checks p, so that programs which would fail or panic
+// part way through running are rejected before they start. Every path
+// through the code is followed with the types of the values on the stack
+// and in the locals, checking that
+//
+//   - jump and call targets are in range,
+//   - the stack never underflows and has the same depth and types on every
+//     path reaching an instruction,
+//   - operands have the type the instruction expects,
+//   - locals are declared before they are used, with the type they are
+//     used as.
+//
+// Jump, JumpIfZero, JumpNotZero and Call take their target from the stack,
+// it has to be known statically, such as an address pushed by Push<uptr>.
+// The same holds for the argument count of Call and the id of Syscall.
+// Functions entered by Call are checked with the arguments of all their
+// call sites and can't access the stack or locals of their callers.
+// Functions run by threads are checked like called ones, and a join has to
+// be given a handle returned by a spawn of a known function.
+func Verify(p Program) error {
+	v := verifier{program: p, contexts: map[int]*verifyContext{}}
+	for pc, i := range p.Instructions {
+		if err := v.checkInstruction(pc, i); err != nil {
+			return err
+		}
+	}
+	v.code = decode(p.Instructions)
+	if err := v.merge(v.context(topLevel), 0, verifyState{}); err != nil {
+		return err
+	}
+	for len(v.work) > 0 {
+		item := v.work[len(v.work)-1]
+		v.work = v.work[:len(v.work)-1]
+		if err := v.step(item.context, item.pc, item.context.states[item.pc].copy()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type VerifyError struct {
+	Pc          int
+	Instruction string
+	Function    string
+	Reason      string
+}
+
+func (e VerifyError) Error() string {
+	return fmt.Sprintf("invalid bytecode at %d '%s' in function %s: %s", e.Pc, e.Instruction, e.Function, e.Reason)
+}
+
+// what the verifier knows about a value
+type verifyValue struct {
+	typ Type
+	// the value is known statically, such as a pushed address
+	constant bool
+	bits     uint64
+	// the return address pushed by Call for the current function
+	returnAddress bool
+	// the handle of a thread running the function at thread-1, 0 if not
+	// known
+	thread int
+}
+
+type verifyState struct {
+	stack  []verifyValue
+	locals []verifyValue
+}
+
+func (s verifyState) copy() verifyState {
+	return verifyState{
+		stack:  append([]verifyValue{}, s.stack...),
+		locals: append([]verifyValue{}, s.locals...),
+	}
+}
+
+const topLevel = -1
+
+// The code run for the top level or one function entered by Call. States
+// are kept per context, since a function doesn't see its callers' stack.
+type verifyContext struct {
+	entry int
+	// state at every instruction, nil until it is reached
+	states []*verifyState
+	// type of the returned values, nil until a Return is reached
+	returns *Type
+	calls   []verifyCall
+}
+
+// a call waiting for the called function to return
+type verifyCall struct {
+	context *verifyContext
+	pc      int
+	state   verifyState
+}
+
+type verifyWork struct {
+	context *verifyContext
+	pc      int
+}
+
+type verifier struct {
+	program  Program
+	code     []decodedInstruction
+	contexts map[int]*verifyContext
+	work     []verifyWork
+}
+
+func (v *verifier) fail(pc int, format string, args ...interface{}) error {
+	err := VerifyError{Pc: pc, Function: v.program.FunctionAt(uintptr(pc)), Reason: fmt.Sprintf(format, args...)}
+	if pc >= 0 && pc < len(v.program.Instructions) {
+		err.Instruction = v.program.Instructions[pc].String()
+	}
+	return err
+}
+
+func (v *verifier) context(entry int) *verifyContext {
+	if c, ok := v.contexts[entry]; ok {
+		return c
+	}
+	c := &verifyContext{entry: entry, states: make([]*verifyState, len(v.program.Instructions))}
+	v.contexts[entry] = c
+	return c
+}
+
+// checks what can be checked without following the code, before the
+// instructions are decoded
+func (v *verifier) checkInstruction(pc int, i Instruction) error {
+	if i == nil {
+		return v.fail(pc, "missing instruction")
+	}
+	d := decodeInstruction(i)
+	if !validType(d.typ) || !validType(d.src) {
+		return v.fail(pc, "invalid type")
+	}
+	if _, ok := comparisonsByName[opName(d.cmp)]; d.code == JumpIfNotInstruction && !ok {
+		return v.fail(pc, "invalid comparison %d", d.cmp)
+	}
+	return nil
+}
+
+func validType(t Type) bool {
+	return t >= U8 && t <= UPTR
+}
+
+// Adds the state s reaching pc in c, the instruction is checked again if
+// that changes what is known at pc.
+func (v *verifier) merge(c *verifyContext, pc int, s verifyState) error {
+	if pc == len(v.code) {
+		// running past the last instruction ends the program
+		return nil
+	}
+	old := c.states[pc]
+	if old == nil {
+		s = s.copy()
+		c.states[pc] = &s
+		v.work = append(v.work, verifyWork{context: c, pc: pc})
+		return nil
+	}
+	if len(old.stack) != len(s.stack) {
+		return v.fail(pc, "reached with %d values on the stack and with %d on another path", len(s.stack), len(old.stack))
+	}
+	if len(old.locals) != len(s.locals) {
+		return v.fail(pc, "reached with %d locals and with %d on another path", len(s.locals), len(old.locals))
+	}
+	changed := false
+	join := func(kind string, index int, a *verifyValue, b verifyValue) error {
+		if a.typ != b.typ || a.returnAddress != b.returnAddress {
+			return v.fail(pc, "%s %d is %s, but %s on another path", kind, index, b.describe(), a.describe())
+		}
+		if a.constant && (!b.constant || a.bits != b.bits) {
+			a.constant = false
+			changed = true
+		}
+		if a.thread != 0 && a.thread != b.thread {
+			a.thread = 0
+			changed = true
+		}
+		return nil
+	}
+	for i := range s.stack {
+		if err := join("stack value", i, &old.stack[i], s.stack[i]); err != nil {
+			return err
+		}
+	}
+	for i := range s.locals {
+		if err := join("local", len(s.locals)-i-1, &old.locals[i], s.locals[i]); err != nil {
+			return err
+		}
+	}
+	if changed {
+		v.work = append(v.work, verifyWork{context: c, pc: pc})
+	}
+	return nil
+}
+
+func (value verifyValue) describe() string {
+	if value.returnAddress {
+		return "the return address"
+	}
+	return value.typ.String()
+}
+
+func (v *verifier) step(c *verifyContext, pc int, s verifyState) error {
+	i := &v.code[pc]
+	var err error
+	pop := func() verifyValue {
+		if err != nil {
+			return verifyValue{}
+		}
+		if len(s.stack) == 0 {
+			if c.entry == topLevel {
+				err = v.fail(pc, "stack underflow")
+			} else {
+				err = v.fail(pc, "stack underflow, the stack of the caller can't be accessed")
+			}
+			return verifyValue{}
+		}
+		value := s.stack[len(s.stack)-1]
+		s.stack = s.stack[:len(s.stack)-1]
+		return value
+	}
+	popType := func(t Type, what string) verifyValue {
+		value := pop()
+		if err == nil && value.typ != t {
+			err = v.fail(pc, "expected %s of type %s, got %s", what, t, value.typ)
+		}
+		return value
+	}
+	popConstant := func(t Type, what string) uint64 {
+		value := popType(t, what)
+		if err == nil && !value.constant {
+			err = v.fail(pc, "%s isn't known statically", what)
+		}
+		return value.bits
+	}
+	push := func(value verifyValue) {
+		s.stack = append(s.stack, value)
+	}
+	local := func(t Type) *verifyValue {
+		if i.operand >= len(s.locals) {
+			if err == nil {
+				err = v.fail(pc, "local %d out of range, %d locals are declared", i.operand, len(s.locals))
+			}
+			return &verifyValue{}
+		}
+		l := &s.locals[len(s.locals)-i.operand-1]
+		if err == nil && l.typ != t {
+			err = v.fail(pc, "local %d is declared as %s", i.operand, l.typ)
+		}
+		return l
+	}
+	next := func() error {
+		if err != nil {
+			return err
+		}
+		return v.merge(c, pc+1, s)
+	}
+	jump := func(target uint64) error {
+		if err != nil {
+			return err
+		}
+		if target > uint64(len(v.code)) {
+			return v.fail(pc, "jump target %d out of range, the program has %d instructions", target, len(v.code))
+		}
+		return v.merge(c, int(target), s)
+	}
+
+	switch i.code {
+	case AllocateInstruction:
+		popType(USIZE, "amount")
+		push(verifyValue{typ: UPTR})
+	case DeallocateInstruction:
+		popType(UPTR, "address")
+	case StoreInstruction:
+		popType(UPTR, "address")
+		popType(i.typ, "value")
+	case LoadInstruction:
+		popType(UPTR, "address")
+		push(verifyValue{typ: i.typ})
+	case DeclareLocalInstruction:
+		s.locals = append(s.locals, verifyValue{typ: i.typ})
+	case UndeclareLocalInstruction:
+		if len(s.locals) == 0 {
+			return v.fail(pc, "no local is declared")
+		}
+		s.locals = s.locals[:len(s.locals)-1]
+	case StoreLocalInstruction:
+		value := popType(i.typ, "value")
+		*local(i.typ) = value
+	case StoreLocalKeepInstruction:
+		value := popType(i.typ, "value")
+		*local(i.typ) = value
+		push(value)
+	case LoadLocalInstruction:
+		push(*local(i.typ))
+	case IncrementLocalInstruction:
+		l := local(i.typ)
+		l.constant = false
+	case PushInstruction:
+		push(verifyValue{typ: i.typ, constant: true, bits: IntSlot(i.typ, int64(i.operand)).Bits})
+	case PopInstruction:
+		pop()
+	case NotInstruction:
+		popType(i.typ, "operand")
+		push(verifyValue{typ: i.typ})
+	case ConvertInstruction:
+		popType(i.src, "operand")
+		push(verifyValue{typ: i.typ})
+	case SyscallInstruction:
+		switch id := popConstant(USIZE, "syscall id"); {
+		case err != nil:
+		case id == 1000:
+			push(verifyValue{typ: UPTR, constant: true, bits: uint64(pc)})
+		case id == 1012:
+			popType(I32, "syscall argument")
+		case id == 1022:
+			pop()
+		case id == 1023:
+			push(verifyValue{typ: I32})
+		case id == 1100:
+			push(verifyValue{typ: I64})
+		case id == 1110:
+			push(verifyValue{typ: U64})
+		case id == 1200:
+			target := popConstant(UPTR, "thread function")
+			argc := popConstant(USIZE, "argument count")
+			if err != nil {
+				return err
+			}
+			if argc > uint64(len(s.stack)) {
+				return v.fail(pc, "%d arguments expected on the stack, got %d", argc, len(s.stack))
+			}
+			args := make([]verifyValue, argc)
+			for j := range args {
+				args[j] = pop()
+			}
+			if _, err := v.enter(pc, target, args); err != nil {
+				return err
+			}
+			push(verifyValue{typ: USIZE, thread: int(target) + 1})
+		case id == 1201:
+			handle := popType(USIZE, "thread handle")
+			if err != nil {
+				return err
+			}
+			if handle.thread == 0 {
+				return v.fail(pc, "thread handle isn't known to be returned by a spawn")
+			}
+			return v.await(c, pc, s, v.context(handle.thread-1))
+		case id == 1202:
+		default:
+			return v.fail(pc, "no syscall with id %d", id)
+		}
+	case JumpInstruction:
+		return jump(popConstant(UPTR, "jump target"))
+	case JumpIfZeroInstruction, JumpNotZeroInstruction:
+		target := popConstant(UPTR, "jump target")
+		pop()
+		if err := next(); err != nil {
+			return err
+		}
+		return jump(target)
+	case JumpToInstruction:
+		return jump(uint64(i.operand))
+	case JumpIfZeroToInstruction:
+		pop()
+		if err := next(); err != nil {
+			return err
+		}
+		return jump(uint64(i.operand))
+	case JumpIfNotInstruction:
+		popType(i.typ, "right operand")
+		popType(i.typ, "left operand")
+		if err := next(); err != nil {
+			return err
+		}
+		return jump(uint64(i.operand))
+	case CallInstruction:
+		target := popConstant(UPTR, "call target")
+		argc := popConstant(USIZE, "argument count")
+		if err != nil {
+			return err
+		}
+		if argc > uint64(len(s.stack)) {
+			return v.fail(pc, "%d arguments expected on the stack, got %d", argc, len(s.stack))
+		}
+		args := make([]verifyValue, argc)
+		for j := range args {
+			args[j] = pop()
+		}
+		return v.call(c, pc, s, target, args)
+	case ReturnInstruction:
+		value := popType(i.typ, "return value")
+		if c.entry == topLevel {
+			// without a call the return address is an ordinary jump target
+			target := popConstant(UPTR, "return address")
+			push(value)
+			return jump(target)
+		}
+		if address := pop(); err == nil && !address.returnAddress {
+			err = v.fail(pc, "expected the return address below the return value, got %s, %d values are left on the stack", address.typ, len(s.stack)+1)
+		}
+		if err != nil {
+			return err
+		}
+		return v.returns(c, pc, i.typ)
+	default:
+		if i.code >= AddInstruction && i.code <= XnorInstruction {
+			b := popType(i.typ, "right operand")
+			a := popType(i.typ, "left operand")
+			result := verifyValue{typ: i.typ}
+			// addresses relative to the one pushed by Syscall 1000
+			if a.constant && b.constant && (i.code == AddInstruction || i.code == SubtractInstruction) {
+				result.constant = true
+				result.bits = EvalBinary(i.code, i.typ, Slot{Bits: a.bits, Tag: i.typ}, Slot{Bits: b.bits, Tag: i.typ}).Bits
+			}
+			push(result)
+			break
+		}
+		return v.fail(pc, "unknown instruction")
+	}
+	return next()
+}
+
+// Checks the function at target with the arguments, which are popped from
+// the stack of the caller, last argument first.
+func (v *verifier) call(c *verifyContext, pc int, s verifyState, target uint64, args []verifyValue) error {
+	callee, err := v.enter(pc, target, args)
+	if err != nil {
+		return err
+	}
+	return v.await(c, pc, s, callee)
+}
+
+// Checks the function at target entered by a call or a spawn at pc with
+// the arguments.
+func (v *verifier) enter(pc int, target uint64, args []verifyValue) (*verifyContext, error) {
+	if target >= uint64(len(v.code)) {
+		return nil, v.fail(pc, "call target %d out of range, the program has %d instructions", target, len(v.code))
+	}
+	// the called function gets the return address and the arguments in
+	// reverse order
+	entry := verifyState{stack: append([]verifyValue{{typ: UPTR, returnAddress: true}}, args...)}
+	callee := v.context(int(target))
+	if err := v.merge(callee, int(target), entry); err != nil {
+		return nil, err
+	}
+	return callee, nil
+}
+
+// Continues after pc with the value returned by callee, once it is known to
+// return.
+func (v *verifier) await(c *verifyContext, pc int, s verifyState, callee *verifyContext) error {
+	callee.calls = append(callee.calls, verifyCall{context: c, pc: pc + 1, state: s.copy()})
+	if callee.returns == nil {
+		// continued once the function is known to return
+		return nil
+	}
+	s.stack = append(s.stack, verifyValue{typ: *callee.returns})
+	return v.merge(c, pc+1, s)
+}
+
+func (v *verifier) returns(c *verifyContext, pc int, t Type) error {
+	if c.returns != nil {
+		if *c.returns != t {
+			return v.fail(pc, "returns %s, but %s elsewhere", t, *c.returns)
+		}
+		return nil
+	}
+	c.returns = &t
+	for _, call := range c.calls {
+		s := call.state.copy()
+		s.stack = append(s.stack, verifyValue{typ: t})
+		if err := v.merge(call.context, call.pc, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package bytecode_test
+
+import (
+	"errors"
+	"eud/bytecode"
+	"eud/internal/parsetest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifyAcceptsValidPrograms(t *testing.T) {
+	for name, program := range map[string]bytecode.Program{
+		"sum":       sumProgram(t),
+		"while":     whileProgram(10),
+		"fused":     whileProgramFused(10),
+		"optimized": bytecode.Optimize(whileProgram(10), 2),
+	} {
+		if err := bytecode.Verify(program); err != nil {
+			t.Errorf("%s: %s", name, err)
+		}
+	}
+
+	program, err := bytecode.Assemble(`
+		; recursive function, called with the address from a local
+		    DeclareLocal<uptr>
+		    Push<uptr> countdown
+		    StoreLocal<uptr> 0
+		    Push<i32> 3
+		    Push<usize> 1
+		    LoadLocal<uptr> 0
+		    Call<uptr>
+		    Pop<i32>
+		    JumpTo end
+		.func countdown
+		countdown:
+		    DeclareLocal<i32>
+		    StoreLocal<i32> 0
+		    LoadLocal<i32> 0
+		    Push<i32> 0
+		    JumpIfNot<CmpGT, i32> done
+		    LoadLocal<i32> 0
+		    Push<i32> 1
+		    Subtract<i32>
+		    Push<usize> 1
+		    Push<uptr> countdown
+		    Call<uptr>
+		    Return<i32>
+		done:
+		    Push<i32> 0
+		    Return<i32>
+		.endfunc
+		end:
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bytecode.Verify(program); err != nil {
+		t.Errorf("recursion: %s", err)
+	}
+}
+
+func TestVerifyRejectsInvalidPrograms(t *testing.T) {
+	cases := []struct {
+		name   string
+		source string
+		pc     int
+		reason string
+	}{
+		{"underflow", `
+			Push<i32> 1
+			Add<i32>`,
+			1, "stack underflow"},
+		{"operand type", `
+			Push<i32> 1
+			Push<usize> 2
+			Add<i32>`,
+			2, "expected right operand of type i32, got usize"},
+		{"jump target", `
+			JumpTo 5`,
+			0, "jump target 5 out of range"},
+		{"stack depth at merge", `
+			Push<i32> 1
+			Push<i32> 1
+			JumpIfZeroTo end
+			Push<i32> 2
+			end:
+			Pop<i32>`,
+			4, "reached with 2 values on the stack and with 1 on another path"},
+		{"type at merge", `
+			Push<i32> 0
+			JumpIfZeroTo other
+			Push<i32> 1
+			JumpTo end
+			other:
+			Push<f64> 1
+			end:
+			Pop<i32>`,
+			5, "stack value 0 is i32, but f64 on another path"},
+		{"local out of range", `
+			DeclareLocal<i32>
+			LoadLocal<i32> 1`,
+			1, "local 1 out of range, 1 locals are declared"},
+		{"local type", `
+			DeclareLocal<i32>
+			Push<u8> 1
+			StoreLocal<u8> 0`,
+			2, "local 0 is declared as i32"},
+		{"unknown target", `
+			Push<usize> 1
+			Allocate<uptr>
+			Jump`,
+			2, "jump target isn't known statically"},
+		{"caller stack", `
+			Push<i32> 1
+			Push<usize> 0
+			Push<uptr> f
+			Call<uptr>
+			JumpTo end
+			f:
+			Pop<uptr>
+			Pop<i32>
+			end:`,
+			6, "stack underflow, the stack of the caller can't be accessed"},
+		{"values left at return", `
+			Push<usize> 0
+			Push<uptr> f
+			Call<uptr>
+			JumpTo end
+			f:
+			Push<i32> 1
+			Push<i32> 2
+			Return<i32>
+			end:`,
+			6, "expected the return address below the return value, got i32"},
+		{"syscall", `
+			Push<usize> 1
+			Syscall`,
+			1, "no syscall with id 1"},
+	}
+	for _, c := range cases {
+		program, err := bytecode.Assemble(c.source)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err)
+		}
+		err = bytecode.Verify(program)
+		var verifyErr bytecode.VerifyError
+		if !errors.As(err, &verifyErr) {
+			t.Errorf("%s: expected a VerifyError, got %v", c.name, err)
+			continue
+		}
+		if verifyErr.Pc != c.pc || !strings.HasPrefix(verifyErr.Reason, c.reason) {
+			t.Errorf("%s: expected %q at %d, got %q", c.name, c.reason, c.pc, err)
+		}
+	}
+}
+
+// examples which astjson can't parse
+var unsupportedExamples = map[string]bool{
+	"sys-print-i32.eud": true,
+	"sys-put-i32.eud":   true,
+	"while-print.eud":   true,
+}
+
+// Examples the compiler doesn't support yet are skipped.
+func TestVerifyCompiledExamples(t *testing.T) {
+	files, err := filepath.Glob("../examples/*.eud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if unsupportedExamples[filepath.Base(file)] {
+			continue
+		}
+		program, err := bytecode.Compile(parsetest.Parse(t, file))
+		if err != nil {
+			continue
+		}
+		for level := 0; level <= 2; level++ {
+			if err := bytecode.Verify(bytecode.Optimize(program, level)); err != nil {
+				t.Errorf("%s at -O%d: %s", filepath.Base(file), level, err)
+			}
+		}
+	}
+}
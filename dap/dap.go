@@ -0,0 +1,622 @@
+// Package dap serves the Debug Adapter Protocol, which editors such as VS Code
+// use to talk to debuggers, for programs run by a bytecode.Debugger.
+//
+// A session debugs a single program on a single thread. Requests are handled
+// one at a time, so a running program can't be paused, only stopped by
+// breakpoints.
+package dap
+
+import (
+	"bufio"
+	"encoding/json"
+	"eud/bytecode"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Compiles the program of a launch request.
+type Loader func(path string) (bytecode.Program, error)
+
+// the only thread of a program
+const threadID = 1
+
+type request struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command"`
+	Arguments json.RawMessage `json:"arguments"`
+}
+
+type response struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type event struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type source struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+type variable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	Type               string `json:"type,omitempty"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type server struct {
+	in      *bufio.Reader
+	out     io.Writer
+	load    Loader
+	options bytecode.RunOptions
+	seq     int
+
+	debugger    *bytecode.Debugger
+	path        string
+	stopOnEntry bool
+	// breakpoints of setBreakpoints and setFunctionBreakpoints, which replace
+	// all breakpoints of their kind
+	lineBreakpoints     []int
+	functionBreakpoints []int
+	dataBreakpoints     []int
+	// variables of the references handed out since the program stopped,
+	// reference i+1 is references[i]
+	references []func() []variable
+	// the references whose variables can be watched, with "local" for the
+	// locals of the innermost frame and "heap" for heap values
+	watchable map[int]string
+	// run after the response to the current request was sent
+	after        func()
+	disconnected bool
+}
+
+// Serves a session, reading requests from in and writing responses and events
+// to out, until the client disconnects or in ends. The output of the program
+// is sent as output events. The program reads its input from options.Stdin,
+// which is empty if nil, never from in or os.Stdin.
+func Serve(in io.Reader, out io.Writer, load Loader, options bytecode.RunOptions) error {
+	s := &server{in: bufio.NewReader(in), out: out, load: load, options: options, watchable: map[int]string{}}
+	s.options.Stdout = outputWriter{s}
+	if s.options.Stdin == nil {
+		s.options.Stdin = strings.NewReader("")
+	}
+	for !s.disconnected {
+		data, err := readMessage(s.in)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var r request
+		if err := json.Unmarshal(data, &r); err != nil {
+			return fmt.Errorf("invalid message: %w", err)
+		}
+		if r.Type != "request" {
+			continue
+		}
+		if err := s.handle(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads a message framed by a Content-Length header.
+func readMessage(in *bufio.Reader) ([]byte, error) {
+	length := -1
+	for {
+		line, err := in.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && length == -1 {
+				return nil, io.EOF
+			}
+			return nil, fmt.Errorf("reading header: %w", err)
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			break
+		}
+		if value := strings.TrimPrefix(line, "Content-Length:"); value != line {
+			length, err = strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without Content-Length")
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, fmt.Errorf("reading message: %w", err)
+	}
+	return data, nil
+}
+
+func (s *server) send(message interface{}) error {
+	data, err := json.Marshal(message)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(data), data)
+	return err
+}
+
+func (s *server) nextSeq() int {
+	s.seq++
+	return s.seq
+}
+
+func (s *server) sendEvent(name string, body interface{}) {
+	// write errors end the session when the next response is sent
+	s.send(event{Seq: s.nextSeq(), Type: "event", Event: name, Body: body})
+}
+
+// Sends the program output to the client.
+type outputWriter struct{ s *server }
+
+func (w outputWriter) Write(p []byte) (int, error) {
+	w.s.sendEvent("output", map[string]interface{}{"category": "stdout", "output": string(p)})
+	return len(p), nil
+}
+
+var handlers = map[string]func(s *server, arguments json.RawMessage) (interface{}, error){
+	"initialize":             (*server).initialize,
+	"launch":                 (*server).launch,
+	"setBreakpoints":         (*server).setBreakpoints,
+	"setFunctionBreakpoints": (*server).setFunctionBreakpoints,
+	"setExceptionBreakpoints": func(s *server, arguments json.RawMessage) (interface{}, error) {
+		return nil, nil
+	},
+	"dataBreakpointInfo": (*server).dataBreakpointInfo,
+	"setDataBreakpoints": (*server).setDataBreakpoints,
+	"configurationDone":  (*server).configurationDone,
+	"threads":            (*server).threads,
+	"stackTrace":         (*server).stackTrace,
+	"scopes":             (*server).scopes,
+	"variables":          (*server).variables,
+	"evaluate":           (*server).evaluate,
+	"continue":           resume((*bytecode.Debugger).Continue),
+	"next":               resume((*bytecode.Debugger).Next),
+	"stepIn":             resume((*bytecode.Debugger).Step),
+	"stepOut":            resume((*bytecode.Debugger).Finish),
+	"stepBack":           resume((*bytecode.Debugger).StepBack),
+	"reverseContinue":    resume((*bytecode.Debugger).ReverseContinue),
+	"disconnect":         (*server).disconnect,
+	"terminate":          (*server).disconnect,
+}
+
+func (s *server) handle(r request) error {
+	handler, ok := handlers[r.Command]
+	var body interface{}
+	var err error
+	if ok {
+		body, err = handler(s, r.Arguments)
+	} else {
+		err = fmt.Errorf("unsupported request %s", r.Command)
+	}
+	resp := response{Seq: s.nextSeq(), Type: "response", RequestSeq: r.Seq, Success: err == nil, Command: r.Command, Body: body}
+	if err != nil {
+		resp.Message = err.Error()
+	}
+	if err := s.send(resp); err != nil {
+		return err
+	}
+	if s.after != nil {
+		after := s.after
+		s.after = nil
+		after()
+	}
+	return nil
+}
+
+func parseArguments(arguments json.RawMessage, v interface{}) error {
+	if len(arguments) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(arguments, v); err != nil {
+		return fmt.Errorf("invalid arguments: %w", err)
+	}
+	return nil
+}
+
+func (s *server) started() error {
+	if s.debugger == nil {
+		return fmt.Errorf("no program was launched")
+	}
+	return nil
+}
+
+func (s *server) initialize(arguments json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"supportsConfigurationDoneRequest": true,
+		"supportsFunctionBreakpoints":      true,
+		"supportsEvaluateForHovers":        true,
+		"supportsTerminateRequest":         true,
+		"supportsStepBack":                 true,
+		"supportsDataBreakpoints":          true,
+	}, nil
+}
+
+func (s *server) launch(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Program     string `json:"program"`
+		StopOnEntry bool   `json:"stopOnEntry"`
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.Program == "" {
+		return nil, fmt.Errorf("launch needs a program")
+	}
+	program, err := s.load(args.Program)
+	if err != nil {
+		return nil, err
+	}
+	if err := bytecode.Verify(program); err != nil {
+		return nil, err
+	}
+	s.debugger = bytecode.NewDebugger(program, s.options)
+	s.path, s.stopOnEntry = args.Program, args.StopOnEntry
+	// breakpoints can be set from now on
+	s.after = func() { s.sendEvent("initialized", nil) }
+	return nil, nil
+}
+
+func (s *server) setBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			Line int `json:"line"`
+		} `json:"breakpoints"`
+	}
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	for _, id := range s.lineBreakpoints {
+		s.debugger.Delete(id)
+	}
+	s.lineBreakpoints = nil
+	breakpoints := []map[string]interface{}{}
+	for _, requested := range args.Breakpoints {
+		b, err := s.debugger.BreakAtLine(requested.Line)
+		if err != nil {
+			breakpoints = append(breakpoints, map[string]interface{}{"verified": false, "line": requested.Line, "message": err.Error()})
+			continue
+		}
+		s.lineBreakpoints = append(s.lineBreakpoints, b.ID)
+		line := requested.Line
+		if entry, ok := s.debugger.Program.DebugInfo.LineAt(b.Pc); ok {
+			line = entry.Line
+		}
+		breakpoints = append(breakpoints, map[string]interface{}{"id": b.ID, "verified": true, "line": line})
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+func (s *server) setFunctionBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			Name string `json:"name"`
+		} `json:"breakpoints"`
+	}
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	for _, id := range s.functionBreakpoints {
+		s.debugger.Delete(id)
+	}
+	s.functionBreakpoints = nil
+	breakpoints := []map[string]interface{}{}
+	for _, requested := range args.Breakpoints {
+		b, err := s.debugger.BreakAtFunction(requested.Name)
+		if err != nil {
+			breakpoints = append(breakpoints, map[string]interface{}{"verified": false, "message": err.Error()})
+			continue
+		}
+		s.functionBreakpoints = append(s.functionBreakpoints, b.ID)
+		breakpoints = append(breakpoints, map[string]interface{}{"id": b.ID, "verified": true})
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+// Data breakpoints are watchpoints, on locals of the innermost frame with
+// the data id local:name and on heap values with heap:addr.
+func (s *server) dataBreakpointInfo(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+	}
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	switch s.watchable[args.VariablesReference] {
+	case "local":
+		return map[string]interface{}{"dataId": "local:" + args.Name, "description": args.Name, "accessTypes": []string{"write"}}, nil
+	case "heap":
+		addr := strings.TrimSuffix(strings.TrimPrefix(args.Name, "["), "]")
+		return map[string]interface{}{"dataId": "heap:" + addr, "description": "heap " + addr, "accessTypes": []string{"write"}}, nil
+	}
+	return map[string]interface{}{"dataId": nil, "description": "only locals of the current function and heap values can be watched"}, nil
+}
+
+func (s *server) setDataBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			DataID string `json:"dataId"`
+		} `json:"breakpoints"`
+	}
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	for _, id := range s.dataBreakpoints {
+		s.debugger.Delete(id)
+	}
+	s.dataBreakpoints = nil
+	breakpoints := []map[string]interface{}{}
+	for _, requested := range args.Breakpoints {
+		var w bytecode.Watchpoint
+		err := fmt.Errorf("invalid data id %q", requested.DataID)
+		kind, value, _ := strings.Cut(requested.DataID, ":")
+		switch kind {
+		case "local":
+			w, err = s.debugger.WatchLocal(value, nil)
+		case "heap":
+			if addr, convErr := strconv.ParseUint(value, 10, 64); convErr == nil {
+				w, err = s.debugger.WatchHeap(uintptr(addr), uintptr(addr), nil)
+			}
+		}
+		if err != nil {
+			breakpoints = append(breakpoints, map[string]interface{}{"verified": false, "message": err.Error()})
+			continue
+		}
+		s.dataBreakpoints = append(s.dataBreakpoints, w.ID)
+		breakpoints = append(breakpoints, map[string]interface{}{"id": w.ID, "verified": true})
+	}
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+func (s *server) configurationDone(arguments json.RawMessage) (interface{}, error) {
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	if s.stopOnEntry {
+		s.after = func() { s.stopped("entry") }
+	} else {
+		s.after = func() { s.run((*bytecode.Debugger).Continue) }
+	}
+	return nil, nil
+}
+
+func (s *server) threads(arguments json.RawMessage) (interface{}, error) {
+	return map[string]interface{}{
+		"threads": []map[string]interface{}{{"id": threadID, "name": "main"}},
+	}, nil
+}
+
+func (s *server) stackTrace(arguments json.RawMessage) (interface{}, error) {
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	frames := []map[string]interface{}{}
+	for i, frame := range s.debugger.Backtrace() {
+		f := map[string]interface{}{
+			"id":                          i + 1,
+			"name":                        frame.Function,
+			"line":                        0,
+			"column":                      0,
+			"instructionPointerReference": strconv.Itoa(int(frame.Pc)),
+		}
+		if frame.HasPosition {
+			f["line"], f["column"] = frame.Position.Line, frame.Position.Col
+			f["source"] = source{Name: filepath.Base(s.path), Path: s.path}
+		}
+		frames = append(frames, f)
+	}
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": len(frames)}, nil
+}
+
+// Hands out a reference to variables, valid until the program runs again.
+func (s *server) reference(variables func() []variable) int {
+	s.references = append(s.references, variables)
+	return len(s.references)
+}
+
+func (s *server) scopes(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		FrameID int `json:"frameId"`
+	}
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	frame := args.FrameID - 1
+	if frame < 0 || frame > len(s.debugger.Runtime.Frames) {
+		return nil, fmt.Errorf("no frame %d", args.FrameID)
+	}
+	locals := s.reference(func() []variable { return s.locals(frame) })
+	if frame == 0 {
+		s.watchable[locals] = "local"
+	}
+	stack := s.reference(s.stack)
+	heap := s.reference(s.heap)
+	return map[string]interface{}{
+		"scopes": []map[string]interface{}{
+			{"name": "Locals", "presentationHint": "locals", "variablesReference": locals, "expensive": false},
+			{"name": "Stack", "variablesReference": stack, "expensive": false},
+			{"name": "Heap", "variablesReference": heap, "expensive": false},
+		},
+	}, nil
+}
+
+func (s *server) locals(frame int) []variable {
+	variables := []variable{}
+	for _, v := range s.debugger.FrameLocals(frame) {
+		variables = append(variables, variable{Name: v.Name, Value: v.Value.String(), Type: v.Type.String()})
+	}
+	return variables
+}
+
+// the value stack, the top first
+func (s *server) stack() []variable {
+	runtime := s.debugger.Runtime
+	variables := []variable{}
+	for i := int(runtime.Sp) - 1; i >= 0; i-- {
+		slot := runtime.Stack[i]
+		variables = append(variables, variable{Name: fmt.Sprintf("[%d]", i), Value: slot.String(), Type: slot.Tag.String()})
+	}
+	return variables
+}
+
+// the allocations, which expand to their values
+func (s *server) heap() []variable {
+	variables := []variable{}
+	for _, alloc := range s.debugger.Runtime.Allocs {
+		alloc := alloc
+		values := s.reference(func() []variable {
+			slots, err := s.debugger.Heap(alloc.From, int(alloc.To-alloc.From)+1)
+			if err != nil {
+				return []variable{}
+			}
+			variables := []variable{}
+			for i, slot := range slots {
+				variables = append(variables, variable{Name: fmt.Sprintf("[%d]", int(alloc.From)+i), Value: slot.String(), Type: slot.Tag.String()})
+			}
+			return variables
+		})
+		s.watchable[values] = "heap"
+		variables = append(variables, variable{
+			Name:               strconv.Itoa(int(alloc.From)),
+			Value:              fmt.Sprintf("%d..%d", alloc.From, alloc.To),
+			VariablesReference: values,
+		})
+	}
+	return variables
+}
+
+func (s *server) variables(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		VariablesReference int `json:"variablesReference"`
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	if args.VariablesReference < 1 || args.VariablesReference > len(s.references) {
+		return nil, fmt.Errorf("no variables with reference %d", args.VariablesReference)
+	}
+	return map[string]interface{}{"variables": s.references[args.VariablesReference-1]()}, nil
+}
+
+// Evaluates the name of a local.
+func (s *server) evaluate(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Expression string `json:"expression"`
+		FrameID    int    `json:"frameId"`
+	}
+	if err := s.started(); err != nil {
+		return nil, err
+	}
+	if err := parseArguments(arguments, &args); err != nil {
+		return nil, err
+	}
+	frame := 0
+	if args.FrameID > 0 {
+		frame = args.FrameID - 1
+	}
+	name := strings.TrimSpace(args.Expression)
+	for _, v := range s.debugger.FrameLocals(frame) {
+		if v.Name == name {
+			return map[string]interface{}{"result": v.Value.String(), "type": v.Type.String(), "variablesReference": 0}, nil
+		}
+	}
+	return nil, fmt.Errorf("no local %s in scope", name)
+}
+
+// Returns a handler running the program with run after the response.
+func resume(run func(*bytecode.Debugger) (bytecode.StopReason, error)) func(*server, json.RawMessage) (interface{}, error) {
+	return func(s *server, arguments json.RawMessage) (interface{}, error) {
+		if err := s.started(); err != nil {
+			return nil, err
+		}
+		s.after = func() { s.run(run) }
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+	}
+}
+
+func (s *server) run(run func(*bytecode.Debugger) (bytecode.StopReason, error)) {
+	s.references = nil
+	s.watchable = map[int]string{}
+	reason, err := run(s.debugger)
+	switch {
+	case err != nil:
+		s.sendEvent("output", map[string]interface{}{"category": "stderr", "output": fmt.Sprintf("runtime error: %s\n", err)})
+		s.exited(1)
+	case reason == bytecode.StopExited:
+		s.exited(0)
+	case reason == bytecode.StopBreakpoint:
+		s.stopped("breakpoint")
+	case reason == bytecode.StopWatchpoint:
+		s.watched(s.debugger.Triggered())
+	default:
+		s.stopped("step")
+	}
+}
+
+func (s *server) stopped(reason string) {
+	s.sendEvent("stopped", map[string]interface{}{"reason": reason, "threadId": threadID, "allThreadsStopped": true})
+}
+
+// Reports a stop at data breakpoints with the changes of the values.
+func (s *server) watched(events []bytecode.WatchEvent) {
+	ids := []int{}
+	changes := []string{}
+	for _, e := range events {
+		ids = append(ids, e.Watchpoint.ID)
+		if e.Freed {
+			changes = append(changes, fmt.Sprintf("%s freed", e.Watchpoint.Location))
+		} else {
+			changes = append(changes, fmt.Sprintf("%s changed from %s to %s", e.Watchpoint.Location, e.Old, e.New))
+		}
+	}
+	s.sendEvent("stopped", map[string]interface{}{"reason": "data breakpoint", "threadId": threadID, "allThreadsStopped": true,
+		"hitBreakpointIds": ids, "text": strings.Join(changes, ", ")})
+}
+
+func (s *server) exited(code int) {
+	s.sendEvent("exited", map[string]interface{}{"exitCode": code})
+	s.sendEvent("terminated", nil)
+}
+
+func (s *server) disconnect(arguments json.RawMessage) (interface{}, error) {
+	s.disconnected = true
+	return nil, nil
+}
@@ -0,0 +1,362 @@
+package dap_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"eud/bytecode"
+	"eud/dap"
+	"eud/internal/parsetest"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func load(path string) (bytecode.Program, error) {
+	if strings.HasSuffix(path, ".eudasm") {
+		source, err := os.ReadFile(path)
+		if err != nil {
+			return bytecode.Program{}, err
+		}
+		return bytecode.Assemble(string(source))
+	}
+	ast, err := parsetest.ParseFile(path)
+	if err != nil {
+		return bytecode.Program{}, err
+	}
+	program, err := bytecode.Compile(ast)
+	if err != nil {
+		return bytecode.Program{}, err
+	}
+	program.DebugInfo.File = path
+	return program, nil
+}
+
+type message = map[string]interface{}
+
+// A scripted client, which sends requests and checks the messages of the
+// server in the order they arrive.
+type client struct {
+	t    *testing.T
+	in   io.WriteCloser
+	out  *bufio.Reader
+	seq  int
+	done chan error
+}
+
+func newClient(t *testing.T) *client {
+	requests, requestsWriter := io.Pipe()
+	messagesReader, messages := io.Pipe()
+	c := &client{t: t, in: requestsWriter, out: bufio.NewReader(messagesReader), done: make(chan error, 1)}
+	go func() {
+		err := dap.Serve(requests, messages, load, bytecode.RunOptions{})
+		messages.Close()
+		c.done <- err
+	}()
+	return c
+}
+
+func (c *client) send(command string, arguments interface{}) {
+	c.t.Helper()
+	c.seq++
+	data, err := json.Marshal(message{"seq": c.seq, "type": "request", "command": command, "arguments": arguments})
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if _, err := fmt.Fprintf(c.in, "Content-Length: %d\r\n\r\n%s", len(data), data); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+func (c *client) next() message {
+	c.t.Helper()
+	length := 0
+	for {
+		line, err := c.out.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("reading header: %s", err)
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		length, err = strconv.Atoi(strings.TrimPrefix(line, "Content-Length: "))
+		if err != nil {
+			c.t.Fatalf("unexpected header %q", line)
+		}
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(c.out, data); err != nil {
+		c.t.Fatal(err)
+	}
+	var m message
+	if err := json.Unmarshal(data, &m); err != nil {
+		c.t.Fatal(err)
+	}
+	return m
+}
+
+// Reads the response to the last request, which must have succeeded, and
+// returns its body.
+func (c *client) response(command string) message {
+	c.t.Helper()
+	m := c.next()
+	if m["type"] != "response" || m["command"] != command || m["request_seq"] != float64(c.seq) {
+		c.t.Fatalf("expected a response to %s, got %v", command, m)
+	}
+	if m["success"] != true {
+		c.t.Fatalf("%s failed: %v", command, m["message"])
+	}
+	body, _ := m["body"].(message)
+	return body
+}
+
+func (c *client) failure(command string) string {
+	c.t.Helper()
+	m := c.next()
+	if m["type"] != "response" || m["command"] != command || m["success"] != false {
+		c.t.Fatalf("expected %s to fail, got %v", command, m)
+	}
+	return m["message"].(string)
+}
+
+func (c *client) event(name string) message {
+	c.t.Helper()
+	m := c.next()
+	if m["type"] != "event" || m["event"] != name {
+		c.t.Fatalf("expected a %s event, got %v", name, m)
+	}
+	body, _ := m["body"].(message)
+	return body
+}
+
+func (c *client) request(command string, arguments interface{}) message {
+	c.t.Helper()
+	c.send(command, arguments)
+	return c.response(command)
+}
+
+func (c *client) stopped(reason string) {
+	c.t.Helper()
+	if body := c.event("stopped"); body["reason"] != reason {
+		c.t.Fatalf("expected to stop for %s, stopped for %v", reason, body["reason"])
+	}
+}
+
+func (c *client) disconnect() {
+	c.t.Helper()
+	c.request("disconnect", nil)
+	c.in.Close()
+	if err := <-c.done; err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// Returns the lines and function names of the stack frames.
+func (c *client) stackTrace() []string {
+	c.t.Helper()
+	frames := []string{}
+	for _, f := range c.request("stackTrace", message{"threadId": 1})["stackFrames"].([]interface{}) {
+		frame := f.(message)
+		frames = append(frames, fmt.Sprintf("%s:%v", frame["name"], frame["line"]))
+	}
+	return frames
+}
+
+// Returns the variables of the scope of a frame as name=value.
+func (c *client) scope(frame int, name string) []string {
+	c.t.Helper()
+	for _, s := range c.request("scopes", message{"frameId": frame})["scopes"].([]interface{}) {
+		scope := s.(message)
+		if scope["name"] != name {
+			continue
+		}
+		variables := []string{}
+		body := c.request("variables", message{"variablesReference": scope["variablesReference"]})
+		for _, v := range body["variables"].([]interface{}) {
+			variable := v.(message)
+			variables = append(variables, fmt.Sprintf("%s=%s", variable["name"], variable["value"]))
+		}
+		return variables
+	}
+	c.t.Fatalf("no scope %s", name)
+	return nil
+}
+
+func expectStrings(t *testing.T, what string, got []string, expected ...string) {
+	t.Helper()
+	if strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Errorf("expected %s %v, got %v", what, expected, got)
+	}
+}
+
+func TestSession(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed to parse testdata/add.eud")
+	}
+	c := newClient(t)
+
+	capabilities := c.request("initialize", message{"adapterID": "eud"})
+	if capabilities["supportsConfigurationDoneRequest"] != true || capabilities["supportsStepBack"] != true {
+		t.Errorf("expected support for configurationDone and stepBack, got %v", capabilities)
+	}
+	c.request("launch", message{"program": "testdata/add.eud"})
+	c.event("initialized")
+
+	body := c.request("setBreakpoints", message{
+		"source":      message{"path": "testdata/add.eud"},
+		"breakpoints": []message{{"line": 3}, {"line": 20}},
+	})
+	breakpoints := body["breakpoints"].([]interface{})
+	if b := breakpoints[0].(message); b["verified"] != true || b["line"] != float64(3) {
+		t.Errorf("expected a breakpoint on line 3, got %v", b)
+	}
+	if b := breakpoints[1].(message); b["verified"] != false {
+		t.Errorf("expected no breakpoint after the last line, got %v", b)
+	}
+	c.request("configurationDone", nil)
+	c.stopped("breakpoint")
+
+	threads := c.request("threads", nil)["threads"].([]interface{})
+	if len(threads) != 1 {
+		t.Errorf("expected a single thread, got %v", threads)
+	}
+	expectStrings(t, "stack frames", c.stackTrace(), "add:3", "main:8")
+	expectStrings(t, "locals of add", c.scope(1, "Locals"), "a=I32(4)", "b=I32(3)", "c=I32(7)")
+	expectStrings(t, "locals of main", c.scope(2, "Locals"), "x=I32(4)", "y=I32(0)")
+	expectStrings(t, "value stack", c.scope(1, "Stack"), "[0]=UPTR(23)")
+	if result := c.request("evaluate", message{"expression": "c", "frameId": 1}); result["result"] != "I32(7)" {
+		t.Errorf("expected c to evaluate to I32(7), got %v", result)
+	}
+	c.send("evaluate", message{"expression": "missing"})
+	c.failure("evaluate")
+
+	c.request("stepOut", message{"threadId": 1})
+	c.stopped("step")
+	expectStrings(t, "stack frames", c.stackTrace(), "main:8")
+	c.request("next", message{"threadId": 1})
+	c.stopped("step")
+	expectStrings(t, "stack frames", c.stackTrace(), "main:9")
+	expectStrings(t, "locals of main", c.scope(1, "Locals"), "x=I32(4)", "y=I32(7)")
+
+	// back into add, to the breakpoint
+	c.request("stepBack", message{"threadId": 1})
+	c.stopped("breakpoint")
+	expectStrings(t, "stack frames", c.stackTrace(), "add:3", "main:8")
+	c.request("reverseContinue", message{"threadId": 1})
+	c.stopped("step")
+	expectStrings(t, "stack frames", c.stackTrace(), "main:1")
+	c.request("continue", message{"threadId": 1})
+	c.stopped("breakpoint")
+	expectStrings(t, "stack frames", c.stackTrace(), "add:3", "main:8")
+
+	c.request("continue", message{"threadId": 1})
+	if body := c.event("exited"); body["exitCode"] != float64(0) {
+		t.Errorf("expected exit code 0, got %v", body)
+	}
+	c.event("terminated")
+	c.disconnect()
+}
+
+func TestSessionOutput(t *testing.T) {
+	c := newClient(t)
+	c.request("initialize", nil)
+	c.request("launch", message{"program": "testdata/print.eudasm", "stopOnEntry": true})
+	c.event("initialized")
+	c.request("configurationDone", nil)
+	c.stopped("entry")
+	expectStrings(t, "stack frames", c.stackTrace(), "main:0")
+
+	c.request("continue", message{"threadId": 1})
+	if body := c.event("output"); body["output"] != "42" {
+		t.Errorf("expected the output 42, got %v", body)
+	}
+	c.event("exited")
+	c.event("terminated")
+	c.disconnect()
+}
+
+func TestSessionInput(t *testing.T) {
+	// the program must not read the input of the process
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if _, err := w.WriteString("x"); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	stdin := os.Stdin
+	os.Stdin = r
+	defer func() { os.Stdin = stdin }()
+
+	c := newClient(t)
+	c.request("initialize", nil)
+	c.request("launch", message{"program": "testdata/read.eudasm"})
+	c.event("initialized")
+	c.request("configurationDone", nil)
+	if body := c.event("output"); body["output"] != "-1" {
+		t.Errorf("expected the end of the input, got %v", body)
+	}
+	c.event("exited")
+	c.event("terminated")
+	c.disconnect()
+}
+
+func TestSessionErrors(t *testing.T) {
+	c := newClient(t)
+	c.request("initialize", nil)
+	c.send("stackTrace", message{"threadId": 1})
+	if message := c.failure("stackTrace"); message != "no program was launched" {
+		t.Errorf("unexpected error %q", message)
+	}
+	c.send("launch", message{"program": "testdata/missing.eudasm"})
+	c.failure("launch")
+	c.send("readMemory", nil)
+	c.failure("readMemory")
+	c.disconnect()
+}
+
+func TestSessionDataBreakpoints(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("python3 is needed to parse testdata/add.eud")
+	}
+	c := newClient(t)
+	if capabilities := c.request("initialize", nil); capabilities["supportsDataBreakpoints"] != true {
+		t.Errorf("expected support for data breakpoints, got %v", capabilities)
+	}
+	c.request("launch", message{"program": "testdata/add.eud"})
+	c.event("initialized")
+	c.request("setBreakpoints", message{"source": message{"path": "testdata/add.eud"}, "breakpoints": []message{{"line": 9}}})
+	c.request("configurationDone", nil)
+	c.stopped("breakpoint")
+
+	var locals interface{}
+	for _, s := range c.request("scopes", message{"frameId": 1})["scopes"].([]interface{}) {
+		if scope := s.(message); scope["name"] == "Locals" {
+			locals = scope["variablesReference"]
+		}
+	}
+	info := c.request("dataBreakpointInfo", message{"variablesReference": locals, "name": "y"})
+	if info["dataId"] != "local:y" {
+		t.Fatalf("expected the data id local:y, got %v", info)
+	}
+	body := c.request("setDataBreakpoints", message{"breakpoints": []message{{"dataId": "local:y"}, {"dataId": "local:missing"}}})
+	breakpoints := body["breakpoints"].([]interface{})
+	if breakpoints[0].(message)["verified"] != true || breakpoints[1].(message)["verified"] != false {
+		t.Errorf("expected a data breakpoint on y only, got %v", breakpoints)
+	}
+
+	c.request("continue", message{"threadId": 1})
+	if stop := c.event("stopped"); stop["reason"] != "data breakpoint" || stop["text"] != "y changed from I32(7) to I32(8)" {
+		t.Errorf("expected to stop for the change of y, got %v", stop)
+	}
+	c.request("continue", message{"threadId": 1})
+	c.event("exited")
+	c.event("terminated")
+	c.disconnect()
+}
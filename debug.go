@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"eud/bytecode"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const debugHelp = `commands:
+  break, b <line|function>  set a breakpoint
+  watch <name>              stop when a local variable changes
+  watch <addr> [count]      stop when values of the heap change or are freed
+  delete <id>               delete a breakpoint or watchpoint
+  breakpoints               list the breakpoints and watchpoints
+  step, s                   run to the next statement, entering calls
+  next, n                   run to the next statement, stepping over calls
+  finish                    run until the current function returns
+  continue, c               run until a breakpoint or the end
+  stepi                     execute a single instruction
+  reverse-step, rs          run back to the previous statement, entering calls
+  reverse-next, rn          run back to the previous statement, stepping over calls
+  reverse-finish            run back to the call of the current function
+  reverse-continue, rc      run back to a breakpoint or the start of the history
+  reverse-stepi, rsi        undo a single instruction
+  last-write, lw <name>     run back to the last write of a local variable
+  print, p <name>           print a local variable
+  locals                    print the local variables in scope
+  x <addr> [count]          print values of the heap
+  backtrace, bt             print the call stack
+  stack                     print the value stack
+  list, l                   print the source around the current line
+  help                      print this help
+  quit, q                   exit the debugger
+an empty line repeats the last command`
+
+// Returns the input of a program run under a debugger, whose stdin carries
+// the commands: the file of --input, or an empty input.
+func debugInput(options Options) io.Reader {
+	if options.Input == "" {
+		return strings.NewReader("")
+	}
+	file, err := os.Open(options.Input)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return file
+}
+
+// eud debug file [options], runs a program under an interactive debugger
+func debugCommand(args []string) {
+	file := getFileFromArgs(args)
+	options := getOptionsFromArgs(args[1:])
+	options.Quiet = true
+
+	var program bytecode.Program
+	if strings.HasSuffix(file, ".eudc") {
+		program = bytecode.Optimize(loadBytecodeFile(file), options.OptimizationLevel)
+	} else {
+		var ok bool
+		if program, ok = compileFile(file, options); !ok {
+			fmt.Println("the register backend can't be debugged")
+			os.Exit(1)
+		}
+	}
+	if err := bytecode.Verify(program); err != nil {
+		log.Fatal(err)
+	}
+
+	d := bytecode.NewDebugger(program, bytecode.RunOptions{
+		Stdin:         debugInput(options),
+		MaxStackSize:  options.MaxStackSize,
+		MaxHeapSize:   options.MaxHeapSize,
+		GC:            options.GC,
+		ThreadQuantum: options.ThreadQuantum,
+	})
+	fmt.Printf("debugging %s, %d instructions, type help for the commands\n", file, len(program.Instructions))
+	printDebugLocation(os.Stdout, d)
+
+	input := bufio.NewScanner(os.Stdin)
+	last := ""
+	for {
+		fmt.Print("(eud) ")
+		if !input.Scan() {
+			fmt.Println()
+			return
+		}
+		line := strings.TrimSpace(input.Text())
+		if line == "" {
+			line = last
+		}
+		last = line
+		if !runDebugCommand(os.Stdout, d, line) {
+			return
+		}
+	}
+}
+
+// Runs a command of the debugger, returns false to quit.
+func runDebugCommand(out io.Writer, d *bytecode.Debugger, line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return true
+	}
+	command, args := fields[0], fields[1:]
+
+	// commands resuming the program
+	var resume func() (bytecode.StopReason, error)
+	switch command {
+	case "step", "s":
+		resume = d.Step
+	case "next", "n":
+		resume = d.Next
+	case "finish":
+		resume = d.Finish
+	case "continue", "c":
+		resume = d.Continue
+	case "stepi", "si":
+		resume = func() (bytecode.StopReason, error) {
+			return bytecode.StopStep, d.StepInstruction()
+		}
+	}
+	// commands running the program backwards
+	reverse := true
+	switch command {
+	case "reverse-step", "rs":
+		resume = d.StepBack
+	case "reverse-next", "rn":
+		resume = d.ReverseNext
+	case "reverse-finish":
+		resume = d.ReverseFinish
+	case "reverse-continue", "rc":
+		resume = d.ReverseContinue
+	case "reverse-stepi", "rsi":
+		resume = d.StepBackInstruction
+	case "last-write", "lw":
+		if len(args) != 1 {
+			fmt.Fprintln(out, "usage: last-write <name>")
+			return true
+		}
+		if _, ok := d.Local(args[0]); !ok {
+			fmt.Fprintf(out, "no local %s in scope\n", args[0])
+			return true
+		}
+		resume = func() (bytecode.StopReason, error) { return d.ReverseToWrite(args[0]) }
+	default:
+		reverse = false
+	}
+	if resume != nil {
+		if d.Exited() && !reverse {
+			fmt.Fprintln(out, "the program has exited")
+			return true
+		}
+		reason, err := resume()
+		if err != nil {
+			fmt.Fprintf(out, "runtime error: %s\n", err)
+			return true
+		}
+		if reason == bytecode.StopExited || d.Exited() {
+			fmt.Fprintln(out, "the program has exited")
+			return true
+		}
+		if reason == bytecode.StopStart {
+			fmt.Fprintln(out, "reached the start of the history")
+		}
+		if reason == bytecode.StopWatchpoint {
+			printWatchEvents(out, d)
+		}
+		if reason == bytecode.StopBreakpoint {
+			for _, b := range d.Breakpoints() {
+				if b.Pc == d.Runtime.Pc {
+					fmt.Fprintf(out, "breakpoint %d, %s\n", b.ID, b.Location)
+				}
+			}
+		}
+		printDebugLocation(out, d)
+		return true
+	}
+
+	switch command {
+	case "break", "b":
+		if len(args) != 1 {
+			fmt.Fprintln(out, "usage: break <line|function>")
+			return true
+		}
+		var b bytecode.Breakpoint
+		var err error
+		if line, convErr := strconv.Atoi(args[0]); convErr == nil {
+			b, err = d.BreakAtLine(line)
+		} else {
+			b, err = d.BreakAtFunction(args[0])
+		}
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return true
+		}
+		fmt.Fprintf(out, "breakpoint %d at %s, pc %d\n", b.ID, b.Location, b.Pc)
+	case "delete", "d":
+		id, err := debugArgument(args, 0)
+		if err == nil {
+			err = d.Delete(id)
+		}
+		if err != nil {
+			fmt.Fprintln(out, err)
+		}
+	case "watch", "w":
+		var w bytecode.Watchpoint
+		var err error
+		if addr, convErr := debugArgument(args, 0); convErr == nil {
+			count := 1
+			if len(args) > 1 {
+				count, err = debugArgument(args, 1)
+			}
+			if err != nil || addr < 0 || count < 1 {
+				fmt.Fprintln(out, "usage: watch <addr> [count]")
+				return true
+			}
+			w, err = d.WatchHeap(uintptr(addr), uintptr(addr+count-1), nil)
+		} else if len(args) == 1 {
+			w, err = d.WatchLocal(args[0], nil)
+		} else {
+			fmt.Fprintln(out, "usage: watch <name> or watch <addr> [count]")
+			return true
+		}
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return true
+		}
+		fmt.Fprintf(out, "watchpoint %d on %s\n", w.ID, w.Location)
+	case "breakpoints", "info":
+		for _, b := range d.Breakpoints() {
+			fmt.Fprintf(out, "%d\t%s, pc %d\n", b.ID, b.Location, b.Pc)
+		}
+		for _, w := range d.Watchpoints() {
+			fmt.Fprintf(out, "%d\twatch %s\n", w.ID, w.Location)
+		}
+	case "print", "p":
+		if len(args) != 1 {
+			fmt.Fprintln(out, "usage: print <name>")
+			return true
+		}
+		v, ok := d.Local(args[0])
+		if !ok {
+			fmt.Fprintf(out, "no local %s in scope\n", args[0])
+			return true
+		}
+		fmt.Fprintf(out, "%s: %s = %s\n", v.Name, v.Type, v.Value)
+	case "locals":
+		for _, v := range d.Locals() {
+			fmt.Fprintf(out, "%s: %s = %s\n", v.Name, v.Type, v.Value)
+		}
+	case "x", "heap":
+		addr, err := debugArgument(args, 0)
+		count := 1
+		if err == nil && len(args) > 1 {
+			count, err = debugArgument(args, 1)
+		}
+		if err != nil {
+			fmt.Fprintln(out, "usage: x <addr> [count]")
+			return true
+		}
+		values, err := d.Heap(uintptr(addr), count)
+		if err != nil {
+			fmt.Fprintln(out, err)
+			return true
+		}
+		for i, v := range values {
+			fmt.Fprintf(out, "%d:\t%s\n", addr+i, v)
+		}
+	case "backtrace", "bt":
+		for i, frame := range d.Backtrace() {
+			if frame.HasPosition {
+				fmt.Fprintf(out, "#%d %s at %s:%d, pc %d\n", i, frame.Function, d.Program.DebugInfo.File, frame.Position.Line, frame.Pc)
+			} else {
+				fmt.Fprintf(out, "#%d %s, pc %d\n", i, frame.Function, frame.Pc)
+			}
+		}
+	case "stack":
+		fmt.Fprintln(out, d.Runtime.String())
+	case "list", "l":
+		entry, ok := d.Position()
+		if !ok {
+			fmt.Fprintln(out, "no source line for the current instruction")
+			return true
+		}
+		lines := strings.Count(strings.TrimRight(d.Program.DebugInfo.Source, "\n"), "\n") + 1
+		for line := entry.Line - 3; line <= entry.Line+3; line++ {
+			if line < 1 || line > lines {
+				continue
+			}
+			marker := "  "
+			if line == entry.Line {
+				marker = "=>"
+			}
+			fmt.Fprintf(out, "%s %d: %s\n", marker, line, d.Program.DebugInfo.SourceLine(line))
+		}
+	case "help", "h":
+		fmt.Fprintln(out, debugHelp)
+	case "quit", "q":
+		return false
+	default:
+		fmt.Fprintf(out, "unknown command %q, type help for the commands\n", command)
+	}
+	return true
+}
+
+func debugArgument(args []string, i int) (int, error) {
+	if i >= len(args) {
+		return 0, fmt.Errorf("missing argument")
+	}
+	return strconv.Atoi(args[i])
+}
+
+// Prints the changes which stopped the program at watchpoints.
+func printWatchEvents(out io.Writer, d *bytecode.Debugger) {
+	for _, e := range d.Triggered() {
+		where := fmt.Sprintf("pc %d", e.Pc)
+		if e.HasPosition {
+			where = fmt.Sprintf("%s:%d", d.Program.DebugInfo.File, e.Position.Line)
+		}
+		switch {
+		case e.Freed:
+			fmt.Fprintf(out, "watchpoint %d, %s freed at %s\n", e.Watchpoint.ID, e.Watchpoint.Location, where)
+		case e.Watchpoint.Local != "":
+			fmt.Fprintf(out, "watchpoint %d, %s changed at %s\n  old = %s\n  new = %s\n", e.Watchpoint.ID, e.Watchpoint.Local, where, e.Old, e.New)
+		default:
+			fmt.Fprintf(out, "watchpoint %d, heap %d changed at %s\n  old = %s\n  new = %s\n", e.Watchpoint.ID, e.Addr, where, e.Old, e.New)
+		}
+	}
+}
+
+// Prints the source line of the current instruction, or the instruction if
+// there is no line for it.
+func printDebugLocation(out io.Writer, d *bytecode.Debugger) {
+	if d.Exited() {
+		fmt.Fprintln(out, "the program has exited")
+		return
+	}
+	if thread := d.Runtime.Thread(); thread != 0 {
+		fmt.Fprintf(out, "thread %d: ", thread)
+	}
+	pc := d.Runtime.Pc
+	if entry, ok := d.Position(); ok {
+		fmt.Fprintf(out, "%s:%d in %s: %s\n", d.Program.DebugInfo.File, entry.Line, entry.Function, strings.TrimSpace(d.Program.DebugInfo.SourceLine(entry.Line)))
+		return
+	}
+	fmt.Fprintf(out, "pc %d in %s: %s\n", pc, d.Function(), d.Program.Instructions[pc])
+}
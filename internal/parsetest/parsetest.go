@@ -0,0 +1,35 @@
+// Package parsetest parses Eud source files for the tests of the other
+// packages, with parser.py at the root of the module. Tests run in the
+// directory of their package, one level below the root.
+package parsetest
+
+import (
+	"eud/astjson"
+	"eud/parser"
+	"fmt"
+	"os/exec"
+	"testing"
+)
+
+// Parses file with parser.py.
+func ParseFile(file string) ([]parser.BaseStatement, error) {
+	out, err := exec.Command("python3", "../parser.py", file).Output()
+	if err != nil {
+		return nil, fmt.Errorf("parser.py %s: %w", file, err)
+	}
+	return astjson.Parse(string(out)), nil
+}
+
+// Parses file with parser.py, skipping the test when python3 isn't
+// installed and failing it when file can't be parsed.
+func Parse(t testing.TB, file string) []parser.BaseStatement {
+	t.Helper()
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skipf("python3 is needed to parse %s", file)
+	}
+	ast, err := ParseFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ast
+}
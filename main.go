@@ -1,63 +1,380 @@
 package main
 
 import (
+	"bufio"
+	"context"
 	"errors"
 	"eud/astjson"
 	"eud/bytecode"
+	"eud/dap"
 	"eud/parser"
+	"eud/register"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
 	"os/exec"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
 type Options struct {
 	NoRuntimeDebug bool
+	MaxStackSize   uint
+	MaxHeapSize    uint
+	// instructions a thread runs before the next one, 0 for the default
+	ThreadQuantum uint
+	// free unreachable allocations automatically
+	GC                bool
+	Backend           string
+	OptimizationLevel int
+	// output file of eud build
+	Output string
+	// don't print the input, AST and instructions while compiling
+	Quiet bool
+	// profile the program or record its coverage, the reports are written
+	// to OutputBase with extensions added, by default next to the input
+	Profile    bool
+	Cover      bool
+	OutputBase string
+	// write a JSON trace of the executed instructions to TracePath, by
+	// default OutputBase with .trace.jsonl added
+	Trace       bool
+	TracePath   string
+	TraceFilter bytecode.TraceFilter
+	// write a JSON dump of the heap at the end of the run, also when it
+	// fails, to HeapDumpPath, by default OutputBase with .heap.json added
+	HeapDump     bool
+	HeapDumpPath string
+	// record the results of syscalls such as input reads to this file, for
+	// eud replay
+	Record string
+	// write a snapshot of the runtime to this file when interrupted, and
+	// every SnapshotEvery instructions if it isn't 0, for eud resume
+	Snapshot      string
+	SnapshotEvery uint64
+	// the input of a program run by eud debug or eud dap, whose stdin
+	// carries the commands, empty if not given
+	Input string
 }
 
 func main() {
-	file := getFileFromArgs()
-	options := getOptionsFromArgs()
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "build":
+			buildCommand(os.Args[2:])
+			return
+		case "run":
+			runCommand(os.Args[2:])
+			return
+		case "debug":
+			debugCommand(os.Args[2:])
+			return
+		case "dap":
+			dapCommand(os.Args[2:])
+			return
+		case "test":
+			testCommand(os.Args[2:])
+			return
+		case "replay":
+			replayCommand(os.Args[2:])
+			return
+		case "resume":
+			resumeCommand(os.Args[2:])
+			return
+		}
+	}
+	runCommand(os.Args[1:])
+}
 
-	file_bytes, err := ioutil.ReadFile(file)
+// eud build file [-o out.eudc] [options], compiles file to a .eudc file
+func buildCommand(args []string) {
+	file := getFileFromArgs(args)
+	options := getOptionsFromArgs(args[1:])
+	if options.Output == "" {
+		options.Output = strings.TrimSuffix(file, filepath.Ext(file)) + ".eudc"
+	}
+
+	program, ok := compileFile(file, options)
+	if !ok {
+		fmt.Println("the register backend can't be written to a .eudc file")
+		os.Exit(1)
+	}
+	if err := bytecode.Verify(program); err != nil {
+		log.Fatal(err)
+	}
+	data, err := bytecode.Marshal(program)
 	if err != nil {
 		log.Fatal(err)
 	}
+	if err := ioutil.WriteFile(options.Output, data, 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("\033[1;36mWrote %s\033[0m (%d instructions, %d bytes)\n", options.Output, len(program.Instructions), len(data))
+}
 
-	text := string(file_bytes)
+// eud test [files or directories] [options], runs every program, the .eud
+// files of directories, and reports the ones which don't compile or fail with
+// a runtime error. With --cover the coverage of every file is written next
+// to it as HTML and of all files to coverage.lcov.
+func testCommand(args []string) {
+	options := getOptionsFromArgs(args)
+	options.Quiet = true
+	options.NoRuntimeDebug = true
+	files := []string{}
+	for _, arg := range args {
+		if strings.HasPrefix(arg, "-") {
+			continue
+		}
+		info, err := os.Stat(arg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		matches, err := filepath.Glob(filepath.Join(arg, "*.eud"))
+		if err != nil {
+			log.Fatal(err)
+		}
+		files = append(files, matches...)
+	}
+	if len(files) == 0 {
+		fmt.Println("no files given")
+		os.Exit(1)
+	}
 
-	fmt.Printf("\033[1;36mInput:\033[0m\n%s\n\n", text)
+	failed := 0
+	var lcov strings.Builder
+	for _, file := range files {
+		program, _, err := tryCompileFile(file, options)
+		if err != nil {
+			fmt.Printf("FAIL\t%s\n\t%s\n", file, err)
+			failed++
+			continue
+		}
+		if err := bytecode.Verify(program); err != nil {
+			fmt.Printf("FAIL\t%s: %s\n", file, err)
+			failed++
+			continue
+		}
+		options.OutputBase = strings.TrimSuffix(file, filepath.Ext(file))
+		runtime, coverage, err := executeProgram(program, options)
+		status := "ok"
+		if err != nil {
+			status = "FAIL"
+			failed++
+			if entry, ok := program.DebugInfo.LineAt(runtime.Pc); ok {
+				err = fmt.Errorf("%s:%d:%d: %w", program.DebugInfo.File, entry.Line, entry.Col, err)
+			}
+		}
+		fmt.Printf("%s\t%s (%d instructions executed)\n", status, file, runtime.Executed)
+		if err != nil {
+			fmt.Printf("\t%s\n", err)
+		}
+		if coverage != nil {
+			coverage.WriteText(os.Stdout)
+			coverage.WriteLCOV(&lcov)
+			writeOutputFile(options.OutputBase+".cover.html", coverage.WriteHTML)
+		}
+	}
+	if options.Cover {
+		writeOutputFile("coverage.lcov", func(w io.Writer) error {
+			_, err := io.WriteString(w, lcov.String())
+			return err
+		})
+	}
+	if failed > 0 {
+		fmt.Printf("%d of %d programs failed\n", failed, len(files))
+		os.Exit(1)
+	}
+}
 
-	ast := parseUsingPythonParser(text, file)
+// eud dap [options], serves the Debug Adapter Protocol on stdin and stdout
+func dapCommand(args []string) {
+	options := getOptionsFromArgs(args)
+	options.Quiet = true
+	load := func(file string) (bytecode.Program, error) {
+		if !fileExists(file) {
+			return bytecode.Program{}, fmt.Errorf("file %q does not exist", file)
+		}
+		if strings.HasSuffix(file, ".eudc") {
+			data, err := ioutil.ReadFile(file)
+			if err != nil {
+				return bytecode.Program{}, err
+			}
+			program, err := bytecode.Unmarshal(data)
+			if err != nil {
+				return bytecode.Program{}, fmt.Errorf("%s: %w", file, err)
+			}
+			return bytecode.Optimize(program, options.OptimizationLevel), nil
+		}
+		options.Backend = "stack"
+		program, _, err := tryCompileFile(file, options)
+		return program, err
+	}
+	err := dap.Serve(os.Stdin, os.Stdout, load, bytecode.RunOptions{
+		Stdin:         debugInput(options),
+		MaxStackSize:  options.MaxStackSize,
+		MaxHeapSize:   options.MaxHeapSize,
+		GC:            options.GC,
+		ThreadQuantum: options.ThreadQuantum,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+}
 
-	// fmt.Printf("%s\n", ast)
-	for i := range ast {
-		fmt.Printf("%s\n", ast[i].StringNested(1))
+// eud [run] file [options], runs source code, assembly or a .eudc file
+func runCommand(args []string) {
+	file := getFileFromArgs(args)
+	options := getOptionsFromArgs(args[1:])
+	if options.OutputBase == "" {
+		options.OutputBase = strings.TrimSuffix(file, filepath.Ext(file))
 	}
 
-	println("\033[1;36mCompiling AST:\033[0m")
+	if strings.HasSuffix(file, ".eudc") {
+		runProgram(bytecode.Optimize(loadBytecodeFile(file), options.OptimizationLevel), options)
+		return
+	}
 
-	program, err := bytecode.Compile(ast)
+	program, ok := compileFile(file, options)
+	if ok {
+		runProgram(program, options)
+	}
+}
 
+func loadBytecodeFile(file string) bytecode.Program {
+	data, err := ioutil.ReadFile(file)
 	if err != nil {
 		log.Fatal(err)
-		return
+	}
+	program, err := bytecode.Unmarshal(data)
+	if err != nil {
+		log.Fatalf("%s: %s", file, err)
+	}
+	return program
+}
+
+// Compiles and optimizes a source or assembly file, exiting when it can't.
+// With the register backend the program is run right away and ok is false.
+func compileFile(file string, options Options) (program bytecode.Program, ok bool) {
+	program, ok, err := tryCompileFile(file, options)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return program, ok
+}
+
+// Compiles and optimizes a source or assembly file like compileFile, but
+// returns an error when the file can't be read, parsed or compiled.
+func tryCompileFile(file string, options Options) (program bytecode.Program, ok bool, err error) {
+	file_bytes, err := ioutil.ReadFile(file)
+	if err != nil {
+		return bytecode.Program{}, false, err
 	}
 
+	text := string(file_bytes)
+
+	if !options.Quiet {
+		fmt.Printf("\033[1;36mInput:\033[0m\n%s\n\n", text)
+	}
+
+	if strings.HasSuffix(file, ".eudasm") {
+		if !options.Quiet {
+			println("\033[1;36mAssembling:\033[0m")
+		}
+		program, err = bytecode.Assemble(text)
+		if err != nil {
+			return bytecode.Program{}, false, err
+		}
+	} else {
+		ast, err := parseUsingPythonParser(text, file, options.Quiet)
+		if err != nil {
+			return bytecode.Program{}, false, err
+		}
+
+		if !options.Quiet {
+			// fmt.Printf("%s\n", ast)
+			for i := range ast {
+				fmt.Printf("%s\n", ast[i].StringNested(1))
+			}
+
+			println("\033[1;36mCompiling AST:\033[0m")
+		}
+
+		if options.Backend == "register" {
+			runRegisterBackend(ast)
+			return bytecode.Program{}, false, nil
+		}
+
+		program, err = bytecode.Compile(ast)
+		if err != nil {
+			return bytecode.Program{}, false, fmt.Errorf("%s: %w", file, err)
+		}
+	}
+
+	if program.DebugInfo == nil {
+		program.DebugInfo = &bytecode.DebugInfo{}
+	}
+	program.DebugInfo.File, program.DebugInfo.Source = file, text
+	return bytecode.Optimize(program, options.OptimizationLevel), true, nil
+}
+
+func runProgram(program bytecode.Program, options Options) {
+	line := 0
 	for i := range program.Instructions {
+		// the source line before the first of its instructions
+		if entry, ok := program.DebugInfo.LineAt(uintptr(i)); ok && entry.Line != line {
+			line = entry.Line
+			fmt.Printf("\033[2m%d: %s\033[0m\n", entry.Line, strings.TrimSpace(program.DebugInfo.SourceLine(entry.Line)))
+		}
 		fmt.Printf("  %d:\t%s\n", i, program.Instructions[i].String())
 	}
 
+	if err := bytecode.Verify(program); err != nil {
+		log.Fatal(err)
+	}
+
 	println("\033[1;36mRunning bytecode:\033[0m")
 
 	program.RunWithDebug = !options.NoRuntimeDebug
-	runtime := bytecode.Run(program)
-
-	last_useful_index := findLastUsefulIndex(runtime)
+	runtime, coverage, err := executeProgram(program, options)
+	if coverage != nil {
+		println("\033[1;36mCoverage:\033[0m")
+		coverage.WriteText(os.Stdout)
+		writeOutputFile(options.OutputBase+".lcov", coverage.WriteLCOV)
+		writeOutputFile(options.OutputBase+".cover.html", coverage.WriteHTML)
+	}
+	if options.HeapDump {
+		path := options.HeapDumpPath
+		if path == "" {
+			path = options.OutputBase + ".heap.json"
+		}
+		writeOutputFile(path, runtime.DumpHeap().WriteJSON)
+	}
+	if options.GC {
+		stats := runtime.GCStats()
+		fmt.Printf("\033[1;36mGC:\033[0m %d collections freed %d allocations of %d values, %d allocations of %d values live after the last\n",
+			stats.Collections, stats.Freed, stats.FreedValues, stats.Live, stats.LiveValues)
+	}
+	printResult(program, runtime, err)
+}
 
-	// fmt.Printf("\033[1;36mResult:\033[0m\n%s\n\nStack: %s\n", text, runtime.Stack[:last_useful_index])
+// Prints the stack and the locals of a finished run, or exits with its error.
+func printResult(program bytecode.Program, runtime bytecode.Runtime, err error) {
+	if err != nil {
+		if entry, ok := program.DebugInfo.LineAt(runtime.Pc); ok {
+			log.Fatalf("%s:%d:%d: %s", program.DebugInfo.File, entry.Line, entry.Col, err)
+		}
+		log.Fatal(err)
+	}
 
 	locals_str := "["
 	locals_str_first := true
@@ -71,16 +388,254 @@ func main() {
 	}
 	locals_str += "]"
 
-	fmt.Printf("\033[1;36mResult:\033[0m\n  Stack: %s\n  Locals: %s\n", runtime.Stack[:last_useful_index], locals_str)
+	fmt.Printf("\033[1;36mResult:\033[0m\n  Stack: %s\n  Locals: %s\n", runtime.Stack[:runtime.Sp], locals_str)
 }
 
-func getFileFromArgs() string {
-	if len(os.Args) == 1 {
+// Runs program, step by step with a profiler, coverage counters or a tracer if
+// options enable them. The profile is written to OutputBase with the
+// extensions .pprof for go tool pprof and .folded for flame graphs.
+func executeProgram(program bytecode.Program, options Options) (bytecode.Runtime, *bytecode.Coverage, error) {
+	runOptions := bytecode.RunOptions{
+		MaxStackSize:  options.MaxStackSize,
+		MaxHeapSize:   options.MaxHeapSize,
+		GC:            options.GC,
+		ThreadQuantum: options.ThreadQuantum,
+	}
+	var recording *bytecode.Recording
+	if options.Record != "" {
+		recording = bytecode.NewRecording(program, runOptions)
+		runOptions.Record = recording
+	}
+	if !options.Profile && !options.Cover && !options.Trace {
+		runtime := bytecode.NewRuntime(program, runOptions)
+		err := resumeProgram(runtime, options)
+		writeRecording(options.Record, recording, runtime, err)
+		return *runtime, nil, err
+	}
+
+	var profiler *bytecode.Profiler
+	var coverage *bytecode.Coverage
+	if options.Profile {
+		profiler = bytecode.NewProfiler(program)
+	}
+	if options.Cover {
+		coverage = bytecode.NewCoverage(program)
+	}
+	var tracer *bytecode.Tracer
+	var traceFile *bufio.Writer
+	tracePath := options.TracePath
+	if options.Trace {
+		if tracePath == "" {
+			tracePath = options.OutputBase + ".trace.jsonl"
+		}
+		f, err := os.Create(tracePath)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		traceFile = bufio.NewWriter(f)
+		tracer = bytecode.NewTracer(traceFile, program, options.TraceFilter)
+	}
+	runtime := bytecode.NewRuntime(program, runOptions)
+	_, err := runtime.RunUntil(func(r *bytecode.Runtime) bool {
+		if profiler != nil {
+			profiler.Sample(r)
+		}
+		if coverage != nil {
+			coverage.Record(r)
+		}
+		if tracer != nil {
+			tracer.Record(r)
+		}
+		return false
+	})
+	if tracer != nil {
+		// the error of the program is in the trace, only failing to write
+		// it is fatal here
+		if traceErr := tracer.Stop(runtime, err); traceErr != nil && traceErr != err {
+			log.Fatal(traceErr)
+		}
+		if err := traceFile.Flush(); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("\033[1;36mWrote %s\033[0m\n", tracePath)
+	}
+	if profiler != nil {
+		profiler.Stop()
+		println("\033[1;36mProfile:\033[0m")
+		profiler.WriteSummary(os.Stdout, 10)
+		writeOutputFile(options.OutputBase+".pprof", profiler.WritePprof)
+		writeOutputFile(options.OutputBase+".folded", profiler.WriteFolded)
+	}
+	writeRecording(options.Record, recording, runtime, err)
+	return *runtime, coverage, err
+}
+
+// Continues runtime until the program ends. With a snapshot file in options,
+// a snapshot is written to it every SnapshotEvery instructions, and when the
+// process is interrupted or terminated, which then exits.
+func resumeProgram(runtime *bytecode.Runtime, options Options) error {
+	if options.Snapshot == "" {
+		return bytecode.Resume(context.Background(), runtime, bytecode.RunOptions{})
+	}
+	c, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	for {
+		err := bytecode.Resume(c, runtime, bytecode.RunOptions{InstructionLimit: options.SnapshotEvery})
+		var limit bytecode.InstructionLimitError
+		var cancelled bytecode.CancelledError
+		switch {
+		case errors.As(err, &limit):
+			writeSnapshot(options.Snapshot, runtime)
+		case errors.As(err, &cancelled):
+			writeSnapshot(options.Snapshot, runtime)
+			fmt.Printf("\n\033[1;36mStopped after %d instructions, wrote %s\033[0m\n", runtime.Executed, options.Snapshot)
+			os.Exit(1)
+		default:
+			return err
+		}
+	}
+}
+
+// Writes a snapshot of runtime to path, the previous snapshot is only
+// replaced once the new one is complete.
+func writeSnapshot(path string, runtime *bytecode.Runtime) {
+	data, err := runtime.Snapshot()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+".tmp", data, 0644); err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// eud resume snapshot program [options], continues the run a snapshot was
+// taken of. The program has to be built the way it was for that run, from its
+// source, assembly or .eudc file.
+func resumeCommand(args []string) {
+	file := getFileFromArgs(args)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	options := getOptionsFromArgs(args[2:])
+	program := loadProgram(getFileFromArgs(args[1:]), options, "resumed")
+	program.RunWithDebug = !options.NoRuntimeDebug
+	runtime, err := bytecode.RestoreRuntime(program, data, bytecode.RunOptions{ThreadQuantum: options.ThreadQuantum})
+	if err != nil {
+		log.Fatalf("%s: %s", file, err)
+	}
+	err = resumeProgram(runtime, options)
+	printResult(program, *runtime, err)
+}
+
+// Loads a .eudc file, or compiles a source or assembly file without printing
+// the steps, for commands which continue or repeat a run of it.
+func loadProgram(file string, options Options, action string) bytecode.Program {
+	options.Quiet = true
+	if strings.HasSuffix(file, ".eudc") {
+		return bytecode.Optimize(loadBytecodeFile(file), options.OptimizationLevel)
+	}
+	program, ok := compileFile(file, options)
+	if !ok {
+		fmt.Printf("the register backend can't be %s\n", action)
+		os.Exit(1)
+	}
+	return program
+}
+
+// Completes recording with how the run ended and writes it to path, nothing
+// is written without a recording.
+func writeRecording(path string, recording *bytecode.Recording, runtime *bytecode.Runtime, err error) {
+	if recording == nil {
+		return
+	}
+	recording.Finish(runtime, err)
+	writeOutputFile(path, func(w io.Writer) error {
+		data, err := recording.Marshal()
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	})
+}
+
+// eud replay recording [program], runs the recorded program again with the
+// recorded syscall results, or another build of it given as a source,
+// assembly or .eudc file, and checks that it does what the recorded run did.
+// Only the output of the program is written to stdout.
+func replayCommand(args []string) {
+	file := getFileFromArgs(args)
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	recording, err := bytecode.UnmarshalRecording(data)
+	if err != nil {
+		log.Fatalf("%s: %s", file, err)
+	}
+	program := recording.Program
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		program = loadProgram(getFileFromArgs(args[1:]), getOptionsFromArgs(args[2:]), "replayed")
+	}
+
+	runtime, err := bytecode.RunWithContext(context.Background(), program, recording.RunOptions())
+	if err := recording.Verify(&runtime, err); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Fprintf(os.Stderr, "\nreplayed %d instructions and %d syscalls as recorded", runtime.Executed, len(recording.Syscalls))
+	if recording.Error != "" {
+		fmt.Fprintf(os.Stderr, ", the run failed with: %s", recording.Error)
+	}
+	fmt.Fprintln(os.Stderr)
+}
+
+func writeOutputFile(path string, write func(io.Writer) error) {
+	f, err := os.Create(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := write(f); err != nil {
+		log.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("\033[1;36mWrote %s\033[0m\n", path)
+}
+
+func runRegisterBackend(ast []parser.BaseStatement) {
+	program, err := register.Compile(ast)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for i := range program.Instructions {
+		fmt.Printf("  %d:\t%s\n", i, program.Instructions[i].String())
+	}
+
+	println("\033[1;36mRunning register code:\033[0m")
+
+	runtime := register.Run(program)
+
+	variables := make([]string, len(program.Variables))
+	for i, v := range program.Variables {
+		variables[i] = fmt.Sprintf("%s: %s", v.Name, runtime.Registers[v.Register].String())
+	}
+	fmt.Printf("\033[1;36mResult:\033[0m\n  Variables: [%s]\n", strings.Join(variables, ", "))
+}
+
+func getFileFromArgs(args []string) string {
+	if len(args) == 0 {
 		fmt.Println("no files given")
 		os.Exit(1)
 	}
 
-	file := os.Args[1]
+	file := args[0]
 
 	if !fileExists(file) {
 		fmt.Printf("file %q does not exist\n", file)
@@ -89,18 +644,123 @@ func getFileFromArgs() string {
 	return file
 }
 
-func getOptionsFromArgs() Options {
-	args := os.Args[2:]
-	options := Options{}
-	for i := range args {
-		switch args[i] {
-		case "--nodebug":
+func getOptionsFromArgs(args []string) Options {
+	options := Options{Backend: "stack"}
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "-o":
+			if i+1 == len(args) {
+				fmt.Println("-o needs an output file")
+				os.Exit(1)
+			}
+			i++
+			options.Output = args[i]
+		case args[i] == "--profile":
+			options.Profile = true
+		case strings.HasPrefix(args[i], "--profile="):
+			options.Profile = true
+			options.OutputBase = strings.TrimPrefix(args[i], "--profile=")
+		case args[i] == "--cover":
+			options.Cover = true
+		case args[i] == "--snapshot":
+			if i+1 == len(args) {
+				fmt.Println("--snapshot needs an output file")
+				os.Exit(1)
+			}
+			i++
+			options.Snapshot = args[i]
+		case strings.HasPrefix(args[i], "--snapshot-every="):
+			options.SnapshotEvery = uint64(parseSizeOption(args[i], "--snapshot-every="))
+		case args[i] == "--record":
+			if i+1 == len(args) {
+				fmt.Println("--record needs an output file")
+				os.Exit(1)
+			}
+			i++
+			options.Record = args[i]
+		case args[i] == "--input":
+			if i+1 == len(args) {
+				fmt.Println("--input needs an input file")
+				os.Exit(1)
+			}
+			i++
+			options.Input = args[i]
+		case args[i] == "--trace":
+			options.Trace = true
+		case strings.HasPrefix(args[i], "--trace="):
+			options.Trace = true
+			options.TracePath = strings.TrimPrefix(args[i], "--trace=")
+		case args[i] == "--gc":
+			options.GC = true
+		case args[i] == "--heap-dump":
+			options.HeapDump = true
+		case strings.HasPrefix(args[i], "--heap-dump="):
+			options.HeapDump = true
+			options.HeapDumpPath = strings.TrimPrefix(args[i], "--heap-dump=")
+		case strings.HasPrefix(args[i], "--trace-pc="):
+			options.Trace = true
+			options.TraceFilter.From, options.TraceFilter.To = parsePcRange(args[i], "--trace-pc=")
+		case strings.HasPrefix(args[i], "--trace-func="):
+			options.Trace = true
+			options.TraceFilter.Function = strings.TrimPrefix(args[i], "--trace-func=")
+		case args[i] == "--nodebug":
 			options.NoRuntimeDebug = true
+		case strings.HasPrefix(args[i], "--max-stack="):
+			options.MaxStackSize = parseSizeOption(args[i], "--max-stack=")
+		case strings.HasPrefix(args[i], "--max-heap="):
+			options.MaxHeapSize = parseSizeOption(args[i], "--max-heap=")
+		case strings.HasPrefix(args[i], "--thread-quantum="):
+			options.ThreadQuantum = parseSizeOption(args[i], "--thread-quantum=")
+		case args[i] == "-O":
+			options.OptimizationLevel = 1
+		case strings.HasPrefix(args[i], "-O"):
+			level, err := strconv.Atoi(strings.TrimPrefix(args[i], "-O"))
+			if err != nil || level < 0 || level > 2 {
+				fmt.Printf("invalid optimization level in %q, expected -O0, -O1 or -O2\n", args[i])
+				os.Exit(1)
+			}
+			options.OptimizationLevel = level
+		case strings.HasPrefix(args[i], "--backend="):
+			options.Backend = strings.TrimPrefix(args[i], "--backend=")
+			if options.Backend != "stack" && options.Backend != "register" {
+				fmt.Printf("unknown backend %q, expected stack or register\n", options.Backend)
+				os.Exit(1)
+			}
 		}
 	}
 	return options
 }
 
+func parseSizeOption(arg string, prefix string) uint {
+	size, err := strconv.ParseUint(strings.TrimPrefix(arg, prefix), 10, 64)
+	if err != nil {
+		fmt.Printf("invalid size in %q\n", arg)
+		os.Exit(1)
+	}
+	return uint(size)
+}
+
+// Parses FROM:TO, either of which may be left out, TO is exclusive.
+func parsePcRange(arg string, prefix string) (uintptr, uintptr) {
+	from, to, ok := strings.Cut(strings.TrimPrefix(arg, prefix), ":")
+	bounds := [2]uintptr{}
+	for i, bound := range []string{from, to} {
+		if bound == "" {
+			continue
+		}
+		pc, err := strconv.ParseUint(bound, 10, 64)
+		if err != nil {
+			ok = false
+		}
+		bounds[i] = uintptr(pc)
+	}
+	if !ok {
+		fmt.Printf("invalid pc range in %q, expected FROM:TO\n", arg)
+		os.Exit(1)
+	}
+	return bounds[0], bounds[1]
+}
+
 func fileExists(filename string) bool {
 	_, err := os.Stat(filename)
 	if errors.Is(err, os.ErrNotExist) {
@@ -111,37 +771,31 @@ func fileExists(filename string) bool {
 	return true
 }
 
-func parseUsingPythonParser(text string, filepath string) []parser.BaseStatement {
+func parseUsingPythonParser(text string, filepath string, quiet bool) ([]parser.BaseStatement, error) {
 	python_comand := "python3"
 	if runtime.GOOS == "windows" {
 		python_comand = "py"
 	}
-	fmt.Printf("\033[1;36mParsing text to AST with `%s parser.py %s -ofile`:\033[0m\n", python_comand, filepath)
+	if !quiet {
+		fmt.Printf("\033[1;36mParsing text to AST with `%s parser.py %s -ofile`:\033[0m\n", python_comand, filepath)
+	}
 	cmd := exec.Command(python_comand, "parser.py", filepath, "-ofile")
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
+	if !quiet {
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+	}
 	cmd.Stderr = os.Stderr
 	if err := cmd.Run(); err != nil {
-		fmt.Printf("parser.py: %s\n", err)
-		os.Exit(1)
+		return nil, fmt.Errorf("parser.py: %w", err)
 	}
 	asttempjsonbytes, err := ioutil.ReadFile("ast.temp.json")
 	astjsonstring := string(asttempjsonbytes)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-	println("\033[1;36mParsing AST json to internal AST:\033[0m")
-	ast := astjson.Parse(astjsonstring)
-	return ast
-}
-
-func findLastUsefulIndex(runtime bytecode.Runtime) int {
-	last_useful_index := 0
-	for i := len(runtime.Stack) - 1; i >= 0; i-- {
-		if runtime.Stack[i] != nil {
-			last_useful_index = i + 1
-			break
-		}
+	if !quiet {
+		println("\033[1;36mParsing AST json to internal AST:\033[0m")
 	}
-	return last_useful_index
+	ast := astjson.Parse(astjsonstring)
+	return ast, nil
 }
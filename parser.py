@@ -136,6 +136,8 @@ KEYWORDS: List[str] = [
     '__dealloc__',
     '__addrof__',
     '__deref__',
+    'spawn',
+    'join',
 ]
 
 class Lexer:
@@ -211,82 +213,89 @@ class Lexer:
         return tokens
 
     def make_name(self) -> Token:
+        fp = self.fp.copy()
         value = self.c
         self.next()
         while not self.done and self.c in 'abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ1234567890_':
             value += self.c
             self.next()
         if value in KEYWORDS:
-            return Token(TT.KEYWORD, value, self.fp.copy())
+            return Token(TT.KEYWORD, value, fp)
         else:
-            return Token(TT.IDENTIFIER, value, self.fp.copy())
+            return Token(TT.IDENTIFIER, value, fp)
     
     def make_int(self) -> Token:
+        fp = self.fp.copy()
         value = self.c
         self.next()
         while not self.done and self.c in '1234567890':
             value += self.c
             self.next()
-        return Token(TT.INT, value, self.fp.copy())
+        return Token(TT.INT, value, fp)
 
     def make_mul_or_exp_op(self) -> Token:
+        fp = self.fp.copy()
         value = self.c
         self.next()
         if self.c == '*':
             value += self.c
             self.next()
-            return Token(TT.EXP_OP, value, self.fp.copy())
+            return Token(TT.EXP_OP, value, fp)
         else:
-            return Token(TT.MUL_OP, value, self.fp.copy())
+            return Token(TT.MUL_OP, value, fp)
 
     def make_asgn_or_eq_op(self) -> Token:
+        fp = self.fp.copy()
         value = self.c
         self.next()
         if self.c == '=':
             value += self.c
             self.next()
-            return Token(TT.CMP_EQ_OP, value, self.fp.copy())
+            return Token(TT.CMP_EQ_OP, value, fp)
         else:
-            return Token(TT.ASGN_OP, value, self.fp.copy())
+            return Token(TT.ASGN_OP, value, fp)
 
     def make_lt_or_lte_op(self) -> Token:
+        fp = self.fp.copy()
         value = self.c
         self.next()
         if self.c == '=':
             value += self.c
             self.next()
-            return Token(TT.CMP_LTE_OP, value, self.fp.copy())
+            return Token(TT.CMP_LTE_OP, value, fp)
         else:
-            return Token(TT.CMP_LT_OP, value, self.fp.copy())
+            return Token(TT.CMP_LT_OP, value, fp)
 
     def make_gt_or_gte_op(self) -> Token:
+        fp = self.fp.copy()
         value = self.c
         self.next()
         if self.c == '=':
             value += self.c
             self.next()
-            return Token(TT.CMP_GTE_OP, value, self.fp.copy())
+            return Token(TT.CMP_GTE_OP, value, fp)
         else:
-            return Token(TT.CMP_GT_OP, value, self.fp.copy())
+            return Token(TT.CMP_GT_OP, value, fp)
 
     def make_log_not_or_ne_op(self) -> Token:
+        fp = self.fp.copy()
         value = self.c
         self.next()
         if self.c == '=':
             value += self.c
             self.next()
-            return Token(TT.CMP_NE_OP, value, self.fp.copy())
+            return Token(TT.CMP_NE_OP, value, fp)
         else:
-            return Token(TT.LNOT_OP, value, self.fp.copy())
+            return Token(TT.LNOT_OP, value, fp)
 
     def next(self):
+        self.fp.next(self.c == '\n')
         self.pos += 1
         if self.pos < len(self.text):
             self.c = self.text[self.pos]
         else:
             self.done = True
             self.c = '\0'
-        self.fp.next(self.c == '\n')
 
 
 class Node:
@@ -573,6 +582,28 @@ class FuncCall(Expression):
         argstr = ','.join(map(lambda x:x.to_json(), self.args))
         return f'{{"type":"{self.typestr()}","target":{self.target.to_json()},"args":[{argstr}],"fp":{self.fp.to_json()}}}'
 
+class Spawn(Expression):
+    def __init__(self, call: FuncCall, fp: Position) -> None:
+        super().__init__(fp)
+        self.call = call
+    
+    def __repr__(self) -> str:
+        return super().__repr__() + f'({self.call})'
+
+    def to_json(self):
+        return f'{{"type":"{self.typestr()}","call":{self.call.to_json()},"fp":{self.fp.to_json()}}}'
+
+class Join(Expression):
+    def __init__(self, target: Expression, fp: Position) -> None:
+        super().__init__(fp)
+        self.target = target
+    
+    def __repr__(self) -> str:
+        return super().__repr__() + f'({self.target})'
+
+    def to_json(self):
+        return f'{{"type":"{self.typestr()}","target":{self.target.to_json()},"fp":{self.fp.to_json()}}}'
+
 class Int(Expression):
     def __init__(self, token: Token) -> None:
         super().__init__(token.fp)
@@ -951,6 +982,26 @@ class Parser:
                 fail(f"expected ')', got {self.t}", self.t.fp)
             self.next()
             return NonStdSyscall(args[0], args[1:], fp)
+        else:
+            return self.make_spawn()
+
+    def make_spawn(self) -> Expression:
+        if self.t.type == TT.KEYWORD and self.t.value == 'spawn':
+            fp = self.t.fp
+            self.next()
+            call = self.make_func_call()
+            if not isinstance(call, FuncCall):
+                fail(f'expected function call after spawn, got {call}', fp)
+            return Spawn(call, fp)
+        else:
+            return self.make_join()
+
+    def make_join(self) -> Expression:
+        if self.t.type == TT.KEYWORD and self.t.value == 'join':
+            fp = self.t.fp
+            self.next()
+            target = self.make_spawn()
+            return Join(target, fp)
         else:
             return self.make_func_call()
 
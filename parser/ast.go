@@ -5,6 +5,18 @@ import (
 	"strings"
 )
 
+// Where a statement starts in the source. Line and Col count from 1 and are
+// zero for statements which weren't parsed from a file.
+type Position struct {
+	File string
+	Line int
+	Col  int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.File, p.Line, p.Col)
+}
+
 type StatementType int
 
 const (
@@ -20,12 +32,14 @@ const (
 
 type BaseStatement interface {
 	StatementType() StatementType
+	Position() Position
 	String() string
 	StringNested(nesting int) string
 }
 
 type FuncDefStatement struct {
 	BaseStatement
+	Pos        Position
 	Identifier Token
 	ReturnType Type
 	Parameters []TypedDeclaration
@@ -34,12 +48,14 @@ type FuncDefStatement struct {
 
 type WhileStatement struct {
 	BaseStatement
+	Pos       Position
 	Condition BaseExpression
 	Body      []BaseStatement
 }
 
 type IfElseStatement struct {
 	BaseStatement
+	Pos       Position
 	Condition BaseExpression
 	Truthy    []BaseStatement
 	Falsy     []BaseStatement
@@ -47,6 +63,7 @@ type IfElseStatement struct {
 
 type IfStatement struct {
 	BaseStatement
+	Pos       Position
 	Condition BaseExpression
 	Body      []BaseStatement
 }
@@ -160,6 +177,14 @@ type FuncCallExpression struct {
 	Arguments  []BaseExpression
 }
 
+type SpawnExpression struct {
+	Call FuncCallExpression
+}
+
+type JoinExpression struct {
+	Thread BaseExpression
+}
+
 type VarAccessExpression struct {
 	Identifier Token
 }
@@ -171,17 +196,20 @@ type IntLiteral struct {
 
 type ReturnStatement struct {
 	BaseStatement
+	Pos   Position
 	Value BaseExpression
 }
 
 type TypedInitStatement struct {
 	BaseStatement
+	Pos Position
 	TypedDeclaration
 	Value BaseExpression
 }
 
 type DeclarationStatement struct {
 	BaseStatement
+	Pos Position
 	TypedDeclaration
 }
 
@@ -194,6 +222,7 @@ type Type = Token
 
 type ExpressionStatement struct {
 	BaseStatement
+	Pos        Position
 	Expression BaseExpression
 }
 
@@ -222,6 +251,8 @@ const (
 	NonStdSyscallExpressionType
 	NonStdAddrOfExpressionType
 	NonStdDerefExpressionType
+	SpawnExpressionType
+	JoinExpressionType
 )
 
 func (n StatementType) String() string {
@@ -256,6 +287,15 @@ func (n IfElseStatement) StatementType() StatementType      { return IfElseState
 func (n IfStatement) StatementType() StatementType          { return IfStatementType }
 func (n ExpressionStatement) StatementType() StatementType  { return ExpressionStatementType }
 
+func (n DeclarationStatement) Position() Position { return n.Pos }
+func (n TypedInitStatement) Position() Position   { return n.Pos }
+func (n FuncDefStatement) Position() Position     { return n.Pos }
+func (n ReturnStatement) Position() Position      { return n.Pos }
+func (n WhileStatement) Position() Position       { return n.Pos }
+func (n IfElseStatement) Position() Position      { return n.Pos }
+func (n IfStatement) Position() Position          { return n.Pos }
+func (n ExpressionStatement) Position() Position  { return n.Pos }
+
 func (n DeclarationStatement) String() string {
 	return fmt.Sprintf("%s(%s, %s)", n.StatementType(), n.Identifier, n.DeclType)
 }
@@ -489,6 +529,10 @@ func (n ExpressionType) String() string {
 		return "non_std_deref"
 	case FuncCallExpressionType:
 		return "func_call"
+	case SpawnExpressionType:
+		return "spawn"
+	case JoinExpressionType:
+		return "join"
 	default:
 		panic("unexhaustive expressiontype")
 	}
@@ -513,6 +557,8 @@ func (n NonStdDeallocExpression) ExpressionType() ExpressionType { return NonStd
 func (n NonStdSyscallExpression) ExpressionType() ExpressionType { return NonStdSyscallExpressionType }
 func (n NonStdAddrOfExpression) ExpressionType() ExpressionType  { return NonStdAddrOfExpressionType }
 func (n NonStdDerefExpression) ExpressionType() ExpressionType   { return NonStdDerefExpressionType }
+func (n SpawnExpression) ExpressionType() ExpressionType         { return SpawnExpressionType }
+func (n JoinExpression) ExpressionType() ExpressionType          { return JoinExpressionType }
 func (n VarAccessExpression) ExpressionType() ExpressionType     { return VarAccessExpressionType }
 func (n IntLiteral) ExpressionType() ExpressionType              { return IntExpressionType }
 
@@ -573,6 +619,12 @@ func (n NonStdDerefExpression) String() string {
 func (n FuncCallExpression) String() string {
 	return fmt.Sprintf("%s(%s, %s)", n.ExpressionType(), n.Identifier, n.Arguments)
 }
+func (n SpawnExpression) String() string {
+	return fmt.Sprintf("%s(%s)", n.ExpressionType(), n.Call)
+}
+func (n JoinExpression) String() string {
+	return fmt.Sprintf("%s(%s)", n.ExpressionType(), n.Thread)
+}
 func (n VarAccessExpression) String() string {
 	return fmt.Sprintf("%s(%s)", n.ExpressionType(), n.Identifier)
 }
@@ -746,6 +798,22 @@ func (n FuncCallExpression) StringNested(nesting int) string {
 		n.Arguments,
 	)
 }
+func (n SpawnExpression) StringNested(nesting int) string {
+	return fmt.Sprintf(
+		"%s%s(%s)",
+		nstr(nesting),
+		n.ExpressionType(),
+		n.Call,
+	)
+}
+func (n JoinExpression) StringNested(nesting int) string {
+	return fmt.Sprintf(
+		"%s%s(%s)",
+		nstr(nesting),
+		n.ExpressionType(),
+		n.Thread,
+	)
+}
 func (n VarAccessExpression) StringNested(nesting int) string {
 	return fmt.Sprintf(
 		"%s%s(%s)",
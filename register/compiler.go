@@ -0,0 +1,423 @@
+package register
+
+import (
+	"eud/bytecode"
+	"eud/parser"
+	"fmt"
+)
+
+type scope struct {
+	parent    *scope
+	variables map[string]Variable
+}
+
+func (s *scope) get(name string) (Variable, error) {
+	if v, ok := s.variables[name]; ok {
+		return v, nil
+	}
+	if s.parent != nil {
+		return s.parent.get(name)
+	}
+	return Variable{}, fmt.Errorf("symbol \"%s\" undeclared", name)
+}
+
+type Compiler struct {
+	instructions []Instruction
+	functions    []Function
+	// function name to index into functions
+	functionIds map[string]uint
+	scope       *scope
+	// registers below firstTemp hold variables, the ones above are
+	// temporaries which are reused by every statement
+	firstTemp Register
+	nextTemp  Register
+	registers uint
+	// top level variables, nil while compiling a function
+	variables *[]Variable
+}
+
+func Compile(ast []parser.BaseStatement) (Program, error) {
+	variables := []Variable{}
+	ctx := Compiler{
+		instructions: []Instruction{},
+		functions:    []Function{},
+		functionIds:  make(map[string]uint),
+		scope:        &scope{parent: nil, variables: map[string]Variable{}},
+		variables:    &variables,
+	}
+	if err := compileStatements(&ctx, ast); err != nil {
+		return Program{}, err
+	}
+	return Program{
+		Instructions: ctx.instructions,
+		Functions:    ctx.functions,
+		Registers:    ctx.registers,
+		Variables:    variables,
+	}, nil
+}
+
+func (ctx *Compiler) emit(i Instruction) {
+	ctx.instructions = append(ctx.instructions, i)
+}
+
+func (ctx *Compiler) temp() Register {
+	r := ctx.nextTemp
+	ctx.nextTemp++
+	if uint(ctx.nextTemp) > ctx.registers {
+		ctx.registers = uint(ctx.nextTemp)
+	}
+	return r
+}
+
+func (ctx *Compiler) declare(name string, t bytecode.Type) Variable {
+	v := Variable{Name: name, Register: ctx.firstTemp, Type: t}
+	ctx.firstTemp++
+	if ctx.nextTemp < ctx.firstTemp {
+		ctx.nextTemp = ctx.firstTemp
+	}
+	if uint(ctx.firstTemp) > ctx.registers {
+		ctx.registers = uint(ctx.firstTemp)
+	}
+	ctx.scope.variables[name] = v
+	if ctx.variables != nil && ctx.scope.parent != nil && ctx.scope.parent.parent == nil {
+		*ctx.variables = append(*ctx.variables, v)
+	}
+	return v
+}
+
+func compileStatements(ctx *Compiler, nodes []parser.BaseStatement) error {
+	ctx.scope = &scope{parent: ctx.scope, variables: map[string]Variable{}}
+	for i := range nodes {
+		ctx.nextTemp = ctx.firstTemp
+		if err := compileBaseStatement(ctx, nodes[i]); err != nil {
+			return err
+		}
+	}
+	ctx.scope = ctx.scope.parent
+	return nil
+}
+
+func compileBaseStatement(ctx *Compiler, node parser.BaseStatement) error {
+	switch node.StatementType() {
+	case parser.TypedInitStatementType:
+		return compileTypedInitStatement(ctx, node.(parser.TypedInitStatement))
+	case parser.DeclarationStatementType:
+		return compileDeclarationStatement(ctx, node.(parser.DeclarationStatement))
+	case parser.FuncDefStatementType:
+		return compileFuncDefStatement(ctx, node.(parser.FuncDefStatement))
+	case parser.WhileStatementType:
+		return compileWhileStatement(ctx, node.(parser.WhileStatement))
+	case parser.IfElseStatementType:
+		return compileIfElseStatement(ctx, node.(parser.IfElseStatement))
+	case parser.IfStatementType:
+		return compileIfStatement(ctx, node.(parser.IfStatement))
+	case parser.ReturnStatementType:
+		return compileReturnStatement(ctx, node.(parser.ReturnStatement))
+	case parser.ExpressionStatementType:
+		_, err := compileExpression(ctx, node.(parser.ExpressionStatement).Expression)
+		return err
+	default:
+		return fmt.Errorf("unknown or unexpected statement type '%s'", node.StatementType())
+	}
+}
+
+func compileType(t parser.Token) (bytecode.Type, error) {
+	switch t.StringValue {
+	case "u8":
+		return bytecode.U8, nil
+	case "u16":
+		return bytecode.U16, nil
+	case "u32":
+		return bytecode.U32, nil
+	case "u64":
+		return bytecode.U64, nil
+	case "i8":
+		return bytecode.I8, nil
+	case "i16":
+		return bytecode.I16, nil
+	case "i32":
+		return bytecode.I32, nil
+	case "i64":
+		return bytecode.I64, nil
+	case "f32":
+		return bytecode.F32, nil
+	case "f64":
+		return bytecode.F64, nil
+	case "char":
+		return bytecode.CHAR, nil
+	case "usize":
+		return bytecode.USIZE, nil
+	case "uptr":
+		return bytecode.UPTR, nil
+	default:
+		return -1, fmt.Errorf("unknown type '%s'", t.StringValue)
+	}
+}
+
+func compileTypedInitStatement(ctx *Compiler, node parser.TypedInitStatement) error {
+	t, err := compileType(node.DeclType)
+	if err != nil {
+		return err
+	}
+	v := ctx.declare(node.Identifier.StringValue, t)
+	return compileExpressionInto(ctx, node.Value, v.Register)
+}
+
+func compileDeclarationStatement(ctx *Compiler, node parser.DeclarationStatement) error {
+	t, err := compileType(node.DeclType)
+	if err != nil {
+		return err
+	}
+	v := ctx.declare(node.Identifier.StringValue, t)
+	ctx.emit(LoadImmediate{Type: t, Dst: v.Register, Value: 0})
+	return nil
+}
+
+func compileFuncDefStatement(ctx *Compiler, node parser.FuncDefStatement) error {
+	skip := len(ctx.instructions)
+	ctx.emit(Jump{})
+	id := uint(len(ctx.functions))
+	ctx.functions = append(ctx.functions, Function{
+		Name:       node.Identifier.StringValue,
+		Entry:      uint(len(ctx.instructions)),
+		Parameters: uint(len(node.Parameters)),
+	})
+	ctx.functionIds[node.Identifier.StringValue] = id
+
+	// functions get their own registers and can't see variables outside them
+	outer := *ctx
+	ctx.scope = &scope{parent: nil, variables: map[string]Variable{}}
+	ctx.firstTemp, ctx.nextTemp, ctx.registers = 0, 0, 0
+	ctx.variables = nil
+	for i := range node.Parameters {
+		t, err := compileType(node.Parameters[i].DeclType)
+		if err != nil {
+			return err
+		}
+		ctx.declare(node.Parameters[i].Identifier.StringValue, t)
+	}
+	if err := compileStatements(ctx, node.Body); err != nil {
+		return err
+	}
+	if _, err := compileType(node.ReturnType); err != nil {
+		return err
+	}
+	ctx.nextTemp = ctx.firstTemp
+	result := ctx.temp()
+	ctx.emit(LoadImmediate{Type: bytecode.USIZE, Dst: result, Value: 0})
+	ctx.emit(Return{Src: result})
+	ctx.functions[id].Registers = ctx.registers
+
+	ctx.scope, ctx.variables = outer.scope, outer.variables
+	ctx.firstTemp, ctx.nextTemp, ctx.registers = outer.firstTemp, outer.nextTemp, outer.registers
+	ctx.instructions[skip] = Jump{Target: uint(len(ctx.instructions))}
+	return nil
+}
+
+// Compiles the condition followed by a jump taken when it is false, and
+// returns the index of the jump, so the target can be patched in later.
+func compileConditionalJump(ctx *Compiler, condition parser.BaseExpression) (int, error) {
+	if cmp, left, right, ok := comparison(condition); ok {
+		l, err := compileExpression(ctx, left)
+		if err != nil {
+			return 0, err
+		}
+		r, err := compileExpression(ctx, right)
+		if err != nil {
+			return 0, err
+		}
+		ctx.emit(JumpIfNot{Cmp: cmp, Type: bytecode.I32, Left: l, Right: r})
+		return len(ctx.instructions) - 1, nil
+	}
+	c, err := compileExpression(ctx, condition)
+	if err != nil {
+		return 0, err
+	}
+	ctx.emit(JumpIfZero{Cond: c})
+	return len(ctx.instructions) - 1, nil
+}
+
+func patchJump(ctx *Compiler, index int, target int) {
+	switch i := ctx.instructions[index].(type) {
+	case Jump:
+		i.Target = uint(target)
+		ctx.instructions[index] = i
+	case JumpIfZero:
+		i.Target = uint(target)
+		ctx.instructions[index] = i
+	case JumpIfNot:
+		i.Target = uint(target)
+		ctx.instructions[index] = i
+	default:
+		panic(fmt.Sprintf("cannot patch target of '%s'", i))
+	}
+}
+
+func compileWhileStatement(ctx *Compiler, node parser.WhileStatement) error {
+	condition_start := len(ctx.instructions)
+	end_jump_index, err := compileConditionalJump(ctx, node.Condition)
+	if err != nil {
+		return err
+	}
+	if err := compileStatements(ctx, node.Body); err != nil {
+		return err
+	}
+	ctx.emit(Jump{Target: uint(condition_start)})
+	patchJump(ctx, end_jump_index, len(ctx.instructions))
+	return nil
+}
+
+func compileIfElseStatement(ctx *Compiler, node parser.IfElseStatement) error {
+	else_jump_index, err := compileConditionalJump(ctx, node.Condition)
+	if err != nil {
+		return err
+	}
+	if err := compileStatements(ctx, node.Truthy); err != nil {
+		return err
+	}
+	end_jump_index := len(ctx.instructions)
+	ctx.emit(Jump{})
+	patchJump(ctx, else_jump_index, len(ctx.instructions))
+	if err := compileStatements(ctx, node.Falsy); err != nil {
+		return err
+	}
+	patchJump(ctx, end_jump_index, len(ctx.instructions))
+	return nil
+}
+
+func compileIfStatement(ctx *Compiler, node parser.IfStatement) error {
+	end_jump_index, err := compileConditionalJump(ctx, node.Condition)
+	if err != nil {
+		return err
+	}
+	if err := compileStatements(ctx, node.Body); err != nil {
+		return err
+	}
+	patchJump(ctx, end_jump_index, len(ctx.instructions))
+	return nil
+}
+
+func compileReturnStatement(ctx *Compiler, node parser.ReturnStatement) error {
+	r, err := compileExpression(ctx, node.Value)
+	if err != nil {
+		return err
+	}
+	ctx.emit(Return{Src: r})
+	return nil
+}
+
+func comparison(node parser.BaseExpression) (bytecode.InstructionType, parser.BaseExpression, parser.BaseExpression, bool) {
+	switch node := node.(type) {
+	case parser.EqualExpression:
+		return bytecode.CmpEqualInstruction, node.Left, node.Right, true
+	case parser.NotEqualExpression:
+		return bytecode.CmpInequalInstruction, node.Left, node.Right, true
+	case parser.LessThanExpression:
+		return bytecode.CmpLTInstruction, node.Left, node.Right, true
+	case parser.GreaterThanExpression:
+		return bytecode.CmpGTInstruction, node.Left, node.Right, true
+	case parser.LTEExpression:
+		return bytecode.CmpLTEInstruction, node.Left, node.Right, true
+	case parser.GTEExpression:
+		return bytecode.CmpGTEInstruction, node.Left, node.Right, true
+	default:
+		return 0, nil, nil, false
+	}
+}
+
+func arithmetic(node parser.BaseExpression) (bytecode.InstructionType, parser.BaseExpression, parser.BaseExpression, bool) {
+	switch node := node.(type) {
+	case parser.AddExpression:
+		return bytecode.AddInstruction, node.Left, node.Right, true
+	case parser.SubExpression:
+		return bytecode.SubtractInstruction, node.Left, node.Right, true
+	case parser.MulExpression:
+		return bytecode.MultiplyInstruction, node.Left, node.Right, true
+	case parser.DivExpression:
+		return bytecode.DivideInstruction, node.Left, node.Right, true
+	case parser.ExpExpression:
+		return bytecode.ExponentInstruction, node.Left, node.Right, true
+	default:
+		return comparison(node)
+	}
+}
+
+// Compiles node and returns the register holding its value. Variables are
+// used directly, everything else is computed into a new temporary.
+func compileExpression(ctx *Compiler, node parser.BaseExpression) (Register, error) {
+	switch node := node.(type) {
+	case parser.VarAccessExpression:
+		v, err := ctx.scope.get(node.Identifier.StringValue)
+		if err != nil {
+			if _, ok := ctx.functionIds[node.Identifier.StringValue]; ok {
+				return 0, fmt.Errorf("function \"%s\" can only be called", node.Identifier.StringValue)
+			}
+			return 0, err
+		}
+		return v.Register, nil
+	case parser.VarAssignExpression:
+		v, err := ctx.scope.get(node.Identifier.StringValue)
+		if err != nil {
+			return 0, err
+		}
+		return v.Register, compileExpressionInto(ctx, node.Value, v.Register)
+	default:
+		r := ctx.temp()
+		return r, compileExpressionInto(ctx, node, r)
+	}
+}
+
+func compileExpressionInto(ctx *Compiler, node parser.BaseExpression, dst Register) error {
+	if op, left, right, ok := arithmetic(node); ok {
+		l, err := compileExpression(ctx, left)
+		if err != nil {
+			return err
+		}
+		r, err := compileExpression(ctx, right)
+		if err != nil {
+			return err
+		}
+		ctx.emit(Binary{Op: op, Type: bytecode.I32, Dst: dst, Left: l, Right: r})
+		return nil
+	}
+	switch node := node.(type) {
+	case parser.IntLiteral:
+		ctx.emit(LoadImmediate{Type: bytecode.I32, Dst: dst, Value: node.Tok.IntValue})
+		return nil
+	case parser.FuncCallExpression:
+		return compileFuncCallExpression(ctx, node, dst)
+	default:
+		src, err := compileExpression(ctx, node)
+		if err != nil {
+			return err
+		}
+		if src != dst {
+			ctx.emit(Move{Dst: dst, Src: src})
+		}
+		return nil
+	}
+}
+
+func compileFuncCallExpression(ctx *Compiler, node parser.FuncCallExpression, dst Register) error {
+	callee, ok := node.Identifier.(parser.VarAccessExpression)
+	if !ok {
+		return fmt.Errorf("only functions can be called by name")
+	}
+	id, ok := ctx.functionIds[callee.Identifier.StringValue]
+	if !ok {
+		return fmt.Errorf("symbol \"%s\" undeclared", callee.Identifier.StringValue)
+	}
+	args := []Register{}
+	for i := range node.Arguments {
+		r, err := compileExpression(ctx, node.Arguments[i])
+		if err != nil {
+			return err
+		}
+		args = append(args, r)
+	}
+	if uint(len(args)) != ctx.functions[id].Parameters {
+		return fmt.Errorf("function \"%s\" takes %d arguments, got %d", callee.Identifier.StringValue, ctx.functions[id].Parameters, len(args))
+	}
+	ctx.emit(Call{Dst: dst, Function: id, Args: args})
+	return nil
+}
@@ -0,0 +1,146 @@
+package register_test
+
+import (
+	"eud/bytecode"
+	"eud/internal/parsetest"
+	"eud/parser"
+	"eud/register"
+	"path/filepath"
+	"testing"
+)
+
+func ident(name string) parser.Token {
+	return parser.Token{Type: parser.IdentifierToken, StringValue: name, Next: nil}
+}
+
+func keyword(name string) parser.Token {
+	return parser.Token{Type: parser.KeywordToken, StringValue: name, Next: nil}
+}
+
+func TestFunctionCall(t *testing.T) {
+	program, err := register.Compile([]parser.BaseStatement{
+		parser.FuncDefStatement{
+			Identifier: ident("sum"),
+			ReturnType: keyword("i32"),
+			Parameters: []parser.TypedDeclaration{
+				{DeclType: keyword("i32"), Identifier: ident("a")},
+				{DeclType: keyword("i32"), Identifier: ident("b")},
+			},
+			Body: []parser.BaseStatement{
+				parser.ReturnStatement{
+					Value: parser.AddExpression{
+						Left:  parser.VarAccessExpression{Identifier: ident("a")},
+						Right: parser.VarAccessExpression{Identifier: ident("b")},
+					},
+				},
+			},
+		},
+		parser.TypedInitStatement{
+			TypedDeclaration: parser.TypedDeclaration{DeclType: keyword("i32"), Identifier: ident("result")},
+			Value: parser.FuncCallExpression{
+				Identifier: parser.VarAccessExpression{Identifier: ident("sum")},
+				Arguments: []parser.BaseExpression{
+					parser.IntLiteral{Tok: &parser.Token{Type: parser.IntToken, IntValue: 3}},
+					parser.IntLiteral{Tok: &parser.Token{Type: parser.IntToken, IntValue: 5}},
+				},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"Jump 5",
+		"Add<i32> r2, r0, r1",
+		"Return r2",
+		"LoadImmediate<usize> r2, 0",
+		"Return r2",
+		"LoadImmediate<i32> r1, 3",
+		"LoadImmediate<i32> r2, 5",
+		"Call r0, f0(r1, r2)",
+	}
+	if len(program.Instructions) != len(expected) {
+		t.Fatalf("expected %d instructions, got %d: %s", len(expected), len(program.Instructions), program.Instructions)
+	}
+	for i := range expected {
+		if program.Instructions[i].String() != expected[i] {
+			t.Errorf("instruction %d: expected %q, got %q", i, expected[i], program.Instructions[i].String())
+		}
+	}
+
+	runtime := register.Run(program)
+	result, err := runtime.Variable(program, "result")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != (bytecode.I32Value{Value: 8}) {
+		t.Errorf("expected result to be 8, got %s", result)
+	}
+}
+
+func TestOuterVariablesNotVisibleInFunctions(t *testing.T) {
+	_, err := register.Compile([]parser.BaseStatement{
+		parser.DeclarationStatement{
+			TypedDeclaration: parser.TypedDeclaration{DeclType: keyword("i32"), Identifier: ident("x")},
+		},
+		parser.FuncDefStatement{
+			Identifier: ident("f"),
+			ReturnType: keyword("i32"),
+			Body: []parser.BaseStatement{
+				parser.ReturnStatement{Value: parser.VarAccessExpression{Identifier: ident("x")}},
+			},
+		},
+	})
+	if err == nil {
+		t.Fatal("expected an error for the undeclared x")
+	}
+}
+
+// examples which neither backend compiles: astjson can't parse the syscall
+// statements of the sys and while-print examples, and the stack compiler
+// rejects the allocation in heap.eud as well
+var unsupportedExamples = map[string]bool{
+	"heap.eud":          true,
+	"sys-print-i32.eud": true,
+	"sys-put-i32.eud":   true,
+	"while-print.eud":   true,
+}
+
+// Runs every example on both backends and compares the top level variables.
+func TestExamplesMatchStackBackend(t *testing.T) {
+	files, err := filepath.Glob("../examples/*.eud")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if unsupportedExamples[filepath.Base(file)] {
+			continue
+		}
+		t.Run(filepath.Base(file), func(t *testing.T) {
+			ast := parsetest.Parse(t, file)
+
+			stackProgram, err := bytecode.Compile(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stack := bytecode.Run(stackProgram)
+
+			registerProgram, err := register.Compile(ast)
+			if err != nil {
+				t.Fatal(err)
+			}
+			registers := register.Run(registerProgram)
+
+			if len(registerProgram.Variables) > len(stack.Locals) {
+				t.Fatalf("%d variables, but only %d locals", len(registerProgram.Variables), len(stack.Locals))
+			}
+			for i, v := range registerProgram.Variables {
+				expected := stack.Locals[i].Value()
+				got := registers.Registers[v.Register].Value()
+				if got != expected {
+					t.Errorf("%s: expected %s, got %s", v.Name, expected, got)
+				}
+			}
+		})
+	}
+}
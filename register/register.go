@@ -0,0 +1,171 @@
+package register
+
+import (
+	"eud/bytecode"
+	"fmt"
+	"strings"
+)
+
+// A register based alternative to the stack based bytecode. Every function
+// call gets its own set of registers, locals and temporaries of the function
+// are mapped onto them by the compiler. Values and arithmetic are the same as
+// in the bytecode runtime.
+
+type Register uint
+
+type Program struct {
+	Instructions []Instruction
+	Functions    []Function
+	// registers used by the top level code
+	Registers uint
+	// top level variables in declaration order
+	Variables []Variable
+}
+
+type Function struct {
+	Name       string
+	Entry      uint
+	Parameters uint
+	Registers  uint
+}
+
+type Variable struct {
+	Name     string
+	Register Register
+	Type     bytecode.Type
+}
+
+type InstructionType int
+
+const (
+	LoadImmediateInstruction InstructionType = iota
+	MoveInstruction
+	BinaryInstruction
+	JumpInstruction
+	JumpIfZeroInstruction
+	JumpIfNotInstruction
+	CallInstruction
+	ReturnInstruction
+)
+
+type Instruction interface {
+	String() string
+	InstructionType() InstructionType
+}
+
+type LoadImmediate struct {
+	Instruction
+	bytecode.Type
+	Dst   Register
+	Value int
+}
+
+type Move struct {
+	Instruction
+	Dst Register
+	Src Register
+}
+
+// Op is one of the binary bytecode instructions, such as
+// bytecode.AddInstruction or bytecode.CmpLTInstruction.
+type Binary struct {
+	Instruction
+	Op bytecode.InstructionType
+	bytecode.Type
+	Dst   Register
+	Left  Register
+	Right Register
+}
+
+type Jump struct {
+	Instruction
+	Target uint
+}
+
+type JumpIfZero struct {
+	Instruction
+	Cond   Register
+	Target uint
+}
+
+// jumps if the comparison Cmp of Left and Right is false
+type JumpIfNot struct {
+	Instruction
+	Cmp bytecode.InstructionType
+	bytecode.Type
+	Left   Register
+	Right  Register
+	Target uint
+}
+
+// Function is an index into Program.Functions
+type Call struct {
+	Instruction
+	Dst      Register
+	Function uint
+	Args     []Register
+}
+
+type Return struct {
+	Instruction
+	Src Register
+}
+
+func (r Register) String() string { return fmt.Sprintf("r%d", uint(r)) }
+
+func (it InstructionType) String() string {
+	switch it {
+	case LoadImmediateInstruction:
+		return "LoadImmediateInstruction"
+	case MoveInstruction:
+		return "MoveInstruction"
+	case BinaryInstruction:
+		return "BinaryInstruction"
+	case JumpInstruction:
+		return "JumpInstruction"
+	case JumpIfZeroInstruction:
+		return "JumpIfZeroInstruction"
+	case JumpIfNotInstruction:
+		return "JumpIfNotInstruction"
+	case CallInstruction:
+		return "CallInstruction"
+	case ReturnInstruction:
+		return "ReturnInstruction"
+	default:
+		panic("unknown")
+	}
+}
+
+func (n LoadImmediate) InstructionType() InstructionType { return LoadImmediateInstruction }
+func (n Move) InstructionType() InstructionType          { return MoveInstruction }
+func (n Binary) InstructionType() InstructionType        { return BinaryInstruction }
+func (n Jump) InstructionType() InstructionType          { return JumpInstruction }
+func (n JumpIfZero) InstructionType() InstructionType    { return JumpIfZeroInstruction }
+func (n JumpIfNot) InstructionType() InstructionType     { return JumpIfNotInstruction }
+func (n Call) InstructionType() InstructionType          { return CallInstruction }
+func (n Return) InstructionType() InstructionType        { return ReturnInstruction }
+
+func (n LoadImmediate) String() string {
+	return fmt.Sprintf("LoadImmediate<%s> %s, %d", n.Type, n.Dst, n.Value)
+}
+func (n Move) String() string { return fmt.Sprintf("Move %s, %s", n.Dst, n.Src) }
+func (n Binary) String() string {
+	return fmt.Sprintf("%s<%s> %s, %s, %s", opName(n.Op), n.Type, n.Dst, n.Left, n.Right)
+}
+func (n Jump) String() string       { return fmt.Sprintf("Jump %d", n.Target) }
+func (n JumpIfZero) String() string { return fmt.Sprintf("JumpIfZero %s, %d", n.Cond, n.Target) }
+func (n JumpIfNot) String() string {
+	return fmt.Sprintf("JumpIfNot<%s, %s> %s, %s, %d", opName(n.Cmp), n.Type, n.Left, n.Right, n.Target)
+}
+func (n Call) String() string {
+	args := make([]string, len(n.Args))
+	for i := range n.Args {
+		args[i] = n.Args[i].String()
+	}
+	return fmt.Sprintf("Call %s, f%d(%s)", n.Dst, n.Function, strings.Join(args, ", "))
+}
+func (n Return) String() string { return fmt.Sprintf("Return %s", n.Src) }
+
+func opName(op bytecode.InstructionType) string {
+	return strings.TrimSuffix(op.String(), "Instruction")
+}
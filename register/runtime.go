@@ -0,0 +1,153 @@
+package register
+
+import (
+	"eud/bytecode"
+	"fmt"
+)
+
+// The registers of all active calls live in one slice, every frame owns the
+// window starting at its Base.
+type Runtime struct {
+	Registers []bytecode.Slot
+	Frames    []Frame
+	Pc        uint
+	Executed  uint64
+}
+
+type Frame struct {
+	Base int
+	Size int
+	// where the caller continues and wants the result
+	ReturnPc uint
+	Dst      Register
+}
+
+// instructions flattened into one struct, so the runtime doesn't need to
+// type switch on the Instruction interface for every step
+type decodedInstruction struct {
+	code   InstructionType
+	op     bytecode.InstructionType
+	typ    bytecode.Type
+	dst    Register
+	a, b   Register
+	value  bytecode.Slot
+	target uint
+	args   []Register
+}
+
+func decode(instructions []Instruction) []decodedInstruction {
+	code := make([]decodedInstruction, len(instructions))
+	for i := range instructions {
+		d := &code[i]
+		d.code = instructions[i].InstructionType()
+		switch n := instructions[i].(type) {
+		case LoadImmediate:
+			d.typ, d.dst, d.value = n.Type, n.Dst, bytecode.IntSlot(n.Type, int64(n.Value))
+		case Move:
+			d.dst, d.a = n.Dst, n.Src
+		case Binary:
+			d.op, d.typ, d.dst, d.a, d.b = n.Op, n.Type, n.Dst, n.Left, n.Right
+		case Jump:
+			d.target = n.Target
+		case JumpIfZero:
+			d.a, d.target = n.Cond, n.Target
+		case JumpIfNot:
+			d.op, d.typ, d.a, d.b, d.target = n.Cmp, n.Type, n.Left, n.Right, n.Target
+		case Call:
+			d.dst, d.target, d.args = n.Dst, n.Function, n.Args
+		case Return:
+			d.a = n.Src
+		default:
+			panic(fmt.Sprintf("cannot decode '%s'", n))
+		}
+	}
+	return code
+}
+
+func Run(p Program) Runtime {
+	ctx := Runtime{
+		Registers: make([]bytecode.Slot, p.Registers),
+		Frames:    []Frame{{Base: 0, Size: int(p.Registers)}},
+	}
+	code := decode(p.Instructions)
+	for ctx.Pc < uint(len(code)) {
+		i := &code[ctx.Pc]
+		ctx.Pc++
+		ctx.Executed++
+		execute(&ctx, p, i)
+	}
+	return ctx
+}
+
+// Returns the value of a top level variable after running p.
+func (ctx Runtime) Variable(p Program, name string) (bytecode.RuntimeValue, error) {
+	for i := range p.Variables {
+		if p.Variables[i].Name == name {
+			return ctx.Registers[p.Variables[i].Register].Value(), nil
+		}
+	}
+	return nil, fmt.Errorf("no variable named \"%s\"", name)
+}
+
+func execute(ctx *Runtime, p Program, i *decodedInstruction) {
+	regs := ctx.Registers[ctx.Frames[len(ctx.Frames)-1].Base:]
+	switch i.code {
+	case LoadImmediateInstruction:
+		regs[i.dst] = i.value
+	case MoveInstruction:
+		regs[i.dst] = regs[i.a]
+	case BinaryInstruction:
+		regs[i.dst] = bytecode.EvalBinary(i.op, i.typ, regs[i.a], regs[i.b])
+	case JumpInstruction:
+		ctx.Pc = i.target
+	case JumpIfZeroInstruction:
+		if regs[i.a].Bits == 0 {
+			ctx.Pc = i.target
+		}
+	case JumpIfNotInstruction:
+		if bytecode.EvalBinary(i.op, i.typ, regs[i.a], regs[i.b]).Bits == 0 {
+			ctx.Pc = i.target
+		}
+	case CallInstruction:
+		runCall(ctx, p, i)
+	case ReturnInstruction:
+		runReturn(ctx, regs[i.a])
+	default:
+		panic(fmt.Sprintf("unknown instruction '%s'", i.code))
+	}
+}
+
+func runCall(ctx *Runtime, p Program, i *decodedInstruction) {
+	f := p.Functions[i.target]
+	caller := ctx.Frames[len(ctx.Frames)-1]
+	base := caller.Base + caller.Size
+	end := base + int(f.Registers)
+	if end > cap(ctx.Registers) {
+		grown := make([]bytecode.Slot, end, 2*end)
+		copy(grown, ctx.Registers)
+		ctx.Registers = grown
+	} else if end > len(ctx.Registers) {
+		ctx.Registers = ctx.Registers[:end]
+	}
+	for r := base; r < end; r++ {
+		ctx.Registers[r] = bytecode.Slot{}
+	}
+	for a := range i.args {
+		ctx.Registers[base+a] = ctx.Registers[caller.Base+int(i.args[a])]
+	}
+	ctx.Frames = append(ctx.Frames, Frame{Base: base, Size: int(f.Registers), ReturnPc: ctx.Pc, Dst: i.dst})
+	ctx.Pc = f.Entry
+}
+
+func runReturn(ctx *Runtime, value bytecode.Slot) {
+	if len(ctx.Frames) == 1 {
+		// returning from the top level ends the program
+		ctx.Pc = ^uint(0)
+		return
+	}
+	callee := ctx.Frames[len(ctx.Frames)-1]
+	ctx.Frames = ctx.Frames[:len(ctx.Frames)-1]
+	caller := ctx.Frames[len(ctx.Frames)-1]
+	ctx.Registers[caller.Base+int(callee.Dst)] = value
+	ctx.Pc = callee.ReturnPc
+}
@@ -0,0 +1,81 @@
+package register_test
+
+import (
+	"eud/bytecode"
+	"eud/register"
+	"testing"
+)
+
+// a = 0; b = 0; while (a < n) { b = b + a; a = a + 1 }
+func whileProgram(n int) register.Program {
+	return register.Program{
+		Instructions: []register.Instruction{
+			register.LoadImmediate{Type: bytecode.I32, Dst: 0, Value: 0},
+			register.LoadImmediate{Type: bytecode.I32, Dst: 1, Value: 0},
+			register.LoadImmediate{Type: bytecode.I32, Dst: 2, Value: n},
+			register.LoadImmediate{Type: bytecode.I32, Dst: 3, Value: 1},
+			register.JumpIfNot{Cmp: bytecode.CmpLTInstruction, Type: bytecode.I32, Left: 0, Right: 2, Target: 8},
+			register.Binary{Op: bytecode.AddInstruction, Type: bytecode.I32, Dst: 1, Left: 1, Right: 0},
+			register.Binary{Op: bytecode.AddInstruction, Type: bytecode.I32, Dst: 0, Left: 0, Right: 3},
+			register.Jump{Target: 4},
+		},
+		Registers: 4,
+		Variables: []register.Variable{
+			{Name: "a", Register: 0, Type: bytecode.I32},
+			{Name: "b", Register: 1, Type: bytecode.I32},
+		},
+	}
+}
+
+func TestWhile(t *testing.T) {
+	program := whileProgram(10)
+	runtime := register.Run(program)
+	a, _ := runtime.Variable(program, "a")
+	b, _ := runtime.Variable(program, "b")
+	if a != (bytecode.I32Value{Value: 10}) {
+		t.Errorf("expected a to be 10, got %s", a)
+	}
+	if b != (bytecode.I32Value{Value: 45}) {
+		t.Errorf("expected b to be 45, got %s", b)
+	}
+	if runtime.Executed != 4+10*4+1 {
+		t.Errorf("expected %d executed instructions, got %d", 4+10*4+1, runtime.Executed)
+	}
+}
+
+func TestRecursion(t *testing.T) {
+	// fn f(n) { if (n < 1) { return n } return f(n - 1) + n }
+	program := register.Program{
+		Instructions: []register.Instruction{
+			register.Jump{Target: 9},
+			register.LoadImmediate{Type: bytecode.I32, Dst: 1, Value: 1},
+			register.JumpIfNot{Cmp: bytecode.CmpLTInstruction, Type: bytecode.I32, Left: 0, Right: 1, Target: 4},
+			register.Return{Src: 0},
+			register.Binary{Op: bytecode.SubtractInstruction, Type: bytecode.I32, Dst: 2, Left: 0, Right: 1},
+			register.Call{Dst: 2, Function: 0, Args: []register.Register{2}},
+			register.Binary{Op: bytecode.AddInstruction, Type: bytecode.I32, Dst: 2, Left: 2, Right: 0},
+			register.Return{Src: 2},
+			register.Return{Src: 0},
+			register.LoadImmediate{Type: bytecode.I32, Dst: 1, Value: 100},
+			register.Call{Dst: 0, Function: 0, Args: []register.Register{1}},
+		},
+		Functions: []register.Function{{Name: "f", Entry: 1, Parameters: 1, Registers: 3}},
+		Registers: 2,
+		Variables: []register.Variable{{Name: "result", Register: 0, Type: bytecode.I32}},
+	}
+	runtime := register.Run(program)
+	result, _ := runtime.Variable(program, "result")
+	if result != (bytecode.I32Value{Value: 5050}) {
+		t.Errorf("expected result to be 5050, got %s", result)
+	}
+	if len(runtime.Frames) != 1 {
+		t.Errorf("expected only the top level frame to be left, got %d frames", len(runtime.Frames))
+	}
+}
+
+func BenchmarkWhile(b *testing.B) {
+	program := whileProgram(10000)
+	for i := 0; i < b.N; i++ {
+		register.Run(program)
+	}
+}